@@ -0,0 +1,68 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build debug
+
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/pprof"
+	"runtime/trace"
+	"strconv"
+	"time"
+)
+
+var debugPrefix string
+
+func init() {
+	flag.StringVar(&debugPrefix, "debug_prefix", "", "Path prefix of the pprof and trace endpoints on the metrics server")
+}
+
+// registerDebugHandlers mounts the net/http/pprof handlers at <prefix>/debug/pprof/ and a
+// runtime trace at <prefix>/debug/trace. It's only built with the debug tag, since the
+// metrics server has no authentication and profiles expose the internals of the process.
+func registerDebugHandlers(mux *http.ServeMux) {
+	mux.HandleFunc(debugPrefix+"/debug/pprof/", func(w http.ResponseWriter, r *http.Request) {
+		// pprof.Index finds the profile name after "/debug/pprof/", so it can't see the prefix.
+		r.URL.Path = r.URL.Path[len(debugPrefix):]
+		pprof.Index(w, r)
+	})
+	mux.HandleFunc(debugPrefix+"/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc(debugPrefix+"/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc(debugPrefix+"/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc(debugPrefix+"/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc(debugPrefix+"/debug/trace", serveTrace)
+	logger.Warningf("Debug endpoints available at %v/debug/pprof/ on the metrics server", debugPrefix)
+}
+
+// serveTrace writes a runtime trace of the next `seconds` seconds, 1 by default.
+func serveTrace(w http.ResponseWriter, r *http.Request) {
+	seconds, err := strconv.ParseFloat(r.FormValue("seconds"), 64)
+	if err != nil || seconds <= 0 {
+		seconds = 1
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := trace.Start(w); err != nil {
+		// Only one trace can run at a time.
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	select {
+	case <-time.After(time.Duration(seconds * float64(time.Second))):
+	case <-r.Context().Done():
+	}
+	trace.Stop()
+}
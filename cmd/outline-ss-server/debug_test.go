@@ -0,0 +1,50 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build debug
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugHandlers(t *testing.T) {
+	debugPrefix = "/admin"
+	defer func() { debugPrefix = "" }()
+	mux := http.NewServeMux()
+	registerDebugHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/admin/debug/pprof/heap")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	profile, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	// Profiles are gzipped protobufs.
+	require.True(t, bytes.HasPrefix(profile, []byte{0x1f, 0x8b}), "not a profile: %q", profile)
+
+	resp, err = http.Get(server.URL + "/debug/pprof/heap")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -23,10 +23,10 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/Jigsaw-Code/outline-sdk/transport"
 	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
 	"github.com/Jigsaw-Code/outline-ss-server/ipinfo"
 	"github.com/Jigsaw-Code/outline-ss-server/service"
@@ -45,9 +45,17 @@ var version = "dev"
 // 59 seconds is most common timeout for servers that do not respond to invalid requests
 const tcpReadTimeout time.Duration = 59 * time.Second
 
+// How often the keys past their expiry time are removed. Expired keys are rejected
+// as soon as they expire, so this only affects when they are reported and freed.
+const keySweepInterval time.Duration = time.Minute
+
 // A UDP NAT timeout of at least 5 minutes is recommended in RFC 4787 Section 4.3.
 const defaultNatTimeout time.Duration = 5 * time.Minute
 
+// Client IP addresses tracked by -max_connections_per_ip. Beyond that, the least
+// recently connected one is forgotten, which bounds the memory used during floods.
+const maxTrackedClientIPs = 100_000
+
 func init() {
 	var prefix = "%{level:.1s}%{time:2006-01-02T15:04:05.000Z07:00} %{pid} %{shortfile}]"
 	if term.IsTerminal(int(os.Stderr.Fd())) {
@@ -60,9 +68,46 @@ func init() {
 }
 
 type ssPort struct {
-	tcpListener *net.TCPListener
-	packetConn  net.PacketConn
-	cipherList  service.CipherList
+	tcpListener net.Listener
+	packetConns []net.PacketConn
+	cipherList  service.ManagedCipherList
+	// Stops the removal of expired keys.
+	stopSweeper func()
+}
+
+// SSServerOptions configures the optional behavior of a server started with
+// [RunSSServer]. The zero value of each field keeps the default.
+type SSServerOptions struct {
+	// Limiter limits the bandwidth of all the connections and associations.
+	Limiter *service.BandwidthLimiter
+	// Goroutines limits the number of connections and associations.
+	Goroutines *service.GoroutineLimiter
+	// Reputation rejects clients from the IP addresses that it blocks.
+	Reputation service.IPReputation
+	// IPConns limits the number of TCP connections from each client IP address.
+	IPConns *service.IPConnectionLimiter
+	// TargetLingerSecs is the SO_LINGER timeout of target connections, in seconds,
+	// or -1 for the OS default, see [service.TCPHandlerOptions].
+	TargetLingerSecs int
+	// SlowDialThreshold makes target dials that take at least this long be logged.
+	SlowDialThreshold time.Duration
+	// UDPShards is the number of sockets that read UDP on each port, see
+	// [service.ListenShardedUDP].
+	UDPShards int
+	// UDPBuffers are the sizes of the kernel buffers of the UDP sockets, see
+	// [service.SetUDPBufferSizes].
+	UDPBuffers service.UDPBufferSizes
+	// UDPMaxAmplification limits UDP replies to that many times the requests.
+	UDPMaxAmplification float64
+	// MaxKeysPerPort makes configs with more access keys on a port be rejected.
+	MaxKeysPerPort int
+	// RejectWeakSecrets makes configs with a secret that fails
+	// [service.ValidateSecret] be rejected, rather than only logged.
+	RejectWeakSecrets bool
+	// ProbeResponse is what failed TCP handshakes get, and ProbeDecoy what
+	// [service.ProbeResponseDecoy] sends.
+	ProbeResponse service.ProbeResponse
+	ProbeDecoy    []byte
 }
 
 type SSServer struct {
@@ -70,6 +115,12 @@ type SSServer struct {
 	m           *outlineMetrics
 	replayCache service.ReplayCache
 	ports       map[int]*ssPort
+	opts        SSServerOptions
+	// Holds a map[string]string from key IDs to their names in metrics.
+	keyNames atomic.Value
+	// Holds a map[string]string from key IDs to their cipher methods.
+	keyCiphers atomic.Value
+	quiescer   service.Quiescer
 }
 
 func (s *SSServer) startPort(portNum int) error {
@@ -79,27 +130,57 @@ func (s *SSServer) startPort(portNum int) error {
 		return fmt.Errorf("Shadowsocks TCP service failed to start on port %v: %w", portNum, err)
 	}
 	logger.Infof("Shadowsocks TCP service listening on %v", listener.Addr().String())
-	packetConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: portNum})
+	packetConns, err := service.ListenShardedUDP(&net.UDPAddr{Port: portNum}, s.opts.UDPShards)
 	if err != nil {
 		//lint:ignore ST1005 Shadowsocks is capitalized.
 		return fmt.Errorf("Shadowsocks UDP service failed to start on port %v: %w", portNum, err)
 	}
-	logger.Infof("Shadowsocks UDP service listening on %v", packetConn.LocalAddr().String())
-	port := &ssPort{tcpListener: listener, packetConn: packetConn, cipherList: service.NewCipherList()}
+	logger.Infof("Shadowsocks UDP service listening on %v with %v sockets", packetConns[0].LocalAddr().String(), len(packetConns))
+	if s.opts.UDPBuffers != (service.UDPBufferSizes{}) {
+		var granted service.UDPBufferSizes
+		for _, packetConn := range packetConns {
+			if granted, err = service.SetUDPBufferSizes(packetConn, s.opts.UDPBuffers); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			logger.Warningf("Failed to set UDP buffer sizes on port %v: %v", portNum, err)
+		} else {
+			// The kernel may report a different size than requested, see [service.SetUDPBufferSizes].
+			logger.Infof("UDP buffer sizes on port %v: requested %+v, granted %+v", portNum, s.opts.UDPBuffers, granted)
+		}
+	}
+	port := &ssPort{tcpListener: listener, packetConns: packetConns, cipherList: service.NewLimitedCipherList(s.opts.MaxKeysPerPort)}
+	port.stopSweeper = service.SweepExpiredKeys(port.cipherList, keySweepInterval, func(entry service.CipherEntry) {
+		logger.Infof("Access key %v on port %v expired", entry.ID, portNum)
+		s.m.AddExpiredKey()
+	})
 	authFunc := service.NewShadowsocksStreamAuthenticator(port.cipherList, &s.replayCache, s.m)
 	// TODO: Register initial data metrics at zero.
-	tcpHandler := service.NewTCPHandler(portNum, authFunc, s.m, tcpReadTimeout)
-	packetHandler := service.NewPacketHandler(s.natTimeout, port.cipherList, s.m)
+	tcpHandler := service.NewTCPHandlerWithOptions(portNum, authFunc, s.m, tcpReadTimeout, service.TCPHandlerOptions{
+		TargetLingerSecs:    s.opts.TargetLingerSecs,
+		SlowDialThreshold:   s.opts.SlowDialThreshold,
+		ProbeResponse:       s.opts.ProbeResponse,
+		ProbeDecoy:          s.opts.ProbeDecoy,
+		BandwidthLimiter:    s.opts.Limiter,
+		GoroutineLimiter:    s.opts.Goroutines,
+		Quiescer:            &s.quiescer,
+		IPReputation:        s.opts.Reputation,
+		IPConnectionLimiter: s.opts.IPConns,
+	})
+	packetHandler := service.NewPacketHandlerWithOptions(s.natTimeout, port.cipherList, s.m, service.PacketHandlerOptions{
+		MaxAmplification: s.opts.UDPMaxAmplification,
+		BandwidthLimiter: s.opts.Limiter,
+		GoroutineLimiter: s.opts.Goroutines,
+		Quiescer:         &s.quiescer,
+		IPReputation:     s.opts.Reputation,
+	})
 	s.ports[portNum] = port
-	accept := func() (transport.StreamConn, error) {
-		conn, err := listener.AcceptTCP()
-		if err == nil {
-			conn.SetKeepAlive(true)
-		}
-		return conn, err
+	// Connections accepted from a TCPListener have keep-alive enabled by default.
+	go service.ServeListener(listener, tcpHandler.Handle)
+	for _, packetConn := range port.packetConns {
+		go packetHandler.Handle(packetConn)
 	}
-	go service.StreamServe(accept, tcpHandler.Handle)
-	go packetHandler.Handle(port.packetConn)
 	return nil
 }
 
@@ -108,8 +189,14 @@ func (s *SSServer) removePort(portNum int) error {
 	if !ok {
 		return fmt.Errorf("port %v doesn't exist", portNum)
 	}
+	port.stopSweeper()
 	tcpErr := port.tcpListener.Close()
-	udpErr := port.packetConn.Close()
+	var udpErr error
+	for _, packetConn := range port.packetConns {
+		if err := packetConn.Close(); err != nil && udpErr == nil {
+			udpErr = err
+		}
+	}
 	delete(s.ports, portNum)
 	if tcpErr != nil {
 		//lint:ignore ST1005 Shadowsocks is capitalized.
@@ -132,6 +219,8 @@ func (s *SSServer) loadConfig(filename string) error {
 
 	portChanges := make(map[int]int)
 	portCiphers := make(map[int]*list.List) // Values are *List of *CipherEntry.
+	keyNames := make(map[string]string)
+	keyCiphers := make(map[string]string)
 	for _, keyConfig := range config.Keys {
 		portChanges[keyConfig.Port] = 1
 		cipherList, ok := portCiphers[keyConfig.Port]
@@ -139,13 +228,38 @@ func (s *SSServer) loadConfig(filename string) error {
 			cipherList = list.New()
 			portCiphers[keyConfig.Port] = cipherList
 		}
+		if err := service.ValidateSecret(keyConfig.Secret); err != nil {
+			if s.opts.RejectWeakSecrets {
+				return fmt.Errorf("invalid secret for key %v: %w", keyConfig.ID, err)
+			}
+			logger.Warningf("Weak secret for key %v: %v", keyConfig.ID, err)
+		}
 		cryptoKey, err := shadowsocks.NewEncryptionKey(keyConfig.Cipher, keyConfig.Secret)
 		if err != nil {
 			return fmt.Errorf("failed to create encyption key for key %v: %w", keyConfig.ID, err)
 		}
 		entry := service.MakeCipherEntry(keyConfig.ID, cryptoKey, keyConfig.Secret)
+		entry.Priority = keyConfig.Priority
+		entry.DisplayName = keyConfig.Name
+		entry.ExpiresAt = keyConfig.ExpiresAt
+		if entry.DisplayName != "" {
+			keyNames[entry.ID] = entry.MetricsName()
+		}
+		if cipherName, ok := service.CipherName(cryptoKey); ok {
+			keyCiphers[entry.ID] = cipherName
+		}
 		cipherList.PushBack(&entry)
 	}
+	if s.opts.MaxKeysPerPort > 0 {
+		// Checked before anything changes, so that a bad config leaves the server as it was.
+		for portNum, cipherList := range portCiphers {
+			if cipherList.Len() > s.opts.MaxKeysPerPort {
+				return fmt.Errorf("port %v has %v access keys, more than the limit of %v", portNum, cipherList.Len(), s.opts.MaxKeysPerPort)
+			}
+		}
+	}
+	s.keyNames.Store(keyNames)
+	s.keyCiphers.Store(keyCiphers)
 	for port := range s.ports {
 		portChanges[port] = portChanges[port] - 1
 	}
@@ -164,10 +278,36 @@ func (s *SSServer) loadConfig(filename string) error {
 		s.ports[portNum].cipherList.Update(cipherList)
 	}
 	logger.Infof("Loaded %v access keys over %v ports", len(config.Keys), len(s.ports))
+	if len(config.Keys) == 0 {
+		logger.Warningf("No access keys in %v. All connections will be rejected until keys are added", filename)
+	}
 	s.m.SetNumAccessKeys(len(config.Keys), len(portCiphers))
 	return nil
 }
 
+// keyName returns the name of an access key in metrics, or "" to use its ID.
+func (s *SSServer) keyName(accessKey string) string {
+	keyNames, _ := s.keyNames.Load().(map[string]string)
+	return keyNames[accessKey]
+}
+
+// keyCipher returns the cipher method of an access key, or "" if it's unknown.
+func (s *SSServer) keyCipher(accessKey string) string {
+	keyCiphers, _ := s.keyCiphers.Load().(map[string]string)
+	return keyCiphers[accessKey]
+}
+
+// Quiesce stops the server from taking new connections on any port, while it keeps
+// relaying the ones it has, until Resume is called.
+func (s *SSServer) Quiesce() {
+	s.quiescer.Quiesce()
+}
+
+// Resume makes the server take new connections again after Quiesce.
+func (s *SSServer) Resume() {
+	s.quiescer.Resume()
+}
+
 // Stop serving on all ports.
 func (s *SSServer) Stop() error {
 	for portNum := range s.ports {
@@ -179,17 +319,20 @@ func (s *SSServer) Stop() error {
 }
 
 // RunSSServer starts a shadowsocks server running, and returns the server or an error.
-func RunSSServer(filename string, natTimeout time.Duration, sm *outlineMetrics, replayHistory int) (*SSServer, error) {
+func RunSSServer(filename string, natTimeout time.Duration, sm *outlineMetrics, replayHistory int, opts SSServerOptions) (*SSServer, error) {
 	server := &SSServer{
 		natTimeout:  natTimeout,
 		m:           sm,
 		replayCache: service.NewReplayCache(replayHistory),
 		ports:       make(map[int]*ssPort),
+		opts:        opts,
 	}
+	sm.SetKeyNameFunc(server.keyName)
 	err := server.loadConfig(filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed configure server: %w", err)
 	}
+	notifyQuiesceSignals(server)
 	sigHup := make(chan os.Signal, 1)
 	signal.Notify(sigHup, syscall.SIGHUP)
 	go func() {
@@ -209,6 +352,13 @@ type Config struct {
 		Port   int
 		Cipher string
 		Secret string
+		// Keys with a higher priority are tried first. Optional.
+		Priority int
+		// Name of the key in metrics, instead of its ID. Optional.
+		Name string
+		// Time after which the key is rejected and removed, in RFC 3339 format,
+		// like 2024-06-01T00:00:00Z. Optional.
+		ExpiresAt time.Time `yaml:"expires_at"`
 	}
 }
 
@@ -225,16 +375,44 @@ func readConfig(filename string) (*Config, error) {
 	return &config, nil
 }
 
+func readIPBlocklist(filename string) (*service.IPBlocklist, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return service.ReadIPBlocklist(file)
+}
+
 func main() {
 	var flags struct {
-		ConfigFile    string
-		MetricsAddr   string
-		IPCountryDB   string
-		IPASNDB       string
-		natTimeout    time.Duration
-		replayHistory int
-		Verbose       bool
-		Version       bool
+		ConfigFile          string
+		MetricsAddr         string
+		IPCountryDB         string
+		IPASNDB             string
+		natTimeout          time.Duration
+		replayHistory       int
+		BandwidthLimit      int
+		BandwidthFairKeys   bool
+		MaxGoroutines       int
+		IPBlocklist         string
+		MaxConnectionsPerIP int
+		TargetLingerSecs    int
+		SlowDialThreshold   time.Duration
+		UDPShards           int
+		UDPReadBuffer       int
+		UDPWriteBuffer      int
+		UDPMaxAmplification float64
+		MaxKeysPerPort      int
+		RejectWeakSecrets   bool
+		ProbeResponse       string
+		ProbeDecoyFile      string
+		KeyThreshold        int64
+		MaxKeySeries        int
+		PerCipherMetrics    bool
+		AnonymizeIPs        bool
+		Verbose             bool
+		Version             bool
 	}
 	flag.StringVar(&flags.ConfigFile, "config", "", "Configuration filename")
 	flag.StringVar(&flags.MetricsAddr, "metrics", "", "Address for the Prometheus metrics")
@@ -242,6 +420,25 @@ func main() {
 	flag.StringVar(&flags.IPASNDB, "ip_asn_db", "", "Path to the ip-to-ASN mmdb file")
 	flag.DurationVar(&flags.natTimeout, "udptimeout", defaultNatTimeout, "UDP tunnel timeout")
 	flag.IntVar(&flags.replayHistory, "replay_history", 0, "Replay buffer size (# of handshakes)")
+	flag.IntVar(&flags.BandwidthLimit, "bandwidth_limit", 0, "Maximum total throughput of all connections, in bytes per second (0 for no limit)")
+	flag.BoolVar(&flags.BandwidthFairKeys, "bandwidth_fair_keys", false, "Share the -bandwidth_limit equally among access keys rather than among connections")
+	flag.IntVar(&flags.MaxGoroutines, "max_goroutines", 0, "Maximum goroutines used by connections and UDP NAT entries, after which new ones are rejected (0 for no limit)")
+	flag.StringVar(&flags.IPBlocklist, "ip_blocklist", "", "Path to a file of client IP addresses or CIDR prefixes to reject, one per line, like the Tor exit list")
+	flag.IntVar(&flags.MaxConnectionsPerIP, "max_connections_per_ip", 0, "Maximum concurrent TCP connections from each client IP address, after which new ones are rejected (0 for no limit)")
+	flag.IntVar(&flags.TargetLingerSecs, "target_linger", -1, "SO_LINGER timeout of target connections, in seconds: 0 resets them on close to free their ports right away, and -1 keeps the OS default graceful close")
+	flag.DurationVar(&flags.SlowDialThreshold, "slow_dial_threshold", 0, "Log target dials that take at least this long, even if they succeed (0 to disable)")
+	flag.IntVar(&flags.UDPShards, "udp_shards", 1, "Number of sockets that read UDP packets on each port in parallel (Linux only)")
+	flag.IntVar(&flags.UDPReadBuffer, "udp_read_buffer", 0, "Size of the kernel receive buffer (SO_RCVBUF) of the UDP sockets, in bytes (0 for the system default)")
+	flag.IntVar(&flags.UDPWriteBuffer, "udp_write_buffer", 0, "Size of the kernel send buffer (SO_SNDBUF) of the UDP sockets, in bytes (0 for the system default)")
+	flag.Float64Var(&flags.UDPMaxAmplification, "udp_max_amplification", 0, fmt.Sprintf("Maximum ratio of the bytes sent to a UDP client to the bytes received from it, to prevent reflection attacks, such as %v (0 for no limit)", service.RecommendedUDPAmplificationFactor))
+	flag.IntVar(&flags.MaxKeysPerPort, "max_keys_per_port", 0, "Maximum number of access keys on each port, above which a config is rejected, to guard against runaway configs (0 for no limit)")
+	flag.BoolVar(&flags.RejectWeakSecrets, "reject_weak_secrets", false, "Reject configs with an empty or weak secret, such as one shorter than 8 characters, instead of logging a warning")
+	flag.StringVar(&flags.ProbeResponse, "probe_response", "hang", "Response to TCP connections that fail the handshake: hang until the client closes or times out, close right away, or send the -probe_decoy_file and hang (hang, close or decoy)")
+	flag.StringVar(&flags.ProbeDecoyFile, "probe_decoy_file", "", "Path to the bytes sent to failed TCP handshakes with -probe_response=decoy, like the banner of a benign service")
+	flag.Int64Var(&flags.KeyThreshold, "metrics_key_threshold", 0, "Bytes that an access key must relay to get its own metrics, instead of sharing the \"other\" ones")
+	flag.IntVar(&flags.MaxKeySeries, "metrics_max_keys", 0, "Maximum number of access keys with their own metrics (0 for no limit)")
+	flag.BoolVar(&flags.PerCipherMetrics, "metrics_per_cipher", false, "Export the bytes transferred per cipher method, to follow the migration of access keys between methods")
+	flag.BoolVar(&flags.AnonymizeIPs, "anonymize_client_ips", false, "Truncate client IP addresses in logs and metrics to their /24 (IPv4) or /48 (IPv6) network")
 	flag.BoolVar(&flags.Verbose, "verbose", false, "Enables verbose logging output")
 	flag.BoolVar(&flags.Version, "version", false, "The version of the server")
 
@@ -263,10 +460,17 @@ func main() {
 		return
 	}
 
+	if flags.AnonymizeIPs {
+		logger.Infof("Anonymizing client IP addresses")
+		service.SetClientIPAnonymization(true)
+	}
+
 	if flags.MetricsAddr != "" {
-		http.Handle("/metrics", promhttp.Handler())
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		registerDebugHandlers(mux)
 		go func() {
-			logger.Fatalf("Failed to run metrics server: %v. Aborting.", http.ListenAndServe(flags.MetricsAddr, nil))
+			logger.Fatalf("Failed to run metrics server: %v. Aborting.", http.ListenAndServe(flags.MetricsAddr, mux))
 		}()
 		logger.Infof("Prometheus metrics available at http://%v/metrics", flags.MetricsAddr)
 	}
@@ -286,10 +490,73 @@ func main() {
 
 	m := newPrometheusOutlineMetrics(ip2info, prometheus.DefaultRegisterer)
 	m.SetBuildInfo(version)
-	_, err = RunSSServer(flags.ConfigFile, flags.natTimeout, m, flags.replayHistory)
+	if flags.KeyThreshold > 0 || flags.MaxKeySeries > 0 {
+		logger.Infof("Exporting per-key metrics for keys above %v bytes, up to %v keys (0 for no limit)", flags.KeyThreshold, flags.MaxKeySeries)
+		m.SetKeyLabelLimits(flags.KeyThreshold, flags.MaxKeySeries)
+	}
+	var limiter *service.BandwidthLimiter
+	if flags.BandwidthLimit > 0 {
+		logger.Infof("Limiting bandwidth to %v bytes per second", flags.BandwidthLimit)
+		limiter = service.NewBandwidthLimiter(flags.BandwidthLimit)
+		limiter.SetPerKeyFairness(flags.BandwidthFairKeys)
+		registerBandwidthLimiterMetrics(limiter, prometheus.DefaultRegisterer)
+	}
+	var goroutines *service.GoroutineLimiter
+	if flags.MaxGoroutines > 0 {
+		logger.Infof("Limiting connections to %v goroutines", flags.MaxGoroutines)
+		goroutines = service.NewGoroutineLimiter(flags.MaxGoroutines)
+		registerGoroutineLimiterMetrics(goroutines, prometheus.DefaultRegisterer)
+	}
+	var reputation service.IPReputation
+	if flags.IPBlocklist != "" {
+		logger.Infof("Rejecting clients in the IP blocklist at %v", flags.IPBlocklist)
+		reputation, err = readIPBlocklist(flags.IPBlocklist)
+		if err != nil {
+			logger.Fatalf("Failed to read IP blocklist: %v. Aborting", err)
+		}
+	}
+	var ipConns *service.IPConnectionLimiter
+	if flags.MaxConnectionsPerIP > 0 {
+		logger.Infof("Limiting TCP connections to %v per client IP address", flags.MaxConnectionsPerIP)
+		ipConns = service.NewIPConnectionLimiter(flags.MaxConnectionsPerIP, maxTrackedClientIPs)
+		registerIPConnectionLimiterMetrics(ipConns, prometheus.DefaultRegisterer)
+	}
+	probeResponse, err := service.ParseProbeResponse(flags.ProbeResponse)
+	if err != nil {
+		logger.Fatalf("Invalid -probe_response: %v. Aborting", err)
+	}
+	var probeDecoy []byte
+	if probeResponse == service.ProbeResponseDecoy {
+		if flags.ProbeDecoyFile == "" {
+			logger.Fatalf("-probe_response=decoy needs a -probe_decoy_file. Aborting")
+		}
+		probeDecoy, err = os.ReadFile(flags.ProbeDecoyFile)
+		if err != nil {
+			logger.Fatalf("Failed to read probe decoy: %v. Aborting", err)
+		}
+	}
+	server, err := RunSSServer(flags.ConfigFile, flags.natTimeout, m, flags.replayHistory, SSServerOptions{
+		Limiter:             limiter,
+		Goroutines:          goroutines,
+		Reputation:          reputation,
+		IPConns:             ipConns,
+		TargetLingerSecs:    flags.TargetLingerSecs,
+		SlowDialThreshold:   flags.SlowDialThreshold,
+		UDPShards:           flags.UDPShards,
+		UDPBuffers:          service.UDPBufferSizes{Read: flags.UDPReadBuffer, Write: flags.UDPWriteBuffer},
+		UDPMaxAmplification: flags.UDPMaxAmplification,
+		MaxKeysPerPort:      flags.MaxKeysPerPort,
+		RejectWeakSecrets:   flags.RejectWeakSecrets,
+		ProbeResponse:       probeResponse,
+		ProbeDecoy:          probeDecoy,
+	})
 	if err != nil {
 		logger.Fatalf("Server failed to start: %v. Aborting", err)
 	}
+	registerQuiescerMetrics(&server.quiescer, prometheus.DefaultRegisterer)
+	if flags.PerCipherMetrics {
+		m.SetKeyCipherFunc(server.keyCipher)
+	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
@@ -19,7 +19,9 @@ import (
 	"net"
 	"net/netip"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Jigsaw-Code/outline-ss-server/ipinfo"
@@ -36,23 +38,40 @@ var now = time.Now
 type outlineMetrics struct {
 	ipinfo.IPInfoMap
 	*tunnelTimeCollector
+	// Nil unless the number of access key series is limited.
+	keys *keyLabeler
+	// Holds a func(accessKey string) string, see SetKeyNameFunc.
+	keyNames atomic.Value
+	// Holds a func(accessKey string) string, see SetKeyCipherFunc.
+	keyCiphers atomic.Value
 
 	buildInfo            *prometheus.GaugeVec
 	accessKeys           prometheus.Gauge
+	expiredKeys          prometheus.Counter
 	ports                prometheus.Gauge
 	dataBytes            *prometheus.CounterVec
 	dataBytesPerLocation *prometheus.CounterVec
+	dataBytesPerCipher   *prometheus.CounterVec
 	timeToCipherMs       *prometheus.HistogramVec
 	// TODO: Add time to first byte.
 
 	tcpProbes               *prometheus.HistogramVec
+	tcpTruncatedProbes      *prometheus.CounterVec
 	tcpOpenConnections      *prometheus.CounterVec
 	tcpClosedConnections    *prometheus.CounterVec
 	tcpConnectionDurationMs *prometheus.HistogramVec
+	tcpFailedRelayBytes     *prometheus.HistogramVec
+	tcpCircuitBreakerOpens  prometheus.Counter
+	tcpSlowDials            prometheus.Counter
+	tcpProbeResponses       *prometheus.CounterVec
 
 	udpPacketsFromClientPerLocation *prometheus.CounterVec
 	udpAddedNatEntries              prometheus.Counter
 	udpRemovedNatEntries            prometheus.Counter
+	udpDeduplicatedPackets          prometheus.Counter
+	udpAmplificationDrops           prometheus.Counter
+	udpConnectionMigrations         *prometheus.CounterVec
+	udpClientDuplicates             *prometheus.CounterVec
 }
 
 var _ service.TCPMetrics = (*outlineMetrics)(nil)
@@ -85,10 +104,64 @@ type IPKey struct {
 	accessKey string
 }
 
+// otherKeysLabel is the access_key label of the keys that don't get their own series.
+const otherKeysLabel = "other"
+
+// keyLabeler bounds the number of series per access key. A key gets its own series
+// once it has relayed `threshold` bytes, unless `maxKeys` keys already have one.
+// Until then, and forever after that, its metrics go to the "other" series.
+type keyLabeler struct {
+	threshold int64
+	// Zero or negative for no limit.
+	maxKeys int
+
+	mu sync.Mutex
+	// Bytes relayed by the keys that don't have their own series yet.
+	bytes map[string]int64
+	// The keys with their own series.
+	exported map[string]bool
+}
+
+func newKeyLabeler(threshold int64, maxKeys int) *keyLabeler {
+	return &keyLabeler{
+		threshold: threshold,
+		maxKeys:   maxKeys,
+		bytes:     make(map[string]int64),
+		exported:  make(map[string]bool),
+	}
+}
+
+// label accounts `bytes` of traffic to `accessKey`, and returns the access_key label
+// of its metrics. A nil labeler exports every key.
+func (l *keyLabeler) label(accessKey string, bytes int64) string {
+	if l == nil || accessKey == "" {
+		return accessKey
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.exported[accessKey] {
+		return accessKey
+	}
+	if l.maxKeys > 0 && len(l.exported) >= l.maxKeys {
+		return otherKeysLabel
+	}
+	total := l.bytes[accessKey] + bytes
+	if total < l.threshold {
+		l.bytes[accessKey] = total
+		return otherKeysLabel
+	}
+	delete(l.bytes, accessKey)
+	l.exported[accessKey] = true
+	return accessKey
+}
+
 type tunnelTimeCollector struct {
 	ip2info       ipinfo.IPInfoMap
 	mu            sync.Mutex // Protects the activeClients map.
 	activeClients map[IPKey]*activeClient
+	keys          *keyLabeler
+	// Returns the name of an access key in metrics.
+	keyName func(accessKey string) string
 
 	tunnelTimePerKey      *prometheus.CounterVec
 	tunnelTimePerLocation *prometheus.CounterVec
@@ -114,7 +187,7 @@ func (c *tunnelTimeCollector) Collect(ch chan<- prometheus.Metric) {
 func (c *tunnelTimeCollector) reportTunnelTime(ipKey IPKey, client *activeClient, tNow time.Time) {
 	tunnelTime := tNow.Sub(client.startTime)
 	logger.Debugf("Reporting tunnel time for key `%v`, duration: %v", ipKey.accessKey, tunnelTime)
-	c.tunnelTimePerKey.WithLabelValues(ipKey.accessKey).Add(tunnelTime.Seconds())
+	c.tunnelTimePerKey.WithLabelValues(c.keys.label(c.keyName(ipKey.accessKey), 0)).Add(tunnelTime.Seconds())
 	c.tunnelTimePerLocation.WithLabelValues(client.info.CountryCode.String(), asnLabel(client.info.ASN)).Add(tunnelTime.Seconds())
 	// Reset the start time now that the tunnel time has been reported.
 	client.startTime = tNow
@@ -153,6 +226,7 @@ func newTunnelTimeCollector(ip2info ipinfo.IPInfoMap, registerer prometheus.Regi
 	return &tunnelTimeCollector{
 		ip2info:       ip2info,
 		activeClients: make(map[IPKey]*activeClient),
+		keyName:       func(accessKey string) string { return accessKey },
 
 		tunnelTimePerKey: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: namespace,
@@ -184,6 +258,11 @@ func newPrometheusOutlineMetrics(ip2info ipinfo.IPInfoMap, registerer prometheus
 			Name:      "keys",
 			Help:      "Count of access keys",
 		}),
+		expiredKeys: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "keys_expired",
+			Help:      "Access keys removed because they expired",
+		}),
 		ports: prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "ports",
@@ -195,6 +274,11 @@ func newPrometheusOutlineMetrics(ip2info ipinfo.IPInfoMap, registerer prometheus
 			Buckets:   []float64{0, 49, 50, 51, 73, 91},
 			Help:      "Histogram of number of bytes from client to proxy, for detecting possible probes",
 		}, []string{"port", "status", "error"}),
+		tcpTruncatedProbes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tcp_probes_truncated",
+			Help:      "TCP connections that closed before sending enough bytes for a handshake with any cipher",
+		}, []string{"port"}),
 		tcpOpenConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: "tcp",
@@ -222,6 +306,35 @@ func newPrometheusOutlineMetrics(ip2info ipinfo.IPInfoMap, registerer prometheus
 					float64(7 * 24 * time.Hour.Milliseconds()), // Week
 				},
 			}, []string{"status"}),
+		tcpFailedRelayBytes: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Subsystem: "tcp",
+				Name:      "failed_relay_bytes",
+				Help:      "Bytes relayed to and from the target by TCP connections that failed while relaying, to tell early failures from late ones",
+				Buckets:   []float64{0, 1 << 10, 1 << 20, 10 << 20, 100 << 20, 1 << 30},
+			}, []string{"status", "dir"}),
+		tcpCircuitBreakerOpens: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "tcp",
+				Name:      "circuit_breaker_opens",
+				Help:      "Times that dials to a failing target were suspended",
+			}),
+		tcpSlowDials: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "tcp",
+				Name:      "slow_dials",
+				Help:      "Target dials that took longer than the slow dial threshold",
+			}),
+		tcpProbeResponses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "tcp",
+				Name:      "probe_responses",
+				Help:      "Responses to TCP connections that failed the handshake",
+			}, []string{"response"}),
 		dataBytes: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Namespace: namespace,
@@ -234,11 +347,17 @@ func newPrometheusOutlineMetrics(ip2info ipinfo.IPInfoMap, registerer prometheus
 				Name:      "data_bytes_per_location",
 				Help:      "Bytes transferred by the proxy, per location",
 			}, []string{"dir", "proto", "location", "asn"}),
+		dataBytesPerCipher: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "data_bytes_per_cipher",
+				Help:      "Bytes transferred by the proxy, per cipher method of the access key",
+			}, []string{"dir", "proto", "cipher"}),
 		timeToCipherMs: prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
 				Namespace: namespace,
 				Name:      "time_to_cipher_ms",
-				Help:      "Time needed to find the cipher",
+				Help:      "Time needed to find the cipher, from receiving the first bytes of the client (the 50-byte header for TCP), including the snapshot of the access keys and the trial decryptions",
 				Buckets:   []float64{0.1, 1, 10, 100, 1000},
 			}, []string{"proto", "found_key"}),
 		udpPacketsFromClientPerLocation: prometheus.NewCounterVec(
@@ -262,25 +381,171 @@ func newPrometheusOutlineMetrics(ip2info ipinfo.IPInfoMap, registerer prometheus
 				Name:      "nat_entries_removed",
 				Help:      "Entries removed from the UDP NAT table",
 			}),
+		udpAmplificationDrops: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "udp",
+				Name:      "packets_amplification_dropped",
+				Help:      "Replies dropped because they exceeded the amplification limit",
+			}),
+		udpDeduplicatedPackets: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "udp",
+				Name:      "packets_deduplicated",
+				Help:      "Duplicate packets from clients that were dropped instead of forwarded",
+			}),
+		udpConnectionMigrations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "udp",
+				Name:      "connection_migrations",
+				Help:      "NAT entries moved to a new client address",
+			}, []string{"access_key"}),
+		udpClientDuplicates: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "udp",
+				Name:      "client_duplicate_packets",
+				Help:      "Packets from clients identical to a recent one of the same NAT entry, likely retransmitted by a lossy network",
+			}, []string{"access_key"}),
 	}
 	m.tunnelTimeCollector = newTunnelTimeCollector(ip2info, registerer)
+	m.tunnelTimeCollector.keyName = m.keyName
 
 	// TODO: Is it possible to pass where to register the collectors?
-	registerer.MustRegister(m.buildInfo, m.accessKeys, m.ports, m.tcpProbes, m.tcpOpenConnections, m.tcpClosedConnections, m.tcpConnectionDurationMs,
-		m.dataBytes, m.dataBytesPerLocation, m.timeToCipherMs, m.udpPacketsFromClientPerLocation, m.udpAddedNatEntries, m.udpRemovedNatEntries,
-		m.tunnelTimeCollector)
+	registerer.MustRegister(m.buildInfo, m.accessKeys, m.expiredKeys, m.ports, m.tcpProbes, m.tcpTruncatedProbes, m.tcpOpenConnections, m.tcpClosedConnections, m.tcpConnectionDurationMs, m.tcpFailedRelayBytes,
+		m.dataBytes, m.dataBytesPerLocation, m.dataBytesPerCipher, m.timeToCipherMs, m.udpPacketsFromClientPerLocation, m.udpAddedNatEntries, m.udpRemovedNatEntries,
+		m.udpDeduplicatedPackets, m.udpAmplificationDrops, m.udpConnectionMigrations, m.udpClientDuplicates, m.tcpCircuitBreakerOpens, m.tcpSlowDials, m.tcpProbeResponses, m.tunnelTimeCollector)
 	return m
 }
 
+// registerBandwidthLimiterMetrics exports the state of the limiter. The utilization
+// is the rate of bandwidth_limiter_bytes divided by bandwidth_limit_bytes_per_second.
+func registerBandwidthLimiterMetrics(limiter *service.BandwidthLimiter, registerer prometheus.Registerer) {
+	registerer.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "bandwidth_limit_bytes_per_second",
+			Help:      "Maximum total throughput of all connections",
+		}, func() float64 { return float64(limiter.Limit()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bandwidth_limiter_bytes",
+			Help:      "Bytes relayed through the bandwidth limiter",
+		}, func() float64 { return float64(limiter.Bytes()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bandwidth_limiter_delay_seconds",
+			Help:      "Total time that relays were delayed by the bandwidth limiter",
+		}, func() float64 { return limiter.Delay().Seconds() }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bandwidth_limiter_dropped_packets",
+			Help:      "UDP packets dropped by the bandwidth limiter",
+		}, func() float64 { return float64(limiter.Dropped()) }),
+	)
+}
+
+// registerGoroutineLimiterMetrics exports the state of the limiter shared by the
+// TCP and UDP handlers.
+func registerGoroutineLimiterMetrics(limiter *service.GoroutineLimiter, registerer prometheus.Registerer) {
+	registerer.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "handler_goroutines",
+			Help:      "Goroutines used by connections and UDP NAT entries",
+		}, func() float64 { return float64(limiter.Running()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "handler_goroutines_shed",
+			Help:      "Connections and UDP NAT entries rejected by the goroutine limit",
+		}, func() float64 { return float64(limiter.Shed()) }),
+	)
+}
+
+func registerIPConnectionLimiterMetrics(limiter *service.IPConnectionLimiter, registerer prometheus.Registerer) {
+	registerer.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "ip_connection_limit_tracked_ips",
+			Help:      "Client IP addresses with open TCP connections tracked by the per-IP limit",
+		}, func() float64 { return float64(limiter.Tracked()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "ip_connection_limit_rejected",
+			Help:      "TCP connections rejected by the per-IP connection limit",
+		}, func() float64 { return float64(limiter.Rejected()) }),
+	)
+}
+
+func registerQuiescerMetrics(quiescer *service.Quiescer, registerer prometheus.Registerer) {
+	registerer.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "quiesced",
+		Help:      "1 while the server rejects new connections for maintenance, 0 otherwise",
+	}, func() float64 {
+		if quiescer.Quiesced() {
+			return 1
+		}
+		return 0
+	}))
+}
+
 func (m *outlineMetrics) SetBuildInfo(version string) {
 	m.buildInfo.WithLabelValues(version).Set(1)
 }
 
+// SetKeyLabelLimits bounds the number of series per access key: keys only get their
+// own series after relaying `threshold` bytes, and at most `maxKeys` keys get one,
+// or any number if `maxKeys` is zero. Other keys are reported as "other". It must be
+// called before the metrics are used.
+func (m *outlineMetrics) SetKeyLabelLimits(threshold int64, maxKeys int) {
+	m.keys = newKeyLabeler(threshold, maxKeys)
+	m.tunnelTimeCollector.keys = m.keys
+}
+
+// SetKeyNameFunc sets a function that returns the access_key label of each key,
+// such as a human-friendly name, instead of its ID. An empty name falls back to the
+// ID. The metrics keep using the ID internally, so names can change at any time.
+func (m *outlineMetrics) SetKeyNameFunc(name func(accessKey string) string) {
+	m.keyNames.Store(name)
+}
+
+// keyName returns the name that `accessKey` is reported with.
+func (m *outlineMetrics) keyName(accessKey string) string {
+	if name, ok := m.keyNames.Load().(func(string) string); ok && name != nil {
+		if keyName := name(accessKey); keyName != "" {
+			return keyName
+		}
+	}
+	return accessKey
+}
+
+// SetKeyCipherFunc sets a function that returns the cipher method of each key, like
+// "chacha20-ietf-poly1305". When set, data_bytes_per_cipher reports the bytes of the
+// keys with a known method, so operators can tell when a method is no longer in use.
+func (m *outlineMetrics) SetKeyCipherFunc(cipher func(accessKey string) string) {
+	m.keyCiphers.Store(cipher)
+}
+
+// keyCipher returns the cipher method of `accessKey`, or "" if it's unknown.
+func (m *outlineMetrics) keyCipher(accessKey string) string {
+	if cipher, ok := m.keyCiphers.Load().(func(string) string); ok && cipher != nil {
+		return cipher(accessKey)
+	}
+	return ""
+}
+
 func (m *outlineMetrics) SetNumAccessKeys(numKeys int, ports int) {
 	m.accessKeys.Set(float64(numKeys))
 	m.ports.Set(float64(ports))
 }
 
+func (m *outlineMetrics) AddExpiredKey() {
+	m.expiredKeys.Inc()
+}
+
 func (m *outlineMetrics) AddOpenTCPConnection(clientInfo ipinfo.IPInfo) {
 	m.tcpOpenConnections.WithLabelValues(clientInfo.CountryCode.String(), asnLabel(clientInfo.ASN)).Inc()
 }
@@ -307,16 +572,27 @@ func asnLabel(asn int) string {
 }
 
 func (m *outlineMetrics) AddClosedTCPConnection(clientInfo ipinfo.IPInfo, clientAddr net.Addr, accessKey, status string, data metrics.ProxyMetrics, duration time.Duration) {
-	m.tcpClosedConnections.WithLabelValues(clientInfo.CountryCode.String(), asnLabel(clientInfo.ASN), status, accessKey).Inc()
+	keyLabel := m.keys.label(m.keyName(accessKey), data.ClientProxy+data.ProxyClient)
+	m.tcpClosedConnections.WithLabelValues(clientInfo.CountryCode.String(), asnLabel(clientInfo.ASN), status, keyLabel).Inc()
 	m.tcpConnectionDurationMs.WithLabelValues(status).Observe(duration.Seconds() * 1000)
-	addIfNonZero(data.ClientProxy, m.dataBytes, "c>p", "tcp", accessKey)
+	if strings.HasPrefix(status, "ERR_RELAY_") {
+		m.tcpFailedRelayBytes.WithLabelValues(status, "p>t").Observe(float64(data.ProxyTarget))
+		m.tcpFailedRelayBytes.WithLabelValues(status, "p<t").Observe(float64(data.TargetProxy))
+	}
+	addIfNonZero(data.ClientProxy, m.dataBytes, "c>p", "tcp", keyLabel)
 	addIfNonZero(data.ClientProxy, m.dataBytesPerLocation, "c>p", "tcp", clientInfo.CountryCode.String(), asnLabel(clientInfo.ASN))
-	addIfNonZero(data.ProxyTarget, m.dataBytes, "p>t", "tcp", accessKey)
+	addIfNonZero(data.ProxyTarget, m.dataBytes, "p>t", "tcp", keyLabel)
 	addIfNonZero(data.ProxyTarget, m.dataBytesPerLocation, "p>t", "tcp", clientInfo.CountryCode.String(), asnLabel(clientInfo.ASN))
-	addIfNonZero(data.TargetProxy, m.dataBytes, "p<t", "tcp", accessKey)
+	addIfNonZero(data.TargetProxy, m.dataBytes, "p<t", "tcp", keyLabel)
 	addIfNonZero(data.TargetProxy, m.dataBytesPerLocation, "p<t", "tcp", clientInfo.CountryCode.String(), asnLabel(clientInfo.ASN))
-	addIfNonZero(data.ProxyClient, m.dataBytes, "c<p", "tcp", accessKey)
+	addIfNonZero(data.ProxyClient, m.dataBytes, "c<p", "tcp", keyLabel)
 	addIfNonZero(data.ProxyClient, m.dataBytesPerLocation, "c<p", "tcp", clientInfo.CountryCode.String(), asnLabel(clientInfo.ASN))
+	if cipher := m.keyCipher(accessKey); cipher != "" {
+		addIfNonZero(data.ClientProxy, m.dataBytesPerCipher, "c>p", "tcp", cipher)
+		addIfNonZero(data.ProxyTarget, m.dataBytesPerCipher, "p>t", "tcp", cipher)
+		addIfNonZero(data.TargetProxy, m.dataBytesPerCipher, "p<t", "tcp", cipher)
+		addIfNonZero(data.ProxyClient, m.dataBytesPerCipher, "c<p", "tcp", cipher)
+	}
 
 	ipKey, err := toIPKey(clientAddr, accessKey)
 	if err == nil {
@@ -326,17 +602,27 @@ func (m *outlineMetrics) AddClosedTCPConnection(clientInfo ipinfo.IPInfo, client
 
 func (m *outlineMetrics) AddUDPPacketFromClient(clientInfo ipinfo.IPInfo, accessKey, status string, clientProxyBytes, proxyTargetBytes int) {
 	m.udpPacketsFromClientPerLocation.WithLabelValues(clientInfo.CountryCode.String(), asnLabel(clientInfo.ASN), status).Inc()
-	addIfNonZero(int64(clientProxyBytes), m.dataBytes, "c>p", "udp", accessKey)
+	keyLabel := m.keys.label(m.keyName(accessKey), int64(clientProxyBytes))
+	addIfNonZero(int64(clientProxyBytes), m.dataBytes, "c>p", "udp", keyLabel)
 	addIfNonZero(int64(clientProxyBytes), m.dataBytesPerLocation, "c>p", "udp", clientInfo.CountryCode.String(), asnLabel(clientInfo.ASN))
-	addIfNonZero(int64(proxyTargetBytes), m.dataBytes, "p>t", "udp", accessKey)
+	addIfNonZero(int64(proxyTargetBytes), m.dataBytes, "p>t", "udp", keyLabel)
 	addIfNonZero(int64(proxyTargetBytes), m.dataBytesPerLocation, "p>t", "udp", clientInfo.CountryCode.String(), asnLabel(clientInfo.ASN))
+	if cipher := m.keyCipher(accessKey); cipher != "" {
+		addIfNonZero(int64(clientProxyBytes), m.dataBytesPerCipher, "c>p", "udp", cipher)
+		addIfNonZero(int64(proxyTargetBytes), m.dataBytesPerCipher, "p>t", "udp", cipher)
+	}
 }
 
 func (m *outlineMetrics) AddUDPPacketFromTarget(clientInfo ipinfo.IPInfo, accessKey, status string, targetProxyBytes, proxyClientBytes int) {
-	addIfNonZero(int64(targetProxyBytes), m.dataBytes, "p<t", "udp", accessKey)
+	keyLabel := m.keys.label(m.keyName(accessKey), int64(proxyClientBytes))
+	addIfNonZero(int64(targetProxyBytes), m.dataBytes, "p<t", "udp", keyLabel)
 	addIfNonZero(int64(targetProxyBytes), m.dataBytesPerLocation, "p<t", "udp", clientInfo.CountryCode.String(), asnLabel(clientInfo.ASN))
-	addIfNonZero(int64(proxyClientBytes), m.dataBytes, "c<p", "udp", accessKey)
+	addIfNonZero(int64(proxyClientBytes), m.dataBytes, "c<p", "udp", keyLabel)
 	addIfNonZero(int64(proxyClientBytes), m.dataBytesPerLocation, "c<p", "udp", clientInfo.CountryCode.String(), asnLabel(clientInfo.ASN))
+	if cipher := m.keyCipher(accessKey); cipher != "" {
+		addIfNonZero(int64(targetProxyBytes), m.dataBytesPerCipher, "p<t", "udp", cipher)
+		addIfNonZero(int64(proxyClientBytes), m.dataBytesPerCipher, "c<p", "udp", cipher)
+	}
 }
 
 func (m *outlineMetrics) AddUDPNatEntry(clientAddr net.Addr, accessKey string) {
@@ -357,8 +643,41 @@ func (m *outlineMetrics) RemoveUDPNatEntry(clientAddr net.Addr, accessKey string
 	}
 }
 
+func (m *outlineMetrics) AddUDPDeduplication() {
+	m.udpDeduplicatedPackets.Inc()
+}
+
+func (m *outlineMetrics) AddUDPAmplificationDrop() {
+	m.udpAmplificationDrops.Inc()
+}
+
+func (m *outlineMetrics) AddUDPConnectionMigration(accessKey string) {
+	m.udpConnectionMigrations.WithLabelValues(m.keys.label(m.keyName(accessKey), 0)).Inc()
+}
+
+func (m *outlineMetrics) AddUDPClientDuplicate(accessKey string) {
+	m.udpClientDuplicates.WithLabelValues(m.keys.label(m.keyName(accessKey), 0)).Inc()
+}
+
 func (m *outlineMetrics) AddTCPProbe(status, drainResult string, port int, clientProxyBytes int64) {
 	m.tcpProbes.WithLabelValues(strconv.Itoa(port), status, drainResult).Observe(float64(clientProxyBytes))
+	if status == "ERR_PROBE_TRUNCATED" {
+		m.tcpTruncatedProbes.WithLabelValues(strconv.Itoa(port)).Inc()
+	}
+}
+
+// AddTCPCircuitBreakerOpen doesn't label by target, since there can be any number of them.
+func (m *outlineMetrics) AddTCPCircuitBreakerOpen(target string) {
+	m.tcpCircuitBreakerOpens.Inc()
+}
+
+// AddTCPSlowDial doesn't label by target either. The targets are logged.
+func (m *outlineMetrics) AddTCPSlowDial(target string, elapsed time.Duration) {
+	m.tcpSlowDials.Inc()
+}
+
+func (m *outlineMetrics) AddTCPProbeResponse(response string) {
+	m.tcpProbeResponses.WithLabelValues(response).Inc()
 }
 
 func (m *outlineMetrics) AddTCPCipherSearch(accessKeyFound bool, timeToCipher time.Duration) {
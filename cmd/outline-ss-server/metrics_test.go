@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/Jigsaw-Code/outline-ss-server/ipinfo"
+	"github.com/Jigsaw-Code/outline-ss-server/service"
 	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
 	"github.com/op/go-logging"
 	"github.com/prometheus/client_golang/prometheus"
@@ -68,7 +69,14 @@ func TestMethodsDontPanic(t *testing.T) {
 	ssMetrics.AddUDPPacketFromTarget(ipInfo, "3", "OK", 10, 20)
 	ssMetrics.AddUDPNatEntry(fakeAddr("127.0.0.1:9"), "key-1")
 	ssMetrics.RemoveUDPNatEntry(fakeAddr("127.0.0.1:9"), "key-1")
+	ssMetrics.AddUDPDeduplication()
+	ssMetrics.AddUDPAmplificationDrop()
+	ssMetrics.AddUDPConnectionMigration("key-1")
+	ssMetrics.AddUDPClientDuplicate("key-1")
 	ssMetrics.AddTCPProbe("ERR_CIPHER", "eof", 443, proxyMetrics.ClientProxy)
+	ssMetrics.AddTCPCircuitBreakerOpen("192.0.2.2:80")
+	ssMetrics.AddTCPSlowDial("192.0.2.2:80", time.Second)
+	ssMetrics.AddTCPProbeResponse("decoy")
 	ssMetrics.AddTCPCipherSearch(true, 10*time.Millisecond)
 	ssMetrics.AddUDPCipherSearch(true, 10*time.Millisecond)
 }
@@ -206,3 +214,223 @@ func BenchmarkNAT(b *testing.B) {
 		ssMetrics.RemoveUDPNatEntry(fakeAddr("127.0.0.1:9"), "key-0")
 	}
 }
+
+func TestBandwidthLimiterMetrics(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	limiter := service.NewBandwidthLimiter(1000000)
+	registerBandwidthLimiterMetrics(limiter, reg)
+	limiter.Wait(100)
+
+	expected := strings.NewReader(`
+	# HELP shadowsocks_bandwidth_limit_bytes_per_second Maximum total throughput of all connections
+	# TYPE shadowsocks_bandwidth_limit_bytes_per_second gauge
+	shadowsocks_bandwidth_limit_bytes_per_second 1e+06
+	# HELP shadowsocks_bandwidth_limiter_bytes Bytes relayed through the bandwidth limiter
+	# TYPE shadowsocks_bandwidth_limiter_bytes counter
+	shadowsocks_bandwidth_limiter_bytes 100
+	# HELP shadowsocks_bandwidth_limiter_delay_seconds Total time that relays were delayed by the bandwidth limiter
+	# TYPE shadowsocks_bandwidth_limiter_delay_seconds counter
+	shadowsocks_bandwidth_limiter_delay_seconds 0
+	# HELP shadowsocks_bandwidth_limiter_dropped_packets UDP packets dropped by the bandwidth limiter
+	# TYPE shadowsocks_bandwidth_limiter_dropped_packets counter
+	shadowsocks_bandwidth_limiter_dropped_packets 0
+`)
+	err := promtest.GatherAndCompare(
+		reg,
+		expected,
+		"shadowsocks_bandwidth_limit_bytes_per_second",
+		"shadowsocks_bandwidth_limiter_bytes",
+		"shadowsocks_bandwidth_limiter_delay_seconds",
+		"shadowsocks_bandwidth_limiter_dropped_packets",
+	)
+	require.NoError(t, err, "unexpected metric value found")
+}
+
+func TestKeyLabeler(t *testing.T) {
+	l := newKeyLabeler(100, 2)
+	require.Equal(t, otherKeysLabel, l.label("key-1", 60))
+	require.Equal(t, "key-1", l.label("key-1", 60))
+	require.Equal(t, "key-1", l.label("key-1", 0))
+	require.Equal(t, "key-2", l.label("key-2", 100))
+	// The limit of exported keys has been reached.
+	require.Equal(t, otherKeysLabel, l.label("key-3", 1000))
+	require.Equal(t, "", l.label("", 1000))
+
+	var nilLabeler *keyLabeler
+	require.Equal(t, "key-3", nilLabeler.label("key-3", 0))
+}
+
+func TestKeyLabelLimits(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	ssMetrics := newPrometheusOutlineMetrics(nil, reg)
+	ssMetrics.SetKeyLabelLimits(10, 0)
+
+	ssMetrics.AddUDPPacketFromTarget(ipinfo.IPInfo{}, "small", "OK", 5, 5)
+	ssMetrics.AddUDPPacketFromTarget(ipinfo.IPInfo{}, "big", "OK", 20, 20)
+
+	expected := strings.NewReader(`
+	# HELP shadowsocks_data_bytes Bytes transferred by the proxy, per access key
+	# TYPE shadowsocks_data_bytes counter
+	shadowsocks_data_bytes{access_key="big",dir="c<p",proto="udp"} 20
+	shadowsocks_data_bytes{access_key="big",dir="p<t",proto="udp"} 20
+	shadowsocks_data_bytes{access_key="other",dir="c<p",proto="udp"} 5
+	shadowsocks_data_bytes{access_key="other",dir="p<t",proto="udp"} 5
+`)
+	err := promtest.GatherAndCompare(reg, expected, "shadowsocks_data_bytes")
+	require.NoError(t, err, "unexpected metric value found")
+}
+
+func TestKeyNameFunc(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	ssMetrics := newPrometheusOutlineMetrics(nil, reg)
+	ssMetrics.SetKeyNameFunc(func(accessKey string) string {
+		if accessKey == "id-0" {
+			return "alice"
+		}
+		return ""
+	})
+
+	ssMetrics.AddUDPPacketFromTarget(ipinfo.IPInfo{}, "id-0", "OK", 5, 5)
+	ssMetrics.AddUDPPacketFromTarget(ipinfo.IPInfo{}, "id-1", "OK", 7, 7)
+
+	expected := strings.NewReader(`
+	# HELP shadowsocks_data_bytes Bytes transferred by the proxy, per access key
+	# TYPE shadowsocks_data_bytes counter
+	shadowsocks_data_bytes{access_key="alice",dir="c<p",proto="udp"} 5
+	shadowsocks_data_bytes{access_key="alice",dir="p<t",proto="udp"} 5
+	shadowsocks_data_bytes{access_key="id-1",dir="c<p",proto="udp"} 7
+	shadowsocks_data_bytes{access_key="id-1",dir="p<t",proto="udp"} 7
+`)
+	err := promtest.GatherAndCompare(reg, expected, "shadowsocks_data_bytes")
+	require.NoError(t, err, "unexpected metric value found")
+}
+
+func TestFailedRelayBytes(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	ssMetrics := newPrometheusOutlineMetrics(nil, reg)
+	ssMetrics.AddClosedTCPConnection(ipinfo.IPInfo{}, fakeAddr("127.0.0.1:9"), "id-0", "ERR_RELAY_TARGET", metrics.ProxyMetrics{ClientProxy: 2 << 20, ProxyTarget: 2 << 20, TargetProxy: 100}, time.Second)
+	// Connections that didn't fail while relaying aren't observed.
+	ssMetrics.AddClosedTCPConnection(ipinfo.IPInfo{}, fakeAddr("127.0.0.1:9"), "id-0", "OK", metrics.ProxyMetrics{ProxyTarget: 10}, time.Second)
+
+	expected := strings.NewReader(`
+	# HELP shadowsocks_tcp_failed_relay_bytes Bytes relayed to and from the target by TCP connections that failed while relaying, to tell early failures from late ones
+	# TYPE shadowsocks_tcp_failed_relay_bytes histogram
+	shadowsocks_tcp_failed_relay_bytes_bucket{dir="p<t",status="ERR_RELAY_TARGET",le="0"} 0
+	shadowsocks_tcp_failed_relay_bytes_bucket{dir="p<t",status="ERR_RELAY_TARGET",le="1024"} 1
+	shadowsocks_tcp_failed_relay_bytes_bucket{dir="p<t",status="ERR_RELAY_TARGET",le="1.048576e+06"} 1
+	shadowsocks_tcp_failed_relay_bytes_bucket{dir="p<t",status="ERR_RELAY_TARGET",le="1.048576e+07"} 1
+	shadowsocks_tcp_failed_relay_bytes_bucket{dir="p<t",status="ERR_RELAY_TARGET",le="1.048576e+08"} 1
+	shadowsocks_tcp_failed_relay_bytes_bucket{dir="p<t",status="ERR_RELAY_TARGET",le="1.073741824e+09"} 1
+	shadowsocks_tcp_failed_relay_bytes_bucket{dir="p<t",status="ERR_RELAY_TARGET",le="+Inf"} 1
+	shadowsocks_tcp_failed_relay_bytes_sum{dir="p<t",status="ERR_RELAY_TARGET"} 100
+	shadowsocks_tcp_failed_relay_bytes_count{dir="p<t",status="ERR_RELAY_TARGET"} 1
+	shadowsocks_tcp_failed_relay_bytes_bucket{dir="p>t",status="ERR_RELAY_TARGET",le="0"} 0
+	shadowsocks_tcp_failed_relay_bytes_bucket{dir="p>t",status="ERR_RELAY_TARGET",le="1024"} 0
+	shadowsocks_tcp_failed_relay_bytes_bucket{dir="p>t",status="ERR_RELAY_TARGET",le="1.048576e+06"} 0
+	shadowsocks_tcp_failed_relay_bytes_bucket{dir="p>t",status="ERR_RELAY_TARGET",le="1.048576e+07"} 1
+	shadowsocks_tcp_failed_relay_bytes_bucket{dir="p>t",status="ERR_RELAY_TARGET",le="1.048576e+08"} 1
+	shadowsocks_tcp_failed_relay_bytes_bucket{dir="p>t",status="ERR_RELAY_TARGET",le="1.073741824e+09"} 1
+	shadowsocks_tcp_failed_relay_bytes_bucket{dir="p>t",status="ERR_RELAY_TARGET",le="+Inf"} 1
+	shadowsocks_tcp_failed_relay_bytes_sum{dir="p>t",status="ERR_RELAY_TARGET"} 2.097152e+06
+	shadowsocks_tcp_failed_relay_bytes_count{dir="p>t",status="ERR_RELAY_TARGET"} 1
+`)
+	err := promtest.GatherAndCompare(reg, expected, "shadowsocks_tcp_failed_relay_bytes")
+	require.NoError(t, err, "unexpected metric value found")
+}
+
+func TestTruncatedProbes(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	ssMetrics := newPrometheusOutlineMetrics(nil, reg)
+	ssMetrics.AddTCPProbe("ERR_PROBE_TRUNCATED", "timeout", 443, 10)
+	ssMetrics.AddTCPProbe("ERR_PROBE_TRUNCATED", "eof", 443, 0)
+	// Probes that sent a full handshake aren't counted.
+	ssMetrics.AddTCPProbe("ERR_CIPHER", "eof", 443, 50)
+
+	expected := strings.NewReader(`
+	# HELP shadowsocks_tcp_probes_truncated TCP connections that closed before sending enough bytes for a handshake with any cipher
+	# TYPE shadowsocks_tcp_probes_truncated counter
+	shadowsocks_tcp_probes_truncated{port="443"} 2
+`)
+	err := promtest.GatherAndCompare(reg, expected, "shadowsocks_tcp_probes_truncated")
+	require.NoError(t, err, "unexpected metric value found")
+}
+
+func TestKeyCipherFunc(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	ssMetrics := newPrometheusOutlineMetrics(nil, reg)
+	ssMetrics.SetKeyCipherFunc(func(accessKey string) string {
+		switch accessKey {
+		case "id-0":
+			return "chacha20-ietf-poly1305"
+		case "id-1":
+			return "aes-256-gcm"
+		}
+		return ""
+	})
+
+	ssMetrics.AddClosedTCPConnection(ipinfo.IPInfo{}, fakeAddr("127.0.0.1:9"), "id-0", "OK", metrics.ProxyMetrics{ClientProxy: 10, ProxyTarget: 8}, time.Second)
+	ssMetrics.AddUDPPacketFromClient(ipinfo.IPInfo{}, "id-1", "OK", 5, 3)
+	ssMetrics.AddUDPPacketFromTarget(ipinfo.IPInfo{}, "id-1", "OK", 3, 5)
+	// Keys with an unknown cipher aren't reported.
+	ssMetrics.AddUDPPacketFromClient(ipinfo.IPInfo{}, "id-2", "OK", 7, 7)
+
+	expected := strings.NewReader(`
+	# HELP shadowsocks_data_bytes_per_cipher Bytes transferred by the proxy, per cipher method of the access key
+	# TYPE shadowsocks_data_bytes_per_cipher counter
+	shadowsocks_data_bytes_per_cipher{cipher="aes-256-gcm",dir="c<p",proto="udp"} 5
+	shadowsocks_data_bytes_per_cipher{cipher="aes-256-gcm",dir="c>p",proto="udp"} 5
+	shadowsocks_data_bytes_per_cipher{cipher="aes-256-gcm",dir="p<t",proto="udp"} 3
+	shadowsocks_data_bytes_per_cipher{cipher="aes-256-gcm",dir="p>t",proto="udp"} 3
+	shadowsocks_data_bytes_per_cipher{cipher="chacha20-ietf-poly1305",dir="c>p",proto="tcp"} 10
+	shadowsocks_data_bytes_per_cipher{cipher="chacha20-ietf-poly1305",dir="p>t",proto="tcp"} 8
+`)
+	err := promtest.GatherAndCompare(reg, expected, "shadowsocks_data_bytes_per_cipher")
+	require.NoError(t, err, "unexpected metric value found")
+}
+
+func TestGoroutineLimiterMetrics(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	registerGoroutineLimiterMetrics(service.NewGoroutineLimiter(10), reg)
+
+	expected := strings.NewReader(`
+	# HELP shadowsocks_handler_goroutines Goroutines used by connections and UDP NAT entries
+	# TYPE shadowsocks_handler_goroutines gauge
+	shadowsocks_handler_goroutines 0
+	# HELP shadowsocks_handler_goroutines_shed Connections and UDP NAT entries rejected by the goroutine limit
+	# TYPE shadowsocks_handler_goroutines_shed counter
+	shadowsocks_handler_goroutines_shed 0
+`)
+	err := promtest.GatherAndCompare(reg, expected, "shadowsocks_handler_goroutines", "shadowsocks_handler_goroutines_shed")
+	require.NoError(t, err, "unexpected metric value found")
+}
+
+func TestIPConnectionLimiterMetrics(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	registerIPConnectionLimiterMetrics(service.NewIPConnectionLimiter(1, 10), reg)
+
+	expected := strings.NewReader(`
+	# HELP shadowsocks_ip_connection_limit_rejected TCP connections rejected by the per-IP connection limit
+	# TYPE shadowsocks_ip_connection_limit_rejected counter
+	shadowsocks_ip_connection_limit_rejected 0
+	# HELP shadowsocks_ip_connection_limit_tracked_ips Client IP addresses with open TCP connections tracked by the per-IP limit
+	# TYPE shadowsocks_ip_connection_limit_tracked_ips gauge
+	shadowsocks_ip_connection_limit_tracked_ips 0
+`)
+	err := promtest.GatherAndCompare(reg, expected, "shadowsocks_ip_connection_limit_rejected", "shadowsocks_ip_connection_limit_tracked_ips")
+	require.NoError(t, err, "unexpected metric value found")
+}
+
+func TestQuiescerMetrics(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	var quiescer service.Quiescer
+	registerQuiescerMetrics(&quiescer, reg)
+	quiescer.Quiesce()
+
+	expected := strings.NewReader(`
+	# HELP shadowsocks_quiesced 1 while the server rejects new connections for maintenance, 0 otherwise
+	# TYPE shadowsocks_quiesced gauge
+	shadowsocks_quiesced 1
+`)
+	err := promtest.GatherAndCompare(reg, expected, "shadowsocks_quiesced")
+	require.NoError(t, err, "unexpected metric value found")
+}
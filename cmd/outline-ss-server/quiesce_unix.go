@@ -0,0 +1,40 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyQuiesceSignals makes SIGUSR1 quiesce the server and SIGUSR2 resume it.
+func notifyQuiesceSignals(server *SSServer) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigCh {
+			if sig == syscall.SIGUSR1 {
+				logger.Infof("SIGUSR1 received. Rejecting new connections")
+				server.Quiesce()
+			} else {
+				logger.Infof("SIGUSR2 received. Accepting new connections")
+				server.Resume()
+			}
+		}
+	}()
+}
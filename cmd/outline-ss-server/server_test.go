@@ -15,19 +15,90 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/Jigsaw-Code/outline-ss-server/service"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestRunSSServer(t *testing.T) {
 	m := newPrometheusOutlineMetrics(nil, prometheus.DefaultRegisterer)
-	server, err := RunSSServer("config_example.yml", 30*time.Second, m, 10000)
+	server, err := RunSSServer("config_example.yml", 30*time.Second, m, 10000, SSServerOptions{UDPMaxAmplification: service.RecommendedUDPAmplificationFactor})
 	if err != nil {
 		t.Fatalf("RunSSServer() error = %v", err)
 	}
+	if cipher := server.keyCipher("user-0"); cipher != "chacha20-ietf-poly1305" {
+		t.Errorf("keyCipher(user-0) = %q, want chacha20-ietf-poly1305", cipher)
+	}
 	if err := server.Stop(); err != nil {
 		t.Errorf("Error while stopping server: %v", err)
 	}
 }
+
+func TestReadConfigExpiresAt(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yml")
+	config := `keys:
+  - id: trial
+    port: 9000
+    cipher: chacha20-ietf-poly1305
+    secret: Secret0-ChangeMe
+    expires_at: 2024-06-01T12:00:00Z
+  - id: forever
+    port: 9000
+    cipher: chacha20-ietf-poly1305
+    secret: Secret1-ChangeMe
+`
+	if err := os.WriteFile(filename, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := readConfig(filename)
+	if err != nil {
+		t.Fatalf("readConfig() error = %v", err)
+	}
+	if want := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC); !parsed.Keys[0].ExpiresAt.Equal(want) {
+		t.Errorf("ExpiresAt = %v, want %v", parsed.Keys[0].ExpiresAt, want)
+	}
+	if !parsed.Keys[1].ExpiresAt.IsZero() {
+		t.Errorf("ExpiresAt = %v, want zero", parsed.Keys[1].ExpiresAt)
+	}
+}
+
+func TestRunSSServerMaxKeysPerPort(t *testing.T) {
+	m := newPrometheusOutlineMetrics(nil, prometheus.NewRegistry())
+	// Port 9000 has 2 keys in the example config.
+	_, err := RunSSServer("config_example.yml", 30*time.Second, m, 10000, SSServerOptions{UDPMaxAmplification: service.RecommendedUDPAmplificationFactor, MaxKeysPerPort: 1})
+	if err == nil {
+		t.Fatal("RunSSServer() succeeded with too many keys on a port")
+	}
+}
+
+func TestRunSSServerWeakSecret(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yml")
+	config := `keys:
+  - id: user-0
+    port: 9002
+    cipher: chacha20-ietf-poly1305
+    secret: short
+`
+	if err := os.WriteFile(filename, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Weak secrets are only logged by default, so existing configs keep working.
+	m := newPrometheusOutlineMetrics(nil, prometheus.NewRegistry())
+	server, err := RunSSServer(filename, 30*time.Second, m, 10000, SSServerOptions{})
+	if err != nil {
+		t.Fatalf("RunSSServer() error = %v", err)
+	}
+	if err := server.Stop(); err != nil {
+		t.Errorf("Error while stopping server: %v", err)
+	}
+
+	m = newPrometheusOutlineMetrics(nil, prometheus.NewRegistry())
+	if _, err := RunSSServer(filename, 30*time.Second, m, 10000, SSServerOptions{RejectWeakSecrets: true}); err == nil {
+		t.Fatal("RunSSServer() succeeded with a weak secret and RejectWeakSecrets")
+	}
+}
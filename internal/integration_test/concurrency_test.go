@@ -0,0 +1,115 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration
+
+package integration_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/Jigsaw-Code/outline-ss-server/service"
+	"github.com/stretchr/testify/require"
+)
+
+// BenchmarkTCPHighConcurrency relays b.N connections through a single access key,
+// keeping 1000 of them in progress at any time. Each connection echoes 4 KB, so
+// MB/s is the total throughput and ns/op the cost of one connection. Every
+// connection uses four sockets, so the file descriptor limit must be above 4000.
+//
+// Run with: go test -tags integration -run '^$' -bench TCPHighConcurrency ./internal/integration_test
+func BenchmarkTCPHighConcurrency(b *testing.B) {
+	procsList := []int{1}
+	if runtime.NumCPU() > 1 {
+		procsList = append(procsList, runtime.NumCPU())
+	}
+	for _, procs := range procsList {
+		b.Run(fmt.Sprintf("GOMAXPROCS=%v", procs), func(b *testing.B) {
+			defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+			benchmarkTCPHighConcurrency(b)
+		})
+	}
+}
+
+func benchmarkTCPHighConcurrency(b *testing.B) {
+	const numConns = 1000
+	const payloadSize = 4096
+
+	echoListener, echoRunning := startTCPEchoServer(b)
+	proxyListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(b, err)
+	secrets := makeTestSecrets(1)
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(b, err)
+	replayCache := service.NewReplayCache(service.MaxCapacity)
+	testMetrics := &service.NoOpTCPMetrics{}
+	authFunc := service.NewShadowsocksStreamAuthenticator(cipherList, &replayCache, testMetrics)
+	handler := service.NewTCPHandler(proxyListener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 10*time.Second)
+	handler.SetTargetDialer(&transport.TCPDialer{})
+	done := make(chan struct{})
+	go func() {
+		service.StreamServe(service.WrapStreamListener(proxyListener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+	require.NoError(b, err)
+	client, err := shadowsocks.NewStreamDialer(&transport.TCPEndpoint{Address: proxyListener.Addr().String()}, cryptoKey)
+	require.NoError(b, err)
+
+	b.SetBytes(2 * payloadSize)
+	b.ResetTimer()
+	var remaining atomic.Int64
+	remaining.Store(int64(b.N))
+	var wg sync.WaitGroup
+	for i := 0; i < numConns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			up := make([]byte, payloadSize)
+			down := make([]byte, payloadSize)
+			for remaining.Add(-1) >= 0 {
+				conn, err := client.DialStream(context.Background(), echoListener.Addr().String())
+				if err != nil {
+					b.Errorf("DialStream failed: %v", err)
+					return
+				}
+				if _, err := conn.Write(up); err != nil {
+					b.Errorf("Write failed: %v", err)
+				}
+				if _, err := io.ReadFull(conn, down); err != nil {
+					b.Errorf("Read failed: %v", err)
+				}
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	proxyListener.Close()
+	<-done
+	echoListener.Close()
+	echoRunning.Wait()
+}
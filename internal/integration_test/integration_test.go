@@ -16,11 +16,13 @@ package integration_test
 
 import (
 	"bytes"
+	"container/list"
 	"context"
 	"fmt"
 	"io"
 	"net"
 	"net/netip"
+	"os"
 	"sync"
 	"testing"
 	"time"
@@ -31,6 +33,7 @@ import (
 	"github.com/Jigsaw-Code/outline-ss-server/service"
 	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
 	logging "github.com/op/go-logging"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -131,7 +134,7 @@ func TestTCPEcho(t *testing.T) {
 	}
 	replayCache := service.NewReplayCache(5)
 	const testTimeout = 200 * time.Millisecond
-	testMetrics := &service.NoOpTCPMetrics{}
+	testMetrics := &statusMetrics{}
 	authFunc := service.NewShadowsocksStreamAuthenticator(cipherList, &replayCache, testMetrics)
 	handler := service.NewTCPHandler(proxyListener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, testTimeout)
 	handler.SetTargetDialer(&transport.TCPDialer{})
@@ -179,20 +182,292 @@ func TestTCPEcho(t *testing.T) {
 	<-done
 	echoListener.Close()
 	echoRunning.Wait()
+
+	// The connection is reported once the handler sees the client close it.
+	require.Eventually(t, func() bool { return testMetrics.closedConnections() == 1 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, []string{"OK"}, testMetrics.statuses)
+	data := testMetrics.data[0]
+	// The target sees the plaintext, while the client side also carries the salt,
+	// and for each chunk an encrypted length and two tags. The upstream starts with
+	// the target address, and the number of chunks depends on how the writes and
+	// reads are split, so only the minimum overhead is certain.
+	const saltSize, chunkOverhead = 32, 2 + 16 + 16
+	targetAddrSize := len(socks.ParseAddr(echoListener.Addr().String()))
+	require.Equal(t, int64(N), data.ProxyTarget)
+	require.Equal(t, int64(N), data.TargetProxy)
+	require.GreaterOrEqual(t, data.ClientProxy, int64(saltSize+targetAddrSize+N+chunkOverhead))
+	require.LessOrEqual(t, data.ClientProxy, int64(saltSize+targetAddrSize+N+2*chunkOverhead))
+	require.GreaterOrEqual(t, data.ProxyClient, int64(saltSize+N+chunkOverhead))
+}
+
+// Writes `payload` to `conn` and checks that it is echoed back.
+func requireEcho(t *testing.T, conn io.ReadWriter, payload []byte) {
+	_, err := conn.Write(payload)
+	require.NoError(t, err)
+	down := make([]byte, len(payload))
+	_, err = io.ReadFull(conn, down)
+	require.NoError(t, err)
+	require.Equal(t, payload, down)
+}
+
+func TestEchoAllCipherTypes(t *testing.T) {
+	tcpEchoListener, tcpEchoRunning := startTCPEchoServer(t)
+	defer tcpEchoRunning.Wait()
+	defer tcpEchoListener.Close()
+	udpEchoConn, udpEchoRunning := startUDPEchoServer(t)
+	defer udpEchoRunning.Wait()
+	defer udpEchoConn.Close()
+
+	cipherLists, err := service.MakeTestCiphersAllTypes([]string{"secret"})
+	require.NoError(t, err)
+	require.Len(t, cipherLists, 3)
+	for _, cipherList := range cipherLists {
+		cryptoKey := cipherList.SnapshotForClientIP(netip.Addr{})[0].Value.(*service.CipherEntry).CryptoKey
+		cipherName, ok := service.CipherName(cryptoKey)
+		require.True(t, ok)
+		t.Run(cipherName, func(t *testing.T) {
+			proxyListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+			require.NoError(t, err)
+			testMetrics := &service.NoOpTCPMetrics{}
+			authFunc := service.NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+			handler := service.NewTCPHandler(proxyListener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond)
+			handler.SetTargetDialer(&transport.TCPDialer{})
+			tcpDone := make(chan struct{})
+			go func() {
+				service.StreamServe(service.WrapStreamListener(proxyListener.AcceptTCP), handler.Handle)
+				tcpDone <- struct{}{}
+			}()
+			proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+			require.NoError(t, err)
+			proxy := service.NewPacketHandler(time.Hour, cipherList, &fakeUDPMetrics{})
+			proxy.SetTargetIPValidator(allowAll)
+			udpDone := make(chan struct{})
+			go func() {
+				proxy.Handle(proxyConn)
+				udpDone <- struct{}{}
+			}()
+
+			streamClient, err := shadowsocks.NewStreamDialer(&transport.TCPEndpoint{Address: proxyListener.Addr().String()}, cryptoKey)
+			require.NoError(t, err)
+			conn, err := streamClient.DialStream(context.Background(), tcpEchoListener.Addr().String())
+			require.NoError(t, err)
+			requireEcho(t, conn, makeTestPayload(1000))
+			conn.Close()
+
+			packetClient, err := shadowsocks.NewPacketListener(&transport.UDPEndpoint{Address: proxyConn.LocalAddr().String()}, cryptoKey)
+			require.NoError(t, err)
+			packetConn, err := packetClient.ListenPacket(context.Background())
+			require.NoError(t, err)
+			up := makeTestPayload(1000)
+			_, err = packetConn.WriteTo(up, udpEchoConn.LocalAddr())
+			require.NoError(t, err)
+			down := make([]byte, len(up))
+			n, _, err := packetConn.ReadFrom(down)
+			require.NoError(t, err)
+			require.Equal(t, up, down[:n])
+			packetConn.Close()
+
+			proxyListener.Close()
+			<-tcpDone
+			proxyConn.Close()
+			<-udpDone
+		})
+	}
+}
+
+func TestTCPKeyRotation(t *testing.T) {
+	echoListener, echoRunning := startTCPEchoServer(t)
+
+	proxyListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	cipherList, err := service.MakeTestCiphers([]string{"old secret"})
+	require.NoError(t, err)
+	const testTimeout = 200 * time.Millisecond
+	testMetrics := &statusMetrics{}
+	authFunc := service.NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	handler := service.NewTCPHandler(proxyListener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, testTimeout)
+	handler.SetTargetDialer(&transport.TCPDialer{})
+	done := make(chan struct{})
+	go func() {
+		service.StreamServe(service.WrapStreamListener(proxyListener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	dial := func(secret string) transport.StreamConn {
+		cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secret)
+		require.NoError(t, err)
+		client, err := shadowsocks.NewStreamDialer(&transport.TCPEndpoint{Address: proxyListener.Addr().String()}, cryptoKey)
+		require.NoError(t, err)
+		conn, err := client.DialStream(context.Background(), echoListener.Addr().String())
+		require.NoError(t, err)
+		return conn
+	}
+	oldConn := dial("old secret")
+	requireEcho(t, oldConn, []byte("before rotation"))
+
+	// Rotate the key material, keeping the same ID.
+	cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, "new secret")
+	require.NoError(t, err)
+	entry := service.MakeCipherEntry("id-0", cryptoKey, "new secret")
+	rotated := list.New()
+	rotated.PushBack(&entry)
+	cipherList.Update(rotated)
+
+	// The established connection is unaffected.
+	requireEcho(t, oldConn, []byte("after rotation"))
+	oldConn.Close()
+
+	// New connections must use the new key.
+	newConn := dial("new secret")
+	requireEcho(t, newConn, []byte("with new key"))
+	newConn.Close()
+
+	staleConn := dial("old secret")
+	_, err = staleConn.Write([]byte("with old key"))
+	require.NoError(t, err)
+	_, err = staleConn.Read(make([]byte, 10))
+	require.Error(t, err)
+	staleConn.Close()
+
+	proxyListener.Close()
+	<-done
+	echoListener.Close()
+	echoRunning.Wait()
+	require.ElementsMatch(t, []string{"OK", "OK", "ERR_CIPHER"}, testMetrics.statuses)
+}
+
+func TestTCPSetAuthenticator(t *testing.T) {
+	echoListener, echoRunning := startTCPEchoServer(t)
+
+	proxyListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	blueList, err := service.MakeTestCiphers([]string{"blue secret"})
+	require.NoError(t, err)
+	testMetrics := &statusMetrics{}
+	handler := service.NewTCPHandler(proxyListener.Addr().(*net.TCPAddr).Port, service.NewShadowsocksStreamAuthenticator(blueList, nil, testMetrics), testMetrics, 200*time.Millisecond)
+	handler.SetTargetDialer(&transport.TCPDialer{})
+	done := make(chan struct{})
+	go func() {
+		service.StreamServe(service.WrapStreamListener(proxyListener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	dial := func(secret string) transport.StreamConn {
+		cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secret)
+		require.NoError(t, err)
+		client, err := shadowsocks.NewStreamDialer(&transport.TCPEndpoint{Address: proxyListener.Addr().String()}, cryptoKey)
+		require.NoError(t, err)
+		conn, err := client.DialStream(context.Background(), echoListener.Addr().String())
+		require.NoError(t, err)
+		return conn
+	}
+	blueConn := dial("blue secret")
+	requireEcho(t, blueConn, []byte("before swap"))
+
+	greenList, err := service.MakeTestCiphers([]string{"green secret"})
+	require.NoError(t, err)
+	handler.(service.AuthenticatorSetter).SetAuthenticator(service.NewShadowsocksStreamAuthenticator(greenList, nil, testMetrics))
+
+	// The established connection is unaffected, and new ones use the new list.
+	requireEcho(t, blueConn, []byte("after swap"))
+	blueConn.Close()
+	greenConn := dial("green secret")
+	requireEcho(t, greenConn, []byte("with green key"))
+	greenConn.Close()
+	staleConn := dial("blue secret")
+	_, err = staleConn.Write([]byte("with blue key"))
+	require.NoError(t, err)
+	_, err = staleConn.Read(make([]byte, 10))
+	require.Error(t, err)
+	staleConn.Close()
+
+	proxyListener.Close()
+	<-done
+	echoListener.Close()
+	echoRunning.Wait()
+	require.ElementsMatch(t, []string{"OK", "OK", "ERR_CIPHER"}, testMetrics.statuses)
+}
+
+func TestUDPSetCipherList(t *testing.T) {
+	echoConn, echoRunning := startUDPEchoServer(t)
+
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	blueList, err := service.MakeTestCiphers([]string{"blue secret"})
+	require.NoError(t, err)
+	proxy := service.NewPacketHandler(time.Hour, blueList, &fakeUDPMetrics{})
+	proxy.SetTargetIPValidator(allowAll)
+	done := make(chan struct{})
+	go func() {
+		proxy.Handle(proxyConn)
+		done <- struct{}{}
+	}()
+
+	listen := func(secret string) net.PacketConn {
+		cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secret)
+		require.NoError(t, err)
+		client, err := shadowsocks.NewPacketListener(&transport.UDPEndpoint{Address: proxyConn.LocalAddr().String()}, cryptoKey)
+		require.NoError(t, err)
+		conn, err := client.ListenPacket(context.Background())
+		require.NoError(t, err)
+		return conn
+	}
+	echo := func(conn net.PacketConn, payload []byte) error {
+		_, err := conn.WriteTo(payload, echoConn.LocalAddr())
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		down := make([]byte, len(payload))
+		n, _, err := conn.ReadFrom(down)
+		if err != nil {
+			return err
+		}
+		require.Equal(t, payload, down[:n])
+		return nil
+	}
+	blueConn := listen("blue secret")
+	defer blueConn.Close()
+	require.NoError(t, echo(blueConn, []byte("before swap")))
+
+	greenList, err := service.MakeTestCiphers([]string{"green secret"})
+	require.NoError(t, err)
+	proxy.(service.CipherListSetter).SetCipherList(greenList)
+
+	// The existing NAT entry keeps its key, and new clients use the new list.
+	require.NoError(t, echo(blueConn, []byte("after swap")))
+	greenConn := listen("green secret")
+	defer greenConn.Close()
+	require.NoError(t, echo(greenConn, []byte("with green key")))
+	staleConn := listen("blue secret")
+	defer staleConn.Close()
+	require.Error(t, echo(staleConn, []byte("with blue key")))
+
+	echoConn.Close()
+	echoRunning.Wait()
+	proxyConn.Close()
+	<-done
 }
 
+// Records the status and byte counts of closed TCP connections.
 type statusMetrics struct {
 	service.NoOpTCPMetrics
 	sync.Mutex
 	statuses []string
+	data     []metrics.ProxyMetrics
 }
 
 func (m *statusMetrics) AddClosedTCPConnection(clientInfo ipinfo.IPInfo, ip net.Addr, accessKey string, status string, data metrics.ProxyMetrics, duration time.Duration) {
 	m.Lock()
 	m.statuses = append(m.statuses, status)
+	m.data = append(m.data, data)
 	m.Unlock()
 }
 
+func (m *statusMetrics) closedConnections() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.statuses)
+}
+
 func TestRestrictedAddresses(t *testing.T) {
 	proxyListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
 	require.NoError(t, err, "ListenTCP failed: %v", err)
@@ -241,7 +516,15 @@ func TestRestrictedAddresses(t *testing.T) {
 
 	proxyListener.Close()
 	<-done
+	require.Eventually(t, func() bool { return testMetrics.closedConnections() == len(addresses) }, time.Second, 10*time.Millisecond)
 	assert.ElementsMatch(t, testMetrics.statuses, expectedStatus)
+	// Nothing is relayed to or from rejected targets.
+	for _, data := range testMetrics.data {
+		require.Zero(t, data.ProxyTarget)
+		require.Zero(t, data.TargetProxy)
+		require.Zero(t, data.ProxyClient)
+		require.NotZero(t, data.ClientProxy)
+	}
 }
 
 // Metrics about one UDP packet.
@@ -253,8 +536,13 @@ type udpRecord struct {
 
 // Fake metrics implementation for UDP
 type fakeUDPMetrics struct {
-	up, down []udpRecord
-	natAdded int
+	// Guards up and down, which are written by every NAT entry.
+	mu           sync.Mutex
+	up, down     []udpRecord
+	natAdded     int
+	deduplicated int
+	migrated     int
+	duplicates   int
 }
 
 var _ service.UDPMetrics = (*fakeUDPMetrics)(nil)
@@ -263,9 +551,13 @@ func (m *fakeUDPMetrics) GetIPInfo(ip net.IP) (ipinfo.IPInfo, error) {
 	return ipinfo.IPInfo{CountryCode: "QQ"}, nil
 }
 func (m *fakeUDPMetrics) AddUDPPacketFromClient(clientInfo ipinfo.IPInfo, accessKey, status string, clientProxyBytes, proxyTargetBytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.up = append(m.up, udpRecord{clientInfo, accessKey, status, clientProxyBytes, proxyTargetBytes})
 }
 func (m *fakeUDPMetrics) AddUDPPacketFromTarget(clientInfo ipinfo.IPInfo, accessKey, status string, targetProxyBytes, proxyClientBytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.down = append(m.down, udpRecord{clientInfo, accessKey, status, targetProxyBytes, proxyClientBytes})
 }
 func (m *fakeUDPMetrics) AddUDPNatEntry(clientAddr net.Addr, accessKey string) {
@@ -274,6 +566,17 @@ func (m *fakeUDPMetrics) AddUDPNatEntry(clientAddr net.Addr, accessKey string) {
 func (m *fakeUDPMetrics) RemoveUDPNatEntry(clientAddr net.Addr, accessKey string) {
 	// Not tested because it requires waiting for a long timeout.
 }
+func (m *fakeUDPMetrics) AddUDPDeduplication() {
+	m.deduplicated++
+}
+func (m *fakeUDPMetrics) AddUDPAmplificationDrop() {
+}
+func (m *fakeUDPMetrics) AddUDPConnectionMigration(accessKey string) {
+	m.migrated++
+}
+func (m *fakeUDPMetrics) AddUDPClientDuplicate(accessKey string) {
+	m.duplicates++
+}
 func (m *fakeUDPMetrics) AddUDPCipherSearch(accessKeyFound bool, timeToCipher time.Duration) {}
 
 func TestUDPEcho(t *testing.T) {
@@ -338,6 +641,9 @@ func TestUDPEcho(t *testing.T) {
 	// Verify that the expected metrics were reported.
 	snapshot := cipherList.SnapshotForClientIP(netip.Addr{})
 	keyID := snapshot[0].Value.(*service.CipherEntry).ID
+	// The encrypted packets in both directions hold the salt, the address of the
+	// target, the payload and the tag.
+	udpOverhead := cryptoKey.SaltSize() + len(socks.ParseAddr(echoConn.LocalAddr().String())) + cryptoKey.TagSize()
 
 	if testMetrics.natAdded != 1 {
 		t.Errorf("Wrong NAT add count: %d", testMetrics.natAdded)
@@ -350,7 +656,7 @@ func TestUDPEcho(t *testing.T) {
 		if record.clientInfo.CountryCode != "XL" ||
 			record.accessKey != keyID ||
 			record.status != "OK" ||
-			record.in <= record.out ||
+			record.in != udpOverhead+N ||
 			record.out != N {
 			t.Errorf("Bad upstream metrics: %v", record)
 		}
@@ -363,12 +669,1151 @@ func TestUDPEcho(t *testing.T) {
 			record.accessKey != keyID ||
 			record.status != "OK" ||
 			record.in != N ||
-			record.out <= record.in {
+			record.out != udpOverhead+N {
 			t.Errorf("Bad upstream metrics: %v", record)
 		}
 	}
 }
 
+func TestUDPDeduplication(t *testing.T) {
+	echoConn, echoRunning := startUDPEchoServer(t)
+
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	secrets := []string{"secret"}
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	testMetrics := &fakeUDPMetrics{}
+	proxy := service.NewPacketHandlerWithOptions(time.Hour, cipherList, testMetrics, service.PacketHandlerOptions{Deduplication: time.Minute})
+	proxy.SetTargetIPValidator(allowAll)
+	done := make(chan struct{})
+	go func() {
+		proxy.Handle(proxyConn)
+		done <- struct{}{}
+	}()
+
+	cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+	require.NoError(t, err)
+	client, err := shadowsocks.NewPacketListener(&transport.UDPEndpoint{Address: proxyConn.LocalAddr().String()}, cryptoKey)
+	require.NoError(t, err)
+	conn, err := client.ListenPacket(context.Background())
+	require.NoError(t, err)
+
+	// Each write is encrypted with a new salt, so only the plaintext is repeated.
+	query := []byte("query")
+	other := []byte("other query")
+	for _, payload := range [][]byte{query, query, other} {
+		_, err = conn.WriteTo(payload, echoConn.LocalAddr())
+		require.NoError(t, err)
+	}
+
+	// The echo server only sees the first copy of the query.
+	buf := make([]byte, 100)
+	for _, expected := range [][]byte{query, other} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, expected, buf[:n])
+	}
+
+	conn.Close()
+	echoConn.Close()
+	echoRunning.Wait()
+	proxyConn.Close()
+	<-done
+	require.Equal(t, 1, testMetrics.deduplicated)
+	require.Len(t, testMetrics.up, 3)
+}
+
+func TestUDPReplayProtection(t *testing.T) {
+	echoConn, echoRunning := startUDPEchoServer(t)
+
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	secrets := []string{"secret"}
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	testMetrics := &fakeUDPMetrics{}
+	proxy := service.NewPacketHandlerWithOptions(time.Hour, cipherList, testMetrics, service.PacketHandlerOptions{ReplayProtection: time.Minute})
+	proxy.SetTargetIPValidator(allowAll)
+	done := make(chan struct{})
+	go func() {
+		proxy.Handle(proxyConn)
+		done <- struct{}{}
+	}()
+
+	cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+	require.NoError(t, err)
+	plaintext := append(socks.ParseAddr(echoConn.LocalAddr().String()), []byte("ping")...)
+	pkt, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+	require.NoError(t, err)
+	retransmission, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+
+	// The client's packet and its retransmission, with a new salt, go through, but a
+	// copy of the packet doesn't, even from another address.
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	defer client.Close()
+	attacker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	defer attacker.Close()
+	for i, step := range []struct {
+		conn      *net.UDPConn
+		packet    []byte
+		delivered bool
+	}{
+		{client, pkt, true},
+		{client, retransmission, true},
+		{client, pkt, false},
+		{attacker, pkt, false},
+	} {
+		_, err = step.conn.WriteTo(step.packet, proxyConn.LocalAddr())
+		require.NoError(t, err)
+		step.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _, err = step.conn.ReadFrom(buf)
+		if step.delivered {
+			require.NoError(t, err, "step %v", i)
+		} else {
+			require.ErrorIs(t, err, os.ErrDeadlineExceeded, "step %v", i)
+		}
+	}
+
+	echoConn.Close()
+	echoRunning.Wait()
+	proxyConn.Close()
+	<-done
+
+	testMetrics.mu.Lock()
+	defer testMetrics.mu.Unlock()
+	require.Len(t, testMetrics.up, 4)
+	require.Equal(t, "ERR_REPLAY_CLIENT", testMetrics.up[2].status)
+	require.Equal(t, "ERR_REPLAY_CLIENT", testMetrics.up[3].status)
+	require.Equal(t, 1, testMetrics.natAdded)
+}
+
+func TestUDPDuplicateDetection(t *testing.T) {
+	echoConn, echoRunning := startUDPEchoServer(t)
+
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	secrets := []string{"secret"}
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	testMetrics := &fakeUDPMetrics{}
+	proxy := service.NewPacketHandlerWithOptions(time.Hour, cipherList, testMetrics, service.PacketHandlerOptions{DuplicateDetection: time.Minute})
+	proxy.SetTargetIPValidator(allowAll)
+	done := make(chan struct{})
+	go func() {
+		proxy.Handle(proxyConn)
+		done <- struct{}{}
+	}()
+
+	cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+	require.NoError(t, err)
+	plaintext := append(socks.ParseAddr(echoConn.LocalAddr().String()), []byte("ping")...)
+	pkt, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+	require.NoError(t, err)
+	retransmission, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+
+	// Exact copies of the first packet are counted, but still forwarded. The
+	// client's own retransmission has a new salt, so it isn't a copy.
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	defer client.Close()
+	for i, packet := range [][]byte{pkt, pkt, retransmission, pkt} {
+		_, err = client.WriteTo(packet, proxyConn.LocalAddr())
+		require.NoError(t, err)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err = client.ReadFrom(buf)
+		require.NoError(t, err, "packet %v", i)
+	}
+
+	echoConn.Close()
+	echoRunning.Wait()
+	proxyConn.Close()
+	<-done
+
+	testMetrics.mu.Lock()
+	defer testMetrics.mu.Unlock()
+	require.Len(t, testMetrics.up, 4)
+	require.Equal(t, 2, testMetrics.duplicates)
+	require.Equal(t, 1, testMetrics.natAdded)
+}
+
+func TestUDPQuiescer(t *testing.T) {
+	echoConn, echoRunning := startUDPEchoServer(t)
+
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	secrets := []string{"secret"}
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	testMetrics := &fakeUDPMetrics{}
+	var quiescer service.Quiescer
+	proxy := service.NewPacketHandlerWithOptions(time.Hour, cipherList, testMetrics, service.PacketHandlerOptions{Quiescer: &quiescer})
+	proxy.SetTargetIPValidator(allowAll)
+	done := make(chan struct{})
+	go func() {
+		proxy.Handle(proxyConn)
+		done <- struct{}{}
+	}()
+
+	cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+	require.NoError(t, err)
+	plaintext := append(socks.ParseAddr(echoConn.LocalAddr().String()), []byte("ping")...)
+	buf := make([]byte, 1024)
+	existing, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	defer existing.Close()
+	newClient, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	defer newClient.Close()
+	for i, step := range []struct {
+		conn      *net.UDPConn
+		quiesced  bool
+		delivered bool
+	}{
+		{existing, false, true},
+		// The existing association keeps working, but no new one is created.
+		{existing, true, true},
+		{newClient, true, false},
+		{newClient, false, true},
+	} {
+		if step.quiesced {
+			quiescer.Quiesce()
+		} else {
+			quiescer.Resume()
+		}
+		pkt, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+		require.NoError(t, err)
+		_, err = step.conn.WriteTo(pkt, proxyConn.LocalAddr())
+		require.NoError(t, err)
+		step.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _, err = step.conn.ReadFrom(buf)
+		if step.delivered {
+			require.NoError(t, err, "step %v", i)
+		} else {
+			require.ErrorIs(t, err, os.ErrDeadlineExceeded, "step %v", i)
+		}
+	}
+
+	echoConn.Close()
+	echoRunning.Wait()
+	proxyConn.Close()
+	<-done
+
+	testMetrics.mu.Lock()
+	defer testMetrics.mu.Unlock()
+	require.Len(t, testMetrics.up, 4)
+	require.Equal(t, "ERR_QUIESCED", testMetrics.up[2].status)
+}
+
+func TestUDPConnectionMigration(t *testing.T) {
+	echoConn, echoRunning := startUDPEchoServer(t)
+
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	secrets := []string{"secret"}
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	testMetrics := &fakeUDPMetrics{}
+	proxy := service.NewPacketHandlerWithOptions(time.Hour, cipherList, testMetrics, service.PacketHandlerOptions{ConnectionMigration: true, ReplayProtection: time.Hour})
+	proxy.SetTargetIPValidator(allowAll)
+	done := make(chan struct{})
+	go func() {
+		proxy.Handle(proxyConn)
+		done <- struct{}{}
+	}()
+
+	cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+	require.NoError(t, err)
+	// Migration requires a change of IP, so the client moves to another loopback address.
+	oldConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	newConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 0})
+	require.NoError(t, err)
+
+	buf := make([]byte, 1024)
+	for _, conn := range []*net.UDPConn{oldConn, newConn} {
+		payload := []byte("from " + conn.LocalAddr().String())
+		plaintext := append(socks.ParseAddr(echoConn.LocalAddr().String()), payload...)
+		pkt, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+		require.NoError(t, err)
+		_, err = conn.WriteTo(pkt, proxyConn.LocalAddr())
+		require.NoError(t, err)
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		reply, err := shadowsocks.Unpack(nil, buf[:n], cryptoKey)
+		require.NoError(t, err)
+		srcAddr := socks.SplitAddr(reply)
+		require.Equal(t, echoConn.LocalAddr().String(), srcAddr.String())
+		require.Equal(t, payload, reply[len(srcAddr):])
+	}
+
+	oldConn.Close()
+	newConn.Close()
+	echoConn.Close()
+	echoRunning.Wait()
+	proxyConn.Close()
+	<-done
+	require.Equal(t, 1, testMetrics.natAdded)
+	require.Equal(t, 1, testMetrics.migrated)
+}
+
+func TestUDPConnectionMigrationReplay(t *testing.T) {
+	for _, replayProtection := range []bool{false, true} {
+		t.Run(fmt.Sprintf("replayProtection=%v", replayProtection), func(t *testing.T) {
+			echoConn, echoRunning := startUDPEchoServer(t)
+
+			proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+			require.NoError(t, err)
+			secrets := []string{"secret"}
+			cipherList, err := service.MakeTestCiphers(secrets)
+			require.NoError(t, err)
+			testMetrics := &fakeUDPMetrics{}
+			opts := service.PacketHandlerOptions{ConnectionMigration: true}
+			if replayProtection {
+				opts.ReplayProtection = time.Hour
+			}
+			proxy := service.NewPacketHandlerWithOptions(time.Hour, cipherList, testMetrics, opts)
+			proxy.SetTargetIPValidator(allowAll)
+			done := make(chan struct{})
+			go func() {
+				proxy.Handle(proxyConn)
+				done <- struct{}{}
+			}()
+
+			cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+			require.NoError(t, err)
+			plaintext := append(socks.ParseAddr(echoConn.LocalAddr().String()), []byte("ping")...)
+			pkt, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+			require.NoError(t, err)
+			client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+			require.NoError(t, err)
+			defer client.Close()
+			attacker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: 0})
+			require.NoError(t, err)
+			defer attacker.Close()
+
+			buf := make([]byte, 1024)
+			_, err = client.WriteTo(pkt, proxyConn.LocalAddr())
+			require.NoError(t, err)
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			_, _, err = client.ReadFrom(buf)
+			require.NoError(t, err)
+
+			// A copy of the client's packet from another IP never takes over its entry.
+			_, err = attacker.WriteTo(pkt, proxyConn.LocalAddr())
+			require.NoError(t, err)
+			attacker.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, _, err = attacker.ReadFrom(buf)
+			if replayProtection {
+				require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+			} else {
+				// Without replay protection the copy gets its own entry instead.
+				require.NoError(t, err)
+			}
+
+			// The client keeps getting its replies.
+			pkt, err = shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+			require.NoError(t, err)
+			_, err = client.WriteTo(pkt, proxyConn.LocalAddr())
+			require.NoError(t, err)
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			_, _, err = client.ReadFrom(buf)
+			require.NoError(t, err)
+
+			echoConn.Close()
+			echoRunning.Wait()
+			proxyConn.Close()
+			<-done
+
+			testMetrics.mu.Lock()
+			defer testMetrics.mu.Unlock()
+			require.Equal(t, 0, testMetrics.migrated)
+			if replayProtection {
+				require.Len(t, testMetrics.up, 3)
+				require.Equal(t, "ERR_REPLAY_CLIENT", testMetrics.up[1].status)
+				require.Equal(t, 1, testMetrics.natAdded)
+			} else {
+				require.Equal(t, 2, testMetrics.natAdded)
+			}
+		})
+	}
+}
+
+func TestUDPSessions(t *testing.T) {
+	echoConn, echoRunning := startUDPEchoServer(t)
+
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	secrets := []string{"secret"}
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	testMetrics := &fakeUDPMetrics{}
+	proxy := service.NewPacketHandlerWithOptions(time.Hour, cipherList, testMetrics, service.PacketHandlerOptions{Sessions: true, ReplayProtection: time.Hour})
+	proxy.SetTargetIPValidator(allowAll)
+	done := make(chan struct{})
+	go func() {
+		proxy.Handle(proxyConn)
+		done <- struct{}{}
+	}()
+
+	cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+	require.NoError(t, err)
+	// Unlike address-based migration, sessions work for clients on the same IP.
+	var conns []*net.UDPConn
+	for i := 0; i < 3; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+		require.NoError(t, err)
+		conns = append(conns, conn)
+	}
+	// The first two sockets belong to the same session.
+	sessionIDs := []string{"session1", "session1", "session2"}
+
+	buf := make([]byte, 1024)
+	for i, conn := range conns {
+		payload := []byte("from " + conn.LocalAddr().String())
+		plaintext := append([]byte{0x7f}, sessionIDs[i]...)
+		plaintext = append(plaintext, socks.ParseAddr(echoConn.LocalAddr().String())...)
+		plaintext = append(plaintext, payload...)
+		pkt, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+		require.NoError(t, err)
+		_, err = conn.WriteTo(pkt, proxyConn.LocalAddr())
+		require.NoError(t, err)
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		reply, err := shadowsocks.Unpack(nil, buf[:n], cryptoKey)
+		require.NoError(t, err)
+		srcAddr := socks.SplitAddr(reply)
+		require.Equal(t, echoConn.LocalAddr().String(), srcAddr.String())
+		require.Equal(t, payload, reply[len(srcAddr):])
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	echoConn.Close()
+	echoRunning.Wait()
+	proxyConn.Close()
+	<-done
+	require.Equal(t, 2, testMetrics.natAdded)
+	require.Equal(t, 1, testMetrics.migrated)
+}
+
+func TestUDPSessionsReplay(t *testing.T) {
+	for _, replayProtection := range []bool{false, true} {
+		t.Run(fmt.Sprintf("replayProtection=%v", replayProtection), func(t *testing.T) {
+			echoConn, echoRunning := startUDPEchoServer(t)
+
+			proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+			require.NoError(t, err)
+			secrets := []string{"secret"}
+			cipherList, err := service.MakeTestCiphers(secrets)
+			require.NoError(t, err)
+			testMetrics := &fakeUDPMetrics{}
+			opts := service.PacketHandlerOptions{Sessions: true}
+			if replayProtection {
+				opts.ReplayProtection = time.Hour
+			}
+			proxy := service.NewPacketHandlerWithOptions(time.Hour, cipherList, testMetrics, opts)
+			proxy.SetTargetIPValidator(allowAll)
+			done := make(chan struct{})
+			go func() {
+				proxy.Handle(proxyConn)
+				done <- struct{}{}
+			}()
+
+			cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+			require.NoError(t, err)
+			plaintext := append([]byte{0x7f}, "session1"...)
+			plaintext = append(plaintext, socks.ParseAddr(echoConn.LocalAddr().String())...)
+			plaintext = append(plaintext, "ping"...)
+			pkt, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+			require.NoError(t, err)
+			client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+			require.NoError(t, err)
+			defer client.Close()
+			attacker, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+			require.NoError(t, err)
+			defer attacker.Close()
+
+			buf := make([]byte, 1024)
+			_, err = client.WriteTo(pkt, proxyConn.LocalAddr())
+			require.NoError(t, err)
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			_, _, err = client.ReadFrom(buf)
+			require.NoError(t, err)
+
+			// A copy of the client's packet, session header included, never takes over
+			// its session.
+			_, err = attacker.WriteTo(pkt, proxyConn.LocalAddr())
+			require.NoError(t, err)
+			attacker.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, _, err = attacker.ReadFrom(buf)
+			if replayProtection {
+				require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+			} else {
+				// Without replay protection the copy gets its own entry instead.
+				require.NoError(t, err)
+			}
+
+			// The client keeps getting its replies.
+			pkt, err = shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+			require.NoError(t, err)
+			_, err = client.WriteTo(pkt, proxyConn.LocalAddr())
+			require.NoError(t, err)
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			_, _, err = client.ReadFrom(buf)
+			require.NoError(t, err)
+
+			echoConn.Close()
+			echoRunning.Wait()
+			proxyConn.Close()
+			<-done
+
+			testMetrics.mu.Lock()
+			defer testMetrics.mu.Unlock()
+			require.Equal(t, 0, testMetrics.migrated)
+			if replayProtection {
+				require.Len(t, testMetrics.up, 3)
+				require.Equal(t, "ERR_REPLAY_CLIENT", testMetrics.up[1].status)
+				require.Equal(t, 1, testMetrics.natAdded)
+			} else {
+				require.Equal(t, 2, testMetrics.natAdded)
+			}
+		})
+	}
+}
+
+func TestUDPCloseNatEntry(t *testing.T) {
+	echoConn, echoRunning := startUDPEchoServer(t)
+
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	secrets := []string{"secret"}
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	testMetrics := &fakeUDPMetrics{}
+	proxy := service.NewPacketHandler(time.Hour, cipherList, testMetrics)
+	proxy.SetTargetIPValidator(allowAll)
+	closer, ok := proxy.(service.NATEntryCloser)
+	require.True(t, ok)
+	done := make(chan struct{})
+	go func() {
+		proxy.Handle(proxyConn)
+		done <- struct{}{}
+	}()
+
+	cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+	require.NoError(t, err)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	require.False(t, closer.CloseNatEntry(conn.LocalAddr()))
+
+	buf := make([]byte, 1024)
+	for i := 0; i < 2; i++ {
+		payload := []byte(fmt.Sprintf("packet %v", i))
+		plaintext := append(socks.ParseAddr(echoConn.LocalAddr().String()), payload...)
+		pkt, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+		require.NoError(t, err)
+		_, err = conn.WriteTo(pkt, proxyConn.LocalAddr())
+		require.NoError(t, err)
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		reply, err := shadowsocks.Unpack(nil, buf[:n], cryptoKey)
+		require.NoError(t, err)
+		require.Equal(t, payload, reply[len(socks.SplitAddr(reply)):])
+
+		require.True(t, closer.CloseNatEntry(conn.LocalAddr()))
+		require.False(t, closer.CloseNatEntry(conn.LocalAddr()))
+	}
+
+	conn.Close()
+	echoConn.Close()
+	echoRunning.Wait()
+	proxyConn.Close()
+	<-done
+	// Each packet after a close starts a new entry.
+	require.Equal(t, 2, testMetrics.natAdded)
+}
+
+// Records the events published by an EventEmitter.
+type recordingEventSink struct {
+	events []service.ConnectionEvent
+}
+
+func (s *recordingEventSink) Publish(event service.ConnectionEvent) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+type noOpEventMetrics struct{}
+
+func (noOpEventMetrics) AddDroppedConnectionEvent() {}
+func (noOpEventMetrics) AddFailedConnectionEvent()  {}
+
+func TestConnectionEvents(t *testing.T) {
+	sink := &recordingEventSink{}
+	emitter := service.NewEventEmitter(sink, 10, noOpEventMetrics{})
+	secrets := []string{"secret"}
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+	require.NoError(t, err)
+
+	// TCP
+	echoListener, echoRunning := startTCPEchoServer(t)
+	proxyListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	authFunc := service.NewShadowsocksStreamAuthenticator(cipherList, nil, &service.NoOpTCPMetrics{})
+	handler := service.NewTCPHandlerWithOptions(proxyListener.Addr().(*net.TCPAddr).Port, authFunc, &service.NoOpTCPMetrics{}, 200*time.Millisecond, service.TCPHandlerOptions{EventEmitter: emitter})
+	handler.SetTargetDialer(&transport.TCPDialer{})
+	tcpDone := make(chan struct{})
+	go func() {
+		service.StreamServe(service.WrapStreamListener(proxyListener.AcceptTCP), handler.Handle)
+		tcpDone <- struct{}{}
+	}()
+	client, err := shadowsocks.NewStreamDialer(&transport.TCPEndpoint{Address: proxyListener.Addr().String()}, cryptoKey)
+	require.NoError(t, err)
+	conn, err := client.DialStream(context.Background(), echoListener.Addr().String())
+	require.NoError(t, err)
+	requireEcho(t, conn, []byte("tcp"))
+	conn.Close()
+	proxyListener.Close()
+	<-tcpDone
+	echoListener.Close()
+	echoRunning.Wait()
+
+	// UDP
+	udpEchoConn, udpEchoRunning := startUDPEchoServer(t)
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	proxy := service.NewPacketHandlerWithOptions(time.Hour, cipherList, &fakeUDPMetrics{}, service.PacketHandlerOptions{EventEmitter: emitter})
+	proxy.SetTargetIPValidator(allowAll)
+	udpDone := make(chan struct{})
+	go func() {
+		proxy.Handle(proxyConn)
+		udpDone <- struct{}{}
+	}()
+	udpClient, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	pkt, err := shadowsocks.Pack(make([]byte, 1024), append(socks.ParseAddr(udpEchoConn.LocalAddr().String()), []byte("udp")...), cryptoKey)
+	require.NoError(t, err)
+	_, err = udpClient.WriteTo(pkt, proxyConn.LocalAddr())
+	require.NoError(t, err)
+	udpClient.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = udpClient.ReadFrom(make([]byte, 1024))
+	require.NoError(t, err)
+	require.True(t, proxy.(service.NATEntryCloser).CloseNatEntry(udpClient.LocalAddr()))
+	udpClient.Close()
+	proxyConn.Close()
+	<-udpDone
+	udpEchoConn.Close()
+	udpEchoRunning.Wait()
+
+	emitter.Close()
+	require.Len(t, sink.events, 4)
+	tcpOpen, tcpClose, udpOpen, udpClose := sink.events[0], sink.events[1], sink.events[2], sink.events[3]
+	require.Equal(t, service.ConnectionOpened, tcpOpen.Type)
+	require.Equal(t, "tcp", tcpOpen.Protocol)
+	require.Equal(t, "id-0", tcpOpen.AccessKey)
+	require.Equal(t, echoListener.Addr().String(), tcpOpen.TargetAddr)
+	require.Equal(t, service.ConnectionClosed, tcpClose.Type)
+	require.Equal(t, "OK", tcpClose.Status)
+	require.Equal(t, tcpOpen.ClientAddr, tcpClose.ClientAddr)
+	require.Greater(t, tcpClose.BytesFromClient, int64(0))
+	require.Greater(t, tcpClose.BytesToClient, int64(0))
+
+	require.Equal(t, service.ConnectionOpened, udpOpen.Type)
+	require.Equal(t, "udp", udpOpen.Protocol)
+	require.Equal(t, udpClient.LocalAddr().String(), udpOpen.ClientAddr)
+	require.Equal(t, service.ConnectionClosed, udpClose.Type)
+	require.Equal(t, int64(len(pkt)), udpClose.BytesFromClient)
+	require.Greater(t, udpClose.BytesToClient, int64(0))
+}
+
+type packetEvent struct {
+	keyID, addr string
+	bytes       int
+}
+
+// Records the events of a UDPPacketEventHook.
+type recordingPacketHook struct {
+	mu         sync.Mutex
+	fromClient []packetEvent
+	fromTarget []packetEvent
+}
+
+func (h *recordingPacketHook) OnPacketFromClient(keyID, clientAddr string, bytes int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fromClient = append(h.fromClient, packetEvent{keyID, clientAddr, bytes})
+}
+
+func (h *recordingPacketHook) OnPacketFromTarget(keyID, targetAddr string, bytes int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fromTarget = append(h.fromTarget, packetEvent{keyID, targetAddr, bytes})
+}
+
+func TestUDPPacketEventHook(t *testing.T) {
+	echoConn, echoRunning := startUDPEchoServer(t)
+
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	secrets := []string{"secret"}
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	hook := &recordingPacketHook{}
+	proxy := service.NewPacketHandlerWithOptions(time.Hour, cipherList, &service.NoOpUDPMetrics{}, service.PacketHandlerOptions{PacketEventHook: hook})
+	proxy.SetTargetIPValidator(allowAll)
+	done := make(chan struct{})
+	go func() {
+		proxy.Handle(proxyConn)
+		done <- struct{}{}
+	}()
+
+	cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+	require.NoError(t, err)
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+
+	buf := make([]byte, 1024)
+	for _, payload := range [][]byte{[]byte("short"), []byte("a longer payload")} {
+		plaintext := append(socks.ParseAddr(echoConn.LocalAddr().String()), payload...)
+		pkt, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+		require.NoError(t, err)
+		_, err = clientConn.WriteTo(pkt, proxyConn.LocalAddr())
+		require.NoError(t, err)
+
+		clientConn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err = clientConn.ReadFrom(buf)
+		require.NoError(t, err)
+	}
+
+	clientConn.Close()
+	echoConn.Close()
+	echoRunning.Wait()
+	proxyConn.Close()
+	<-done
+
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	clientAddr := clientConn.LocalAddr().String()
+	targetAddr := echoConn.LocalAddr().String()
+	require.Equal(t, []packetEvent{{"id-0", clientAddr, 5}, {"id-0", clientAddr, 16}}, hook.fromClient)
+	require.Equal(t, []packetEvent{{"id-0", targetAddr, 5}, {"id-0", targetAddr, 16}}, hook.fromTarget)
+}
+
+type accessLogEntry struct {
+	keyID, clientAddr, targetAddr string
+	direction                     service.Direction
+	bytes                         int
+}
+
+// Records the calls to an AccessLogger.
+type recordingAccessLogger struct {
+	mu      sync.Mutex
+	entries []accessLogEntry
+}
+
+func (l *recordingAccessLogger) LogUDPPacket(keyID, clientAddr, targetAddr string, direction service.Direction, bytes int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, accessLogEntry{keyID, clientAddr, targetAddr, direction, bytes})
+}
+
+func TestUDPAccessLog(t *testing.T) {
+	echoConn, echoRunning := startUDPEchoServer(t)
+
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	secrets := []string{"secret"}
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	accessLog := &recordingAccessLogger{}
+	proxy := service.NewPacketHandlerWithOptions(time.Hour, cipherList, &service.NoOpUDPMetrics{}, service.PacketHandlerOptions{AccessLog: accessLog})
+	proxy.SetTargetIPValidator(allowAll)
+	done := make(chan struct{})
+	go func() {
+		proxy.Handle(proxyConn)
+		done <- struct{}{}
+	}()
+
+	cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+	require.NoError(t, err)
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+
+	buf := make([]byte, 1024)
+	for _, payload := range [][]byte{[]byte("request"), []byte("second request")} {
+		plaintext := append(socks.ParseAddr(echoConn.LocalAddr().String()), payload...)
+		pkt, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+		require.NoError(t, err)
+		_, err = clientConn.WriteTo(pkt, proxyConn.LocalAddr())
+		require.NoError(t, err)
+
+		clientConn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err = clientConn.ReadFrom(buf)
+		require.NoError(t, err)
+	}
+
+	clientConn.Close()
+	echoConn.Close()
+	echoRunning.Wait()
+	proxyConn.Close()
+	<-done
+
+	accessLog.mu.Lock()
+	defer accessLog.mu.Unlock()
+	clientAddr := clientConn.LocalAddr().String()
+	targetAddr := echoConn.LocalAddr().String()
+	require.Equal(t, []accessLogEntry{
+		{"id-0", clientAddr, targetAddr, service.DirectionUpstream, 7},
+		{"id-0", clientAddr, targetAddr, service.DirectionDownstream, 7},
+		{"id-0", clientAddr, targetAddr, service.DirectionUpstream, 14},
+		{"id-0", clientAddr, targetAddr, service.DirectionDownstream, 14},
+	}, accessLog.entries)
+}
+
+// startUDPAmplifier starts a UDP server that replies to every packet with `replySize` bytes.
+func startUDPAmplifier(t testing.TB, replySize int) (*net.UDPConn, *sync.WaitGroup) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	var running sync.WaitGroup
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		defer conn.Close()
+		buf := make([]byte, maxUDPPacketSize)
+		reply := make([]byte, replySize)
+		for {
+			_, clientAddr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(reply, clientAddr)
+		}
+	}()
+	return conn, &running
+}
+
+func TestUDPMaxAmplification(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		factor    float64
+		delivered bool
+	}{
+		{"recommended", service.RecommendedUDPAmplificationFactor, true},
+		{"limited", 2, false},
+		// The limit is off by default.
+		{"unlimited", 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			amplifier, amplifierRunning := startUDPAmplifier(t, 1000)
+
+			proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+			require.NoError(t, err)
+			secrets := []string{"secret"}
+			cipherList, err := service.MakeTestCiphers(secrets)
+			require.NoError(t, err)
+			testMetrics := &fakeUDPMetrics{}
+			proxy := service.NewPacketHandlerWithOptions(time.Hour, cipherList, testMetrics, service.PacketHandlerOptions{MaxAmplification: tc.factor})
+			proxy.SetTargetIPValidator(allowAll)
+			done := make(chan struct{})
+			go func() {
+				proxy.Handle(proxyConn)
+				done <- struct{}{}
+			}()
+
+			cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+			require.NoError(t, err)
+			clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+			require.NoError(t, err)
+			plaintext := append(socks.ParseAddr(amplifier.LocalAddr().String()), []byte("hi")...)
+			pkt, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+			require.NoError(t, err)
+			_, err = clientConn.WriteTo(pkt, proxyConn.LocalAddr())
+			require.NoError(t, err)
+
+			clientConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			buf := make([]byte, 2048)
+			_, _, err = clientConn.ReadFrom(buf)
+			if tc.delivered {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+			}
+
+			clientConn.Close()
+			amplifier.Close()
+			amplifierRunning.Wait()
+			proxyConn.Close()
+			<-done
+
+			testMetrics.mu.Lock()
+			defer testMetrics.mu.Unlock()
+			require.Len(t, testMetrics.down, 1)
+			if tc.delivered {
+				require.Equal(t, "OK", testMetrics.down[0].status)
+			} else {
+				require.Equal(t, "ERR_AMPLIFICATION", testMetrics.down[0].status)
+			}
+		})
+	}
+}
+
+func TestUDPGoroutineLimiter(t *testing.T) {
+	echoConn, echoRunning := startUDPEchoServer(t)
+
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	secrets := []string{"secret"}
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	testMetrics := &fakeUDPMetrics{}
+	limiter := service.NewGoroutineLimiter(1)
+	proxy := service.NewPacketHandlerWithOptions(time.Hour, cipherList, testMetrics, service.PacketHandlerOptions{GoroutineLimiter: limiter})
+	proxy.SetTargetIPValidator(allowAll)
+	done := make(chan struct{})
+	go func() {
+		proxy.Handle(proxyConn)
+		done <- struct{}{}
+	}()
+
+	cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+	require.NoError(t, err)
+	plaintext := append(socks.ParseAddr(echoConn.LocalAddr().String()), []byte("ping")...)
+	pkt, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+
+	// The first client gets the only NAT entry, and the second one is shed.
+	for i, delivered := range []bool{true, false} {
+		clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+		require.NoError(t, err)
+		defer clientConn.Close()
+		_, err = clientConn.WriteTo(pkt, proxyConn.LocalAddr())
+		require.NoError(t, err)
+		clientConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _, err = clientConn.ReadFrom(buf)
+		if delivered {
+			require.NoError(t, err, "client %v", i)
+		} else {
+			require.ErrorIs(t, err, os.ErrDeadlineExceeded, "client %v", i)
+		}
+	}
+	require.Equal(t, int64(1), limiter.Running())
+	require.Equal(t, int64(1), limiter.Shed())
+
+	echoConn.Close()
+	echoRunning.Wait()
+	proxyConn.Close()
+	<-done
+	// Handle waits for the NAT entry goroutines, which release their slots.
+	require.Equal(t, int64(0), limiter.Running())
+
+	testMetrics.mu.Lock()
+	defer testMetrics.mu.Unlock()
+	require.Len(t, testMetrics.up, 2)
+	require.Equal(t, "OK", testMetrics.up[0].status)
+	require.Equal(t, "ERR_OVERLOADED", testMetrics.up[1].status)
+}
+
+func TestUDPIPReputation(t *testing.T) {
+	echoConn, echoRunning := startUDPEchoServer(t)
+
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	secrets := []string{"secret"}
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	testMetrics := &fakeUDPMetrics{}
+	blocklist := service.NewIPBlocklist([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	proxy := service.NewPacketHandlerWithOptions(time.Hour, cipherList, testMetrics, service.PacketHandlerOptions{IPReputation: blocklist})
+	proxy.SetTargetIPValidator(allowAll)
+	done := make(chan struct{})
+	go func() {
+		proxy.Handle(proxyConn)
+		done <- struct{}{}
+	}()
+
+	cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+	require.NoError(t, err)
+	plaintext := append(socks.ParseAddr(echoConn.LocalAddr().String()), []byte("ping")...)
+	pkt, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+	require.NoError(t, err)
+	clientConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	defer clientConn.Close()
+	_, err = clientConn.WriteTo(pkt, proxyConn.LocalAddr())
+	require.NoError(t, err)
+	clientConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = clientConn.ReadFrom(make([]byte, 1024))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	echoConn.Close()
+	echoRunning.Wait()
+	proxyConn.Close()
+	<-done
+
+	testMetrics.mu.Lock()
+	defer testMetrics.mu.Unlock()
+	require.Len(t, testMetrics.up, 1)
+	require.Equal(t, "ERR_IP_BLOCKED", testMetrics.up[0].status)
+}
+
+func TestTunneledUDPEcho(t *testing.T) {
+	echoConn, echoRunning := startUDPEchoServer(t)
+
+	proxyListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	secrets := []string{"secret"}
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	testMetrics := &fakeUDPMetrics{}
+	proxy := service.NewPacketHandler(time.Hour, cipherList, testMetrics)
+	proxy.SetTargetIPValidator(allowAll)
+	done := make(chan struct{})
+	go func() {
+		service.StreamServe(service.WrapStreamListener(proxyListener.AcceptTCP), service.NewTunneledUDPHandler(proxy))
+		done <- struct{}{}
+	}()
+
+	tcpConn, err := net.Dial("tcp", proxyListener.Addr().String())
+	require.NoError(t, err)
+	clientConn := service.NewStreamPacketConn(tcpConn)
+	cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+	require.NoError(t, err)
+	targetAddr := socks.ParseAddr(echoConn.LocalAddr().String())
+	buf := make([]byte, 1024)
+	for _, payload := range []string{"ping", "pong"} {
+		plaintext := append([]byte(targetAddr), payload...)
+		pkt, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cryptoKey)
+		require.NoError(t, err)
+		_, err = clientConn.WriteTo(pkt, nil)
+		require.NoError(t, err)
+
+		clientConn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := clientConn.ReadFrom(buf)
+		require.NoError(t, err)
+		reply, err := shadowsocks.Unpack(nil, buf[:n], cryptoKey)
+		require.NoError(t, err)
+		require.Equal(t, plaintext, reply)
+	}
+	clientConn.Close()
+
+	proxyListener.Close()
+	<-done
+	echoConn.Close()
+	echoRunning.Wait()
+
+	testMetrics.mu.Lock()
+	defer testMetrics.mu.Unlock()
+	require.Len(t, testMetrics.up, 2)
+	require.Equal(t, "OK", testMetrics.up[0].status)
+}
+
+func TestBenchmarkProxy(t *testing.T) {
+	echoListener, echoRunning := startTCPEchoServer(t)
+	defer echoRunning.Wait()
+	defer echoListener.Close()
+
+	proxyListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	secrets := []string{"secret"}
+	cipherList, err := service.MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	testMetrics := &service.NoOpTCPMetrics{}
+	authFunc := service.NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	handler := service.NewTCPHandler(proxyListener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond)
+	handler.SetTargetDialer(&transport.TCPDialer{})
+	done := make(chan struct{})
+	go func() {
+		service.StreamServe(func() (transport.StreamConn, error) { return proxyListener.AcceptTCP() }, handler.Handle)
+		close(done)
+	}()
+
+	cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[0])
+	require.NoError(t, err)
+	result, err := service.BenchmarkProxy(proxyListener.Addr().String(), cryptoKey, echoListener.Addr().String(), 200*time.Millisecond)
+	require.NoError(t, err)
+	require.Greater(t, result.BytesSent, int64(0))
+	require.Equal(t, result.BytesSent, result.BytesRecv)
+	require.Greater(t, result.Throughput, 0.0)
+	require.Less(t, result.P99Latency, time.Second)
+	require.LessOrEqual(t, result.MeanLatency, result.P99Latency)
+	require.Zero(t, result.Errors)
+
+	proxyListener.Close()
+	<-done
+}
+
+func TestClientSetCipher(t *testing.T) {
+	echoListener, echoRunning := startTCPEchoServer(t)
+	defer echoRunning.Wait()
+	defer echoListener.Close()
+
+	proxyListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	require.NoError(t, err)
+	const secret = "secret"
+	keys := list.New()
+	for _, cipherName := range []string{shadowsocks.CHACHA20IETFPOLY1305, shadowsocks.AES256GCM} {
+		cryptoKey, err := shadowsocks.NewEncryptionKey(cipherName, secret)
+		require.NoError(t, err)
+		entry := service.MakeCipherEntry(cipherName, cryptoKey, secret)
+		keys.PushBack(&entry)
+	}
+	cipherList := service.NewCipherList()
+	cipherList.Update(keys)
+	testMetrics := &service.NoOpTCPMetrics{}
+	authFunc := service.NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	handler := service.NewTCPHandler(proxyListener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond)
+	handler.SetTargetDialer(&transport.TCPDialer{})
+	done := make(chan struct{})
+	go func() {
+		service.StreamServe(func() (transport.StreamConn, error) { return proxyListener.AcceptTCP() }, handler.Handle)
+		close(done)
+	}()
+	// lastUsedKey returns the ID of the key that the proxy last found.
+	lastUsedKey := func() string {
+		return cipherList.SnapshotForClientIP(netip.Addr{})[0].Value.(*service.CipherEntry).ID
+	}
+
+	client, err := service.NewClient(proxyListener.Addr().String(), shadowsocks.CHACHA20IETFPOLY1305, secret)
+	require.NoError(t, err)
+	chachaConn, err := client.DialStream(context.Background(), echoListener.Addr().String())
+	require.NoError(t, err)
+	requireEcho(t, chachaConn, []byte("chacha"))
+	require.Equal(t, shadowsocks.CHACHA20IETFPOLY1305, lastUsedKey())
+
+	require.Error(t, client.SetCipher("rot13"))
+	require.NoError(t, client.SetCipher(shadowsocks.AES256GCM))
+	aesConn, err := client.DialStream(context.Background(), echoListener.Addr().String())
+	require.NoError(t, err)
+	requireEcho(t, aesConn, []byte("aes"))
+	require.Equal(t, shadowsocks.AES256GCM, lastUsedKey())
+
+	// The first connection keeps its cipher.
+	requireEcho(t, chachaConn, []byte("chacha again"))
+
+	chachaConn.Close()
+	aesConn.Close()
+	proxyListener.Close()
+	<-done
+}
+
 func BenchmarkTCPThroughput(b *testing.B) {
 	echoListener, echoRunning := startTCPEchoServer(b)
 
@@ -61,3 +61,87 @@ func RequirePublicIP(ip net.IP) error {
 	}
 	return nil
 }
+
+type blockedNetwork struct {
+	network *net.IPNet
+	status  string
+}
+
+// CIDRBlocker rejects IP addresses that belong to any of a set of blocked networks.
+type CIDRBlocker struct {
+	blocked []blockedNetwork
+}
+
+// NewCIDRBlocker creates a CIDRBlocker that doesn't block any address.
+func NewCIDRBlocker() *CIDRBlocker {
+	return &CIDRBlocker{}
+}
+
+// NewDefaultPrivateBlocker creates a CIDRBlocker that blocks the private networks
+// reported by [IsPrivateAddress] with status "ERR_ADDRESS_PRIVATE", and the
+// unspecified, broadcast, loopback, link-local and multicast addresses with
+// status "ERR_ADDRESS_INVALID".
+func NewDefaultPrivateBlocker() *CIDRBlocker {
+	b := NewCIDRBlocker()
+	for _, cidr := range []string{
+		// Unspecified addresses
+		"0.0.0.0/32",
+		"::/128",
+		// Limited broadcast
+		"255.255.255.255/32",
+		// Loopback
+		"127.0.0.0/8",
+		"::1/128",
+		// Link-local
+		"169.254.0.0/16",
+		"fe80::/10",
+		// Multicast
+		"224.0.0.0/4",
+		"ff00::/8",
+	} {
+		b.mustBlock(cidr, "ERR_ADDRESS_INVALID")
+	}
+	for _, network := range privateNetworks {
+		b.blocked = append(b.blocked, blockedNetwork{network, "ERR_ADDRESS_PRIVATE"})
+	}
+	return b
+}
+
+func (b *CIDRBlocker) mustBlock(cidr string, status string) {
+	if err := b.Block(cidr, status); err != nil {
+		panic(err)
+	}
+}
+
+// Block adds the network `cidr` to the blocked networks. Addresses in that network
+// are rejected with a [ConnectionError] with the given status.
+func (b *CIDRBlocker) Block(cidr string, status string) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	b.blocked = append(b.blocked, blockedNetwork{network, status})
+	return nil
+}
+
+// Check returns an error if the IP address is invalid or belongs to a blocked network.
+func (b *CIDRBlocker) Check(ip net.IP) *ConnectionError {
+	if ip.To16() == nil {
+		return NewConnectionError("ERR_ADDRESS_INVALID", fmt.Sprintf("Address is invalid: %s", ip.String()), nil)
+	}
+	for _, entry := range b.blocked {
+		if entry.network.Contains(ip) {
+			return NewConnectionError(entry.status, fmt.Sprintf("Address %s is in blocked network %s", ip.String(), entry.network.String()), nil)
+		}
+	}
+	return nil
+}
+
+// Validate is a [TargetIPValidator] that returns the result of Check.
+func (b *CIDRBlocker) Validate(ip net.IP) error {
+	// Avoid returning a nil *ConnectionError as a non-nil error.
+	if err := b.Check(ip); err != nil {
+		return err
+	}
+	return nil
+}
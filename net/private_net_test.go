@@ -96,3 +96,56 @@ func TestRequirePublicIPInterface(t *testing.T) {
 	assert.True(t, err == nil)
 	assert.Equal(t, nil, err)
 }
+
+func TestDefaultPrivateBlocker(t *testing.T) {
+	blocker := NewDefaultPrivateBlocker()
+	for _, tt := range []struct {
+		address string
+		status  string
+	}{
+		// RFC 1918
+		{"10.0.2.11", "ERR_ADDRESS_PRIVATE"},
+		{"172.16.1.2", "ERR_ADDRESS_PRIVATE"},
+		{"192.168.0.23", "ERR_ADDRESS_PRIVATE"},
+		// ULA and CGNAT
+		{"fd66:f83a:c650::1", "ERR_ADDRESS_PRIVATE"},
+		{"100.64.0.1", "ERR_ADDRESS_PRIVATE"},
+		// Loopback
+		{"127.0.0.1", "ERR_ADDRESS_INVALID"},
+		{"::1", "ERR_ADDRESS_INVALID"},
+		{"::ffff:127.0.0.1", "ERR_ADDRESS_INVALID"},
+		// Link-local
+		{"169.254.169.254", "ERR_ADDRESS_INVALID"},
+		{"fe80::1", "ERR_ADDRESS_INVALID"},
+		// Multicast
+		{"224.0.0.251", "ERR_ADDRESS_INVALID"},
+		{"ff02::fb", "ERR_ADDRESS_INVALID"},
+		// Unspecified and broadcast
+		{"0.0.0.0", "ERR_ADDRESS_INVALID"},
+		{"::", "ERR_ADDRESS_INVALID"},
+		{"255.255.255.255", "ERR_ADDRESS_INVALID"},
+	} {
+		connErr := blocker.Check(net.ParseIP(tt.address))
+		if assert.NotNil(t, connErr, tt.address) {
+			assert.Equal(t, tt.status, connErr.Status, tt.address)
+		}
+	}
+
+	assert.Nil(t, blocker.Check(net.ParseIP("8.8.8.8")))
+	assert.Nil(t, blocker.Check(net.ParseIP("2001:4860:4860::8888")))
+	assert.Equal(t, "ERR_ADDRESS_INVALID", blocker.Check(nil).Status)
+}
+
+func TestCIDRBlocker(t *testing.T) {
+	blocker := NewCIDRBlocker()
+	assert.Nil(t, blocker.Check(net.ParseIP("192.0.2.1")))
+	assert.Error(t, blocker.Block("192.0.2.0", "ERR_TEST"))
+	assert.NoError(t, blocker.Block("192.0.2.0/24", "ERR_TEST"))
+	assert.Equal(t, "ERR_TEST", blocker.Check(net.ParseIP("192.0.2.1")).Status)
+	assert.Nil(t, blocker.Check(net.ParseIP("192.0.3.1")))
+
+	// Validate returns a nil interface for allowed addresses.
+	assert.True(t, blocker.Validate(net.ParseIP("192.0.3.1")) == nil)
+	var connErr *ConnectionError
+	assert.True(t, errors.As(blocker.Validate(net.ParseIP("192.0.2.1")), &connErr))
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+)
+
+// AccessKeyURL holds the parts of a Shadowsocks access key shared as a SIP002 URI,
+// like "ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888#Example1". See
+// https://shadowsocks.org/doc/sip002.html.
+type AccessKeyURL struct {
+	Cipher string
+	Secret string
+	Host   string
+	Port   int
+	// KeyID is the tag in the fragment of the URI, which names the key. Optional.
+	KeyID string
+}
+
+// NewCipherFromURL parses a SIP002 URI and creates the encryption key that it
+// describes. Both the base64 user info and the percent-encoded "method:password"
+// form are accepted. Plugins aren't supported, and the query is ignored.
+func NewCipherFromURL(rawURL string) (*AccessKeyURL, *shadowsocks.EncryptionKey, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Scheme != "ss" {
+		return nil, nil, fmt.Errorf("scheme is %q, not ss", u.Scheme)
+	}
+	if u.User == nil {
+		return nil, nil, errors.New("user info is missing")
+	}
+	if u.Query().Has("plugin") {
+		return nil, nil, errors.New("plugins are not supported")
+	}
+	key := &AccessKeyURL{KeyID: u.Fragment}
+	if password, ok := u.User.Password(); ok {
+		key.Cipher, key.Secret = u.User.Username(), password
+	} else {
+		userInfo, err := decodeBase64UserInfo(u.User.Username())
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decode user info: %w", err)
+		}
+		var found bool
+		if key.Cipher, key.Secret, found = strings.Cut(userInfo, ":"); !found {
+			return nil, nil, errors.New("user info is not method:password")
+		}
+	}
+	key.Host = u.Hostname()
+	if key.Host == "" {
+		return nil, nil, errors.New("host is missing")
+	}
+	if key.Port, err = strconv.Atoi(u.Port()); err != nil || key.Port < 1 || key.Port > 65535 {
+		return nil, nil, fmt.Errorf("invalid port %q", u.Port())
+	}
+	cryptoKey, err := shadowsocks.NewEncryptionKey(key.Cipher, key.Secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, cryptoKey, nil
+}
+
+// decodeBase64UserInfo decodes user info in either base64 alphabet, with or
+// without padding, since clients don't agree on one.
+func decodeBase64UserInfo(userInfo string) (string, error) {
+	userInfo = strings.TrimRight(userInfo, "=")
+	decoded, err := base64.RawURLEncoding.DecodeString(userInfo)
+	if err != nil {
+		decoded, err = base64.RawStdEncoding.DecodeString(userInfo)
+	}
+	return string(decoded), err
+}
+
+// FormatURL returns the SIP002 URI of the key, with the user info in unpadded
+// URL-safe base64, as the spec recommends. NewCipherFromURL parses it back.
+func (k *AccessKeyURL) FormatURL() string {
+	u := url.URL{
+		Scheme:   "ss",
+		User:     url.User(base64.RawURLEncoding.EncodeToString([]byte(k.Cipher + ":" + k.Secret))),
+		Host:     net.JoinHostPort(k.Host, strconv.Itoa(k.Port)),
+		Fragment: k.KeyID,
+	}
+	return u.String()
+}
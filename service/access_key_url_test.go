@@ -0,0 +1,70 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessKeyURLRoundTrip(t *testing.T) {
+	for _, rawURL := range []string{
+		"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888#Example1",
+		"ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpzZWNyZXQ@example.com:443#My%20key",
+		"ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpzZWNyZXQ@[2001:db8::1]:8388",
+	} {
+		key, cryptoKey, err := NewCipherFromURL(rawURL)
+		require.NoError(t, err, rawURL)
+		require.NotNil(t, cryptoKey)
+		require.Equal(t, rawURL, key.FormatURL())
+	}
+}
+
+func TestNewCipherFromURL(t *testing.T) {
+	key, cryptoKey, err := NewCipherFromURL("ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888#Example1")
+	require.NoError(t, err)
+	require.Equal(t, &AccessKeyURL{Cipher: "aes-128-gcm", Secret: "test", Host: "192.168.100.1", Port: 8888, KeyID: "Example1"}, key)
+	expectedKey, err := shadowsocks.NewEncryptionKey(shadowsocks.AES128GCM, "test")
+	require.NoError(t, err)
+	require.Equal(t, expectedKey, cryptoKey)
+
+	// Other encodings of the same key.
+	for _, rawURL := range []string{
+		"ss://YWVzLTEyOC1nY206dGVzdA==@192.168.100.1:8888/?outline=1#Example1",
+		"ss://aes-128-gcm:test@192.168.100.1:8888#Example1",
+	} {
+		parsed, _, err := NewCipherFromURL(rawURL)
+		require.NoError(t, err, rawURL)
+		require.Equal(t, key, parsed, rawURL)
+	}
+}
+
+func TestNewCipherFromURLErrors(t *testing.T) {
+	for _, rawURL := range []string{
+		"http://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888",
+		"ss://192.168.100.1:8888",
+		"ss://!!!@192.168.100.1:8888",
+		"ss://YWVzLTEyOC1nY20@192.168.100.1:8888",
+		"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1",
+		"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:70000",
+		"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888/?plugin=obfs-local",
+		"ss://cmM0LW1kNTp0ZXN0@192.168.100.1:8888",
+	} {
+		_, _, err := NewCipherFromURL(rawURL)
+		require.Error(t, err, rawURL)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+)
+
+var anonymizeClientIPs atomic.Bool
+
+// SetClientIPAnonymization makes the TCP and UDP handlers truncate client IP
+// addresses, with [AnonymizeIP], everywhere they log or report them: in log
+// messages, metrics, connection events and packet hooks. Since the truncated
+// address stays in the same network, metrics can still attribute it to a country
+// and ASN. Relaying and access key affinity still use the full address.
+// Anonymization is disabled by default.
+func SetClientIPAnonymization(enabled bool) {
+	anonymizeClientIPs.Store(enabled)
+}
+
+// AnonymizeIP zeroes the last 8 bits of an IPv4 address, and the last 80 bits of
+// an IPv6 address, which leaves the /24 or /48 network that it belongs to.
+func AnonymizeIP(ip netip.Addr) netip.Addr {
+	ip = ip.Unmap()
+	bits := 48
+	if ip.Is4() {
+		bits = 24
+	}
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return ip
+	}
+	return prefix.Addr()
+}
+
+// anonymizeAddr returns `addr` with its IP anonymized, if anonymization is enabled.
+// The port is kept.
+func anonymizeAddr(addr net.Addr) net.Addr {
+	if !anonymizeClientIPs.Load() || addr == nil {
+		return addr
+	}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(AnonymizeIP(a.AddrPort().Addr()), uint16(a.Port)))
+	case *net.UDPAddr:
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(AnonymizeIP(a.AddrPort().Addr()), uint16(a.Port)))
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return addr
+	}
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(AnonymizeIP(addrPort.Addr()), addrPort.Port()))
+}
@@ -0,0 +1,41 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnonymizeIP(t *testing.T) {
+	require.Equal(t, netip.MustParseAddr("192.0.2.0"), AnonymizeIP(netip.MustParseAddr("192.0.2.123")))
+	require.Equal(t, netip.MustParseAddr("192.0.2.0"), AnonymizeIP(netip.MustParseAddr("::ffff:192.0.2.123")))
+	require.Equal(t, netip.MustParseAddr("2001:db8:1::"), AnonymizeIP(netip.MustParseAddr("2001:db8:1:2:3:4:5:6")))
+}
+
+func TestAnonymizeAddr(t *testing.T) {
+	udpAddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.123"), Port: 12345}
+	require.Same(t, udpAddr, anonymizeAddr(udpAddr))
+
+	SetClientIPAnonymization(true)
+	defer SetClientIPAnonymization(false)
+	require.Equal(t, "192.0.2.0:12345", anonymizeAddr(udpAddr).String())
+	tcpAddr := &net.TCPAddr{IP: net.ParseIP("2001:db8:1:2:3:4:5:6"), Port: 443}
+	require.Equal(t, "[2001:db8:1::]:443", anonymizeAddr(tcpAddr).String())
+	require.Nil(t, anonymizeAddr(nil))
+}
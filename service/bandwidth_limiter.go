@@ -0,0 +1,248 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Smallest burst allowed by a BandwidthLimiter, so that a full-size packet
+// doesn't need to wait for more than one reservation.
+const minBandwidthBurst = 1500
+
+// BandwidthLimiter is a token bucket that limits the aggregate throughput of all
+// the TCP and UDP relays that share it. Relays reserve bytes in the order they
+// ask for them, and TCP relays ask for at most a burst at a time, so when the
+// limit is reached every relay slows down and none can starve the others.
+//
+// The bucket holds up to 50ms worth of bytes, so short bursts are not delayed.
+//
+// By default the bandwidth is shared by relay, so an access key with many
+// connections gets a larger share than one with a single connection. See
+// [BandwidthLimiter.SetPerKeyFairness] to share it by access key instead.
+type BandwidthLimiter struct {
+	rate      int
+	burst     int
+	burstTime time.Duration
+
+	mu sync.Mutex
+	// The time at which the bytes reserved so far will have been paid for, and the
+	// bucket full again. Reservations that leave it more than a burst in the
+	// future have to wait.
+	next    time.Time
+	bytes   int64
+	delay   time.Duration
+	dropped int64
+
+	// Whether the bandwidth is shared by access key, see SetPerKeyFairness.
+	fair bool
+	// The time at which the bytes reserved by each active key will have been paid
+	// for, at the share of the bandwidth it had when reserving them. Keys that have
+	// paid for everything are removed every burstTime, at prunedAt.
+	keyNext  map[string]time.Time
+	prunedAt time.Time
+}
+
+// NewBandwidthLimiter returns a BandwidthLimiter that allows up to
+// `bytesPerSecond` bytes per second, which must be positive.
+func NewBandwidthLimiter(bytesPerSecond int) *BandwidthLimiter {
+	burst := bytesPerSecond / 20
+	if burst < minBandwidthBurst {
+		burst = minBandwidthBurst
+	}
+	return &BandwidthLimiter{
+		rate:      bytesPerSecond,
+		burst:     burst,
+		burstTime: time.Duration(float64(burst) * float64(time.Second) / float64(bytesPerSecond)),
+	}
+}
+
+// reserve takes `n` bytes from the bucket and returns how long to wait before
+// using them.
+func (l *BandwidthLimiter) reserve(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.take(n, now, false)
+}
+
+// take is like reserve, with the lock held. If `onlyNow` is set, the bytes are only
+// taken if they can be used right away.
+func (l *BandwidthLimiter) take(n int, now time.Time, onlyNow bool) time.Duration {
+	cost := time.Duration(float64(n) * float64(time.Second) / float64(l.rate))
+	start := l.next
+	if start.Before(now) {
+		// All previous reservations have been paid for, so the bucket is full.
+		start = now
+	}
+	next := start.Add(cost)
+	wait := next.Sub(now) - l.burstTime
+	if wait > 0 && onlyNow {
+		return wait
+	}
+	l.next = next
+	l.bytes += int64(n)
+	if wait < 0 {
+		return 0
+	}
+	l.delay += wait
+	return wait
+}
+
+// SetPerKeyFairness makes the limiter share the bandwidth equally among the access
+// keys that are using it, rather than among their relays, so that a key with many
+// connections can't crowd out the others. Each key pays for its bytes at the rate
+// it would get if the bandwidth were split evenly among the active keys, and waits
+// for its own reservations only, not for those of other keys.
+//
+// A key counts as active until it has paid for its reservations, so the number of
+// keys, and the share of each, are updated every 50ms or so. Between updates a key
+// that just went idle is still counted, which leaves some bandwidth unused rather
+// than going over the limit. Each key that becomes active can send its share of a
+// burst right away. Relays without an access key share one slot.
+func (l *BandwidthLimiter) SetPerKeyFairness(enabled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fair = enabled
+	l.keyNext = nil
+	if enabled {
+		l.keyNext = make(map[string]time.Time)
+	}
+}
+
+// reserveKey is like reserve, but for a relay of access key `key`, which matters if
+// the limiter is fair.
+func (l *BandwidthLimiter) reserveKey(key string, n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.fair {
+		return l.take(n, now, false)
+	}
+	return l.takeKey(key, n, now, false)
+}
+
+// takeKey is like take, for a fair limiter.
+func (l *BandwidthLimiter) takeKey(key string, n int, now time.Time, onlyNow bool) time.Duration {
+	if now.Sub(l.prunedAt) >= l.burstTime {
+		for k, next := range l.keyNext {
+			if next.Before(now) {
+				delete(l.keyNext, k)
+			}
+		}
+		l.prunedAt = now
+	}
+	start, ok := l.keyNext[key]
+	if start.Before(now) {
+		start = now
+	}
+	activeKeys := len(l.keyNext)
+	if !ok {
+		activeKeys++
+	}
+	cost := time.Duration(float64(n) * float64(activeKeys) * float64(time.Second) / float64(l.rate))
+	next := start.Add(cost)
+	wait := next.Sub(now) - l.burstTime
+	if wait > 0 && onlyNow {
+		return wait
+	}
+	l.keyNext[key] = next
+	l.bytes += int64(n)
+	if wait < 0 {
+		return 0
+	}
+	l.delay += wait
+	return wait
+}
+
+// allowKey takes `n` bytes for a relay of access key `key` only if they can be sent
+// right away, and reports whether it did. Unlike waitKey it never blocks, so that
+// relays reading the packets of many keys from one socket can drop the packets over
+// the limit instead of delaying those of every other key.
+func (l *BandwidthLimiter) allowKey(key string, n int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	if l.fair {
+		wait = l.takeKey(key, n, now, true)
+	} else {
+		wait = l.take(n, now, true)
+	}
+	if wait > 0 {
+		l.dropped++
+		return false
+	}
+	return true
+}
+
+// Wait blocks until `n` bytes can be sent without exceeding the limit.
+func (l *BandwidthLimiter) Wait(n int) {
+	l.waitKey("", n)
+}
+
+// waitKey is like Wait, for a relay of access key `key`.
+func (l *BandwidthLimiter) waitKey(key string, n int) {
+	if wait := l.reserveKey(key, n, time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Limit returns the maximum throughput, in bytes per second.
+func (l *BandwidthLimiter) Limit() int {
+	return l.rate
+}
+
+// Bytes returns the total number of bytes that have gone through the limiter.
+// Its rate over the limit is the current utilization.
+func (l *BandwidthLimiter) Bytes() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bytes
+}
+
+// Delay returns the total time that relays have been delayed by the limiter.
+func (l *BandwidthLimiter) Delay() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.delay
+}
+
+// Dropped returns the number of UDP packets that were dropped because they would
+// have gone over the limit.
+func (l *BandwidthLimiter) Dropped() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dropped
+}
+
+// limitedReader is an [io.Reader] that waits for the BandwidthLimiter after each
+// read, and reads at most a burst at a time.
+type limitedReader struct {
+	io.Reader
+	limiter *BandwidthLimiter
+	// The access key of the relay.
+	key string
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.limiter.burst {
+		p = p[:r.limiter.burst]
+	}
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.limiter.waitKey(r.key, n)
+	}
+	return n, err
+}
@@ -0,0 +1,175 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBandwidthLimiterReserve(t *testing.T) {
+	// 100 kB/s, with a burst of 5 kB (50ms).
+	limiter := NewBandwidthLimiter(100000)
+	require.Equal(t, 5000, limiter.burst)
+	now := time.Now()
+
+	// The burst goes through without waiting.
+	require.Zero(t, limiter.reserve(5000, now))
+	// Then each reservation waits for the previous ones.
+	require.Equal(t, 10*time.Millisecond, limiter.reserve(1000, now))
+	require.Equal(t, 20*time.Millisecond, limiter.reserve(1000, now))
+	require.Equal(t, 30*time.Millisecond, limiter.Delay())
+
+	// The bucket refills over time, up to the burst.
+	now = now.Add(time.Second)
+	require.Zero(t, limiter.reserve(5000, now))
+	require.Equal(t, 10*time.Millisecond, limiter.reserve(1000, now))
+	require.Equal(t, int64(13000), limiter.Bytes())
+}
+
+func TestBandwidthLimiterMinBurst(t *testing.T) {
+	limiter := NewBandwidthLimiter(1000)
+	require.Equal(t, minBandwidthBurst, limiter.burst)
+	require.Equal(t, 1500*time.Millisecond, limiter.burstTime)
+}
+
+func TestBandwidthLimiterPerKeyFairness(t *testing.T) {
+	// 100 kB/s, with a burst of 5 kB (50ms).
+	limiter := NewBandwidthLimiter(100000)
+	limiter.SetPerKeyFairness(true)
+	now := time.Now()
+
+	// A single key gets the whole bandwidth.
+	require.Zero(t, limiter.reserveKey("a", 5000, now))
+	require.Equal(t, 10*time.Millisecond, limiter.reserveKey("a", 1000, now))
+	// A second key doesn't wait behind the first one, and pays for half the bandwidth.
+	require.Zero(t, limiter.reserveKey("b", 2500, now))
+	require.Equal(t, 20*time.Millisecond, limiter.reserveKey("b", 1000, now))
+	// So does the first key, now that the second one is active.
+	require.Equal(t, 30*time.Millisecond, limiter.reserveKey("a", 1000, now))
+	require.Equal(t, int64(10500), limiter.Bytes())
+
+	// Idle keys stop counting.
+	now = now.Add(time.Second)
+	require.Zero(t, limiter.reserveKey("a", 5000, now))
+	require.Equal(t, 10*time.Millisecond, limiter.reserveKey("a", 1000, now))
+}
+
+func TestBandwidthLimiterAllowKey(t *testing.T) {
+	// 100 kB/s, with a burst of 5 kB (50ms).
+	limiter := NewBandwidthLimiter(100000)
+	now := time.Now()
+
+	require.True(t, limiter.allowKey("a", 5000, now))
+	// Bytes that would have to wait are refused, and not taken from the bucket.
+	require.False(t, limiter.allowKey("a", 1000, now))
+	require.False(t, limiter.allowKey("a", 1000, now))
+	require.Equal(t, int64(5000), limiter.Bytes())
+	require.Zero(t, limiter.Delay())
+	require.Equal(t, int64(2), limiter.Dropped())
+
+	now = now.Add(10 * time.Millisecond)
+	require.True(t, limiter.allowKey("a", 1000, now))
+	require.False(t, limiter.allowKey("a", 1000, now))
+}
+
+// simulateBandwidthShare runs `heavyRelays` relays of one access key and a single
+// relay of another through `limiter` for a second of simulated time, each reading
+// 1500 bytes at a time as soon as the limiter lets it. It returns the fraction of
+// the bytes that went to the single relay.
+func simulateBandwidthShare(limiter *BandwidthLimiter, heavyRelays int) float64 {
+	type relay struct {
+		key   string
+		ready time.Time
+		bytes int
+	}
+	start := time.Now()
+	relays := []*relay{{key: "light", ready: start}}
+	for i := 0; i < heavyRelays; i++ {
+		relays = append(relays, &relay{key: "heavy", ready: start})
+	}
+	total := 0
+	for {
+		next := relays[0]
+		for _, r := range relays {
+			if r.ready.Before(next.ready) {
+				next = r
+			}
+		}
+		if next.ready.Sub(start) >= time.Second {
+			break
+		}
+		next.ready = next.ready.Add(limiter.reserveKey(next.key, 1500, next.ready))
+		next.bytes += 1500
+		total += 1500
+	}
+	return float64(relays[0].bytes) / float64(total)
+}
+
+func TestBandwidthLimiterPerKeyFairnessShare(t *testing.T) {
+	// Relays share the bandwidth by default.
+	require.Less(t, simulateBandwidthShare(NewBandwidthLimiter(1000000), 8), 0.2)
+
+	fairLimiter := NewBandwidthLimiter(1000000)
+	fairLimiter.SetPerKeyFairness(true)
+	require.InDelta(t, 0.5, simulateBandwidthShare(fairLimiter, 8), 0.02)
+	// The limit still holds, give or take the initial burst of each key.
+	require.InDelta(t, 1000000, fairLimiter.Bytes(), float64(2*fairLimiter.burst))
+}
+
+// Reports the share of the bandwidth that one connection gets against eight
+// connections of another access key, with and without per-key fairness.
+func BenchmarkBandwidthLimiterFairness(b *testing.B) {
+	for _, fair := range []bool{false, true} {
+		name := "relay"
+		if fair {
+			name = "key"
+		}
+		b.Run(name, func(b *testing.B) {
+			var share float64
+			for i := 0; i < b.N; i++ {
+				limiter := NewBandwidthLimiter(1000000)
+				limiter.SetPerKeyFairness(fair)
+				share = simulateBandwidthShare(limiter, 8)
+			}
+			b.ReportMetric(share, "light-share")
+		})
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	// 200 kB/s, with a burst of 10 kB.
+	limiter := NewBandwidthLimiter(200000)
+	payload := makeTestPayload(30000)
+	reader := &limitedReader{bytes.NewReader(payload), limiter, ""}
+
+	// Reads are split into bursts.
+	buf := make([]byte, len(payload))
+	n, err := reader.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, 10000, n)
+
+	// The remaining 20 kB take about 100ms.
+	start := time.Now()
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, payload[n:], rest)
+	require.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	require.Equal(t, int64(len(payload)), limiter.Bytes())
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+)
+
+// benchmarkChunkSize is the size of each write of [BenchmarkProxy].
+const benchmarkChunkSize = 16 * 1024
+
+// BenchmarkResult is the performance of a proxy as measured by [BenchmarkProxy].
+type BenchmarkResult struct {
+	BytesSent, BytesRecv int64
+	// Bytes received per second.
+	Throughput float64
+	// Round-trip time of each chunk, through the proxy and the target.
+	MeanLatency, P99Latency time.Duration
+	// Failed reads and writes, which end the benchmark early.
+	Errors int
+}
+
+// BenchmarkProxy measures the throughput and latency of the Shadowsocks proxy at
+// `proxyAddr` from the client's side. It opens a single connection to `targetAddr`
+// through the proxy with `key`, and for `duration` writes chunks as fast as the
+// round trips allow, reading each one back before the next. The target must echo
+// what it receives. Only a failure to connect is returned as an error: failures
+// once connected end the benchmark, and are counted in the result.
+func BenchmarkProxy(proxyAddr string, key *shadowsocks.EncryptionKey, targetAddr string, duration time.Duration) (BenchmarkResult, error) {
+	var result BenchmarkResult
+	dialer, err := shadowsocks.NewStreamDialer(&transport.TCPEndpoint{Address: proxyAddr}, key)
+	if err != nil {
+		return result, err
+	}
+	conn, err := dialer.DialStream(context.Background(), targetAddr)
+	if err != nil {
+		return result, fmt.Errorf("failed to connect to %v through %v: %w", targetAddr, proxyAddr, err)
+	}
+	defer conn.Close()
+
+	chunk := make([]byte, benchmarkChunkSize)
+	echo := make([]byte, benchmarkChunkSize)
+	var latencies []time.Duration
+	start := time.Now()
+	deadline := start.Add(duration)
+	conn.SetDeadline(deadline.Add(time.Second))
+	for time.Now().Before(deadline) {
+		sent := time.Now()
+		n, err := conn.Write(chunk)
+		result.BytesSent += int64(n)
+		if err != nil {
+			result.Errors++
+			break
+		}
+		n, err = io.ReadFull(conn, echo)
+		result.BytesRecv += int64(n)
+		if err != nil {
+			result.Errors++
+			break
+		}
+		latencies = append(latencies, time.Since(sent))
+	}
+	elapsed := time.Since(start)
+
+	if elapsed > 0 {
+		result.Throughput = float64(result.BytesRecv) / elapsed.Seconds()
+	}
+	if len(latencies) > 0 {
+		var total time.Duration
+		for _, latency := range latencies {
+			total += latency
+		}
+		result.MeanLatency = total / time.Duration(len(latencies))
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		result.P99Latency = latencies[(len(latencies)*99+99)/100-1]
+	}
+	return result, nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"io"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+)
+
+var errEmptyChain = errors.New("at least one key is required")
+
+// NewWriterChain returns a Writer that encrypts the data written to it with each of
+// the keys in turn, and writes the result to `w`. That is, keys[0] is applied first,
+// and the output of the last key is what `w` receives. This is the layering needed
+// to reach a server through one or more Shadowsocks hops, with keys[0] being the
+// key of the last hop.
+func NewWriterChain(w io.Writer, keys ...*shadowsocks.EncryptionKey) (*shadowsocks.Writer, error) {
+	if len(keys) == 0 {
+		return nil, errEmptyChain
+	}
+	for i := len(keys) - 1; i > 0; i-- {
+		w = shadowsocks.NewWriter(w, keys[i])
+	}
+	return shadowsocks.NewWriter(w, keys[0]), nil
+}
+
+// NewReaderChain returns a Reader that decrypts data produced by a writer chain
+// created with the same keys. The last key is removed first, so keys[0] is the
+// innermost layer.
+func NewReaderChain(r io.Reader, keys ...*shadowsocks.EncryptionKey) (shadowsocks.Reader, error) {
+	if len(keys) == 0 {
+		return nil, errEmptyChain
+	}
+	for i := len(keys) - 1; i > 0; i-- {
+		r = shadowsocks.NewReader(r, keys[i])
+	}
+	return shadowsocks.NewReader(r, keys[0]), nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/stretchr/testify/require"
+)
+
+func makeChainKeys(t *testing.T) (inner, outer *shadowsocks.EncryptionKey) {
+	inner, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, "inner")
+	require.NoError(t, err)
+	outer, err = shadowsocks.NewEncryptionKey(shadowsocks.AES256GCM, "outer")
+	require.NoError(t, err)
+	return inner, outer
+}
+
+func TestWriterChain(t *testing.T) {
+	inner, outer := makeChainKeys(t)
+	var buf bytes.Buffer
+	w, err := NewWriterChain(&buf, inner, outer)
+	require.NoError(t, err)
+	payload := makeTestPayload(50000)
+	_, err = w.Write(payload)
+	require.NoError(t, err)
+
+	// Peel off the layers one at a time, outer first.
+	outerReader := shadowsocks.NewReader(bytes.NewReader(buf.Bytes()), outer)
+	innerReader := shadowsocks.NewReader(outerReader, inner)
+	decrypted, err := io.ReadAll(innerReader)
+	require.NoError(t, err)
+	require.Equal(t, payload, decrypted)
+
+	// The inner layer alone can't decrypt it.
+	_, err = io.ReadAll(shadowsocks.NewReader(bytes.NewReader(buf.Bytes()), inner))
+	require.Error(t, err)
+
+	chainReader, err := NewReaderChain(bytes.NewReader(buf.Bytes()), inner, outer)
+	require.NoError(t, err)
+	decrypted, err = io.ReadAll(chainReader)
+	require.NoError(t, err)
+	require.Equal(t, payload, decrypted)
+}
+
+func TestEmptyChain(t *testing.T) {
+	_, err := NewWriterChain(io.Discard)
+	require.Error(t, err)
+	_, err = NewReaderChain(bytes.NewReader(nil))
+	require.Error(t, err)
+}
@@ -0,0 +1,203 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+)
+
+// ErrChunkTooLarge is returned by a reader from [NewShadowsocksReader] when the
+// stream has a chunk over the configured MaxChunkSize.
+var ErrChunkTooLarge = errors.New("chunk too large")
+
+// ShadowsocksReaderOptions configures [NewShadowsocksReader].
+type ShadowsocksReaderOptions struct {
+	// MaxChunkSize is the largest chunk payload to accept, in bytes. 0 means the
+	// protocol maximum of 16383.
+	MaxChunkSize int
+	// ChunkTiming, if set, is called for each chunk with its payload size and the
+	// time from reading its size block to reading the end of its payload. It doesn't
+	// include decryption, so slow chunks point to the network rather than the CPU.
+	ChunkTiming func(size int, elapsed time.Duration)
+}
+
+// NewShadowsocksReader is like [shadowsocks.NewReader], but enforces `opts`. With
+// zero options it returns the plain SDK reader.
+//
+// A chunk's size is checked as soon as its size block decrypts, so a peer can't make
+// the reader buffer a payload larger than MaxChunkSize.
+func NewShadowsocksReader(r io.Reader, key *shadowsocks.EncryptionKey, opts ShadowsocksReaderOptions) shadowsocks.Reader {
+	if opts.MaxChunkSize <= 0 || opts.MaxChunkSize > maxChunkPayload {
+		opts.MaxChunkSize = maxChunkPayload
+	}
+	if opts.MaxChunkSize == maxChunkPayload && opts.ChunkTiming == nil {
+		return shadowsocks.NewReader(r, key)
+	}
+	return shadowsocks.NewReader(&chunkInspector{reader: r, key: key, opts: opts}, key)
+}
+
+// chunkInspector passes the ciphertext through unchanged, decrypting only the size
+// blocks to check and time each chunk before the SDK reader sees it.
+type chunkInspector struct {
+	reader io.Reader
+	key    *shadowsocks.EncryptionKey
+	opts   ShadowsocksReaderOptions
+	aead   cipher.AEAD
+	nonce  []byte
+	// Ciphertext already read from `reader` and not yet returned.
+	pending []byte
+	// Ciphertext left in the current payload block.
+	payloadLeft int
+	sizeBlock   []byte
+	sizePlain   []byte
+	// Size of the current chunk and when its size block was read, for ChunkTiming.
+	chunkSize  int
+	chunkStart time.Time
+}
+
+func (c *chunkInspector) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 && c.payloadLeft == 0 {
+		if err := c.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if len(p) > c.payloadLeft {
+		p = p[:c.payloadLeft]
+	}
+	n, err := c.reader.Read(p)
+	c.payloadLeft -= n
+	if c.payloadLeft == 0 && c.opts.ChunkTiming != nil {
+		c.opts.ChunkTiming(c.chunkSize, time.Since(c.chunkStart))
+	}
+	if err == io.EOF && c.payloadLeft > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// readHeader reads the salt on the first call, and the next size block after that.
+func (c *chunkInspector) readHeader() error {
+	if c.aead == nil {
+		salt := make([]byte, c.key.SaltSize())
+		if _, err := io.ReadFull(c.reader, salt); err != nil {
+			return err
+		}
+		aead, err := c.key.NewAEAD(salt)
+		if err != nil {
+			return fmt.Errorf("failed to create AEAD: %w", err)
+		}
+		c.aead = aead
+		c.nonce = make([]byte, aead.NonceSize())
+		c.sizeBlock = make([]byte, 2+aead.Overhead())
+		c.sizePlain = make([]byte, 0, 2)
+		c.pending = salt
+		return nil
+	}
+	if _, err := io.ReadFull(c.reader, c.sizeBlock); err != nil {
+		return err
+	}
+	if c.opts.ChunkTiming != nil {
+		c.chunkStart = time.Now()
+	}
+	plain, err := c.aead.Open(c.sizePlain[:0], c.nonce, c.sizeBlock, nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt chunk size: %w", err)
+	}
+	incrementNonce(c.nonce)
+	size := (int(plain[0])<<8 | int(plain[1])) & maxChunkPayload
+	if size > c.opts.MaxChunkSize {
+		return fmt.Errorf("%w: %d bytes", ErrChunkTooLarge, size)
+	}
+	// The payload uses the next nonce.
+	incrementNonce(c.nonce)
+	c.chunkSize = size
+	c.pending = c.sizeBlock
+	c.payloadLeft = size + c.aead.Overhead()
+	return nil
+}
+
+// incrementNonce increments the little-endian nonce, like the SDK does.
+func incrementNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// NewChunkLimitedWriter returns a writer that sends at most `maxChunkSize` bytes of
+// payload per chunk through `sw`, for peers that only accept smaller chunks than the
+// protocol allows. It has no effect if `maxChunkSize` isn't between 1 and 16383.
+//
+// The returned writer also implements [io.ReaderFrom], so [io.Copy] keeps the
+// Shadowsocks writer's buffering.
+func NewChunkLimitedWriter(sw *shadowsocks.Writer, maxChunkSize int) io.Writer {
+	if maxChunkSize <= 0 || maxChunkSize > maxChunkPayload {
+		maxChunkSize = maxChunkPayload
+	}
+	return &chunkLimitedWriter{sw: sw, maxChunkSize: maxChunkSize}
+}
+
+type chunkLimitedWriter struct {
+	sw           *shadowsocks.Writer
+	maxChunkSize int
+}
+
+func (w *chunkLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		piece := p
+		if len(piece) > w.maxChunkSize {
+			piece = piece[:w.maxChunkSize]
+		}
+		n, err := w.sw.Write(piece)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(piece):]
+	}
+	return written, nil
+}
+
+// ReadFrom relies on the Shadowsocks writer sending one chunk per read.
+func (w *chunkLimitedWriter) ReadFrom(r io.Reader) (int64, error) {
+	return w.sw.ReadFrom(&shortReader{reader: r, max: w.maxChunkSize})
+}
+
+// shortReader reads at most `max` bytes per Read.
+type shortReader struct {
+	reader io.Reader
+	max    int
+}
+
+func (r *shortReader) Read(p []byte) (int, error) {
+	if len(p) > r.max {
+		p = p[:r.max]
+	}
+	return r.reader.Read(p)
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShadowsocksReaderMaxChunkSize(t *testing.T) {
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err)
+	key := firstCipher(cipherList)
+
+	var ciphertext bytes.Buffer
+	writer := shadowsocks.NewWriter(&ciphertext, key)
+	small := bytes.Repeat([]byte("a"), 100)
+	large := bytes.Repeat([]byte("b"), 1000)
+	_, err = writer.Write(small)
+	require.NoError(t, err)
+	_, err = writer.Write(large)
+	require.NoError(t, err)
+
+	// Data from chunks within the limit is returned before the large chunk fails.
+	reader := NewShadowsocksReader(bytes.NewReader(ciphertext.Bytes()), key, ShadowsocksReaderOptions{MaxChunkSize: 500})
+	decrypted, err := io.ReadAll(reader)
+	require.True(t, errors.Is(err, ErrChunkTooLarge), "unexpected error %v", err)
+	require.Equal(t, small, decrypted)
+
+	reader = NewShadowsocksReader(bytes.NewReader(ciphertext.Bytes()), key, ShadowsocksReaderOptions{MaxChunkSize: 1000})
+	decrypted, err = io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, append(small, large...), decrypted)
+}
+
+func TestChunkLimitedWriter(t *testing.T) {
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err)
+	key := firstCipher(cipherList)
+
+	var ciphertext bytes.Buffer
+	writer := NewChunkLimitedWriter(shadowsocks.NewWriter(&ciphertext, key), 500)
+	payload := bytes.Repeat([]byte("c"), 1200)
+	n, err := writer.Write(payload)
+	require.NoError(t, err)
+	require.Equal(t, len(payload), n)
+	_, err = io.Copy(writer, bytes.NewReader(payload))
+	require.NoError(t, err)
+
+	reader := NewShadowsocksReader(&ciphertext, key, ShadowsocksReaderOptions{MaxChunkSize: 500})
+	decrypted, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, append(payload, payload...), decrypted)
+}
+
+func TestShadowsocksReaderChunkTiming(t *testing.T) {
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err)
+	key := firstCipher(cipherList)
+
+	var ciphertext bytes.Buffer
+	writer := shadowsocks.NewWriter(&ciphertext, key)
+	for _, size := range []int{10, 1000, 1} {
+		_, err = writer.Write(make([]byte, size))
+		require.NoError(t, err)
+	}
+
+	var sizes []int
+	reader := NewShadowsocksReader(&ciphertext, key, ShadowsocksReaderOptions{
+		ChunkTiming: func(size int, elapsed time.Duration) {
+			require.GreaterOrEqual(t, elapsed, time.Duration(0))
+			sizes = append(sizes, size)
+		},
+	})
+	decrypted, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Len(t, decrypted, 1011)
+	require.Equal(t, []int{10, 1000, 1}, sizes)
+}
@@ -16,8 +16,15 @@ package service
 
 import (
 	"container/list"
+	"errors"
+	"fmt"
+	"math/rand"
 	"net/netip"
+	"reflect"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
 )
@@ -26,12 +33,102 @@ import (
 const minSaltEntropy = 16
 
 // CipherEntry holds a Cipher with an identifier.
-// The public fields are constant, but lastClientIP is mutable under cipherList.mu.
+// The public fields are constant, but the private ones are mutable under cipherList.mu.
 type CipherEntry struct {
 	ID            string
 	CryptoKey     *shadowsocks.EncryptionKey
 	SaltGenerator ServerSaltGenerator
-	lastClientIP  netip.Addr
+	// DisplayName, if set, is reported in metrics instead of the ID, which is still
+	// what identifies the key everywhere else. Optional.
+	DisplayName string
+	// ExpiresAt is the time after which the key is expired. Expired keys are left
+	// out of snapshots, so clients can no longer use them, and can be removed with
+	// RemoveExpired. The zero value means it never expires.
+	ExpiresAt time.Time
+	// Priority orders the trial decryption independently of usage. The keys last
+	// used by the client's IP still come first, but within them, and within the
+	// rest, keys with a higher priority are tried first. The zero value is neutral:
+	// while every key has priority zero, the order is the usual one, most recently
+	// used first with affinity.
+	//
+	// Once any key has a nonzero priority, keys of the same priority are tried in
+	// order of usage, most used first, so that the order doesn't depend on which of
+	// them was used last. This tiebreak only applies with affinity and without
+	// SetShuffle. Without affinity, and in constant-time mode, keys of the same
+	// priority keep the list order, which a sort by usage would undo, and with the
+	// shuffle they keep the shuffled order, for the same reason. Pinned entries, and
+	// lists made with [WithForensicMode], ignore Priority.
+	Priority     int
+	lastClientIP netip.Addr
+	usageCount   int64
+	lastUsed     time.Time
+	// Set by PushFront. Pinned entries are tried before all the others.
+	pinned bool
+}
+
+// MetricsName returns the name under which the key is reported in metrics: its
+// DisplayName, or its ID if it has none.
+func (e *CipherEntry) MetricsName() string {
+	if e.DisplayName != "" {
+		return e.DisplayName
+	}
+	return e.ID
+}
+
+// expired reports whether the entry is past its expiry time at `now`.
+func (e *CipherEntry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && now.After(e.ExpiresAt)
+}
+
+// cipherNames are the Shadowsocks names of the supported ciphers, as used in
+// config files, in the order CipherName tries them.
+var cipherNames = []string{"chacha20-ietf-poly1305", "aes-256-gcm", "aes-192-gcm", "aes-128-gcm"}
+
+type cipherFingerprint struct {
+	saltSize int
+	aeadType reflect.Type
+}
+
+// cipherFingerprints identify each cipher by its salt size, which gives the AES key
+// size, and by the type of its AEAD, which tells AES-GCM from ChaCha20-Poly1305.
+var cipherFingerprints = func() map[string]cipherFingerprint {
+	fingerprints := make(map[string]cipherFingerprint, len(cipherNames))
+	for _, name := range cipherNames {
+		key, err := shadowsocks.NewEncryptionKey(name, "fingerprint")
+		if err != nil {
+			panic(err)
+		}
+		fingerprint, err := fingerprintCipher(key)
+		if err != nil {
+			panic(err)
+		}
+		fingerprints[name] = fingerprint
+	}
+	return fingerprints
+}()
+
+func fingerprintCipher(key *shadowsocks.EncryptionKey) (cipherFingerprint, error) {
+	aead, err := key.NewAEAD(make([]byte, key.SaltSize()))
+	if err != nil {
+		return cipherFingerprint{}, err
+	}
+	return cipherFingerprint{key.SaltSize(), reflect.TypeOf(aead)}, nil
+}
+
+// CipherName returns the name of the cipher of `key`, such as "aes-256-gcm",
+// which [shadowsocks.NewEncryptionKey] accepts. The key doesn't keep the name it
+// was created with, so it's found by matching the key against each cipher.
+func CipherName(key *shadowsocks.EncryptionKey) (string, bool) {
+	fingerprint, err := fingerprintCipher(key)
+	if err != nil {
+		return "", false
+	}
+	for _, name := range cipherNames {
+		if cipherFingerprints[name] == fingerprint {
+			return name, true
+		}
+	}
+	return "", false
 }
 
 // MakeCipherEntry constructs a CipherEntry.
@@ -52,10 +149,84 @@ func MakeCipherEntry(id string, cryptoKey *shadowsocks.EncryptionKey, secret str
 	}
 }
 
+// Secrets shorter than this, or with fewer distinct characters than
+// minSecretDistinctChars, are rejected by ValidateSecret.
+const (
+	minSecretLength        = 8
+	minSecretDistinctChars = 4
+)
+
+// ValidateSecret returns an error if `secret` is empty or too weak to protect an
+// access key, as is often the result of a copy-paste or templating error.
+func ValidateSecret(secret string) error {
+	if secret == "" {
+		return errors.New("secret is empty")
+	}
+	if len(secret) < minSecretLength {
+		return fmt.Errorf("secret is shorter than %v characters", minSecretLength)
+	}
+	distinct := make(map[rune]struct{})
+	for _, r := range secret {
+		distinct[r] = struct{}{}
+	}
+	if len(distinct) < minSecretDistinctChars {
+		return fmt.Errorf("secret has fewer than %v distinct characters", minSecretDistinctChars)
+	}
+	return nil
+}
+
+// CipherListObserver is notified of every change to the contents of a CipherList.
+// Its methods are called while the list's write lock is held, so they must not
+// call any methods of the list.
+type CipherListObserver interface {
+	// OnAdd is called when an entry is added to the list.
+	OnAdd(entry CipherEntry)
+	// OnRemove is called when the entry with the given ID is removed from the list.
+	OnRemove(id string)
+}
+
+// CipherListEventType is the kind of a [CipherListEvent].
+type CipherListEventType int
+
+const (
+	// CipherListEventAdd is sent when an entry is added to the list.
+	CipherListEventAdd CipherListEventType = iota + 1
+	// CipherListEventRemove is sent when an entry is removed from the list.
+	CipherListEventRemove
+)
+
+// CipherListEvent describes a change to the contents of a CipherList, as received
+// by its subscribers.
+type CipherListEvent struct {
+	Type  CipherListEventType
+	Entry CipherEntry
+}
+
+// cipherListEventBuffer is the capacity of the channel of each subscriber.
+const cipherListEventBuffer = 100
+
+// CipherListStats holds aggregate statistics about the entries of a CipherList.
+type CipherListStats struct {
+	TotalKeys int
+	// Keys used in the last 24 hours.
+	ActiveKeys    int
+	NeverUsedKeys int
+	// Keys past their ExpiresAt time.
+	ExpiredKeys int
+	// Average number of times each key was used.
+	AverageUsageCount float64
+	// Events that were not sent to a subscriber because its channel was full.
+	DroppedEvents int64
+}
+
+// Keys used within this period are counted as active by Statistics.
+const activeKeyPeriod = 24 * time.Hour
+
 // CipherList is a thread-safe collection of CipherEntry elements that allows for
 // snapshotting and moving to front.
 type CipherList interface {
-	// Returns a snapshot of the cipher list optimized for this client IP
+	// Returns a snapshot of the cipher list optimized for this client IP. Expired
+	// entries are left out.
 	SnapshotForClientIP(clientIP netip.Addr) []*list.Element
 	MarkUsedByClientIP(e *list.Element, clientIP netip.Addr)
 	// Update replaces the current contents of the CipherList with `contents`,
@@ -64,15 +235,218 @@ type CipherList interface {
 	Update(contents *list.List)
 }
 
+// ManagedCipherList is a [CipherList] whose entries can also be managed one by one,
+// observed, and tuned. The lists made by [NewCipherList] and
+// [NewLimitedCipherList] implement it. It's separate from CipherList, so that other
+// implementations of CipherList don't need all of its methods.
+type ManagedCipherList interface {
+	CipherList
+	// PushBack adds an entry at the end of the list and returns its element. If the
+	// list can't hold another entry, like a full [LimitedCipherList], it logs an error
+	// and returns nil.
+	PushBack(entry *CipherEntry) *list.Element
+	// PushFront adds an entry at the front of the list and returns its element. The
+	// entry is pinned: it's tried before every entry that isn't, whatever their
+	// usage and Priority, for keys that must always be found quickly, like a master
+	// key. Pinned entries are tried in the order they were pushed, latest first. Like
+	// PushBack, it logs an error and returns nil if the list is full.
+	PushFront(entry *CipherEntry) *list.Element
+	// Len returns the number of entries in the list, including expired ones.
+	Len() int
+	// Remove removes the entry with the given ID from the list.
+	// Returns false if there is no such entry.
+	Remove(id string) bool
+	// RemoveExpired removes the entries that are past their ExpiresAt time, and
+	// returns them. See [SweepExpiredKeys] to do it periodically.
+	RemoveExpired() []CipherEntry
+	// SetObserver sets the observer to be notified of all subsequent additions and
+	// removals, including those made by Update. A nil observer disables notifications.
+	SetObserver(observer CipherListObserver)
+	// Subscribe returns a channel that receives an event for each subsequent addition
+	// and removal, including those made by Update, and a function to cancel the
+	// subscription, which closes the channel. Unlike an observer, a subscriber can
+	// use the list when it receives an event. Events are dropped, and counted in
+	// [CipherListStats], if the subscriber falls behind and its channel is full.
+	Subscribe() (<-chan CipherListEvent, func())
+	// SetAffinity enables or disables the reordering of the list based on usage.
+	// Affinity is enabled by default: ciphers last used by the client IP are
+	// tried first, followed by the rest in most-recently-used order.
+	//
+	// With affinity disabled, the list is no longer reordered by usage, so the time
+	// to find a client's cipher no longer reveals which key that IP last used.
+	// Ciphers are tried in the current list order, which is the order given to
+	// Update and PushBack unless affinity reordered it before being disabled.
+	// Entries pinned with PushFront still come first, Priority still applies, and
+	// SetShuffle still reorders each snapshot. Lists made with [WithForensicMode]
+	// always keep the order in which entries were added instead.
+	//
+	// The cost is CPU: each failed trial decryption takes roughly 2µs, so a key at
+	// position N always takes about N*2µs to find. With thousands of keys that is
+	// several milliseconds per connection or new UDP association.
+	SetAffinity(enabled bool)
+	// SetConstantTime enables or disables constant-time trial decryption. When
+	// enabled, the list is kept in a fixed order as with SetAffinity(false), and
+	// the TCP and UDP handlers try every cipher in the snapshot even after one
+	// matches. The search then takes about the same time whichever key matches,
+	// or if none does, at the cost of a full scan on every connection and every
+	// UDP packet from a client. With 100 keys a search takes about 200µs, against
+	// about 20µs (TCP) and 8µs (UDP) for returning clients with affinity enabled.
+	SetConstantTime(enabled bool)
+	// ConstantTime reports whether constant-time trial decryption is enabled.
+	ConstantTime() bool
+	// SetShuffle enables or disables shuffling the ciphers of each snapshot, with a
+	// new random seed each time, so the time to find a key doesn't reveal its
+	// position in the list. Ciphers last used by the client IP are still tried first
+	// when affinity is enabled, so returning clients are found as quickly as before,
+	// but other clients' keys are no longer found in most-recently-used order. The
+	// shuffle takes about 15ns per cipher, which doubles the cost of a snapshot (see
+	// BenchmarkSnapshotShuffle), but is small next to a trial decryption. It has no
+	// effect with constant-time trial decryption.
+	SetShuffle(enabled bool)
+	// Statistics returns aggregate statistics about the entries, for health checks.
+	// Entries count as used each time MarkUsedByClientIP is called for them.
+	Statistics() CipherListStats
+}
+
 type cipherList struct {
 	CipherList
 	list *list.List
 	mu   sync.RWMutex
+	// If true, the list order is never changed by MarkUsedByClientIP.
+	fixedOrder bool
+	// If true, every cipher is tried during the search. Implies a fixed order.
+	constantTime bool
+	// If true, snapshots are always in list order, see [WithForensicMode].
+	forensic bool
+	// If true, the ciphers not matched by client IP are shuffled in each snapshot.
+	shuffle     bool
+	observer    CipherListObserver
+	subscribers map[chan CipherListEvent]struct{}
+	// Events dropped because a subscriber's channel was full.
+	droppedEvents int64
+}
+
+// errNoKeys is returned by the access key searches when the cipher list is empty,
+// which usually means that the server is misconfigured.
+var errNoKeys = errors.New("no access keys are loaded")
+
+// Unix time in seconds of the last warning about an empty cipher list.
+var lastNoKeysWarning atomic.Int64
+
+// warnNoKeys logs that a connection arrived while the cipher list is empty, at
+// most once a minute, so that it stands out from a flood of authentication failures.
+func warnNoKeys() {
+	now := time.Now().Unix()
+	last := lastNoKeysWarning.Load()
+	if now-last < 60 || !lastNoKeysWarning.CompareAndSwap(last, now) {
+		return
+	}
+	logger.Warningf("Rejecting connections because no access keys are loaded")
+}
+
+// CipherListOption configures a list made by [NewCipherList] or
+// [NewLimitedCipherList].
+type CipherListOption func(cl *cipherList)
+
+// WithForensicMode makes the snapshots of the list always follow the list order,
+// which is the order in which entries were added with Update and PushBack, or
+// PushFront for those at the front. MarkUsedByClientIP never moves entries, and
+// the client IP, Priority and SetShuffle are ignored, whatever SetAffinity is set
+// to, so that each authentication failure can be attributed to the same position
+// in the list, as intrusion detection needs. Expired entries are still left out.
+// It has the CPU cost of SetAffinity(false).
+func WithForensicMode() CipherListOption {
+	return func(cl *cipherList) {
+		cl.forensic = true
+	}
+}
+
+func newCipherList(opts []CipherListOption) *cipherList {
+	cl := &cipherList{list: list.New()}
+	for _, opt := range opts {
+		opt(cl)
+	}
+	return cl
 }
 
 // NewCipherList creates an empty CipherList
-func NewCipherList() CipherList {
-	return &cipherList{list: list.New()}
+func NewCipherList(opts ...CipherListOption) ManagedCipherList {
+	return newCipherList(opts)
+}
+
+// ErrCapacityExceeded is returned by [LimitedCipherList.TryPushBack] and
+// [LimitedCipherList.TryUpdate] when the list would exceed its maximum size.
+var ErrCapacityExceeded = errors.New("cipher list is full")
+
+// LimitedCipherList is a CipherList that holds at most a fixed number of entries,
+// to bound the memory used by keys that are added programmatically, like one per
+// device.
+type LimitedCipherList interface {
+	ManagedCipherList
+	// TryPushBack adds an entry at the end of the list and returns its element, or
+	// returns [ErrCapacityExceeded] if the list is full. PushBack does the same, but
+	// logs the error and returns a nil element, as does PushFront.
+	TryPushBack(entry *CipherEntry) (*list.Element, error)
+	// TryUpdate replaces the contents of the list like Update, or returns
+	// [ErrCapacityExceeded] and keeps the current contents if `contents` has more
+	// entries than the maximum. Update does the same, but logs the error instead.
+	TryUpdate(contents *list.List) error
+}
+
+type limitedCipherList struct {
+	*cipherList
+	maxSize int
+}
+
+// NewLimitedCipherList creates an empty LimitedCipherList that holds at most
+// `maxSize` entries, or any number if `maxSize` is zero.
+func NewLimitedCipherList(maxSize int, opts ...CipherListOption) LimitedCipherList {
+	return &limitedCipherList{cipherList: newCipherList(opts), maxSize: maxSize}
+}
+
+func (cl *limitedCipherList) TryPushBack(entry *CipherEntry) (*list.Element, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.maxSize > 0 && cl.list.Len() >= cl.maxSize {
+		return nil, fmt.Errorf("%w: the limit is %v keys", ErrCapacityExceeded, cl.maxSize)
+	}
+	return cl.pushBackLocked(entry), nil
+}
+
+func (cl *limitedCipherList) TryUpdate(contents *list.List) error {
+	if cl.maxSize > 0 && contents.Len() > cl.maxSize {
+		return fmt.Errorf("%w: got %v keys, the limit is %v", ErrCapacityExceeded, contents.Len(), cl.maxSize)
+	}
+	cl.cipherList.Update(contents)
+	return nil
+}
+
+func (cl *limitedCipherList) Update(contents *list.List) {
+	if err := cl.TryUpdate(contents); err != nil {
+		logger.Warningf("Keeping the current access keys: %v", err)
+	}
+}
+
+func (cl *limitedCipherList) PushBack(entry *CipherEntry) *list.Element {
+	e, err := cl.TryPushBack(entry)
+	if err != nil {
+		logger.Errorf("Failed to add access key %v: %v", entry.ID, err)
+	}
+	return e
+}
+
+func (cl *limitedCipherList) PushFront(entry *CipherEntry) *list.Element {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.maxSize > 0 && cl.list.Len() >= cl.maxSize {
+		logger.Errorf("Failed to add access key %v: %v: the limit is %v keys", entry.ID, ErrCapacityExceeded, cl.maxSize)
+		return nil
+	}
+	return cl.pushFrontLocked(entry)
+}
+
+func isPinned(e *list.Element) bool {
+	return e.Value.(*CipherEntry).pinned
 }
 
 func matchesIP(e *list.Element, clientIP netip.Addr) bool {
@@ -81,38 +455,348 @@ func matchesIP(e *list.Element, clientIP netip.Addr) bool {
 }
 
 func (cl *cipherList) SnapshotForClientIP(clientIP netip.Addr) []*list.Element {
+	now := time.Now()
 	cl.mu.RLock()
 	defer cl.mu.RUnlock()
 	cipherArray := make([]*list.Element, cl.list.Len())
 	i := 0
+	if cl.forensic {
+		for e := cl.list.Front(); e != nil; e = e.Next() {
+			if !e.Value.(*CipherEntry).expired(now) {
+				cipherArray[i] = e
+				i++
+			}
+		}
+		return cipherArray[:i]
+	}
+	prioritized := false
+	// Pinned ciphers come first, in list order.
+	for e := cl.list.Front(); e != nil; e = e.Next() {
+		if isPinned(e) && !e.Value.(*CipherEntry).expired(now) {
+			cipherArray[i] = e
+			i++
+		}
+	}
+	pinned := i
+	if cl.fixedOrder || cl.constantTime {
+		for e := cl.list.Front(); e != nil; e = e.Next() {
+			if isPinned(e) || e.Value.(*CipherEntry).expired(now) {
+				continue
+			}
+			cipherArray[i] = e
+			prioritized = prioritized || e.Value.(*CipherEntry).Priority != 0
+			i++
+		}
+		cipherArray = cipherArray[:i]
+		if cl.shuffle && !cl.constantTime {
+			shuffleElements(cipherArray[pinned:], rand.Uint64())
+		}
+		if prioritized {
+			// No usage tiebreak, which would undo the fixed order.
+			sortByPriority(cipherArray[pinned:], false)
+		}
+		return cipherArray
+	}
 	// First pass: put all ciphers with matching last known IP at the front.
 	for e := cl.list.Front(); e != nil; e = e.Next() {
+		if isPinned(e) || e.Value.(*CipherEntry).expired(now) {
+			continue
+		}
 		if matchesIP(e, clientIP) {
 			cipherArray[i] = e
 			i++
 		}
+		prioritized = prioritized || e.Value.(*CipherEntry).Priority != 0
 	}
+	matched := i
 	// Second pass: include all remaining ciphers in recency order.
 	for e := cl.list.Front(); e != nil; e = e.Next() {
-		if !matchesIP(e, clientIP) {
+		if !isPinned(e) && !matchesIP(e, clientIP) && !e.Value.(*CipherEntry).expired(now) {
 			cipherArray[i] = e
 			i++
 		}
 	}
+	cipherArray = cipherArray[:i]
+	if cl.shuffle {
+		shuffleElements(cipherArray[matched:], rand.Uint64())
+	}
+	if prioritized {
+		// Nor with the shuffle, which it would undo among keys that were used.
+		byUsage := !cl.shuffle
+		sortByPriority(cipherArray[pinned:matched], byUsage)
+		sortByPriority(cipherArray[matched:], byUsage)
+	}
 	return cipherArray
 }
 
+// sortByPriority sorts `elts` by descending priority and, if `byUsage` is set,
+// descending usage count, keeping the order of entries that are tied.
+func sortByPriority(elts []*list.Element, byUsage bool) {
+	sort.SliceStable(elts, func(i, j int) bool {
+		ci, cj := elts[i].Value.(*CipherEntry), elts[j].Value.(*CipherEntry)
+		if ci.Priority != cj.Priority || !byUsage {
+			return ci.Priority > cj.Priority
+		}
+		return ci.usageCount > cj.usageCount
+	})
+}
+
+// shuffleElements does a Fisher-Yates shuffle of `elts`, using a splitmix64
+// generator with the given seed. It's much cheaper than creating a [rand.Rand]
+// for each snapshot, and the bias of the modulo is negligible for list sizes.
+func shuffleElements(elts []*list.Element, seed uint64) {
+	for i := len(elts) - 1; i > 0; i-- {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		z ^= z >> 31
+		j := int(z % uint64(i+1))
+		elts[i], elts[j] = elts[j], elts[i]
+	}
+}
+
 func (cl *cipherList) MarkUsedByClientIP(e *list.Element, clientIP netip.Addr) {
 	cl.mu.Lock()
 	defer cl.mu.Unlock()
-	cl.list.MoveToFront(e)
-
 	c := e.Value.(*CipherEntry)
+	c.usageCount++
+	c.lastUsed = time.Now()
+	if cl.fixedOrder || cl.constantTime || cl.forensic {
+		return
+	}
+	if c.pinned {
+		// Pinned entries keep their place at the front.
+		c.lastClientIP = clientIP
+		return
+	}
+	// Move the entry to the front, but after the pinned entries.
+	var lastPinned *list.Element
+	for p := cl.list.Front(); p != nil && isPinned(p); p = p.Next() {
+		lastPinned = p
+	}
+	// The moves are no-ops if the element is no longer in the list, which is the
+	// case if it was removed, or the list replaced, after the snapshot was taken.
+	if lastPinned == nil {
+		cl.list.MoveToFront(e)
+		if cl.list.Front() != e {
+			return
+		}
+	} else {
+		cl.list.MoveAfter(e, lastPinned)
+		if e.Prev() != lastPinned {
+			return
+		}
+	}
 	c.lastClientIP = clientIP
 }
 
+// notifyLocked tells the observer and the subscribers about a change. The caller
+// must hold the write lock.
+func (cl *cipherList) notifyLocked(eventType CipherListEventType, entry *CipherEntry) {
+	if cl.observer != nil {
+		if eventType == CipherListEventAdd {
+			cl.observer.OnAdd(*entry)
+		} else {
+			cl.observer.OnRemove(entry.ID)
+		}
+	}
+	for ch := range cl.subscribers {
+		select {
+		case ch <- CipherListEvent{Type: eventType, Entry: *entry}:
+		default:
+			cl.droppedEvents++
+		}
+	}
+}
+
 func (cl *cipherList) Update(src *list.List) {
 	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.observer != nil || len(cl.subscribers) > 0 {
+		for e := cl.list.Front(); e != nil; e = e.Next() {
+			cl.notifyLocked(CipherListEventRemove, e.Value.(*CipherEntry))
+		}
+		for e := src.Front(); e != nil; e = e.Next() {
+			cl.notifyLocked(CipherListEventAdd, e.Value.(*CipherEntry))
+		}
+	}
 	cl.list = src
+}
+
+func (cl *cipherList) PushBack(entry *CipherEntry) *list.Element {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.pushBackLocked(entry)
+}
+
+// pushBackLocked adds an entry at the end of the list. The caller must hold the
+// write lock.
+func (cl *cipherList) pushBackLocked(entry *CipherEntry) *list.Element {
+	cl.notifyLocked(CipherListEventAdd, entry)
+	return cl.list.PushBack(entry)
+}
+
+func (cl *cipherList) PushFront(entry *CipherEntry) *list.Element {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.pushFrontLocked(entry)
+}
+
+// pushFrontLocked pins an entry at the front of the list. The caller must hold the
+// write lock.
+func (cl *cipherList) pushFrontLocked(entry *CipherEntry) *list.Element {
+	entry.pinned = true
+	cl.notifyLocked(CipherListEventAdd, entry)
+	return cl.list.PushFront(entry)
+}
+
+func (cl *cipherList) Len() int {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.list.Len()
+}
+
+func (cl *cipherList) Remove(id string) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for e := cl.list.Front(); e != nil; e = e.Next() {
+		if e.Value.(*CipherEntry).ID == id {
+			cl.list.Remove(e)
+			cl.notifyLocked(CipherListEventRemove, e.Value.(*CipherEntry))
+			return true
+		}
+	}
+	return false
+}
+
+func (cl *cipherList) RemoveExpired() []CipherEntry {
+	return cl.removeExpired(time.Now())
+}
+
+func (cl *cipherList) removeExpired(now time.Time) []CipherEntry {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	var removed []CipherEntry
+	for e := cl.list.Front(); e != nil; {
+		next := e.Next()
+		if entry := e.Value.(*CipherEntry); entry.expired(now) {
+			cl.list.Remove(e)
+			cl.notifyLocked(CipherListEventRemove, entry)
+			removed = append(removed, *entry)
+		}
+		e = next
+	}
+	return removed
+}
+
+// SweepExpiredKeys removes the expired entries of `ciphers` every `interval`, until
+// the returned function is called. `onExpired`, if not nil, is called with each
+// entry that is removed. Expired entries are already unusable before they are
+// removed, so the interval only bounds how long they stay in memory.
+func SweepExpiredKeys(ciphers ManagedCipherList, interval time.Duration, onExpired func(entry CipherEntry)) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for _, entry := range ciphers.RemoveExpired() {
+					if onExpired != nil {
+						onExpired(entry)
+					}
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (cl *cipherList) SetObserver(observer CipherListObserver) {
+	cl.mu.Lock()
+	cl.observer = observer
+	cl.mu.Unlock()
+}
+
+func (cl *cipherList) Subscribe() (<-chan CipherListEvent, func()) {
+	ch := make(chan CipherListEvent, cipherListEventBuffer)
+	cl.mu.Lock()
+	if cl.subscribers == nil {
+		cl.subscribers = make(map[chan CipherListEvent]struct{})
+	}
+	cl.subscribers[ch] = struct{}{}
+	cl.mu.Unlock()
+	cancel := func() {
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+		if _, ok := cl.subscribers[ch]; ok {
+			delete(cl.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+func (cl *cipherList) SetAffinity(enabled bool) {
+	cl.mu.Lock()
+	cl.fixedOrder = !enabled
+	cl.mu.Unlock()
+}
+
+func (cl *cipherList) SetConstantTime(enabled bool) {
+	cl.mu.Lock()
+	cl.constantTime = enabled
+	cl.mu.Unlock()
+}
+
+func (cl *cipherList) SetShuffle(enabled bool) {
+	cl.mu.Lock()
+	cl.shuffle = enabled
 	cl.mu.Unlock()
 }
+
+func (cl *cipherList) ConstantTime() bool {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.constantTime
+}
+
+// isConstantTime reports whether the searches over `ciphers` must try every cipher,
+// which only lists that implement ConstantTime, like [ManagedCipherList], can ask.
+func isConstantTime(ciphers CipherList) bool {
+	ct, ok := ciphers.(interface{ ConstantTime() bool })
+	return ok && ct.ConstantTime()
+}
+
+func (cl *cipherList) Statistics() CipherListStats {
+	return cl.statistics(time.Now())
+}
+
+func (cl *cipherList) statistics(now time.Time) CipherListStats {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	var stats CipherListStats
+	var totalUsage int64
+	for e := cl.list.Front(); e != nil; e = e.Next() {
+		c := e.Value.(*CipherEntry)
+		stats.TotalKeys++
+		totalUsage += c.usageCount
+		if c.usageCount == 0 {
+			stats.NeverUsedKeys++
+		} else if now.Sub(c.lastUsed) < activeKeyPeriod {
+			stats.ActiveKeys++
+		}
+		if c.expired(now) {
+			stats.ExpiredKeys++
+		}
+	}
+	if stats.TotalKeys > 0 {
+		stats.AverageUsageCount = float64(totalUsage) / float64(stats.TotalKeys)
+	}
+	stats.DroppedEvents = cl.droppedEvents
+	return stats
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"sync"
+)
+
+// Event types, as encoded in the HashingObserver input.
+const (
+	hashedAddEvent    byte = 1
+	hashedRemoveEvent byte = 2
+)
+
+// HashingObserver is a [CipherListObserver] that accumulates a running
+// HMAC-SHA256 of every mutation it observes. An auditor holding the same key
+// can verify a claimed sequence of changes by replaying it into a fresh
+// HashingObserver and comparing the sums.
+//
+// Only the event type and the key ID are hashed, never the key material.
+type HashingObserver struct {
+	mu  sync.Mutex
+	mac hash.Hash
+}
+
+var _ CipherListObserver = (*HashingObserver)(nil)
+
+// NewHashingObserver creates a HashingObserver that uses `key` for the HMAC.
+func NewHashingObserver(key []byte) *HashingObserver {
+	return &HashingObserver{mac: hmac.New(sha256.New, key)}
+}
+
+func (o *HashingObserver) write(eventType byte, id string) {
+	// Length-prefix the ID so that the encoding of a sequence of events is unambiguous.
+	buf := make([]byte, 0, 1+4+len(id))
+	buf = append(buf, eventType)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(id)))
+	buf = append(buf, id...)
+	o.mu.Lock()
+	o.mac.Write(buf) // Hash.Write never returns an error.
+	o.mu.Unlock()
+}
+
+func (o *HashingObserver) OnAdd(entry CipherEntry) {
+	o.write(hashedAddEvent, entry.ID)
+}
+
+func (o *HashingObserver) OnRemove(id string) {
+	o.write(hashedRemoveEvent, id)
+}
+
+// Sum returns the HMAC of all the mutations observed so far.
+func (o *HashingObserver) Sum() []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.mac.Sum(nil)
+}
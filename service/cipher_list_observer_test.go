@@ -0,0 +1,167 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"container/list"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordingObserver struct {
+	events []string
+}
+
+func (o *recordingObserver) OnAdd(entry CipherEntry) {
+	o.events = append(o.events, "add "+entry.ID)
+}
+
+func (o *recordingObserver) OnRemove(id string) {
+	o.events = append(o.events, "remove "+id)
+}
+
+func TestCipherListObserverRemoveExpired(t *testing.T) {
+	ciphers := NewCipherList()
+	observer := &recordingObserver{}
+	ciphers.SetObserver(observer)
+	expiresAt := time.Now().Add(-time.Nanosecond)
+	for i := 0; i < 10; i++ {
+		ciphers.PushBack(&CipherEntry{ID: fmt.Sprintf("id-%v", i), ExpiresAt: expiresAt})
+	}
+	observer.events = nil
+
+	require.Len(t, ciphers.RemoveExpired(), 10)
+	require.Equal(t, 0, ciphers.Statistics().TotalKeys)
+	require.Len(t, observer.events, 10)
+	require.Equal(t, "remove id-0", observer.events[0])
+}
+
+func TestCipherListObserver(t *testing.T) {
+	ciphers, err := MakeTestCiphers(makeTestSecrets(2))
+	require.NoError(t, err)
+	observer := &recordingObserver{}
+	ciphers.SetObserver(observer)
+
+	entry := &CipherEntry{ID: "id-2"}
+	elt := ciphers.PushBack(entry)
+	require.Same(t, entry, elt.Value)
+	require.True(t, ciphers.Remove("id-0"))
+	require.False(t, ciphers.Remove("id-0"))
+
+	replacement := list.New()
+	replacement.PushBack(&CipherEntry{ID: "id-3"})
+	ciphers.Update(replacement)
+
+	ciphers.SetObserver(nil)
+	ciphers.PushBack(&CipherEntry{ID: "id-4"})
+
+	require.Equal(t, []string{
+		"add id-2",
+		"remove id-0",
+		"remove id-1", "remove id-2", "add id-3",
+	}, observer.events)
+	require.Equal(t, []string{"id-3", "id-4"}, snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{})))
+}
+
+func eventStrings(events <-chan CipherListEvent) []string {
+	var out []string
+	for event := range events {
+		switch event.Type {
+		case CipherListEventAdd:
+			out = append(out, "add "+event.Entry.ID)
+		case CipherListEventRemove:
+			out = append(out, "remove "+event.Entry.ID)
+		}
+	}
+	return out
+}
+
+func TestCipherListSubscribe(t *testing.T) {
+	ciphers, err := MakeTestCiphers(makeTestSecrets(2))
+	require.NoError(t, err)
+	events, cancel := ciphers.Subscribe()
+
+	ciphers.PushBack(&CipherEntry{ID: "id-2"})
+	require.True(t, ciphers.Remove("id-0"))
+	require.False(t, ciphers.Remove("id-0"))
+	replacement := list.New()
+	replacement.PushBack(&CipherEntry{ID: "id-3"})
+	ciphers.Update(replacement)
+
+	cancel()
+	cancel()
+	ciphers.PushBack(&CipherEntry{ID: "id-4"})
+
+	require.Equal(t, []string{
+		"add id-2",
+		"remove id-0",
+		"remove id-1", "remove id-2", "add id-3",
+	}, eventStrings(events))
+	require.Zero(t, ciphers.Statistics().DroppedEvents)
+}
+
+func TestCipherListSubscribeDropsWhenFull(t *testing.T) {
+	ciphers, err := MakeTestCiphers(nil)
+	require.NoError(t, err)
+	slow, cancelSlow := ciphers.Subscribe()
+	fast, cancelFast := ciphers.Subscribe()
+
+	var fastEvents []CipherListEvent
+	for i := 0; i < cipherListEventBuffer+5; i++ {
+		ciphers.PushBack(&CipherEntry{ID: "id"})
+		fastEvents = append(fastEvents, <-fast)
+	}
+	cancelSlow()
+	cancelFast()
+
+	require.Len(t, fastEvents, cipherListEventBuffer+5)
+	require.Len(t, eventStrings(slow), cipherListEventBuffer)
+	require.Empty(t, eventStrings(fast))
+	require.Equal(t, int64(5), ciphers.Statistics().DroppedEvents)
+}
+
+func TestHashingObserver(t *testing.T) {
+	key := []byte("audit key")
+	a := NewHashingObserver(key)
+	a.OnAdd(CipherEntry{ID: "id-0"})
+	a.OnRemove("id-0")
+
+	b := NewHashingObserver(key)
+	b.OnAdd(CipherEntry{ID: "id-0"})
+	b.OnRemove("id-0")
+	require.Equal(t, a.Sum(), b.Sum())
+
+	reordered := NewHashingObserver(key)
+	reordered.OnRemove("id-0")
+	reordered.OnAdd(CipherEntry{ID: "id-0"})
+	require.NotEqual(t, a.Sum(), reordered.Sum())
+
+	// The length prefix keeps the ID boundaries unambiguous.
+	split := NewHashingObserver(key)
+	split.OnAdd(CipherEntry{ID: "id-0id-1"})
+	joined := NewHashingObserver(key)
+	joined.OnAdd(CipherEntry{ID: "id-0"})
+	joined.OnAdd(CipherEntry{ID: "id-1"})
+	require.NotEqual(t, split.Sum(), joined.Sum())
+
+	otherKey := NewHashingObserver([]byte("other key"))
+	otherKey.OnAdd(CipherEntry{ID: "id-0"})
+	otherKey.OnRemove("id-0")
+	require.NotEqual(t, a.Sum(), otherKey.Sum())
+}
@@ -15,11 +15,335 @@
 package service
 
 import (
+	"bytes"
+	"container/list"
+	"encoding/hex"
+	"fmt"
 	"math/rand"
 	"net/netip"
 	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/stretchr/testify/require"
 )
 
+func snapshotIDs(elts []*list.Element) []string {
+	ids := make([]string, len(elts))
+	for i, e := range elts {
+		ids[i] = e.Value.(*CipherEntry).ID
+	}
+	return ids
+}
+
+func TestCipherListAffinity(t *testing.T) {
+	ciphers, err := MakeTestCiphers(makeTestSecrets(3))
+	require.NoError(t, err)
+	clientIP := netip.MustParseAddr("192.0.2.1")
+	otherIP := netip.MustParseAddr("192.0.2.2")
+
+	snapshot := ciphers.SnapshotForClientIP(clientIP)
+	require.Equal(t, []string{"id-0", "id-1", "id-2"}, snapshotIDs(snapshot))
+	ciphers.MarkUsedByClientIP(snapshot[2], clientIP)
+	ciphers.MarkUsedByClientIP(snapshot[1], otherIP)
+
+	// The cipher last used by this IP comes first, then the rest by recency.
+	require.Equal(t, []string{"id-2", "id-1", "id-0"}, snapshotIDs(ciphers.SnapshotForClientIP(clientIP)))
+	require.Equal(t, []string{"id-1", "id-2", "id-0"}, snapshotIDs(ciphers.SnapshotForClientIP(otherIP)))
+}
+
+func TestCipherListPushFront(t *testing.T) {
+	ciphers, err := MakeTestCiphers(makeTestSecrets(3))
+	require.NoError(t, err)
+	clientIP := netip.MustParseAddr("192.0.2.1")
+	ciphers.PushBack(&CipherEntry{ID: "high", Priority: 1})
+	ciphers.PushFront(&CipherEntry{ID: "master"})
+	require.Equal(t, 5, ciphers.Len())
+
+	snapshot := ciphers.SnapshotForClientIP(clientIP)
+	require.Equal(t, []string{"master", "high", "id-0", "id-1", "id-2"}, snapshotIDs(snapshot))
+
+	// A key used by the client moves up, but not ahead of the pinned key.
+	ciphers.MarkUsedByClientIP(snapshot[4], clientIP)
+	require.Equal(t, []string{"master", "id-2", "high", "id-0", "id-1"}, snapshotIDs(ciphers.SnapshotForClientIP(clientIP)))
+	require.Equal(t, []string{"master", "high", "id-2", "id-0", "id-1"}, snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{})))
+
+	// Using the pinned key doesn't move it either.
+	ciphers.MarkUsedByClientIP(snapshot[0], clientIP)
+	require.Equal(t, "master", snapshotIDs(ciphers.SnapshotForClientIP(clientIP))[0])
+
+	// Nor do the fixed order and the shuffle.
+	ciphers.SetAffinity(false)
+	ciphers.SetShuffle(true)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, "master", snapshotIDs(ciphers.SnapshotForClientIP(clientIP))[0])
+	}
+}
+
+func TestCipherListNoAffinity(t *testing.T) {
+	ciphers, err := MakeTestCiphers(makeTestSecrets(3))
+	require.NoError(t, err)
+	ciphers.SetAffinity(false)
+	clientIP := netip.MustParseAddr("192.0.2.1")
+
+	snapshot := ciphers.SnapshotForClientIP(clientIP)
+	ciphers.MarkUsedByClientIP(snapshot[2], clientIP)
+	ciphers.MarkUsedByClientIP(snapshot[1], clientIP)
+
+	require.Equal(t, []string{"id-0", "id-1", "id-2"}, snapshotIDs(ciphers.SnapshotForClientIP(clientIP)))
+	require.Equal(t, []string{"id-0", "id-1", "id-2"}, snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{})))
+}
+
+func TestCipherListForensicMode(t *testing.T) {
+	for _, ciphers := range []ManagedCipherList{NewCipherList(WithForensicMode()), NewLimitedCipherList(10, WithForensicMode())} {
+		for i := 0; i < 4; i++ {
+			ciphers.PushBack(&CipherEntry{ID: fmt.Sprintf("id-%v", i)})
+		}
+		clientIP := netip.MustParseAddr("192.0.2.1")
+		snapshot := ciphers.SnapshotForClientIP(clientIP)
+		require.Equal(t, []string{"id-0", "id-1", "id-2", "id-3"}, snapshotIDs(snapshot))
+		snapshot[2].Value.(*CipherEntry).Priority = 100
+
+		// Neither usage, priorities, affinity nor the shuffle change the order.
+		ciphers.MarkUsedByClientIP(snapshot[3], clientIP)
+		ciphers.MarkUsedByClientIP(snapshot[1], netip.MustParseAddr("192.0.2.2"))
+		ciphers.SetAffinity(true)
+		ciphers.SetShuffle(true)
+		for i := 0; i < 10; i++ {
+			require.Equal(t, []string{"id-0", "id-1", "id-2", "id-3"}, snapshotIDs(ciphers.SnapshotForClientIP(clientIP)))
+		}
+		require.Equal(t, 2, ciphers.Statistics().NeverUsedKeys)
+	}
+}
+
+func TestCipherListMarkUsedAfterUpdate(t *testing.T) {
+	ciphers, err := MakeTestCiphers(makeTestSecrets(2))
+	require.NoError(t, err)
+	clientIP := netip.MustParseAddr("192.0.2.1")
+	stale := ciphers.SnapshotForClientIP(clientIP)
+
+	// Rotate the key material of id-1.
+	rotated := list.New()
+	for i, secret := range []string{"secret-0", "rotated"} {
+		cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secret)
+		require.NoError(t, err)
+		entry := MakeCipherEntry(fmt.Sprintf("id-%v", i), cryptoKey, secret)
+		rotated.PushBack(&entry)
+	}
+	ciphers.Update(rotated)
+
+	// Marking an entry from before the update has no effect on the new list.
+	ciphers.MarkUsedByClientIP(stale[1], clientIP)
+	require.Equal(t, []string{"id-0", "id-1"}, snapshotIDs(ciphers.SnapshotForClientIP(clientIP)))
+	require.False(t, stale[1].Value.(*CipherEntry).lastClientIP.IsValid())
+
+	// Same for an entry that was removed.
+	current := ciphers.SnapshotForClientIP(clientIP)
+	require.True(t, ciphers.Remove("id-1"))
+	ciphers.MarkUsedByClientIP(current[1], clientIP)
+	require.Equal(t, []string{"id-0"}, snapshotIDs(ciphers.SnapshotForClientIP(clientIP)))
+}
+
+func TestCipherListShuffle(t *testing.T) {
+	ciphers, err := MakeTestCiphers(makeTestSecrets(20))
+	require.NoError(t, err)
+	ciphers.SetShuffle(true)
+	clientIP := netip.MustParseAddr("192.0.2.1")
+	snapshot := ciphers.SnapshotForClientIP(clientIP)
+	ciphers.MarkUsedByClientIP(snapshot[10], clientIP)
+	lastUsed := snapshot[10].Value.(*CipherEntry).ID
+
+	orders := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		ids := snapshotIDs(ciphers.SnapshotForClientIP(clientIP))
+		// The cipher last used by this IP stays first.
+		require.Equal(t, lastUsed, ids[0])
+		require.ElementsMatch(t, snapshotIDs(snapshot), ids)
+		orders[fmt.Sprint(ids)] = true
+	}
+	require.Greater(t, len(orders), 1)
+
+	// Without affinity, the whole list is shuffled.
+	ciphers.SetAffinity(false)
+	firsts := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		firsts[snapshotIDs(ciphers.SnapshotForClientIP(clientIP))[0]] = true
+	}
+	require.Greater(t, len(firsts), 1)
+
+	// Constant time keeps the order fixed.
+	ciphers.SetShuffle(false)
+	fixed := snapshotIDs(ciphers.SnapshotForClientIP(clientIP))
+	ciphers.SetShuffle(true)
+	ciphers.SetConstantTime(true)
+	require.Equal(t, fixed, snapshotIDs(ciphers.SnapshotForClientIP(clientIP)))
+}
+
+func TestCipherListPriority(t *testing.T) {
+	ciphers, err := MakeTestCiphers(makeTestSecrets(4))
+	require.NoError(t, err)
+	clientIP := netip.MustParseAddr("192.0.2.1")
+	snapshot := ciphers.SnapshotForClientIP(clientIP)
+	snapshot[3].Value.(*CipherEntry).Priority = 100
+	snapshot[2].Value.(*CipherEntry).Priority = -1
+
+	// The default key comes before the more recently used id-1, and id-2 comes last.
+	ciphers.MarkUsedByClientIP(snapshot[1], netip.MustParseAddr("192.0.2.2"))
+	require.Equal(t, []string{"id-3", "id-1", "id-0", "id-2"}, snapshotIDs(ciphers.SnapshotForClientIP(clientIP)))
+
+	// The key last used by the client's IP still comes first.
+	ciphers.MarkUsedByClientIP(snapshot[2], clientIP)
+	require.Equal(t, []string{"id-2", "id-3", "id-1", "id-0"}, snapshotIDs(ciphers.SnapshotForClientIP(clientIP)))
+
+	// Priorities also apply without affinity.
+	ciphers.SetAffinity(false)
+	require.Equal(t, []string{"id-3", "id-1", "id-0", "id-2"}, snapshotIDs(ciphers.SnapshotForClientIP(clientIP)))
+}
+
+func TestCipherListPriorityUsageTiebreak(t *testing.T) {
+	ciphers, err := MakeTestCiphers(makeTestSecrets(3))
+	require.NoError(t, err)
+	snapshot := ciphers.SnapshotForClientIP(netip.Addr{})
+	snapshot[0].Value.(*CipherEntry).Priority = 1
+	snapshot[1].Value.(*CipherEntry).Priority = 1
+
+	// id-0 is used more, but id-1 more recently. Keys of the same priority are
+	// ordered by usage, not recency.
+	otherIP := netip.MustParseAddr("192.0.2.2")
+	ciphers.MarkUsedByClientIP(snapshot[0], otherIP)
+	ciphers.MarkUsedByClientIP(snapshot[0], otherIP)
+	ciphers.MarkUsedByClientIP(snapshot[1], otherIP)
+	ciphers.MarkUsedByClientIP(snapshot[2], otherIP)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, []string{"id-0", "id-1", "id-2"}, snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{})))
+	}
+
+	// Once id-1 is used more, it comes first.
+	ciphers.MarkUsedByClientIP(snapshot[1], otherIP)
+	ciphers.MarkUsedByClientIP(snapshot[1], otherIP)
+	require.Equal(t, []string{"id-1", "id-0", "id-2"}, snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{})))
+}
+
+func TestCipherListUsageTiebreakScope(t *testing.T) {
+	// newList returns a list of `n` keys where id-1 was used twice, and then id-0
+	// once, with all the keys at priority `priority`.
+	newList := func(n, priority int, configure func(ciphers ManagedCipherList)) ManagedCipherList {
+		ciphers, err := MakeTestCiphers(makeTestSecrets(n))
+		require.NoError(t, err)
+		configure(ciphers)
+		snapshot := ciphers.SnapshotForClientIP(netip.Addr{})
+		for _, e := range snapshot {
+			e.Value.(*CipherEntry).Priority = priority
+		}
+		otherIP := netip.MustParseAddr("192.0.2.2")
+		ciphers.MarkUsedByClientIP(snapshot[1], otherIP)
+		ciphers.MarkUsedByClientIP(snapshot[1], otherIP)
+		ciphers.MarkUsedByClientIP(snapshot[0], otherIP)
+		return ciphers
+	}
+	noChange := func(ciphers ManagedCipherList) {}
+
+	// With affinity and a priority, the most used key comes first.
+	ciphers := newList(3, 1, noChange)
+	require.Equal(t, []string{"id-1", "id-0", "id-2"}, snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{})))
+
+	// Without priorities, the most recently used key does.
+	ciphers = newList(3, 0, noChange)
+	require.Equal(t, []string{"id-0", "id-1", "id-2"}, snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{})))
+
+	// Without affinity, and in constant-time mode, the list order is kept.
+	ciphers = newList(3, 1, func(ciphers ManagedCipherList) { ciphers.SetAffinity(false) })
+	require.Equal(t, []string{"id-0", "id-1", "id-2"}, snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{})))
+	ciphers = newList(3, 1, func(ciphers ManagedCipherList) { ciphers.SetConstantTime(true) })
+	require.Equal(t, []string{"id-0", "id-1", "id-2"}, snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{})))
+
+	// With the shuffle, the most used key isn't always first.
+	ciphers = newList(20, 1, func(ciphers ManagedCipherList) { ciphers.SetShuffle(true) })
+	firsts := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		firsts[snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{}))[0]] = true
+	}
+	require.Greater(t, len(firsts), 1)
+}
+
+func TestLimitedCipherList(t *testing.T) {
+	const maxSize = 3
+	ciphers := NewLimitedCipherList(maxSize)
+	for i := 0; i < maxSize; i++ {
+		e, err := ciphers.TryPushBack(&CipherEntry{ID: fmt.Sprintf("id-%v", i)})
+		require.NoError(t, err)
+		require.NotNil(t, e)
+	}
+
+	e, err := ciphers.TryPushBack(&CipherEntry{ID: "id-extra"})
+	require.ErrorIs(t, err, ErrCapacityExceeded)
+	require.Nil(t, e)
+	require.Nil(t, ciphers.PushBack(&CipherEntry{ID: "id-extra"}))
+	require.Equal(t, maxSize, ciphers.Len())
+	require.Equal(t, []string{"id-0", "id-1", "id-2"}, snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{})))
+
+	// Removing an entry makes room for another.
+	require.True(t, ciphers.Remove("id-0"))
+	_, err = ciphers.TryPushBack(&CipherEntry{ID: "id-3"})
+	require.NoError(t, err)
+	require.Equal(t, maxSize, ciphers.Len())
+
+	// Updates that are too large keep the current contents.
+	contents := list.New()
+	for i := 0; i <= maxSize; i++ {
+		contents.PushBack(&CipherEntry{ID: fmt.Sprintf("new-%v", i)})
+	}
+	require.ErrorIs(t, ciphers.TryUpdate(contents), ErrCapacityExceeded)
+	ciphers.Update(contents)
+	require.Equal(t, []string{"id-1", "id-2", "id-3"}, snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{})))
+	contents.Remove(contents.Back())
+	require.NoError(t, ciphers.TryUpdate(contents))
+	require.Equal(t, []string{"new-0", "new-1", "new-2"}, snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{})))
+}
+
+func TestLimitedCipherListFullThroughManagedCipherList(t *testing.T) {
+	// Callers that only know the ManagedCipherList interface get a nil element, and
+	// the list is left as it was.
+	var ciphers ManagedCipherList = NewLimitedCipherList(1)
+	require.NotNil(t, ciphers.PushBack(&CipherEntry{ID: "id-0"}))
+	require.Nil(t, ciphers.PushBack(&CipherEntry{ID: "id-1"}))
+	require.Nil(t, ciphers.PushFront(&CipherEntry{ID: "id-2"}))
+	require.Equal(t, 1, ciphers.Len())
+	require.Equal(t, []string{"id-0"}, snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{})))
+
+	// The error is available to callers that check for a LimitedCipherList.
+	limited, ok := ciphers.(LimitedCipherList)
+	require.True(t, ok)
+	_, err := limited.TryPushBack(&CipherEntry{ID: "id-1"})
+	require.ErrorIs(t, err, ErrCapacityExceeded)
+}
+
+func TestLimitedCipherListUnlimited(t *testing.T) {
+	ciphers := NewLimitedCipherList(0)
+	for i := 0; i < 100; i++ {
+		_, err := ciphers.TryPushBack(&CipherEntry{ID: fmt.Sprintf("id-%v", i)})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 100, ciphers.Len())
+}
+
+func TestCipherName(t *testing.T) {
+	for _, name := range []string{"chacha20-ietf-poly1305", "aes-256-gcm", "aes-192-gcm", "aes-128-gcm"} {
+		key, err := shadowsocks.NewEncryptionKey(name, "secret")
+		require.NoError(t, err)
+		found, ok := CipherName(key)
+		require.True(t, ok)
+		require.Equal(t, name, found)
+	}
+
+	// IETF names map to the same ciphers.
+	key, err := shadowsocks.NewEncryptionKey(shadowsocks.AES256GCM, "secret")
+	require.NoError(t, err)
+	found, ok := CipherName(key)
+	require.True(t, ok)
+	require.Equal(t, "aes-256-gcm", found)
+}
+
 func BenchmarkLocking(b *testing.B) {
 	var ip netip.Addr
 
@@ -34,6 +358,14 @@ func BenchmarkLocking(b *testing.B) {
 }
 
 func BenchmarkSnapshot(b *testing.B) {
+	benchmarkSnapshot(b, false)
+}
+
+func BenchmarkSnapshotShuffle(b *testing.B) {
+	benchmarkSnapshot(b, true)
+}
+
+func benchmarkSnapshot(b *testing.B, shuffle bool) {
 	// Create a list of cipher entries in a random order.
 
 	// Small cipher lists (N~1e3) fit entirely in cache, and are ~10 times
@@ -52,6 +384,7 @@ func BenchmarkSnapshot(b *testing.B) {
 		// (actually in reverse, but it doesn't matter).
 		ciphers.MarkUsedByClientIP(entry, netip.Addr{})
 	}
+	ciphers.SetShuffle(shuffle)
 
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
@@ -60,3 +393,132 @@ func BenchmarkSnapshot(b *testing.B) {
 		}
 	})
 }
+
+func TestCipherListStatistics(t *testing.T) {
+	ciphers, err := MakeTestCiphers(makeTestSecrets(4))
+	require.NoError(t, err)
+	require.Equal(t, CipherListStats{TotalKeys: 4, NeverUsedKeys: 4}, ciphers.Statistics())
+
+	clientIP := netip.MustParseAddr("192.0.2.1")
+	snapshot := ciphers.SnapshotForClientIP(clientIP)
+	entries := make(map[string]*CipherEntry)
+	for _, e := range snapshot {
+		entries[e.Value.(*CipherEntry).ID] = e.Value.(*CipherEntry)
+	}
+	now := time.Now()
+	// id-0 is used now, id-1 was used two days ago, id-2 is expired and id-3 is never used.
+	ciphers.MarkUsedByClientIP(snapshot[0], clientIP)
+	ciphers.MarkUsedByClientIP(snapshot[0], clientIP)
+	ciphers.MarkUsedByClientIP(snapshot[1], clientIP)
+	entries["id-1"].lastUsed = now.Add(-48 * time.Hour)
+	ciphers.MarkUsedByClientIP(snapshot[2], clientIP)
+	entries["id-2"].ExpiresAt = now.Add(-time.Minute)
+	entries["id-3"].ExpiresAt = now.Add(time.Minute)
+
+	require.Equal(t, CipherListStats{
+		TotalKeys:         4,
+		ActiveKeys:        2,
+		NeverUsedKeys:     1,
+		ExpiredKeys:       1,
+		AverageUsageCount: 1,
+	}, ciphers.(*cipherList).statistics(now))
+}
+
+func TestCipherEntryMetricsName(t *testing.T) {
+	entry := CipherEntry{ID: "id-0"}
+	require.Equal(t, "id-0", entry.MetricsName())
+	entry.DisplayName = "alice"
+	require.Equal(t, "alice", entry.MetricsName())
+}
+
+func TestValidateSecret(t *testing.T) {
+	require.NoError(t, ValidateSecret("secret-0"))
+	require.NoError(t, ValidateSecret("Qx8Jj1cN2YfRgKd7sVbT9w"))
+	for _, secret := range []string{"", "short", "aaaaaaaaaaaa", "abababababab", "abcabcabc"} {
+		require.Error(t, ValidateSecret(secret), "secret %q", secret)
+	}
+}
+
+// Ciphertexts of "test vector" with secret-0 and the salt 00 01 ... 1f.
+const (
+	testVectorPacket = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+		"a45d53130b497e782db874ee5ba94f71dad1ee8eed69d7cca2588d"
+	testVectorStream = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+		"d0330b2111ad94ac40f817cf15adad0520314cae9c4545b49c3e2a07d5c0aa75f93a4b28b9e011aec62819744c"
+)
+
+func makeTestVectorKey(t *testing.T) (*shadowsocks.EncryptionKey, []byte) {
+	key, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, "secret-0")
+	require.NoError(t, err)
+	salt := make([]byte, key.SaltSize())
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+	return key, salt
+}
+
+func TestPackWithTestSalt(t *testing.T) {
+	key, salt := makeTestVectorKey(t)
+	pkt, err := PackWithTestSalt(make([]byte, 100), []byte("test vector"), key, salt)
+	require.NoError(t, err)
+	require.Equal(t, testVectorPacket, hex.EncodeToString(pkt))
+
+	plaintext, err := shadowsocks.Unpack(nil, pkt, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("test vector"), plaintext)
+
+	_, err = PackWithTestSalt(make([]byte, 100), nil, key, salt[1:])
+	require.Error(t, err)
+	_, err = PackWithTestSalt(make([]byte, 50), []byte("test vector"), key, salt)
+	require.Error(t, err)
+}
+
+func TestTestSaltGenerator(t *testing.T) {
+	key, salt := makeTestVectorKey(t)
+	var ciphertext bytes.Buffer
+	writer := shadowsocks.NewWriter(&ciphertext, key)
+	writer.SetSaltGenerator(NewTestSaltGenerator(salt))
+	_, err := writer.Write([]byte("test vector"))
+	require.NoError(t, err)
+	require.Equal(t, testVectorStream, hex.EncodeToString(ciphertext.Bytes()))
+
+	require.Error(t, NewTestSaltGenerator(salt).GetSalt(make([]byte, 16)))
+}
+
+func TestCipherListExpiry(t *testing.T) {
+	ciphers, err := MakeTestCiphers(makeTestSecrets(3))
+	require.NoError(t, err)
+	snapshot := ciphers.SnapshotForClientIP(netip.Addr{})
+	snapshot[0].Value.(*CipherEntry).ExpiresAt = time.Now().Add(-time.Minute)
+	snapshot[2].Value.(*CipherEntry).ExpiresAt = time.Now().Add(time.Hour)
+
+	// Expired keys are skipped by the search, in any mode.
+	require.Equal(t, []string{"id-1", "id-2"}, snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{})))
+	ciphers.SetAffinity(false)
+	require.Equal(t, []string{"id-1", "id-2"}, snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{})))
+
+	removed := ciphers.(*cipherList).removeExpired(time.Now())
+	require.Len(t, removed, 1)
+	require.Equal(t, "id-0", removed[0].ID)
+	require.Equal(t, 2, ciphers.Statistics().TotalKeys)
+
+	removed = ciphers.(*cipherList).removeExpired(time.Now().Add(2 * time.Hour))
+	require.Len(t, removed, 1)
+	require.Equal(t, "id-2", removed[0].ID)
+	require.Equal(t, []string{"id-1"}, snapshotIDs(ciphers.SnapshotForClientIP(netip.Addr{})))
+}
+
+func TestSweepExpiredKeys(t *testing.T) {
+	ciphers, err := MakeTestCiphers(makeTestSecrets(2))
+	require.NoError(t, err)
+	ciphers.SnapshotForClientIP(netip.Addr{})[1].Value.(*CipherEntry).ExpiresAt = time.Now().Add(-time.Minute)
+
+	expired := make(chan string, 2)
+	stop := SweepExpiredKeys(ciphers, time.Millisecond, func(entry CipherEntry) {
+		expired <- entry.ID
+	})
+	defer stop()
+	require.Equal(t, "id-1", <-expired)
+	stop()
+	require.Equal(t, 1, ciphers.Statistics().TotalKeys)
+}
@@ -17,17 +17,37 @@ package service
 import (
 	"container/list"
 	"fmt"
+	"io"
 
 	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
 )
 
 // MakeTestCiphers creates a CipherList containing one fresh AEAD cipher
 // for each secret in `secrets`.
-func MakeTestCiphers(secrets []string) (CipherList, error) {
+func MakeTestCiphers(secrets []string) (ManagedCipherList, error) {
+	return makeTestCiphersOfType(shadowsocks.CHACHA20IETFPOLY1305, secrets)
+}
+
+// MakeTestCiphersAllTypes is like [MakeTestCiphers], but returns one CipherList for
+// each of chacha20-ietf-poly1305, aes-128-gcm and aes-256-gcm, in that order, so
+// that tests can check every cipher type.
+func MakeTestCiphersAllTypes(secrets []string) ([]ManagedCipherList, error) {
+	var lists []ManagedCipherList
+	for _, cipherType := range []string{shadowsocks.CHACHA20IETFPOLY1305, shadowsocks.AES128GCM, shadowsocks.AES256GCM} {
+		cipherList, err := makeTestCiphersOfType(cipherType, secrets)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, cipherList)
+	}
+	return lists, nil
+}
+
+func makeTestCiphersOfType(cipherType string, secrets []string) (ManagedCipherList, error) {
 	l := list.New()
 	for i := 0; i < len(secrets); i++ {
 		cipherID := fmt.Sprintf("id-%v", i)
-		cipher, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[i])
+		cipher, err := shadowsocks.NewEncryptionKey(cipherType, secrets[i])
 		if err != nil {
 			return nil, fmt.Errorf("failed to create cipher %v: %w", i, err)
 		}
@@ -56,3 +76,47 @@ func makeTestSecrets(n int) []string {
 	}
 	return secrets
 }
+
+// fixedSaltGenerator outputs the same salt every time.
+type fixedSaltGenerator struct {
+	salt []byte
+}
+
+func (g fixedSaltGenerator) GetSalt(salt []byte) error {
+	if len(salt) != len(g.salt) {
+		return fmt.Errorf("salt has %v bytes, want %v", len(g.salt), len(salt))
+	}
+	copy(salt, g.salt)
+	return nil
+}
+
+// NewTestSaltGenerator returns a SaltGenerator that always outputs `salt`, which
+// makes the output of a shadowsocks.Writer deterministic. This is only meant for
+// generating test vectors. Never use it in production: reusing a salt exposes the
+// plaintext and the key.
+func NewTestSaltGenerator(salt []byte) shadowsocks.SaltGenerator {
+	return fixedSaltGenerator{salt}
+}
+
+// PackWithTestSalt is like shadowsocks.Pack, but encrypts the packet with `salt`
+// instead of a random salt. Like NewTestSaltGenerator, it's only safe for tests.
+func PackWithTestSalt(dst, plaintext []byte, key *shadowsocks.EncryptionKey, salt []byte) ([]byte, error) {
+	saltSize := key.SaltSize()
+	if len(salt) != saltSize {
+		return nil, fmt.Errorf("salt has %v bytes, want %v", len(salt), saltSize)
+	}
+	if len(dst) < saltSize {
+		return nil, io.ErrShortBuffer
+	}
+	copy(dst, salt)
+	aead, err := key.NewAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(dst) < saltSize+len(plaintext)+aead.Overhead() {
+		return nil, io.ErrShortBuffer
+	}
+	// Each packet has its own salt, so the nonce is always zero.
+	nonce := make([]byte, aead.NonceSize())
+	return aead.Seal(dst[:saltSize], nonce, plaintext, nil), nil
+}
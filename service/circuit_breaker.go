@@ -0,0 +1,86 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// maxCircuitBreakerTargets bounds the memory used by a circuit breaker. Failures
+// to targets beyond the limit are not tracked, so their circuits never open.
+const maxCircuitBreakerTargets = 10000
+
+type circuitState struct {
+	// Consecutive failed dials.
+	failures int
+	// While the circuit is open, dials are rejected until this time.
+	openUntil time.Time
+}
+
+// circuitBreaker rejects dials to a target after `threshold` consecutive failures,
+// for `resetInterval`. After that, the next dial is let through as a trial: if it
+// fails, the circuit opens again, and if it succeeds, it closes.
+type circuitBreaker struct {
+	threshold     int
+	resetInterval time.Duration
+	// Stubbable for testing.
+	now func() time.Time
+
+	mu      sync.Mutex
+	targets map[string]*circuitState
+}
+
+func newCircuitBreaker(threshold int, resetInterval time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold:     threshold,
+		resetInterval: resetInterval,
+		now:           time.Now,
+		targets:       make(map[string]*circuitState),
+	}
+}
+
+// Allow reports whether a dial to `target` may proceed.
+func (b *circuitBreaker) Allow(target string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.targets[target]
+	return state == nil || !b.now().Before(state.openUntil)
+}
+
+// Record updates the state of `target` with the result of a dial, and reports
+// whether it opened the circuit.
+func (b *circuitBreaker) Record(target string, dialErr error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.targets[target]
+	if dialErr == nil {
+		delete(b.targets, target)
+		return false
+	}
+	if state == nil {
+		if len(b.targets) >= maxCircuitBreakerTargets {
+			return false
+		}
+		state = &circuitState{}
+		b.targets[target] = state
+	}
+	state.failures++
+	if state.failures < b.threshold {
+		return false
+	}
+	state.openUntil = b.now().Add(b.resetInterval)
+	return true
+}
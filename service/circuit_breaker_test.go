@@ -0,0 +1,54 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := newCircuitBreaker(2, time.Minute)
+	now := time.Unix(1700000000, 0)
+	breaker.now = func() time.Time { return now }
+	dialErr := errors.New("connection refused")
+
+	// A success resets the count of failures.
+	require.False(t, breaker.Record("a:80", dialErr))
+	require.False(t, breaker.Record("a:80", nil))
+	require.False(t, breaker.Record("a:80", dialErr))
+	require.True(t, breaker.Allow("a:80"))
+
+	require.True(t, breaker.Record("a:80", dialErr))
+	require.False(t, breaker.Allow("a:80"))
+	// Other targets are not affected.
+	require.True(t, breaker.Allow("b:80"))
+
+	// After the reset interval, a failed trial opens the circuit again.
+	now = now.Add(time.Minute)
+	require.True(t, breaker.Allow("a:80"))
+	require.True(t, breaker.Record("a:80", dialErr))
+	require.False(t, breaker.Allow("a:80"))
+
+	// And a successful trial closes it.
+	now = now.Add(time.Minute)
+	require.True(t, breaker.Allow("a:80"))
+	require.False(t, breaker.Record("a:80", nil))
+	require.True(t, breaker.Allow("a:80"))
+	require.False(t, breaker.Record("a:80", dialErr))
+}
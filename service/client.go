@@ -0,0 +1,67 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+)
+
+// Client dials target addresses through a Shadowsocks proxy, with a cipher that
+// can be changed while it's in use, as long-lived clients like mobile apps may
+// need to.
+type Client interface {
+	transport.StreamDialer
+	// SetCipher switches to `cipherName`, with the same secret, for the connections
+	// dialed after it returns. Open connections keep their cipher. It returns an
+	// error, and keeps the current cipher, if `cipherName` isn't supported.
+	SetCipher(cipherName string) error
+}
+
+type ssClient struct {
+	endpoint transport.StreamEndpoint
+	secret   string
+	key      atomic.Pointer[shadowsocks.EncryptionKey]
+}
+
+// NewClient creates a [Client] of the proxy at `proxyAddr`, with the access key
+// made of `cipherName` and `secret`.
+func NewClient(proxyAddr string, cipherName string, secret string) (Client, error) {
+	c := &ssClient{endpoint: &transport.TCPEndpoint{Address: proxyAddr}, secret: secret}
+	if err := c.SetCipher(cipherName); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *ssClient) SetCipher(cipherName string) error {
+	key, err := shadowsocks.NewEncryptionKey(cipherName, c.secret)
+	if err != nil {
+		return err
+	}
+	c.key.Store(key)
+	return nil
+}
+
+func (c *ssClient) DialStream(ctx context.Context, targetAddr string) (transport.StreamConn, error) {
+	dialer, err := shadowsocks.NewStreamDialer(c.endpoint, c.key.Load())
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DialStream(ctx, targetAddr)
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"compress/flate"
+	"context"
+	"io"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+// compressedConn compresses the data written to a StreamConn, and decompresses
+// the data read from it.
+type compressedConn struct {
+	transport.StreamConn
+	w *flate.Writer
+	r io.ReadCloser
+}
+
+// NewCompressedConn wraps a connection to a peer that also uses NewCompressedConn,
+// so that the data in both directions is DEFLATE-compressed on the wire. It's meant
+// for the plaintext leg between the proxy and the next hop of a chain, when both are
+// run by the same operator, to save bandwidth on text-heavy traffic. Ordinary
+// targets don't understand the compressed stream, and the client leg must never be
+// compressed, since the size of compressed data leaks information about the
+// plaintext.
+//
+// Each Write is compressed and flushed before it returns, so the peer can read the
+// data right away, and interactive protocols see no extra delay. The relay writes
+// each chunk it reads, so small chunks compress less well, and each flush adds a few
+// bytes. CloseWrite ends the compressed stream, so the peer reads io.EOF, and then
+// closes the write side of the connection.
+func NewCompressedConn(conn transport.StreamConn) transport.StreamConn {
+	// BestSpeed keeps the latency of the relay low. The error is only for invalid levels.
+	w, _ := flate.NewWriter(conn, flate.BestSpeed)
+	return &compressedConn{StreamConn: conn, w: w, r: flate.NewReader(conn)}
+}
+
+func (c *compressedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *compressedConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+func (c *compressedConn) CloseWrite() error {
+	if err := c.w.Close(); err != nil {
+		return err
+	}
+	return c.StreamConn.CloseWrite()
+}
+
+// NewCompressingStreamDialer returns a dialer whose connections are wrapped with
+// [NewCompressedConn]. Set it with [TCPHandler.SetTargetDialer] only if every target
+// is the next hop of a chain that decompresses the stream.
+func NewCompressingStreamDialer(dialer transport.StreamDialer) transport.StreamDialer {
+	return transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		conn, err := dialer.DialStream(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return NewCompressedConn(conn), nil
+	})
+}
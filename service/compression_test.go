@@ -0,0 +1,83 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedConn(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// The next hop echoes each message, and counts the bytes on the wire.
+	var wireBytes int64
+	peerDone := make(chan struct{})
+	go func() {
+		defer close(peerDone)
+		tcpConn, err := listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		defer tcpConn.Close()
+		measured := &countingConn{StreamConn: tcpConn, read: &wireBytes}
+		conn := NewCompressedConn(measured)
+		io.Copy(conn, conn)
+		conn.CloseWrite()
+	}()
+
+	dialer := NewCompressingStreamDialer(&transport.TCPDialer{})
+	conn, err := dialer.DialStream(context.Background(), listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Each write is flushed, so the echo arrives without closing the stream.
+	message := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n"), 100)
+	for i := 0; i < 3; i++ {
+		_, err = conn.Write(message)
+		require.NoError(t, err)
+		echo := make([]byte, len(message))
+		_, err = io.ReadFull(conn, echo)
+		require.NoError(t, err)
+		require.Equal(t, message, echo)
+	}
+
+	require.NoError(t, conn.CloseWrite())
+	rest, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Empty(t, rest)
+	<-peerDone
+	require.Less(t, wireBytes, int64(len(message)))
+}
+
+// countingConn counts the bytes read from a connection.
+type countingConn struct {
+	transport.StreamConn
+	read *int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.StreamConn.Read(b)
+	*c.read += int64(n)
+	return n, err
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"net"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-ss-server/ipinfo"
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+)
+
+// DiagnosticConfig configures the diagnostic responder of a [TCPHandler].
+type DiagnosticConfig struct {
+	// TargetAddress is the host:port that clients request in order to get a
+	// [DiagnosticReport] instead of being relayed. It should be a name that
+	// can't be a real destination, like "diagnostics.invalid:1".
+	TargetAddress string
+	// ServerVersion is reported as is.
+	ServerVersion string
+	// CipherName returns the name of the cipher used by an access key.
+	// Optional.
+	CipherName func(accessKey string) string
+}
+
+// DiagnosticReport describes a connection as observed by the server.
+type DiagnosticReport struct {
+	ClientIP      string `json:"clientIp"`
+	Country       string `json:"country,omitempty"`
+	ASN           int    `json:"asn,omitempty"`
+	AccessKey     string `json:"accessKey"`
+	Cipher        string `json:"cipher,omitempty"`
+	ServerVersion string `json:"serverVersion,omitempty"`
+}
+
+func (h *tcpHandler) writeDiagnosticReport(clientConn transport.StreamConn, clientAddr net.Addr, accessKey string) *onet.ConnectionError {
+	report := DiagnosticReport{AccessKey: accessKey, ServerVersion: h.diagnostics.ServerVersion}
+	if host, _, err := net.SplitHostPort(clientAddr.String()); err == nil {
+		report.ClientIP = host
+	}
+	if clientInfo, err := ipinfo.GetIPInfoFromAddr(h.m, clientAddr); err == nil {
+		report.Country = clientInfo.CountryCode.String()
+		report.ASN = clientInfo.ASN
+	}
+	if h.diagnostics.CipherName != nil {
+		report.Cipher = h.diagnostics.CipherName(accessKey)
+	}
+	if err := json.NewEncoder(clientConn).Encode(report); err != nil {
+		return onet.NewConnectionError("ERR_WRITE", "Failed to write diagnostic report", err)
+	}
+	clientConn.CloseWrite()
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+type dnsCacheEntry struct {
+	ips    []net.IP
+	err    error
+	expiry time.Time
+}
+
+// dnsCache caches the results of hostname lookups. Successful lookups are kept
+// for `ttl`, and lookups of names that don't exist for a tenth of that.
+// Other errors, like timeouts, are not cached.
+type dnsCache struct {
+	ttl        time.Duration
+	maxEntries int
+	// Stubbable for testing.
+	lookupIP func(ctx context.Context, host string) ([]net.IP, error)
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+func newDNSCache(ttl time.Duration, maxEntries int) *dnsCache {
+	return &dnsCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		lookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
+		now:     time.Now,
+		entries: make(map[string]dnsCacheEntry),
+	}
+}
+
+// LookupIP returns the IP addresses of `host`, from the cache if possible.
+func (c *dnsCache) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	now := c.now()
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expiry) {
+		return entry.ips, entry.err
+	}
+
+	ips, err := c.lookupIP(ctx, host)
+	ttl := c.ttl
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+		ttl = c.ttl / 10
+	}
+	c.store(host, dnsCacheEntry{ips, err, now.Add(ttl)}, now)
+	return ips, err
+}
+
+func (c *dnsCache) store(host string, entry dnsCacheEntry, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[host]; !ok && len(c.entries) >= c.maxEntries {
+		for h, e := range c.entries {
+			if !now.Before(e.expiry) {
+				delete(c.entries, h)
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			// Keep the existing entries rather than spend more time on eviction.
+			return
+		}
+	}
+	c.entries[host] = entry
+}
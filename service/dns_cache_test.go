@@ -0,0 +1,107 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Resolver stub that counts lookups.
+type countingResolver struct {
+	lookups map[string]int
+}
+
+func (r *countingResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	r.lookups[host]++
+	switch host {
+	case "nxdomain.test":
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	case "timeout.test":
+		return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+	default:
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	}
+}
+
+func makeTestDNSCache(ttl time.Duration, maxEntries int) (*dnsCache, *countingResolver, *time.Time) {
+	resolver := &countingResolver{lookups: make(map[string]int)}
+	now := time.Now()
+	cache := newDNSCache(ttl, maxEntries)
+	cache.lookupIP = resolver.LookupIP
+	cache.now = func() time.Time { return now }
+	return cache, resolver, &now
+}
+
+func TestDNSCacheHit(t *testing.T) {
+	cache, resolver, now := makeTestDNSCache(time.Minute, 10)
+
+	ips, err := cache.LookupIP(context.Background(), "example.test")
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1", ips[0].String())
+	ips, err = cache.LookupIP(context.Background(), "example.test")
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.1", ips[0].String())
+	require.Equal(t, 1, resolver.lookups["example.test"])
+
+	*now = now.Add(time.Minute)
+	_, err = cache.LookupIP(context.Background(), "example.test")
+	require.NoError(t, err)
+	require.Equal(t, 2, resolver.lookups["example.test"])
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	cache, resolver, now := makeTestDNSCache(time.Minute, 10)
+
+	for i := 0; i < 2; i++ {
+		_, err := cache.LookupIP(context.Background(), "nxdomain.test")
+		var dnsErr *net.DNSError
+		require.True(t, errors.As(err, &dnsErr))
+		require.True(t, dnsErr.IsNotFound)
+	}
+	require.Equal(t, 1, resolver.lookups["nxdomain.test"])
+	// Negative results expire after a tenth of the TTL.
+	*now = now.Add(6 * time.Second)
+	cache.LookupIP(context.Background(), "nxdomain.test")
+	require.Equal(t, 2, resolver.lookups["nxdomain.test"])
+
+	// Other failures are not cached.
+	cache.LookupIP(context.Background(), "timeout.test")
+	cache.LookupIP(context.Background(), "timeout.test")
+	require.Equal(t, 2, resolver.lookups["timeout.test"])
+}
+
+func TestDNSCacheMaxEntries(t *testing.T) {
+	cache, resolver, now := makeTestDNSCache(time.Minute, 1)
+
+	cache.LookupIP(context.Background(), "a.test")
+	cache.LookupIP(context.Background(), "b.test")
+	cache.LookupIP(context.Background(), "b.test")
+	require.Equal(t, 2, resolver.lookups["b.test"])
+	cache.LookupIP(context.Background(), "a.test")
+	require.Equal(t, 1, resolver.lookups["a.test"])
+
+	// Expired entries make room for new ones.
+	*now = now.Add(time.Minute)
+	cache.LookupIP(context.Background(), "b.test")
+	cache.LookupIP(context.Background(), "b.test")
+	require.Equal(t, 3, resolver.lookups["b.test"])
+	require.Len(t, cache.entries, 1)
+}
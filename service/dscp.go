@@ -0,0 +1,71 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// DSCPClassifier returns the DSCP value, from 0 to 63, to mark the connections of
+// the given access key with, or a negative value to leave them unmarked.
+type DSCPClassifier func(accessKey string) int
+
+var errDSCPUnsupported = errors.New("DSCP marking is not supported")
+
+// setDSCP sets the DSCP field of the packets sent on `conn`, which must expose its
+// socket through [syscall.Conn].
+func setDSCP(conn net.Conn, dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return fmt.Errorf("invalid DSCP value %v", dscp)
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errDSCPUnsupported
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	// IPv4 addresses of dual-stack sockets use the IPv4 option.
+	ipv6 := false
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		ipv6 = addr.IP.To4() == nil
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		// The DSCP is the top 6 bits of the TOS or traffic class byte.
+		sockErr = setsockoptTOS(fd, ipv6, dscp<<2)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// markDSCP sets the DSCP value of a connection, logging the outcome.
+func markDSCP(conn net.Conn, dscp int, role string) {
+	if err := setDSCP(conn, dscp); err != nil {
+		logger.Debugf("Failed to set DSCP %v on %v connection: %v", dscp, role, err)
+		return
+	}
+	remoteAddr := conn.RemoteAddr()
+	if role == "client" {
+		remoteAddr = anonymizeAddr(remoteAddr)
+	}
+	logger.Debugf("Set DSCP %v on %v connection to %v", dscp, role, remoteAddr)
+}
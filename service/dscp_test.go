@@ -0,0 +1,118 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package service
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func getTOS(t *testing.T, conn *net.TCPConn) int {
+	rawConn, err := conn.SyscallConn()
+	require.NoError(t, err)
+	var tos int
+	var sockErr error
+	require.NoError(t, rawConn.Control(func(fd uintptr) {
+		tos, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	}))
+	require.NoError(t, sockErr)
+	return tos
+}
+
+func TestSetDSCP(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	defer listener.Close()
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, setDSCP(conn, 46))
+	require.Equal(t, 46<<2, getTOS(t, conn))
+	require.Error(t, setDSCP(conn, 64))
+
+	pipe, _ := net.Pipe()
+	require.ErrorIs(t, setDSCP(pipe, 46), errDSCPUnsupported)
+}
+
+// Records the TOS of the socket when it's closed.
+type tosRecordingConn struct {
+	*net.TCPConn
+	t   *testing.T
+	mu  *sync.Mutex
+	tos *[]int
+}
+
+func (c *tosRecordingConn) Close() error {
+	c.mu.Lock()
+	*c.tos = append(*c.tos, getTOS(c.t, c.TCPConn))
+	c.mu.Unlock()
+	return c.TCPConn.Close()
+}
+
+func TestTCPDSCP(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(2))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, TCPHandlerOptions{
+		DSCP: func(accessKey string) int {
+			if accessKey == "id-0" {
+				return 46
+			}
+			return -1
+		},
+	})
+	var mu sync.Mutex
+	var tos []int
+	baseDialer := makeValidatingTCPStreamDialer(allowAll)
+	handler.SetTargetDialer(transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		conn, err := baseDialer.DialStream(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &tosRecordingConn{TCPConn: conn.(*net.TCPConn), t: t, mu: &mu, tos: &tos}, nil
+	}))
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	discardListener, discardWait := startDiscardServer(t)
+	snapshot := cipherList.SnapshotForClientIP(netip.Addr{})
+	for _, e := range snapshot {
+		cipher := e.Value.(*CipherEntry).CryptoKey
+		initialBytes := makeClientBytesCoalesced(t, cipher, discardListener.Addr().String())
+		require.NoError(t, probe(listener.Addr().(*net.TCPAddr), initialBytes))
+	}
+	listener.Close()
+	<-done
+	discardListener.Close()
+	discardWait.Wait()
+
+	require.Equal(t, 2, testMetrics.countStatuses()["OK"])
+	require.ElementsMatch(t, []int{46 << 2, 0}, tos)
+}
@@ -0,0 +1,126 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnectionEventType is the kind of a [ConnectionEvent].
+type ConnectionEventType string
+
+const (
+	// ConnectionOpened is emitted when a TCP connection is connected to its target,
+	// or a UDP NAT entry is created.
+	ConnectionOpened ConnectionEventType = "open"
+	// ConnectionClosed is emitted when a connection or NAT entry that was opened ends.
+	ConnectionClosed ConnectionEventType = "close"
+)
+
+// ConnectionEvent describes the opening or closing of a relay.
+type ConnectionEvent struct {
+	Type ConnectionEventType
+	// "tcp" or "udp".
+	Protocol   string
+	Time       time.Time
+	AccessKey  string
+	ClientAddr string
+	// The target of a TCP connection. Empty for UDP, since a NAT entry may send to
+	// any number of targets.
+	TargetAddr string
+	// The fields below are only set on close events. Status is only set for TCP.
+	Status          string
+	BytesFromClient int64
+	BytesToClient   int64
+	Duration        time.Duration
+}
+
+// EventSink receives connection events, for instance to publish them to a message
+// queue. Publish is called from a single goroutine, in the order of the events.
+type EventSink interface {
+	Publish(event ConnectionEvent) error
+}
+
+// EventEmitterMetrics is used to report the events that an [EventEmitter] could
+// not deliver.
+type EventEmitterMetrics interface {
+	// AddDroppedConnectionEvent is called when the queue is full.
+	AddDroppedConnectionEvent()
+	// AddFailedConnectionEvent is called when the sink returns an error.
+	AddFailedConnectionEvent()
+}
+
+// EventEmitter queues connection events and publishes them to an [EventSink] in
+// the background, so that a slow sink never blocks the relays. Events that arrive
+// while the queue is full are dropped.
+type EventEmitter struct {
+	sink    EventSink
+	metrics EventEmitterMetrics
+	queue   chan ConnectionEvent
+	done    chan struct{}
+
+	// Guards closed, so that Emit never sends on a closed queue.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewEventEmitter returns an EventEmitter that queues up to `queueSize` events for
+// `sink`. Call Close to stop it.
+func NewEventEmitter(sink EventSink, queueSize int, metrics EventEmitterMetrics) *EventEmitter {
+	e := &EventEmitter{
+		sink:    sink,
+		metrics: metrics,
+		queue:   make(chan ConnectionEvent, queueSize),
+		done:    make(chan struct{}),
+	}
+	go e.publish()
+	return e
+}
+
+func (e *EventEmitter) publish() {
+	defer close(e.done)
+	for event := range e.queue {
+		if err := e.sink.Publish(event); err != nil {
+			logger.Debugf("Failed to publish %v event: %v", event.Type, err)
+			e.metrics.AddFailedConnectionEvent()
+		}
+	}
+}
+
+// Emit queues the event, or drops it if the queue is full or the emitter is closed.
+func (e *EventEmitter) Emit(event ConnectionEvent) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.queue <- event:
+	default:
+		e.metrics.AddDroppedConnectionEvent()
+	}
+}
+
+// Close stops accepting events, and returns after the queued ones are published.
+func (e *EventEmitter) Close() {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.mu.Unlock()
+	<-e.done
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Blocks in Publish until unblocked, and fails events with an empty access key.
+type blockingSink struct {
+	// Receives each event when Publish is called.
+	received  chan ConnectionEvent
+	unblock   chan struct{}
+	published []string
+}
+
+func (s *blockingSink) Publish(event ConnectionEvent) error {
+	s.received <- event
+	<-s.unblock
+	if event.AccessKey == "" {
+		return errors.New("no access key")
+	}
+	s.published = append(s.published, event.AccessKey)
+	return nil
+}
+
+type countingEventMetrics struct {
+	dropped, failed atomic.Int32
+}
+
+func (m *countingEventMetrics) AddDroppedConnectionEvent() {
+	m.dropped.Add(1)
+}
+
+func (m *countingEventMetrics) AddFailedConnectionEvent() {
+	m.failed.Add(1)
+}
+
+func TestEventEmitter(t *testing.T) {
+	sink := &blockingSink{received: make(chan ConnectionEvent, 10), unblock: make(chan struct{})}
+	metrics := &countingEventMetrics{}
+	emitter := NewEventEmitter(sink, 2, metrics)
+
+	// The first event is taken by the publisher, which blocks on the sink.
+	emitter.Emit(ConnectionEvent{AccessKey: "id-0"})
+	<-sink.received
+	emitter.Emit(ConnectionEvent{AccessKey: "id-1"})
+	emitter.Emit(ConnectionEvent{})
+	// The queue is full, so this one is dropped without blocking.
+	emitter.Emit(ConnectionEvent{AccessKey: "id-3"})
+	require.Equal(t, int32(1), metrics.dropped.Load())
+
+	close(sink.unblock)
+	emitter.Close()
+	require.Equal(t, []string{"id-0", "id-1"}, sink.published)
+	require.Equal(t, int32(1), metrics.failed.Load())
+
+	// Events after Close are ignored.
+	emitter.Emit(ConnectionEvent{AccessKey: "id-4"})
+	require.Equal(t, int32(1), metrics.dropped.Load())
+}
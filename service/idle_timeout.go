@@ -0,0 +1,117 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// IdleTimeout configures when a TCP relay is closed for inactivity. The zero value
+// never closes relays for inactivity, which is the default.
+type IdleTimeout struct {
+	// Upload and Download are how long the relay may go without data from the
+	// client and from the target, respectively. Zero means no limit in that
+	// direction.
+	Upload, Download time.Duration
+	// BothIdle closes the relay only once both directions have been idle for their
+	// timeouts, rather than as soon as either has. It keeps connections where one
+	// side waits quietly for the other, like long polls, so it requires both
+	// timeouts: if either is zero, the relay is never closed for inactivity.
+	BothIdle bool
+}
+
+// idleMonitor tracks the last activity in each direction of a relay, and closes
+// it when it becomes idle according to its IdleTimeout.
+type idleMonitor struct {
+	timeout IdleTimeout
+	// Times of the last reads from the client and from the target, in Unix nanoseconds.
+	lastUpload   atomic.Int64
+	lastDownload atomic.Int64
+	timedOut     atomic.Bool
+}
+
+func newIdleMonitor(timeout IdleTimeout, now time.Time) *idleMonitor {
+	m := &idleMonitor{timeout: timeout}
+	m.lastUpload.Store(now.UnixNano())
+	m.lastDownload.Store(now.UnixNano())
+	return m
+}
+
+// deadline returns the time at which the relay becomes idle if there's no more
+// activity, or false if it never does.
+func (m *idleMonitor) deadline() (time.Time, bool) {
+	upload, hasUpload := directionDeadline(m.lastUpload.Load(), m.timeout.Upload)
+	download, hasDownload := directionDeadline(m.lastDownload.Load(), m.timeout.Download)
+	if m.timeout.BothIdle {
+		if !hasUpload || !hasDownload {
+			return time.Time{}, false
+		}
+		if upload.After(download) {
+			return upload, true
+		}
+		return download, true
+	}
+	if !hasUpload || (hasDownload && download.Before(upload)) {
+		return download, hasDownload
+	}
+	return upload, true
+}
+
+func directionDeadline(last int64, timeout time.Duration) (time.Time, bool) {
+	if timeout <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, last).Add(timeout), true
+}
+
+// run calls `onIdle` once the relay is idle, unless `stop` is closed first.
+func (m *idleMonitor) run(stop <-chan struct{}, onIdle func()) {
+	for {
+		deadline, ok := m.deadline()
+		if !ok {
+			return
+		}
+		if wait := time.Until(deadline); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			// There may have been activity while waiting.
+			continue
+		}
+		m.timedOut.Store(true)
+		onIdle()
+		return
+	}
+}
+
+// idleReader records the time of each read that returns data.
+type idleReader struct {
+	io.Reader
+	last *atomic.Int64
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
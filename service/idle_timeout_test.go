@@ -0,0 +1,74 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdleMonitorDeadline(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	uploadAt := start.Add(time.Minute)
+	for _, tc := range []struct {
+		name     string
+		timeout  IdleTimeout
+		deadline time.Time
+		ok       bool
+	}{
+		{"none", IdleTimeout{}, time.Time{}, false},
+		{"upload", IdleTimeout{Upload: time.Minute}, uploadAt.Add(time.Minute), true},
+		{"download", IdleTimeout{Download: time.Minute}, start.Add(time.Minute), true},
+		{"either", IdleTimeout{Upload: time.Minute, Download: time.Minute}, start.Add(time.Minute), true},
+		{"both", IdleTimeout{Upload: time.Minute, Download: time.Minute, BothIdle: true}, uploadAt.Add(time.Minute), true},
+		{"both without download", IdleTimeout{Upload: time.Minute, BothIdle: true}, time.Time{}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newIdleMonitor(tc.timeout, start)
+			// The client sent something a minute after the target did.
+			m.lastUpload.Store(uploadAt.UnixNano())
+			deadline, ok := m.deadline()
+			require.Equal(t, tc.ok, ok)
+			if ok {
+				require.True(t, tc.deadline.Equal(deadline), "deadline %v, expected %v", deadline, tc.deadline)
+			}
+		})
+	}
+}
+
+func TestIdleMonitorRun(t *testing.T) {
+	m := newIdleMonitor(IdleTimeout{Download: 50 * time.Millisecond}, time.Now())
+	idle := make(chan struct{})
+	go m.run(make(chan struct{}), func() { close(idle) })
+	// Activity postpones the deadline.
+	time.Sleep(30 * time.Millisecond)
+	m.lastDownload.Store(time.Now().UnixNano())
+	select {
+	case <-idle:
+		t.Fatal("Relay should not be idle yet")
+	case <-time.After(30 * time.Millisecond):
+	}
+	<-idle
+	require.True(t, m.timedOut.Load())
+
+	// Stopping the monitor prevents the call.
+	m = newIdleMonitor(IdleTimeout{Download: 10 * time.Millisecond}, time.Now())
+	stop := make(chan struct{})
+	close(stop)
+	m.run(stop, func() { t.Error("Stopped monitor should not call onIdle") })
+	require.False(t, m.timedOut.Load())
+}
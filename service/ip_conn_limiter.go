@@ -0,0 +1,114 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"container/list"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// IPConnectionLimiter caps the number of concurrent connections from each client IP
+// address. It tracks up to `maxIPs` addresses with open connections, and forgets the
+// least recently connected one to make room for a new one, which resets its count.
+// It is safe for concurrent use, and may be shared by several handlers.
+type IPConnectionLimiter struct {
+	maxPerIP int
+	maxIPs   int
+	mu       sync.Mutex
+	// The ipConnCount of each tracked address, most recently connected first.
+	lru      *list.List
+	entries  map[netip.Addr]*list.Element
+	rejected atomic.Int64
+}
+
+// ipConnCount is the number of open connections from an address.
+type ipConnCount struct {
+	ip    netip.Addr
+	count int
+	// Whether the entry was forgotten, so that releasing it doesn't touch a newer one.
+	evicted bool
+}
+
+// NewIPConnectionLimiter creates an [IPConnectionLimiter] that allows up to
+// `maxPerIP` concurrent connections from each address, and tracks up to `maxIPs`
+// addresses.
+func NewIPConnectionLimiter(maxPerIP, maxIPs int) *IPConnectionLimiter {
+	return &IPConnectionLimiter{
+		maxPerIP: maxPerIP,
+		maxIPs:   maxIPs,
+		lru:      list.New(),
+		entries:  make(map[netip.Addr]*list.Element),
+	}
+}
+
+// Tracked returns the number of addresses with open connections being tracked.
+func (l *IPConnectionLimiter) Tracked() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+// Rejected returns the number of connections rejected so far.
+func (l *IPConnectionLimiter) Rejected() int64 {
+	return l.rejected.Load()
+}
+
+// acquire counts a new connection from `ip`, unless it already has the maximum, in
+// which case it counts a rejection and returns false. The returned entry must be
+// passed to release when the connection closes.
+func (l *IPConnectionLimiter) acquire(ip netip.Addr) (*ipConnCount, bool) {
+	ip = ip.Unmap()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if element, ok := l.entries[ip]; ok {
+		entry := element.Value.(*ipConnCount)
+		if entry.count >= l.maxPerIP {
+			l.rejected.Add(1)
+			return nil, false
+		}
+		entry.count++
+		l.lru.MoveToFront(element)
+		return entry, true
+	}
+	if l.maxPerIP < 1 {
+		l.rejected.Add(1)
+		return nil, false
+	}
+	if len(l.entries) >= l.maxIPs {
+		if oldest := l.lru.Back(); oldest != nil {
+			entry := l.lru.Remove(oldest).(*ipConnCount)
+			entry.evicted = true
+			delete(l.entries, entry.ip)
+		}
+	}
+	entry := &ipConnCount{ip: ip, count: 1}
+	l.entries[ip] = l.lru.PushFront(entry)
+	return entry, true
+}
+
+// release uncounts a connection counted by acquire, and stops tracking its address
+// once it has no open connections.
+func (l *IPConnectionLimiter) release(entry *ipConnCount) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.count--
+	if entry.count > 0 || entry.evicted {
+		return
+	}
+	l.lru.Remove(l.entries[entry.ip])
+	delete(l.entries, entry.ip)
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPConnectionLimiter(t *testing.T) {
+	limiter := NewIPConnectionLimiter(2, 10)
+	ip := netip.MustParseAddr("192.0.2.1")
+	first, ok := limiter.acquire(ip)
+	require.True(t, ok)
+	// IPv4-mapped addresses count as the IPv4 address.
+	second, ok := limiter.acquire(netip.MustParseAddr("::ffff:192.0.2.1"))
+	require.True(t, ok)
+	_, ok = limiter.acquire(ip)
+	require.False(t, ok)
+	require.Equal(t, int64(1), limiter.Rejected())
+
+	// Other addresses have their own count.
+	other, ok := limiter.acquire(netip.MustParseAddr("192.0.2.2"))
+	require.True(t, ok)
+	require.Equal(t, 2, limiter.Tracked())
+
+	limiter.release(first)
+	third, ok := limiter.acquire(ip)
+	require.True(t, ok)
+	limiter.release(second)
+	limiter.release(third)
+	limiter.release(other)
+	require.Equal(t, 0, limiter.Tracked())
+	require.Equal(t, int64(1), limiter.Rejected())
+}
+
+func TestIPConnectionLimiterEviction(t *testing.T) {
+	limiter := NewIPConnectionLimiter(1, 2)
+	ip1 := netip.MustParseAddr("192.0.2.1")
+	ip2 := netip.MustParseAddr("192.0.2.2")
+	ip3 := netip.MustParseAddr("192.0.2.3")
+	conn1, ok := limiter.acquire(ip1)
+	require.True(t, ok)
+	conn2, ok := limiter.acquire(ip2)
+	require.True(t, ok)
+	// The least recently connected address is forgotten to make room.
+	conn3, ok := limiter.acquire(ip3)
+	require.True(t, ok)
+	require.Equal(t, 2, limiter.Tracked())
+
+	// So its count starts over.
+	newConn1, ok := limiter.acquire(ip1)
+	require.True(t, ok)
+	_, ok = limiter.acquire(ip1)
+	require.False(t, ok)
+
+	// Releasing a forgotten connection doesn't affect the newer count.
+	limiter.release(conn1)
+	_, ok = limiter.acquire(ip1)
+	require.False(t, ok)
+
+	limiter.release(conn2)
+	limiter.release(conn3)
+	limiter.release(newConn1)
+	require.Equal(t, 0, limiter.Tracked())
+}
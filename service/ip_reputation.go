@@ -0,0 +1,135 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+)
+
+// IPReputation tells whether connections from a client IP address must be rejected,
+// for instance because it's a Tor exit node or appears in a threat feed. Blocked is
+// called for every new connection, before the trial decryption, so it must be fast
+// and safe for concurrent use.
+type IPReputation interface {
+	Blocked(ip netip.Addr) bool
+}
+
+// IPBlocklist is an [IPReputation] that blocks a fixed set of addresses and
+// prefixes. A lookup takes one map access per distinct prefix length in the list,
+// regardless of its size.
+type IPBlocklist struct {
+	// The masked prefixes of each length, for IPv4 and IPv6 apart.
+	prefixes4 map[int]map[netip.Prefix]bool
+	prefixes6 map[int]map[netip.Prefix]bool
+	// The prefix lengths in prefixes4 and prefixes6.
+	bits4, bits6 []int
+}
+
+// NewIPBlocklist creates an [IPBlocklist] that blocks the addresses in `prefixes`.
+func NewIPBlocklist(prefixes []netip.Prefix) *IPBlocklist {
+	l := &IPBlocklist{
+		prefixes4: make(map[int]map[netip.Prefix]bool),
+		prefixes6: make(map[int]map[netip.Prefix]bool),
+	}
+	for _, prefix := range prefixes {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked()
+		byBits, bits := l.prefixes6, &l.bits6
+		if prefix.Addr().Is4() {
+			byBits, bits = l.prefixes4, &l.bits4
+		}
+		if byBits[prefix.Bits()] == nil {
+			byBits[prefix.Bits()] = make(map[netip.Prefix]bool)
+			*bits = append(*bits, prefix.Bits())
+		}
+		byBits[prefix.Bits()][prefix] = true
+	}
+	return l
+}
+
+// ReadIPBlocklist creates an [IPBlocklist] from a list with one IP address or CIDR
+// prefix per line, like the Tor exit list. Empty lines and lines starting with "#"
+// are skipped.
+func ReadIPBlocklist(r io.Reader) (*IPBlocklist, error) {
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.Contains(line, "/") {
+			prefix, err := netip.ParsePrefix(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %w", lineNum, err)
+			}
+			prefixes = append(prefixes, prefix)
+			continue
+		}
+		ip, err := netip.ParseAddr(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", lineNum, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewIPBlocklist(prefixes), nil
+}
+
+// Blocked implements [IPReputation].
+func (l *IPBlocklist) Blocked(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	byBits, bits := l.prefixes6, l.bits6
+	if ip.Is4() {
+		byBits, bits = l.prefixes4, l.bits4
+	}
+	for _, b := range bits {
+		prefix, err := ip.Prefix(b)
+		if err == nil && byBits[b][prefix] {
+			return true
+		}
+	}
+	return false
+}
+
+// IPFamily selects the client addresses accepted by a handler by IP version.
+type IPFamily int
+
+const (
+	// IPFamilyAny accepts clients of both IP versions. It's the default.
+	IPFamilyAny IPFamily = iota
+	// IPFamilyIPv4 accepts IPv4 clients only, including those that a dual-stack
+	// socket reports as IPv4-mapped IPv6 addresses.
+	IPFamilyIPv4
+	// IPFamilyIPv6 accepts IPv6 clients only.
+	IPFamilyIPv6
+)
+
+// allows reports whether clients from `ip` are accepted.
+func (f IPFamily) allows(ip netip.Addr) bool {
+	switch f {
+	case IPFamilyIPv4:
+		return ip.Unmap().Is4()
+	case IPFamilyIPv6:
+		return ip.Is6() && !ip.Is4In6()
+	default:
+		return true
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPBlocklist(t *testing.T) {
+	blocklist := NewIPBlocklist([]netip.Prefix{
+		netip.MustParsePrefix("192.0.2.1/32"),
+		netip.MustParsePrefix("198.51.100.77/24"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	})
+	for ip, blocked := range map[string]bool{
+		"192.0.2.1":           true,
+		"192.0.2.2":           false,
+		"198.51.100.1":        true,
+		"198.51.101.1":        false,
+		"::ffff:192.0.2.1":    true,
+		"2001:db8:1::1":       true,
+		"2001:db9::1":         false,
+		"::ffff:198.51.100.9": true,
+	} {
+		require.Equal(t, blocked, blocklist.Blocked(netip.MustParseAddr(ip)), ip)
+	}
+	require.False(t, NewIPBlocklist(nil).Blocked(netip.MustParseAddr("192.0.2.1")))
+}
+
+func TestReadIPBlocklist(t *testing.T) {
+	blocklist, err := ReadIPBlocklist(strings.NewReader("# Exit nodes\n192.0.2.1\n\n  2001:db8::/32  \n"))
+	require.NoError(t, err)
+	require.True(t, blocklist.Blocked(netip.MustParseAddr("192.0.2.1")))
+	require.True(t, blocklist.Blocked(netip.MustParseAddr("2001:db8::1")))
+	require.False(t, blocklist.Blocked(netip.MustParseAddr("192.0.2.2")))
+
+	_, err = ReadIPBlocklist(strings.NewReader("192.0.2.1\nnot an IP\n"))
+	require.ErrorContains(t, err, "line 2")
+}
+
+func TestIPFamily(t *testing.T) {
+	ipv4 := netip.MustParseAddr("192.0.2.1")
+	mapped := netip.MustParseAddr("::ffff:192.0.2.1")
+	ipv6 := netip.MustParseAddr("2001:db8::1")
+	for _, ip := range []netip.Addr{ipv4, mapped, ipv6} {
+		require.True(t, IPFamilyAny.allows(ip), ip)
+	}
+	require.True(t, IPFamilyIPv4.allows(ipv4))
+	require.True(t, IPFamilyIPv4.allows(mapped))
+	require.False(t, IPFamilyIPv4.allows(ipv6))
+	require.False(t, IPFamilyIPv6.allows(ipv4))
+	require.False(t, IPFamilyIPv6.allows(mapped))
+	require.True(t, IPFamilyIPv6.allows(ipv6))
+}
@@ -0,0 +1,82 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrKeyNotFound is returned by [KeyStore.Lookup] when no key matches the header.
+var ErrKeyNotFound = errors.New("no access key matches the header")
+
+// KeyStore finds the access key of a client from a key-identifying header, as sent
+// by protocols like the Shadowsocks 2022 multi-user extension, in constant time
+// instead of the trial decryption over a [CipherList] that the legacy AEAD ciphers
+// need. It's meant for a [HandshakeParser] of such a protocol, since the Shadowsocks
+// handler only supports the legacy ciphers, whose headers don't identify the key.
+type KeyStore interface {
+	// Lookup returns the entry of the key identified by `header`, or
+	// [ErrKeyNotFound].
+	Lookup(header []byte) (*CipherEntry, error)
+}
+
+// MapKeyStore is a thread-safe [KeyStore] that holds the entries in a map, keyed by
+// their identity, such as the hash of the key in the 2022 identity header.
+type MapKeyStore struct {
+	mu      sync.RWMutex
+	entries map[string]*CipherEntry
+}
+
+var _ KeyStore = (*MapKeyStore)(nil)
+
+// NewMapKeyStore creates an empty MapKeyStore.
+func NewMapKeyStore() *MapKeyStore {
+	return &MapKeyStore{entries: make(map[string]*CipherEntry)}
+}
+
+// Add sets the entry of `identity`, replacing any previous one.
+func (s *MapKeyStore) Add(identity []byte, entry *CipherEntry) {
+	s.mu.Lock()
+	s.entries[string(identity)] = entry
+	s.mu.Unlock()
+}
+
+// Remove removes the entry of `identity`. Returns false if there is no such entry.
+func (s *MapKeyStore) Remove(identity []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[string(identity)]; !ok {
+		return false
+	}
+	delete(s.entries, string(identity))
+	return true
+}
+
+// Len returns the number of entries in the store.
+func (s *MapKeyStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.entries)
+}
+
+func (s *MapKeyStore) Lookup(header []byte) (*CipherEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if entry, ok := s.entries[string(header)]; ok {
+		return entry, nil
+	}
+	return nil, ErrKeyNotFound
+}
@@ -0,0 +1,43 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapKeyStore(t *testing.T) {
+	store := NewMapKeyStore()
+	alice := &CipherEntry{ID: "alice"}
+	bob := &CipherEntry{ID: "bob"}
+	store.Add([]byte("identity-a"), alice)
+	store.Add([]byte("identity-b"), bob)
+	require.Equal(t, 2, store.Len())
+
+	entry, err := store.Lookup([]byte("identity-a"))
+	require.NoError(t, err)
+	require.Same(t, alice, entry)
+
+	_, err = store.Lookup([]byte("identity-c"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	require.True(t, store.Remove([]byte("identity-a")))
+	require.False(t, store.Remove([]byte("identity-a")))
+	_, err = store.Lookup([]byte("identity-a"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	require.Equal(t, 1, store.Len())
+}
@@ -0,0 +1,90 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || darwin || freebsd
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// ExportListener returns a duplicate of the file descriptor of `listener`, to pass
+// to another process, for instance an unprivileged one that handles the connections
+// while the privileged one keeps the port. The caller must close the file, and can
+// close `listener` too without affecting the copy.
+func ExportListener(listener *net.TCPListener) (*os.File, error) {
+	return listener.File()
+}
+
+// NewTCPListenerFromFd reconstructs a listener from a file descriptor made by
+// [ExportListener] and passed to this process. It takes ownership of `fd`.
+func NewTCPListenerFromFd(fd int) (*net.TCPListener, error) {
+	file := os.NewFile(uintptr(fd), "listener")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+	tcpListener, ok := listener.(*net.TCPListener)
+	if !ok {
+		listener.Close()
+		return nil, fmt.Errorf("file descriptor %v is not a TCP listener", fd)
+	}
+	return tcpListener, nil
+}
+
+// SendListener passes `listener` to the process at the other end of `conn` with
+// SCM_RIGHTS, to be received with [ReceiveListener].
+func SendListener(conn *net.UnixConn, listener *net.TCPListener) error {
+	file, err := ExportListener(listener)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// At least one byte of data must accompany the descriptor.
+	_, _, err = conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(file.Fd())), nil)
+	return err
+}
+
+// ReceiveListener receives a listener sent with [SendListener].
+func ReceiveListener(conn *net.UnixConn) (*net.TCPListener, error) {
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(make([]byte, 1), oob)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) != 1 {
+		return nil, errors.New("expected a single control message")
+	}
+	fds, err := syscall.ParseUnixRights(&messages[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return nil, errors.New("expected a single file descriptor")
+	}
+	return NewTCPListenerFromFd(fds[0])
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || darwin || freebsd
+
+package service
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const handoffChildEnv = "OUTLINE_LISTENER_HANDOFF_CHILD"
+
+// TestListenerHandoffChild runs in the child process of TestListenerHandoff. It
+// receives the listener over fd 3, and echoes one connection.
+func TestListenerHandoffChild(t *testing.T) {
+	if os.Getenv(handoffChildEnv) == "" {
+		t.Skip("only runs as a child of TestListenerHandoff")
+	}
+	file := os.NewFile(3, "handoff")
+	fileConn, err := net.FileConn(file)
+	require.NoError(t, err)
+	file.Close()
+	listener, err := ReceiveListener(fileConn.(*net.UnixConn))
+	require.NoError(t, err)
+	defer listener.Close()
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	io.Copy(conn, conn)
+	conn.Close()
+}
+
+func TestListenerHandoff(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	parentFile := os.NewFile(uintptr(fds[0]), "parent")
+	childFile := os.NewFile(uintptr(fds[1]), "child")
+	defer parentFile.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestListenerHandoffChild$")
+	cmd.Env = append(os.Environ(), handoffChildEnv+"=1")
+	cmd.ExtraFiles = []*os.File{childFile}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	require.NoError(t, cmd.Start())
+	childFile.Close()
+
+	listener := makeLocalhostListener(t)
+	fileConn, err := net.FileConn(parentFile)
+	require.NoError(t, err)
+	defer fileConn.Close()
+	require.NoError(t, SendListener(fileConn.(*net.UnixConn), listener))
+	// Only the child accepts connections from now on.
+	addr := listener.Addr().String()
+	listener.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	conn.(*net.TCPConn).CloseWrite()
+	echo, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(echo))
+	conn.Close()
+	require.NoError(t, cmd.Wait())
+}
+
+func TestNewTCPListenerFromFdNotListener(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer conn.Close()
+	file, err := conn.File()
+	require.NoError(t, err)
+	defer file.Close()
+	// NewTCPListenerFromFd takes ownership of the descriptor, so give it a copy.
+	fd, err := syscall.Dup(int(file.Fd()))
+	require.NoError(t, err)
+	_, err = NewTCPListenerFromFd(fd)
+	require.Error(t, err)
+}
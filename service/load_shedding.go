@@ -0,0 +1,79 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// LoadSignal reports whether the server is too loaded to take new connections.
+// It's called once per new connection, so it must be cheap.
+type LoadSignal func() bool
+
+// GoroutineLoadSignal returns a [LoadSignal] that reports overload when the process
+// has more than `max` goroutines. Each TCP connection uses about two goroutines
+// while relaying, so this bounds the number of connections in progress.
+func GoroutineLoadSignal(max int) LoadSignal {
+	return func() bool {
+		return runtime.NumGoroutine() > max
+	}
+}
+
+// GoroutineLimiter counts the goroutines that run on behalf of connections and UDP
+// associations, and sheds new ones once `max` are running. Unlike
+// [GoroutineLoadSignal], it only counts the goroutines of the handlers that use it,
+// for their whole lifetime, so other parts of the process don't cause shedding. It
+// may be shared by several handlers. A TCP connection counts as two goroutines,
+// and a UDP association as one.
+type GoroutineLimiter struct {
+	max     int64
+	running atomic.Int64
+	shed    atomic.Int64
+}
+
+// Goroutines used by each TCP connection: the one that handles it, which also
+// relays the client's data, and the one that relays the target's data.
+const tcpConnectionGoroutines = 2
+
+// NewGoroutineLimiter creates a [GoroutineLimiter] that allows up to `max` goroutines.
+func NewGoroutineLimiter(max int) *GoroutineLimiter {
+	return &GoroutineLimiter{max: int64(max)}
+}
+
+// Running returns the number of goroutines currently counted.
+func (l *GoroutineLimiter) Running() int64 {
+	return l.running.Load()
+}
+
+// Shed returns the number of connections and associations rejected so far.
+func (l *GoroutineLimiter) Shed() int64 {
+	return l.shed.Load()
+}
+
+// acquire counts `n` more goroutines, unless that would exceed the limit, in which
+// case it counts a shed event and returns false.
+func (l *GoroutineLimiter) acquire(n int64) bool {
+	if l.running.Add(n) > l.max {
+		l.running.Add(-n)
+		l.shed.Add(1)
+		return false
+	}
+	return true
+}
+
+func (l *GoroutineLimiter) release(n int64) {
+	l.running.Add(-n)
+}
@@ -0,0 +1,190 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/ipinfo"
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+)
+
+// FaultInjector decides which metrics calls a [FaultInjectingMetrics] drops.
+// `event` is the name of the method, like "AddTCPProbe".
+type FaultInjector interface {
+	ShouldDrop(event string) bool
+}
+
+type randomFaultInjector struct {
+	dropRate float64
+}
+
+// NewRandomFaultInjector returns a [FaultInjector] that drops each call with
+// probability `dropRate`, between 0 and 1.
+func NewRandomFaultInjector(dropRate float64) FaultInjector {
+	return &randomFaultInjector{dropRate: dropRate}
+}
+
+func (f *randomFaultInjector) ShouldDrop(event string) bool {
+	return rand.Float64() < f.dropRate
+}
+
+type deterministicFaultInjector map[string]bool
+
+// NewDeterministicFaultInjector returns a [FaultInjector] that drops every call to
+// the methods named in `events`, and no other.
+func NewDeterministicFaultInjector(events []string) FaultInjector {
+	f := make(deterministicFaultInjector, len(events))
+	for _, event := range events {
+		f[event] = true
+	}
+	return f
+}
+
+func (f deterministicFaultInjector) ShouldDrop(event string) bool {
+	return f[event]
+}
+
+// FaultInjectingMetrics is a [TCPMetrics] and [UDPMetrics] for chaos tests. It
+// passes each call on to the wrapped metrics, unless its [FaultInjector] says to
+// drop it, so tests can check that the handlers don't depend on the metrics being
+// recorded. Dropped GetIPInfo calls return an empty IPInfo.
+type FaultInjectingMetrics struct {
+	tcp    TCPMetrics
+	udp    UDPMetrics
+	faults FaultInjector
+}
+
+var _ TCPMetrics = (*FaultInjectingMetrics)(nil)
+var _ ShadowsocksTCPMetrics = (*FaultInjectingMetrics)(nil)
+var _ UDPMetrics = (*FaultInjectingMetrics)(nil)
+
+// NewFaultInjectingMetrics wraps `tcp` and `udp`, which must not be nil. Use the
+// no-op metrics for the protocol that isn't tested. AddTCPCipherSearch is passed on
+// only if `tcp` implements [ShadowsocksTCPMetrics].
+func NewFaultInjectingMetrics(tcp TCPMetrics, udp UDPMetrics, faults FaultInjector) *FaultInjectingMetrics {
+	return &FaultInjectingMetrics{tcp: tcp, udp: udp, faults: faults}
+}
+
+func (m *FaultInjectingMetrics) GetIPInfo(ip net.IP) (ipinfo.IPInfo, error) {
+	if m.faults.ShouldDrop("GetIPInfo") {
+		return ipinfo.IPInfo{}, nil
+	}
+	return m.tcp.GetIPInfo(ip)
+}
+
+func (m *FaultInjectingMetrics) AddOpenTCPConnection(clientInfo ipinfo.IPInfo) {
+	if !m.faults.ShouldDrop("AddOpenTCPConnection") {
+		m.tcp.AddOpenTCPConnection(clientInfo)
+	}
+}
+
+func (m *FaultInjectingMetrics) AddAuthenticatedTCPConnection(clientAddr net.Addr, accessKey string) {
+	if !m.faults.ShouldDrop("AddAuthenticatedTCPConnection") {
+		m.tcp.AddAuthenticatedTCPConnection(clientAddr, accessKey)
+	}
+}
+
+func (m *FaultInjectingMetrics) AddClosedTCPConnection(clientInfo ipinfo.IPInfo, clientAddr net.Addr, accessKey string, status string, data metrics.ProxyMetrics, duration time.Duration) {
+	if !m.faults.ShouldDrop("AddClosedTCPConnection") {
+		m.tcp.AddClosedTCPConnection(clientInfo, clientAddr, accessKey, status, data, duration)
+	}
+}
+
+func (m *FaultInjectingMetrics) AddTCPProbe(status, drainResult string, port int, clientProxyBytes int64) {
+	if !m.faults.ShouldDrop("AddTCPProbe") {
+		m.tcp.AddTCPProbe(status, drainResult, port, clientProxyBytes)
+	}
+}
+
+func (m *FaultInjectingMetrics) AddTCPCircuitBreakerOpen(target string) {
+	if !m.faults.ShouldDrop("AddTCPCircuitBreakerOpen") {
+		m.tcp.AddTCPCircuitBreakerOpen(target)
+	}
+}
+
+func (m *FaultInjectingMetrics) AddTCPSlowDial(target string, elapsed time.Duration) {
+	if !m.faults.ShouldDrop("AddTCPSlowDial") {
+		m.tcp.AddTCPSlowDial(target, elapsed)
+	}
+}
+
+func (m *FaultInjectingMetrics) AddTCPProbeResponse(response string) {
+	if !m.faults.ShouldDrop("AddTCPProbeResponse") {
+		m.tcp.AddTCPProbeResponse(response)
+	}
+}
+
+func (m *FaultInjectingMetrics) AddTCPCipherSearch(accessKeyFound bool, timeToCipher time.Duration) {
+	if ssMetrics, ok := m.tcp.(ShadowsocksTCPMetrics); ok && !m.faults.ShouldDrop("AddTCPCipherSearch") {
+		ssMetrics.AddTCPCipherSearch(accessKeyFound, timeToCipher)
+	}
+}
+
+func (m *FaultInjectingMetrics) AddUDPPacketFromClient(clientInfo ipinfo.IPInfo, accessKey, status string, clientProxyBytes, proxyTargetBytes int) {
+	if !m.faults.ShouldDrop("AddUDPPacketFromClient") {
+		m.udp.AddUDPPacketFromClient(clientInfo, accessKey, status, clientProxyBytes, proxyTargetBytes)
+	}
+}
+
+func (m *FaultInjectingMetrics) AddUDPPacketFromTarget(clientInfo ipinfo.IPInfo, accessKey, status string, targetProxyBytes, proxyClientBytes int) {
+	if !m.faults.ShouldDrop("AddUDPPacketFromTarget") {
+		m.udp.AddUDPPacketFromTarget(clientInfo, accessKey, status, targetProxyBytes, proxyClientBytes)
+	}
+}
+
+func (m *FaultInjectingMetrics) AddUDPNatEntry(clientAddr net.Addr, accessKey string) {
+	if !m.faults.ShouldDrop("AddUDPNatEntry") {
+		m.udp.AddUDPNatEntry(clientAddr, accessKey)
+	}
+}
+
+func (m *FaultInjectingMetrics) RemoveUDPNatEntry(clientAddr net.Addr, accessKey string) {
+	if !m.faults.ShouldDrop("RemoveUDPNatEntry") {
+		m.udp.RemoveUDPNatEntry(clientAddr, accessKey)
+	}
+}
+
+func (m *FaultInjectingMetrics) AddUDPDeduplication() {
+	if !m.faults.ShouldDrop("AddUDPDeduplication") {
+		m.udp.AddUDPDeduplication()
+	}
+}
+
+func (m *FaultInjectingMetrics) AddUDPAmplificationDrop() {
+	if !m.faults.ShouldDrop("AddUDPAmplificationDrop") {
+		m.udp.AddUDPAmplificationDrop()
+	}
+}
+
+func (m *FaultInjectingMetrics) AddUDPConnectionMigration(accessKey string) {
+	if !m.faults.ShouldDrop("AddUDPConnectionMigration") {
+		m.udp.AddUDPConnectionMigration(accessKey)
+	}
+}
+
+func (m *FaultInjectingMetrics) AddUDPClientDuplicate(accessKey string) {
+	if !m.faults.ShouldDrop("AddUDPClientDuplicate") {
+		m.udp.AddUDPClientDuplicate(accessKey)
+	}
+}
+
+func (m *FaultInjectingMetrics) AddUDPCipherSearch(accessKeyFound bool, timeToCipher time.Duration) {
+	if !m.faults.ShouldDrop("AddUDPCipherSearch") {
+		m.udp.AddUDPCipherSearch(accessKeyFound, timeToCipher)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-ss-server/ipinfo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeterministicFaultInjector(t *testing.T) {
+	faults := NewDeterministicFaultInjector([]string{"AddTCPProbe", "AddUDPNatEntry"})
+	require.True(t, faults.ShouldDrop("AddTCPProbe"))
+	require.True(t, faults.ShouldDrop("AddUDPNatEntry"))
+	require.False(t, faults.ShouldDrop("AddUDPPacketFromClient"))
+}
+
+func TestRandomFaultInjector(t *testing.T) {
+	require.False(t, NewRandomFaultInjector(0).ShouldDrop("AddTCPProbe"))
+	require.True(t, NewRandomFaultInjector(1).ShouldDrop("AddTCPProbe"))
+}
+
+func TestFaultInjectingMetrics(t *testing.T) {
+	snapshot := NewSnapshotMetrics(nil)
+	m := NewFaultInjectingMetrics(&NoOpTCPMetrics{}, snapshot, NewDeterministicFaultInjector([]string{"AddUDPPacketFromClient"}))
+	m.AddUDPPacketFromClient(ipinfo.IPInfo{}, "id-0", "OK", 10, 10)
+	m.AddUDPPacketFromTarget(ipinfo.IPInfo{}, "id-0", "OK", 10, 10)
+	counters := snapshot.Snapshot()
+	require.Equal(t, int64(0), counters.UDPPacketsFromClient)
+	require.Equal(t, int64(1), counters.UDPPacketsFromTarget)
+}
@@ -0,0 +1,46 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+// maxChunkPayload is the largest payload of a Shadowsocks AEAD stream chunk.
+const maxChunkPayload = 0x3FFF
+
+// ExpectedStreamNonces returns the nonces, in order, that a Shadowsocks stream writer
+// uses to seal a stream written in calls of the given lengths. It's meant for tests.
+//
+// The nonce is a little-endian counter that starts at zero and is incremented after
+// every seal. Each chunk takes two: one for its length and one for its payload. A
+// write is split into chunks of at most 16 KiB - 1 bytes, and an empty write sends no
+// chunk. `nonceSize` is the nonce size of the AEAD, 12 for every supported cipher.
+func ExpectedStreamNonces(nonceSize int, writeLengths []int) [][]byte {
+	var nonces [][]byte
+	counter := make([]byte, nonceSize)
+	next := func() {
+		nonces = append(nonces, append([]byte(nil), counter...))
+		for i := range counter {
+			counter[i]++
+			if counter[i] != 0 {
+				break
+			}
+		}
+	}
+	for _, length := range writeLengths {
+		for ; length > 0; length -= maxChunkPayload {
+			next() // Length block.
+			next() // Payload block.
+		}
+	}
+	return nonces
+}
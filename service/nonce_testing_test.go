@@ -0,0 +1,75 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpectedStreamNoncesCounter(t *testing.T) {
+	nonces := ExpectedStreamNonces(12, []int{1, 0, 2*maxChunkPayload + 1})
+	require.Len(t, nonces, 8)
+	for i, nonce := range nonces {
+		expected := make([]byte, 12)
+		expected[0] = byte(i)
+		require.Equal(t, expected, nonce)
+	}
+
+	// The counter carries into the next byte.
+	nonces = ExpectedStreamNonces(12, make([]int, 129))
+	require.Empty(t, nonces)
+	lengths := make([]int, 129)
+	for i := range lengths {
+		lengths[i] = 1
+	}
+	nonces = ExpectedStreamNonces(12, lengths)
+	require.Len(t, nonces, 258)
+	require.Equal(t, []byte{0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, nonces[255])
+	require.Equal(t, []byte{0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, nonces[256])
+}
+
+// Opens the chunks that the shadowsocks.Writer sends with the expected nonces.
+func TestExpectedStreamNoncesMatchWriter(t *testing.T) {
+	key, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, "secret")
+	require.NoError(t, err)
+	lengths := []int{10, 0, maxChunkPayload, maxChunkPayload + 1, 1}
+	var stream bytes.Buffer
+	writer := shadowsocks.NewWriter(&stream, key)
+	for _, length := range lengths {
+		_, err := writer.Write(make([]byte, length))
+		require.NoError(t, err)
+	}
+
+	salt := stream.Next(key.SaltSize())
+	aead, err := key.NewAEAD(salt)
+	require.NoError(t, err)
+	nonces := ExpectedStreamNonces(aead.NonceSize(), lengths)
+	total := 0
+	for i := 0; i < len(nonces); i += 2 {
+		sizeBlock, err := aead.Open(nil, nonces[i], stream.Next(2+aead.Overhead()), nil)
+		require.NoError(t, err, "length block of chunk %v", i/2)
+		size := int(binary.BigEndian.Uint16(sizeBlock))
+		_, err = aead.Open(nil, nonces[i+1], stream.Next(size+aead.Overhead()), nil)
+		require.NoError(t, err, "payload block of chunk %v", i/2)
+		total += size
+	}
+	require.Equal(t, 0, stream.Len())
+	require.Equal(t, 10+2*maxChunkPayload+1+1, total)
+}
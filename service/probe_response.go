@@ -0,0 +1,83 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+)
+
+// ProbeResponse is what the TCP handler does with connections that fail the
+// handshake, which are likely probes.
+type ProbeResponse int
+
+const (
+	// ProbeResponseHang reads and discards what the client sends until it closes or
+	// the read timeout expires, so that the server doesn't reveal how many bytes it
+	// expected. This is the default.
+	ProbeResponseHang ProbeResponse = iota
+	// ProbeResponseClose closes the connection right away. Probes can tell that
+	// the handshake failed, but the connection holds no resources.
+	ProbeResponseClose
+	// ProbeResponseDecoy sends the decoy bytes, like the banner or error page of a
+	// benign service, and then hangs like ProbeResponseHang.
+	ProbeResponseDecoy
+)
+
+var probeResponseNames = []string{"hang", "close", "decoy"}
+
+// String returns the name of the response, as reported in metrics.
+func (r ProbeResponse) String() string {
+	if r < 0 || int(r) >= len(probeResponseNames) {
+		return fmt.Sprintf("ProbeResponse(%d)", int(r))
+	}
+	return probeResponseNames[r]
+}
+
+// ParseProbeResponse returns the ProbeResponse named `name`, as returned by String.
+func ParseProbeResponse(name string) (ProbeResponse, error) {
+	for i, responseName := range probeResponseNames {
+		if name == responseName {
+			return ProbeResponse(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown probe response %q", name)
+}
+
+// absorbProbe responds to a connection that failed the handshake with status
+// `status`, and reports it. The read deadline must be set. `proxyMetrics` is a
+// pointer because its value is being mutated by `clientConn`.
+func (h *tcpHandler) absorbProbe(clientConn transport.StreamConn, status string, proxyMetrics *metrics.ProxyMetrics) {
+	h.m.AddTCPProbeResponse(h.probeResponse.String())
+	if h.probeResponse == ProbeResponseClose {
+		h.m.AddTCPProbe(status, "closed", h.port, proxyMetrics.ClientProxy)
+		return
+	}
+	if h.probeResponse == ProbeResponseDecoy && len(h.probeDecoy) > 0 {
+		clientConn.SetWriteDeadline(time.Now().Add(h.readTimeout))
+		if _, err := clientConn.Write(h.probeDecoy); err != nil {
+			logger.Debugf("Failed to write probe decoy: %v", err)
+		}
+	}
+	// This line updates proxyMetrics.ClientProxy before it's used in AddTCPProbe.
+	_, drainErr := io.Copy(io.Discard, clientConn) // drain socket
+	drainResult := drainErrToString(drainErr)
+	logger.Debugf("Drain error: %v, drain result: %v", drainErr, drainResult)
+	h.m.AddTCPProbe(status, drainResult, h.port, proxyMetrics.ClientProxy)
+}
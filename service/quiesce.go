@@ -0,0 +1,40 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import "sync/atomic"
+
+// Quiescer stops the handlers that share it from taking new connections, for
+// maintenance, while they keep relaying the ones they have, until Resume is called.
+// The zero value is not quiesced.
+type Quiescer struct {
+	quiesced atomic.Bool
+}
+
+// Quiesce makes the handlers reject new connections and UDP associations.
+func (q *Quiescer) Quiesce() {
+	q.quiesced.Store(true)
+}
+
+// Resume makes the handlers take new connections again.
+func (q *Quiescer) Resume() {
+	q.quiesced.Store(false)
+}
+
+// Quiesced reports whether new connections are rejected, for instance so that a
+// health check can report the server as not ready while it's still serving.
+func (q *Quiescer) Quiesced() bool {
+	return q.quiesced.Load()
+}
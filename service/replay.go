@@ -16,7 +16,10 @@ package service
 
 import (
 	"encoding/binary"
+	"runtime"
+	"sort"
 	"sync"
+	"time"
 )
 
 // MaxCapacity is the largest allowed size of ReplayCache.
@@ -26,30 +29,176 @@ import (
 // capacities are desired, the key type should be changed to uint64.
 const MaxCapacity = 20_000
 
+// SaltCache records the salts of handshakes to detect replays.
+// It is implemented by *ReplayCache and *TieredReplayCache.
+type SaltCache interface {
+	// Add a handshake with this key ID and salt to the cache.
+	// Returns false if it is already present.
+	Add(id string, salt []byte) bool
+}
+
+// Caches larger than this are split into segments by NewReplayCache.
+const minSegmentedCapacity = 1000
+
 type empty struct{}
 
+// Number of recent eviction ages kept by evictionAges.
+const evictionSamples = 1024
+
+// evictionAges keeps the ages of the most recently evicted entries of a
+// ReplayCache, in a ring buffer shared by all of its segments.
+type evictionAges struct {
+	// Stubbable for testing.
+	now func() time.Time
+
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func newEvictionAges() *evictionAges {
+	return &evictionAges{
+		now:     time.Now,
+		samples: make([]time.Duration, 0, evictionSamples),
+	}
+}
+
+func (a *evictionAges) record(age time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.samples) < evictionSamples {
+		a.samples = append(a.samples, age)
+		return
+	}
+	a.samples[a.next] = age
+	a.next = (a.next + 1) % evictionSamples
+}
+
+func (a *evictionAges) percentile(p float64) time.Duration {
+	a.mu.Lock()
+	sorted := append([]time.Duration(nil), a.samples...)
+	a.mu.Unlock()
+	if len(sorted) == 0 {
+		return 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	// Nearest-rank method.
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	} else if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// replaySegment remembers at least the most recent `capacity` hashes added to it.
+type replaySegment struct {
+	mutex    sync.Mutex
+	capacity int
+	active   map[uint32]empty
+	archive  map[uint32]empty
+	// When the current `active` and `archive` sets started to be filled.
+	activeSince  time.Time
+	archiveSince time.Time
+	ages         *evictionAges
+}
+
+func (s *replaySegment) add(hash uint32) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.active[hash]; ok {
+		// Fast replay: `salt` is already in the active set.
+		return false
+	}
+	_, inArchive := s.archive[hash]
+	if len(s.active) == s.capacity {
+		s.rotate()
+	}
+	s.active[hash] = empty{}
+	return !inArchive
+}
+
+// rotate discards the archive and moves active to archive. The discarded
+// entries were added while the archive was active, so they are recorded as a
+// single eviction, with the age of the entry added halfway through that period.
+// This avoids storing an insertion time for every entry.
+func (s *replaySegment) rotate() {
+	now := s.ages.now()
+	if len(s.archive) > 0 {
+		midpoint := s.archiveSince.Add(s.activeSince.Sub(s.archiveSince) / 2)
+		s.ages.record(now.Sub(midpoint))
+	}
+	s.archive = s.active
+	s.archiveSince = s.activeSince
+	s.active = make(map[uint32]empty, s.capacity)
+	s.activeSince = now
+}
+
+func (s *replaySegment) contains(hash uint32) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, inActive := s.active[hash]
+	_, inArchive := s.archive[hash]
+	return inActive || inArchive
+}
+
 // ReplayCache allows us to check whether a handshake salt was used within
 // the last `capacity` handshakes.  It requires approximately 20*capacity
 // bytes of memory (as measured by BenchmarkReplayCache_Creation).
 //
+// To reduce lock contention, the capacity may be divided across several
+// segments, each with its own lock.  A salt is assigned to a segment by its
+// hash, so each Add only locks one segment.
+//
 // The nil and zero values represent a cache with capacity 0, i.e. no cache.
 type ReplayCache struct {
-	mutex    sync.Mutex
 	capacity int
-	active   map[uint32]empty
-	archive  map[uint32]empty
+	segments []replaySegment
+	ages     *evictionAges
 }
 
 // NewReplayCache returns a fresh ReplayCache that promises to remember at least
-// the most recent `capacity` handshakes.
+// the most recent `capacity` handshakes.  Caches with a capacity above 1000
+// have one segment per CPU.
 func NewReplayCache(capacity int) ReplayCache {
+	segments := 1
+	if capacity > minSegmentedCapacity {
+		segments = runtime.NumCPU()
+	}
+	return newSegmentedReplayCache(capacity, segments)
+}
+
+// newSegmentedReplayCache returns a ReplayCache whose capacity is divided
+// across `n` segments.  Each segment remembers at least its share of the
+// recent handshakes, and an older generation of up to the same size, so the
+// cache as a whole remembers at least `capacity` handshakes unless the salts
+// are very unevenly distributed across segments.
+func newSegmentedReplayCache(capacity int, n int) ReplayCache {
 	if capacity > MaxCapacity {
 		panic("ReplayCache capacity would result in too many false positives")
 	}
+	if capacity == 0 {
+		return ReplayCache{}
+	}
+	if n > capacity {
+		n = capacity
+	}
+	segmentCapacity := (capacity + n - 1) / n
+	ages := newEvictionAges()
+	now := ages.now()
+	segments := make([]replaySegment, n)
+	for i := range segments {
+		segments[i].capacity = segmentCapacity
+		// `archive` is read-only and initially empty.
+		segments[i].active = make(map[uint32]empty, segmentCapacity)
+		segments[i].activeSince = now
+		segments[i].ages = ages
+	}
 	return ReplayCache{
 		capacity: capacity,
-		active:   make(map[uint32]empty, capacity),
-		// `archive` is read-only and initially empty.
+		segments: segments,
+		ages:     ages,
 	}
 }
 
@@ -85,18 +234,89 @@ func (c *ReplayCache) Add(id string, salt []byte) bool {
 		return true
 	}
 	hash := preHash(id, salt)
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	if _, ok := c.active[hash]; ok {
-		// Fast replay: `salt` is already in the active set.
+	return c.segments[hash%uint32(len(c.segments))].add(hash)
+}
+
+// Contains reports whether Add would reject this key ID and salt as a replay,
+// without adding it. It's meant for tests and for screening salts ahead of the
+// handshake. Checking Contains and then calling Add is racy, since another
+// handshake may add the salt in between, so only the result of Add is
+// authoritative.
+func (c *ReplayCache) Contains(id string, salt []byte) bool {
+	if c == nil || c.capacity == 0 {
 		return false
 	}
-	_, inArchive := c.archive[hash]
-	if len(c.active) == c.capacity {
-		// Discard the archive and move active to archive.
-		c.archive = c.active
-		c.active = make(map[uint32]empty, c.capacity)
+	hash := preHash(id, salt)
+	return c.segments[hash%uint32(len(c.segments))].contains(hash)
+}
+
+// RecordAge records the age of an entry at the time it was evicted from the
+// cache. The cache calls it itself whenever it discards an older generation of
+// salts.
+func (c *ReplayCache) RecordAge(age time.Duration) {
+	if c == nil || c.ages == nil {
+		return
 	}
-	c.active[hash] = empty{}
-	return !inArchive
+	c.ages.record(age)
+}
+
+// Percentile returns the p-th percentile (0 to 100) of the age of the entries at
+// the time they were evicted, over the last 1024 evictions, or 0 if there has
+// been none. If it's much shorter than the time a replay remains a threat, the
+// capacity should be increased.
+func (c *ReplayCache) Percentile(p float64) time.Duration {
+	if c == nil || c.ages == nil {
+		return 0
+	}
+	return c.ages.percentile(p)
+}
+
+// SharedSaltStore is a store of handshake salts shared by several servers, so
+// that a salt accepted by one of them is rejected by all the others. It would
+// typically be backed by a database such as Redis, with SETNX and a TTL.
+type SharedSaltStore interface {
+	// Add records the salt for this key ID. Returns false if it was already
+	// recorded, or an error if the store could not be reached. Implementations
+	// should apply their own timeout, since Add is called during the handshake.
+	Add(id string, salt []byte) (bool, error)
+}
+
+// ReplayCacheMetrics is used to report errors of the shared tier of a
+// TieredReplayCache.
+type ReplayCacheMetrics interface {
+	AddSharedReplayCacheError()
+}
+
+// TieredReplayCache checks salts against a local ReplayCache, and then against
+// a SharedSaltStore for replays first seen by other servers. If the shared
+// store fails, the error is logged and reported and the salt is accepted, so
+// that an outage of the store doesn't reject every connection.
+type TieredReplayCache struct {
+	local   *ReplayCache
+	shared  SharedSaltStore
+	metrics ReplayCacheMetrics
+}
+
+var _ SaltCache = (*TieredReplayCache)(nil)
+
+// NewTieredReplayCache returns a TieredReplayCache that uses `local` as the first
+// tier and `shared` as the second.
+func NewTieredReplayCache(local *ReplayCache, shared SharedSaltStore, metrics ReplayCacheMetrics) *TieredReplayCache {
+	return &TieredReplayCache{local: local, shared: shared, metrics: metrics}
+}
+
+// Add a handshake with this key ID and salt to both tiers.
+// Returns false if it is present in either of them.
+func (c *TieredReplayCache) Add(id string, salt []byte) bool {
+	if !c.local.Add(id, salt) {
+		// Replays to the same server don't need a round trip to the shared store.
+		return false
+	}
+	added, err := c.shared.Add(id, salt)
+	if err != nil {
+		logger.Warningf("Failed to check shared replay cache: %v. Accepting salt.", err)
+		c.metrics.AddSharedReplayCacheError()
+		return true
+	}
+	return added
 }
@@ -16,7 +16,13 @@ package service
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const keyID = "the key"
@@ -91,6 +97,214 @@ func TestReplayCache_Archive(t *testing.T) {
 	}
 }
 
+func TestReplayCache_Contains(t *testing.T) {
+	salts := makeSalts(12)
+	cache := NewReplayCache(10)
+	if cache.Contains(keyID, salts[0]) {
+		t.Error("Clean cache should not contain anything")
+	}
+	if cache.Contains(keyID, salts[0]) || !cache.Add(keyID, salts[0]) {
+		t.Error("Contains should not add the salt")
+	}
+	if !cache.Contains(keyID, salts[0]) {
+		t.Error("Cache should contain an added salt")
+	}
+	if cache.Contains("other key", salts[0]) {
+		t.Error("Salts of other keys should not be contained")
+	}
+	// Salts in the archive are still contained, as Add would reject them.
+	for _, s := range salts[1:] {
+		cache.Add(keyID, s)
+	}
+	for _, s := range salts {
+		if !cache.Contains(keyID, s) {
+			t.Error("Cache should contain archived salts")
+		}
+	}
+
+	var disabled ReplayCache
+	disabled.Add(keyID, salts[0])
+	if disabled.Contains(keyID, salts[0]) {
+		t.Error("Disabled cache should not contain anything")
+	}
+}
+
+func TestReplayCache_Percentile(t *testing.T) {
+	var cache ReplayCache
+	if cache.Percentile(50) != 0 {
+		t.Error("Disabled cache should report no evictions")
+	}
+
+	cache = NewReplayCache(10)
+	if cache.Percentile(50) != 0 {
+		t.Error("Clean cache should report no evictions")
+	}
+	for i := 1; i <= 100; i++ {
+		cache.RecordAge(time.Duration(i) * time.Second)
+	}
+	for _, p := range []float64{0, 50, 95, 99, 100} {
+		expected := time.Duration(p) * time.Second
+		if p == 0 {
+			expected = time.Second
+		}
+		if age := cache.Percentile(p); age != expected {
+			t.Errorf("Percentile(%v) = %v, expected %v", p, age, expected)
+		}
+	}
+
+	// Only the most recent evictions are kept.
+	for i := 101; i <= 2000; i++ {
+		cache.RecordAge(time.Duration(i) * time.Second)
+	}
+	if age := cache.Percentile(0); age != (2000-evictionSamples+1)*time.Second {
+		t.Errorf("Oldest sample should have been discarded, got %v", age)
+	}
+}
+
+func TestReplayCache_EvictionAge(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	now := start
+	cache := newSegmentedReplayCache(10, 1)
+	cache.ages.now = func() time.Time { return now }
+	cache.segments[0].activeSince = start
+	// One handshake per second until the cache has wrapped around several
+	// times, so each salt is evicted 11 to 20 seconds after it was added.
+	for _, s := range makeSalts(101) {
+		now = now.Add(time.Second)
+		cache.Add(keyID, s)
+	}
+	// Each generation is recorded with the age of the midpoint of the period in
+	// which it was filled. The first one was filled from 0 to 11 seconds and
+	// evicted at 21, so its age is 15.5 seconds, and the following ones were
+	// each filled and evicted 10 seconds apart, with an age of 15 seconds.
+	if age := cache.Percentile(50); age != 15*time.Second {
+		t.Errorf("Expected median eviction age of 15s, got %v", age)
+	}
+	if age := cache.Percentile(100); age != 15500*time.Millisecond {
+		t.Errorf("Expected maximum eviction age of 15.5s, got %v", age)
+	}
+}
+
+func TestReplayCache_Segmented(t *testing.T) {
+	salts := makeSalts(2000)
+	cache := newSegmentedReplayCache(2000, 4)
+	if len(cache.segments) != 4 {
+		t.Fatalf("Expected 4 segments, got %d", len(cache.segments))
+	}
+	for _, s := range salts {
+		if !cache.Add(keyID, s) {
+			t.Error("Addition of a new vector should succeed")
+		}
+	}
+	for _, s := range salts {
+		if cache.Add(keyID, s) {
+			t.Error("Duplicate add should fail")
+		}
+	}
+}
+
+func TestReplayCache_Concurrent(t *testing.T) {
+	salts := makeSalts(100)
+	cache := newSegmentedReplayCache(1000, 4)
+	// Each salt is added by several goroutines at once, and only one may succeed.
+	const adders = 8
+	var accepted [100]atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < adders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j, s := range salts {
+				if cache.Add(keyID, s) {
+					accepted[j].Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for j := range accepted {
+		if n := accepted[j].Load(); n != 1 {
+			t.Errorf("Salt %d was accepted %d times", j, n)
+		}
+	}
+}
+
+func TestReplayCache_SegmentCount(t *testing.T) {
+	if n := len(NewReplayCache(minSegmentedCapacity).segments); n != 1 {
+		t.Errorf("Expected a single segment, got %d", n)
+	}
+	if n := len(NewReplayCache(MaxCapacity).segments); n != runtime.NumCPU() {
+		t.Errorf("Expected %d segments, got %d", runtime.NumCPU(), n)
+	}
+	if n := len(newSegmentedReplayCache(3, 8).segments); n != 3 {
+		t.Errorf("Expected no more segments than the capacity, got %d", n)
+	}
+	if cache := NewReplayCache(0); !cache.Add(keyID, makeSalts(1)[0]) {
+		t.Error("Empty cache should accept every salt")
+	}
+}
+
+// Simulates a store shared with other servers.
+type fakeSaltStore struct {
+	salts map[string]bool
+	err   error
+}
+
+func (s *fakeSaltStore) Add(id string, salt []byte) (bool, error) {
+	if s.err != nil {
+		return false, s.err
+	}
+	key := id + string(salt)
+	if s.salts[key] {
+		return false, nil
+	}
+	s.salts[key] = true
+	return true, nil
+}
+
+type fakeReplayCacheMetrics struct {
+	errors int
+}
+
+func (m *fakeReplayCacheMetrics) AddSharedReplayCacheError() {
+	m.errors++
+}
+
+func TestTieredReplayCache(t *testing.T) {
+	salts := makeSalts(3)
+	shared := &fakeSaltStore{salts: make(map[string]bool)}
+	metrics := &fakeReplayCacheMetrics{}
+	localA := NewReplayCache(10)
+	localB := NewReplayCache(10)
+	serverA := NewTieredReplayCache(&localA, shared, metrics)
+	serverB := NewTieredReplayCache(&localB, shared, metrics)
+
+	if !serverA.Add(keyID, salts[0]) {
+		t.Error("First addition should succeed")
+	}
+	if serverA.Add(keyID, salts[0]) {
+		t.Error("Duplicate add to the same server should fail")
+	}
+	if serverB.Add(keyID, salts[0]) {
+		t.Error("Duplicate add to another server should fail")
+	}
+	if !serverB.Add(keyID, salts[1]) {
+		t.Error("Addition of a new vector should succeed")
+	}
+
+	// Fail open if the shared store is unavailable.
+	shared.err = errors.New("unavailable")
+	if !serverA.Add(keyID, salts[2]) {
+		t.Error("Addition should succeed when the shared store fails")
+	}
+	if serverA.Add(keyID, salts[2]) {
+		t.Error("Local replays should still be detected when the shared store fails")
+	}
+	if metrics.errors != 1 {
+		t.Errorf("Expected 1 error, got %d", metrics.errors)
+	}
+}
+
 // Benchmark to determine the memory usage of ReplayCache.
 // Note that NewReplayCache only allocates the active set,
 // so the eventual memory usage will be roughly double.
@@ -135,3 +349,30 @@ func BenchmarkReplayCache_Parallel(b *testing.B) {
 		}
 	})
 }
+
+// Compares a single lock to a segmented cache as the number of goroutines
+// adding salts grows.  Contention only appears with GOMAXPROCS > 1.
+func BenchmarkReplayCacheContention(b *testing.B) {
+	for _, segments := range []int{1, 16} {
+		for _, parallelism := range []int{1, 4, 16} {
+			b.Run(fmt.Sprintf("segments=%d/parallelism=%d", segments, parallelism), func(b *testing.B) {
+				cache := newSegmentedReplayCache(MaxCapacity, segments)
+				var goroutines uint32
+				b.SetParallelism(parallelism)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					// Each goroutine generates its own salts, so that only the
+					// cache is shared.
+					salt := make([]byte, 8)
+					binary.BigEndian.PutUint32(salt, atomic.AddUint32(&goroutines, 1)<<24)
+					var i uint32
+					for pb.Next() {
+						binary.BigEndian.PutUint32(salt[4:], i)
+						cache.Add(keyID, salt)
+						i++
+					}
+				})
+			})
+		}
+	}
+}
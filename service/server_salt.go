@@ -51,6 +51,43 @@ func (randomServerSaltGenerator) IsServerSalt(salt []byte) bool {
 // RandomServerSaltGenerator is a basic ServerSaltGenerator.
 var RandomServerSaltGenerator ServerSaltGenerator = randomServerSaltGenerator{}
 
+// SaltGeneratorFunc returns a new salt of `saltSize` bytes.
+type SaltGeneratorFunc func(saltSize int) ([]byte, error)
+
+// funcServerSaltGenerator generates salts with a SaltGeneratorFunc.
+type funcServerSaltGenerator struct {
+	generate SaltGeneratorFunc
+}
+
+// NewFuncServerSaltGenerator returns a ServerSaltGenerator that gets its salts
+// from `generate`, for keys with special requirements, such as salts in a
+// reserved namespace. It can be set as the SaltGenerator of a CipherEntry, which
+// uses it for the salts of the TCP streams it writes to clients. GetSalt fails
+// if `generate` returns a salt of the wrong size.
+//
+// Its salts are not marked, so IsServerSalt is always false, and the server
+// doesn't recognize them if a client reflects them back, unless `generate`
+// and the replay cache take care of it.
+func NewFuncServerSaltGenerator(generate SaltGeneratorFunc) ServerSaltGenerator {
+	return funcServerSaltGenerator{generate}
+}
+
+func (sg funcServerSaltGenerator) GetSalt(salt []byte) error {
+	generated, err := sg.generate(len(salt))
+	if err != nil {
+		return err
+	}
+	if len(generated) != len(salt) {
+		return fmt.Errorf("salt generator returned %d bytes instead of %d", len(generated), len(salt))
+	}
+	copy(salt, generated)
+	return nil
+}
+
+func (funcServerSaltGenerator) IsServerSalt(salt []byte) bool {
+	return false
+}
+
 // serverSaltGenerator generates unique salts that are secretly marked.
 type serverSaltGenerator struct {
 	key []byte
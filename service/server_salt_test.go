@@ -16,6 +16,7 @@ package service
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 )
 
@@ -151,3 +152,41 @@ func BenchmarkServerSaltGenerator(b *testing.B) {
 		}
 	})
 }
+
+// Test that a custom salt generator is used and its output validated.
+func TestFuncServerSalt(t *testing.T) {
+	prefix := []byte("ns")
+	ssg := NewFuncServerSaltGenerator(func(saltSize int) ([]byte, error) {
+		salt := make([]byte, saltSize)
+		if err := RandomServerSaltGenerator.GetSalt(salt); err != nil {
+			return nil, err
+		}
+		copy(salt, prefix)
+		return salt, nil
+	})
+	salt := make([]byte, 32)
+	if err := ssg.GetSalt(salt); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(salt, prefix) {
+		t.Errorf("Salt %x doesn't come from the custom generator", salt)
+	}
+	if ssg.IsServerSalt(salt) {
+		t.Error("Custom salts are not marked")
+	}
+
+	short := NewFuncServerSaltGenerator(func(saltSize int) ([]byte, error) {
+		return make([]byte, saltSize-1), nil
+	})
+	if err := short.GetSalt(salt); err == nil {
+		t.Error("Salt of the wrong size should be rejected")
+	}
+
+	errFailed := errors.New("failed")
+	failing := NewFuncServerSaltGenerator(func(saltSize int) ([]byte, error) {
+		return nil, errFailed
+	})
+	if err := failing.GetSalt(salt); !errors.Is(err, errFailed) {
+		t.Errorf("Expected the generator's error, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+)
+
+// deadlineWriter sets a write deadline on its connection before each write, and
+// clears it after.
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	if err := w.conn.SetWriteDeadline(time.Now().Add(w.timeout)); err != nil {
+		return 0, err
+	}
+	n, err := w.conn.Write(p)
+	if resetErr := w.conn.SetWriteDeadline(time.Time{}); err == nil {
+		err = resetErr
+	}
+	return n, err
+}
+
+// NewShadowsocksWriter returns a Shadowsocks stream writer to `conn`. If
+// `chunkWriteTimeout` is positive, each write of encrypted chunks to `conn` must
+// complete within it, or fails with [os.ErrDeadlineExceeded], so that a client
+// that stops reading can't block the relay forever. The deadline is cleared after
+// each write, so it doesn't apply while the relay waits for data to write.
+func NewShadowsocksWriter(conn net.Conn, key *shadowsocks.EncryptionKey, chunkWriteTimeout time.Duration) *shadowsocks.Writer {
+	if chunkWriteTimeout <= 0 {
+		return shadowsocks.NewWriter(conn, key)
+	}
+	return shadowsocks.NewWriter(&deadlineWriter{conn, chunkWriteTimeout}, key)
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/stretchr/testify/require"
+)
+
+// slowConn is a net.Conn whose writes take `delay`, and fail if that goes past the
+// write deadline. It records the deadlines set.
+type slowConn struct {
+	net.Conn
+	delay     time.Duration
+	deadline  time.Time
+	deadlines []time.Time
+	written   bytes.Buffer
+}
+
+func (c *slowConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func (c *slowConn) Write(p []byte) (int, error) {
+	if !c.deadline.IsZero() && time.Now().Add(c.delay).After(c.deadline) {
+		time.Sleep(time.Until(c.deadline))
+		return 0, os.ErrDeadlineExceeded
+	}
+	time.Sleep(c.delay)
+	return c.written.Write(p)
+}
+
+func TestShadowsocksWriterChunkDeadline(t *testing.T) {
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err)
+	key := firstCipher(cipherList)
+
+	// Each chunk is written within the deadline, which is cleared after each one.
+	conn := &slowConn{delay: time.Millisecond}
+	writer := NewShadowsocksWriter(conn, key, 100*time.Millisecond)
+	payload := make([]byte, 2*maxChunkPayload)
+	_, err = writer.Write(payload)
+	require.NoError(t, err)
+	require.Len(t, conn.deadlines, 4)
+	for i := 0; i < len(conn.deadlines); i += 2 {
+		require.False(t, conn.deadlines[i].IsZero())
+		require.True(t, conn.deadlines[i+1].IsZero())
+	}
+	decrypted, err := io.ReadAll(shadowsocks.NewReader(&conn.written, key))
+	require.NoError(t, err)
+	require.Equal(t, payload, decrypted)
+
+	// A chunk that takes too long fails.
+	conn = &slowConn{delay: 200 * time.Millisecond}
+	writer = NewShadowsocksWriter(conn, key, 20*time.Millisecond)
+	start := time.Now()
+	_, err = writer.Write([]byte("payload"))
+	require.True(t, errors.Is(err, os.ErrDeadlineExceeded), "unexpected error %v", err)
+	require.Less(t, time.Since(start), 200*time.Millisecond)
+	require.True(t, conn.deadline.IsZero(), "deadline should be cleared")
+
+	// Without a timeout, no deadline is set.
+	conn = &slowConn{}
+	_, err = NewShadowsocksWriter(conn, key, 0).Write([]byte("payload"))
+	require.NoError(t, err)
+	require.Empty(t, conn.deadlines)
+}
+
+func TestShadowsocksWriterPipe(t *testing.T) {
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err)
+	clientEnd, serverEnd := net.Pipe()
+	defer clientEnd.Close()
+	defer serverEnd.Close()
+	// Nobody reads from the client end, so the write blocks until the deadline.
+	writer := NewShadowsocksWriter(serverEnd, firstCipher(cipherList), 20*time.Millisecond)
+	_, err = writer.Write([]byte("payload"))
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
@@ -0,0 +1,212 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/ipinfo"
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+)
+
+// KeyUsage is the usage of one access key.
+type KeyUsage struct {
+	// Closed TCP connections.
+	TCPConnections int64
+	// UDP packets received from the client.
+	UDPPackets int64
+	// Bytes received from and sent to the client, over TCP and UDP.
+	BytesFromClient int64
+	BytesToClient   int64
+}
+
+// MetricsSnapshot holds the values of the counters of a [SnapshotMetrics] at a
+// point in time.
+type MetricsSnapshot struct {
+	// TCP connections that are currently open.
+	TCPOpenConnections   int64
+	TCPClosedConnections int64
+	TCPProbes            int64
+	// Times that a target's circuit breaker opened.
+	TCPCircuitBreakerOpens int64
+	// Target dials that took longer than the slow dial threshold.
+	TCPSlowDials int64
+	// UDP NAT entries that are currently active.
+	UDPNatEntries          int64
+	UDPPacketsFromClient   int64
+	UDPPacketsFromTarget   int64
+	UDPDeduplicatedPackets int64
+	// Replies dropped for exceeding the amplification limit.
+	UDPAmplificationDrops int64
+	// UDP NAT entries moved to a new client address.
+	UDPConnectionMigrations int64
+	// Packets from clients that were likely retransmitted or duplicated by the network.
+	UDPClientDuplicates int64
+	// Usage per access key ID.
+	Keys map[string]KeyUsage
+}
+
+// SnapshotMetrics is a [TCPMetrics] and [UDPMetrics] that keeps aggregate counters
+// in memory, for applications that embed the service and want to poll its usage
+// without exporting Prometheus metrics.
+type SnapshotMetrics struct {
+	ip2info ipinfo.IPInfoMap
+
+	mu       sync.Mutex
+	counters MetricsSnapshot
+}
+
+var _ TCPMetrics = (*SnapshotMetrics)(nil)
+var _ UDPMetrics = (*SnapshotMetrics)(nil)
+
+// NewSnapshotMetrics creates a SnapshotMetrics. `ip2info` is used to look up client
+// locations, and may be nil.
+func NewSnapshotMetrics(ip2info ipinfo.IPInfoMap) *SnapshotMetrics {
+	return &SnapshotMetrics{
+		ip2info:  ip2info,
+		counters: MetricsSnapshot{Keys: make(map[string]KeyUsage)},
+	}
+}
+
+// Snapshot returns a copy of the current counters. It's safe to call concurrently
+// with the reporting methods.
+func (m *SnapshotMetrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snapshot := m.counters
+	snapshot.Keys = make(map[string]KeyUsage, len(m.counters.Keys))
+	for id, usage := range m.counters.Keys {
+		snapshot.Keys[id] = usage
+	}
+	return snapshot
+}
+
+// updateKey applies `update` to the usage of `accessKey`. Must be called with mu held.
+func (m *SnapshotMetrics) updateKey(accessKey string, update func(usage *KeyUsage)) {
+	if accessKey == "" {
+		return
+	}
+	usage := m.counters.Keys[accessKey]
+	update(&usage)
+	m.counters.Keys[accessKey] = usage
+}
+
+func (m *SnapshotMetrics) GetIPInfo(ip net.IP) (ipinfo.IPInfo, error) {
+	if m.ip2info == nil {
+		return ipinfo.IPInfo{}, nil
+	}
+	return m.ip2info.GetIPInfo(ip)
+}
+
+func (m *SnapshotMetrics) AddOpenTCPConnection(clientInfo ipinfo.IPInfo) {
+	m.mu.Lock()
+	m.counters.TCPOpenConnections++
+	m.mu.Unlock()
+}
+
+func (m *SnapshotMetrics) AddAuthenticatedTCPConnection(clientAddr net.Addr, accessKey string) {}
+
+func (m *SnapshotMetrics) AddClosedTCPConnection(clientInfo ipinfo.IPInfo, clientAddr net.Addr, accessKey, status string, data metrics.ProxyMetrics, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters.TCPOpenConnections--
+	m.counters.TCPClosedConnections++
+	m.updateKey(accessKey, func(usage *KeyUsage) {
+		usage.TCPConnections++
+		usage.BytesFromClient += data.ClientProxy
+		usage.BytesToClient += data.ProxyClient
+	})
+}
+
+func (m *SnapshotMetrics) AddTCPProbe(status, drainResult string, port int, clientProxyBytes int64) {
+	m.mu.Lock()
+	m.counters.TCPProbes++
+	m.mu.Unlock()
+}
+
+func (m *SnapshotMetrics) AddTCPCircuitBreakerOpen(target string) {
+	m.mu.Lock()
+	m.counters.TCPCircuitBreakerOpens++
+	m.mu.Unlock()
+}
+
+func (m *SnapshotMetrics) AddTCPSlowDial(target string, elapsed time.Duration) {
+	m.mu.Lock()
+	m.counters.TCPSlowDials++
+	m.mu.Unlock()
+}
+
+func (m *SnapshotMetrics) AddTCPProbeResponse(response string) {}
+
+func (m *SnapshotMetrics) AddTCPCipherSearch(accessKeyFound bool, timeToCipher time.Duration) {}
+
+func (m *SnapshotMetrics) AddUDPPacketFromClient(clientInfo ipinfo.IPInfo, accessKey, status string, clientProxyBytes, proxyTargetBytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters.UDPPacketsFromClient++
+	m.updateKey(accessKey, func(usage *KeyUsage) {
+		usage.UDPPackets++
+		usage.BytesFromClient += int64(clientProxyBytes)
+	})
+}
+
+func (m *SnapshotMetrics) AddUDPPacketFromTarget(clientInfo ipinfo.IPInfo, accessKey, status string, targetProxyBytes, proxyClientBytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters.UDPPacketsFromTarget++
+	m.updateKey(accessKey, func(usage *KeyUsage) {
+		usage.BytesToClient += int64(proxyClientBytes)
+	})
+}
+
+func (m *SnapshotMetrics) AddUDPNatEntry(clientAddr net.Addr, accessKey string) {
+	m.mu.Lock()
+	m.counters.UDPNatEntries++
+	m.mu.Unlock()
+}
+
+func (m *SnapshotMetrics) RemoveUDPNatEntry(clientAddr net.Addr, accessKey string) {
+	m.mu.Lock()
+	m.counters.UDPNatEntries--
+	m.mu.Unlock()
+}
+
+func (m *SnapshotMetrics) AddUDPDeduplication() {
+	m.mu.Lock()
+	m.counters.UDPDeduplicatedPackets++
+	m.mu.Unlock()
+}
+
+func (m *SnapshotMetrics) AddUDPAmplificationDrop() {
+	m.mu.Lock()
+	m.counters.UDPAmplificationDrops++
+	m.mu.Unlock()
+}
+
+func (m *SnapshotMetrics) AddUDPConnectionMigration(accessKey string) {
+	m.mu.Lock()
+	m.counters.UDPConnectionMigrations++
+	m.mu.Unlock()
+}
+
+func (m *SnapshotMetrics) AddUDPClientDuplicate(accessKey string) {
+	m.mu.Lock()
+	m.counters.UDPClientDuplicates++
+	m.mu.Unlock()
+}
+
+func (m *SnapshotMetrics) AddUDPCipherSearch(accessKeyFound bool, timeToCipher time.Duration) {}
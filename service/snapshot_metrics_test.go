@@ -0,0 +1,91 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/ipinfo"
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotMetrics(t *testing.T) {
+	m := NewSnapshotMetrics(nil)
+	clientAddr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	info := ipinfo.IPInfo{}
+
+	m.AddOpenTCPConnection(info)
+	m.AddOpenTCPConnection(info)
+	m.AddClosedTCPConnection(info, clientAddr, "id-0", "OK", metrics.ProxyMetrics{ClientProxy: 10, ProxyClient: 20}, time.Second)
+	m.AddTCPProbe("ERR_CIPHER", "eof", 443, 50)
+	m.AddTCPCircuitBreakerOpen("192.0.2.2:80")
+	m.AddTCPSlowDial("192.0.2.2:80", time.Second)
+	m.AddTCPProbeResponse("hang")
+	m.AddUDPNatEntry(clientAddr, "id-1")
+	m.AddUDPPacketFromClient(info, "id-1", "OK", 30, 28)
+	m.AddUDPPacketFromTarget(info, "id-1", "OK", 40, 42)
+	m.AddUDPDeduplication()
+	m.AddUDPAmplificationDrop()
+	m.AddUDPConnectionMigration("id-1")
+	m.AddUDPClientDuplicate("id-1")
+
+	snapshot := m.Snapshot()
+	require.Equal(t, MetricsSnapshot{
+		TCPOpenConnections:      1,
+		TCPClosedConnections:    1,
+		TCPProbes:               1,
+		TCPCircuitBreakerOpens:  1,
+		TCPSlowDials:            1,
+		UDPNatEntries:           1,
+		UDPPacketsFromClient:    1,
+		UDPPacketsFromTarget:    1,
+		UDPDeduplicatedPackets:  1,
+		UDPAmplificationDrops:   1,
+		UDPConnectionMigrations: 1,
+		UDPClientDuplicates:     1,
+		Keys: map[string]KeyUsage{
+			"id-0": {TCPConnections: 1, BytesFromClient: 10, BytesToClient: 20},
+			"id-1": {UDPPackets: 1, BytesFromClient: 30, BytesToClient: 42},
+		},
+	}, snapshot)
+
+	// The snapshot doesn't change with later updates.
+	m.RemoveUDPNatEntry(clientAddr, "id-1")
+	m.AddUDPPacketFromClient(info, "id-1", "OK", 30, 28)
+	require.Equal(t, int64(1), snapshot.UDPNatEntries)
+	require.Equal(t, int64(1), snapshot.Keys["id-1"].UDPPackets)
+	require.Equal(t, int64(2), m.Snapshot().Keys["id-1"].UDPPackets)
+}
+
+func TestSnapshotMetricsConcurrent(t *testing.T) {
+	m := NewSnapshotMetrics(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.AddUDPPacketFromClient(ipinfo.IPInfo{}, "id-0", "OK", 1, 1)
+				m.Snapshot()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int64(1000), m.Snapshot().Keys["id-0"].BytesFromClient)
+}
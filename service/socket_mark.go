@@ -0,0 +1,53 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+var errSocketMarkUnsupported = errors.New("SO_MARK is only supported on Linux")
+
+// setSocketMark sets SO_MARK on a socket. It's a variable so that tests can check
+// the calls without the CAP_NET_ADMIN capability that the option requires.
+var setSocketMark = setsockoptMark
+
+// markDialer returns a copy of `dialer` that sets SO_MARK to `mark` on its sockets
+// before connecting, after its own Control function, if any. Dialers other than
+// *transport.TCPDialer are returned unchanged, and so is every dialer if `mark` is 0.
+func markDialer(dialer transport.StreamDialer, mark uint32) transport.StreamDialer {
+	tcpDialer, ok := dialer.(*transport.TCPDialer)
+	if !ok || mark == 0 {
+		return dialer
+	}
+	marked := *tcpDialer
+	control := tcpDialer.Dialer.Control
+	marked.Dialer.Control = func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		var sockErr error
+		if err := c.Control(func(fd uintptr) { sockErr = setSocketMark(fd, mark) }); err != nil {
+			return err
+		}
+		return sockErr
+	}
+	return &marked
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"io"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+)
+
+// StreamFilter sees the plaintext that a client sends to its target, after
+// decryption and after the target address, and before it's written to the target.
+// Data from the target to the client is not filtered.
+//
+// Filter is called with each chunk read from the client, whose boundaries depend on
+// the client and the network, so patterns may span chunks. It returns the bytes to
+// write to the target instead, which may be `data` itself, a modified copy, or
+// nothing. It may keep state across calls, but it isn't told when the stream ends,
+// so bytes it holds back are lost. Returning an error closes the connection, with
+// status "ERR_FILTERED".
+//
+// Filters run on the relay goroutine, so a slow filter slows down the connection,
+// and a filter that blocks stalls it. Modifying the stream also breaks protocols
+// with integrity checks, and is usually pointless for encrypted ones like TLS.
+type StreamFilter interface {
+	Filter(data []byte) ([]byte, error)
+}
+
+// NewStreamFilterFunc creates the [StreamFilter] of a connection. It may return nil
+// to leave the connection unfiltered.
+type NewStreamFilterFunc func(accessKey, targetAddr string) StreamFilter
+
+// filteredReader passes the data read from a Reader through a StreamFilter.
+type filteredReader struct {
+	io.Reader
+	filter StreamFilter
+	// Filtered bytes that didn't fit in the caller's buffer.
+	pending []byte
+	// Error to return once pending is empty.
+	err error
+}
+
+func (r *filteredReader) Read(p []byte) (int, error) {
+	if len(r.pending) > 0 {
+		n := copy(p, r.pending)
+		r.pending = r.pending[n:]
+		return n, nil
+	}
+	for r.err == nil {
+		n, err := r.Reader.Read(p)
+		r.err = err
+		if n == 0 {
+			continue
+		}
+		out, filterErr := r.filter.Filter(p[:n])
+		if filterErr != nil {
+			r.err = onet.NewConnectionError("ERR_FILTERED", "Stream filter closed the connection", filterErr)
+			return 0, r.err
+		}
+		if len(out) == 0 {
+			continue
+		}
+		n = copy(p, out)
+		if n < len(out) {
+			// The rest may alias memory that the filter or the caller reuses.
+			r.pending = bytes.Clone(out[n:])
+		}
+		return n, nil
+	}
+	return 0, r.err
+}
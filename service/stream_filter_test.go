@@ -0,0 +1,83 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/stretchr/testify/require"
+)
+
+type funcStreamFilter func(data []byte) ([]byte, error)
+
+func (f funcStreamFilter) Filter(data []byte) ([]byte, error) {
+	return f(data)
+}
+
+func TestFilteredReaderTransform(t *testing.T) {
+	// Doubles every byte, so the output doesn't fit in the read buffer.
+	double := funcStreamFilter(func(data []byte) ([]byte, error) {
+		out := make([]byte, 0, 2*len(data))
+		for _, b := range data {
+			out = append(out, b, b)
+		}
+		return out, nil
+	})
+	r := &filteredReader{Reader: bytes.NewReader([]byte("abc")), filter: double}
+	// iotest.OneByteReader makes the caller's buffer a single byte.
+	out, err := io.ReadAll(iotest.OneByteReader(r))
+	require.NoError(t, err)
+	require.Equal(t, "aabbcc", string(out))
+}
+
+func TestFilteredReaderDrop(t *testing.T) {
+	dropDigits := funcStreamFilter(func(data []byte) ([]byte, error) {
+		return bytes.TrimLeft(data, "0123456789"), nil
+	})
+	r := &filteredReader{Reader: iotest.OneByteReader(bytes.NewReader([]byte("1a23b4"))), filter: dropDigits}
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "ab", string(out))
+}
+
+func TestFilteredReaderTerminate(t *testing.T) {
+	filterErr := errors.New("forbidden")
+	var calls int
+	reject := funcStreamFilter(func(data []byte) ([]byte, error) {
+		calls++
+		if bytes.Contains(data, []byte("x")) {
+			return nil, filterErr
+		}
+		return data, nil
+	})
+	r := &filteredReader{Reader: iotest.OneByteReader(bytes.NewReader([]byte("abxcd"))), filter: reject}
+	out, err := io.ReadAll(r)
+	require.Equal(t, "ab", string(out))
+	require.ErrorIs(t, err, filterErr)
+	var connErr *onet.ConnectionError
+	require.ErrorAs(t, err, &connErr)
+	require.Equal(t, "ERR_FILTERED", connErr.Status)
+
+	// Later reads fail without reading or filtering anything else.
+	n, err := r.Read(make([]byte, 10))
+	require.Equal(t, 0, n)
+	require.ErrorIs(t, err, filterErr)
+	require.Equal(t, 3, calls)
+}
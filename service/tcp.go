@@ -23,7 +23,9 @@ import (
 	"io"
 	"net"
 	"net/netip"
+	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -45,6 +47,11 @@ type TCPMetrics interface {
 	AddAuthenticatedTCPConnection(clientAddr net.Addr, accessKey string)
 	AddClosedTCPConnection(clientInfo ipinfo.IPInfo, clientAddr net.Addr, accessKey string, status string, data metrics.ProxyMetrics, duration time.Duration)
 	AddTCPProbe(status, drainResult string, port int, clientProxyBytes int64)
+	AddTCPCircuitBreakerOpen(target string)
+	AddTCPSlowDial(target string, elapsed time.Duration)
+	// AddTCPProbeResponse is called with the [ProbeResponse] given to each
+	// connection that fails the handshake.
+	AddTCPProbeResponse(response string)
 }
 
 func remoteIP(conn net.Conn) netip.Addr {
@@ -77,16 +84,40 @@ func debugTCP(cipherID, template string, val interface{}) {
 // required = saltSize + 2 + cipher.TagSize, the number of bytes needed to authenticate the connection.
 const bytesForKeyFinding = 50
 
+// minHandshakeSize is the number of bytes that the shortest handshake takes to
+// reach its first authenticated field: the 16-byte salt of aes-128-gcm, followed
+// by the 2-byte length of the first chunk and its 16-byte tag.
+const minHandshakeSize = 16 + 2 + 16
+
+// errTruncatedHandshake is returned by findAccessKey when the client closes the
+// connection before sending minHandshakeSize bytes. Such connections get status
+// "ERR_PROBE_TRUNCATED" rather than "ERR_CIPHER", since they can't hold a valid
+// handshake with any cipher: they are probes or broken clients, not wrong keys.
+// Connections that time out, or close later, keep status "ERR_CIPHER".
+var errTruncatedHandshake = errors.New("handshake truncated")
+
 func findAccessKey(clientReader io.Reader, clientIP netip.Addr, cipherList CipherList) (*CipherEntry, io.Reader, []byte, time.Duration, error) {
-	// We snapshot the list because it may be modified while we use it.
-	ciphers := cipherList.SnapshotForClientIP(clientIP)
+	// Connections that close before sending enough bytes to authenticate are
+	// rejected before taking the snapshot, which is O(n) in the number of ciphers.
 	firstBytes := make([]byte, bytesForKeyFinding)
 	if n, err := io.ReadFull(clientReader, firstBytes); err != nil {
+		if n < minHandshakeSize && (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) {
+			err = fmt.Errorf("%w: %w", errTruncatedHandshake, err)
+		}
 		return nil, clientReader, nil, 0, fmt.Errorf("reading header failed after %d bytes: %w", n, err)
 	}
-
+	// The time to cipher includes the snapshot, as it does for UDP, so that the two
+	// can be compared. It starts once the header is read, so the client's network
+	// delay is not included.
 	findStartTime := time.Now()
-	entry, elt := findEntry(firstBytes, ciphers)
+	// We snapshot the list because it may be modified while we use it.
+	ciphers := cipherList.SnapshotForClientIP(clientIP)
+	if len(ciphers) == 0 {
+		warnNoKeys()
+		return nil, clientReader, nil, time.Since(findStartTime), errNoKeys
+	}
+
+	entry, elt := findEntry(firstBytes, ciphers, isConstantTime(cipherList))
 	timeToCipher := time.Since(findStartTime)
 	if entry == nil {
 		// TODO: Ban and log client IPs with too many failures too quick to protect against DoS.
@@ -100,9 +131,12 @@ func findAccessKey(clientReader io.Reader, clientIP netip.Addr, cipherList Ciphe
 }
 
 // Implements a trial decryption search.  This assumes that all ciphers are AEAD.
-func findEntry(firstBytes []byte, ciphers []*list.Element) (*CipherEntry, *list.Element) {
+// If exhaustive is true, the search continues past the first match so that its
+// duration doesn't depend on which cipher matched.
+func findEntry(firstBytes []byte, ciphers []*list.Element, exhaustive bool) (*CipherEntry, *list.Element) {
 	// To hold the decrypted chunk length.
 	chunkLenBuf := [2]byte{}
+	var foundElt *list.Element
 	for ci, elt := range ciphers {
 		entry := elt.Value.(*CipherEntry)
 		cryptoKey := entry.CryptoKey
@@ -112,26 +146,69 @@ func findEntry(firstBytes []byte, ciphers []*list.Element) (*CipherEntry, *list.
 			continue
 		}
 		debugTCP(entry.ID, "Found cipher at index %d", ci)
-		return entry, elt
+		if !exhaustive {
+			return entry, elt
+		}
+		if foundElt == nil {
+			foundElt = elt
+		}
 	}
-	return nil, nil
+	if foundElt == nil {
+		return nil, nil
+	}
+	return foundElt.Value.(*CipherEntry), foundElt
 }
 
 type StreamAuthenticateFunc func(clientConn transport.StreamConn) (string, transport.StreamConn, *onet.ConnectionError)
 
+// HandshakeParser reads the handshake of a new client connection, to support
+// variants of the protocol. It authenticates the client and reads the address of
+// the target, and returns the access key ID, the target address as "host:port",
+// and the connection to relay to the target, which has consumed the handshake.
+type HandshakeParser func(clientConn transport.StreamConn) (keyID string, tgtAddr string, innerConn transport.StreamConn, err *onet.ConnectionError)
+
+// NewDefaultHandshakeParser returns a HandshakeParser that does what the handler
+// does by default: it authenticates the connection with `authenticate`, and then
+// reads the target as a SOCKS address. Custom parsers can use it for the
+// connections that don't need special handling.
+func NewDefaultHandshakeParser(authenticate StreamAuthenticateFunc) HandshakeParser {
+	return func(clientConn transport.StreamConn) (string, string, transport.StreamConn, *onet.ConnectionError) {
+		id, innerConn, authErr := authenticate(clientConn)
+		if authErr != nil {
+			return id, "", nil, authErr
+		}
+		tgtSocksAddr, err := getProxyRequest(innerConn)
+		if err != nil {
+			return id, "", nil, onet.NewConnectionError("ERR_READ_ADDRESS", "Failed to get target address", err)
+		}
+		return id, tgtSocksAddr.String(), innerConn, nil
+	}
+}
+
 // ShadowsocksTCPMetrics is used to report Shadowsocks metrics on TCP connections.
 type ShadowsocksTCPMetrics interface {
 	// Shadowsocks TCP metrics
+	// AddTCPCipherSearch reports a search for the access key of a connection.
+	// `timeToCipher` runs from when the first bytesForKeyFinding bytes of the
+	// connection have been read, not from when it was accepted, and includes the
+	// snapshot of the cipher list and the trial decryptions, as for UDP.
 	AddTCPCipherSearch(accessKeyFound bool, timeToCipher time.Duration)
 }
 
 // NewShadowsocksStreamAuthenticator creates a stream authenticator that uses Shadowsocks.
 // TODO(fortuna): Offer alternative transports.
-func NewShadowsocksStreamAuthenticator(ciphers CipherList, replayCache *ReplayCache, metrics ShadowsocksTCPMetrics) StreamAuthenticateFunc {
+// A nil replayCache disables replay detection.
+func NewShadowsocksStreamAuthenticator(ciphers CipherList, replayCache SaltCache, metrics ShadowsocksTCPMetrics) StreamAuthenticateFunc {
 	return func(clientConn transport.StreamConn) (string, transport.StreamConn, *onet.ConnectionError) {
 		// Find the cipher and acess key id.
 		cipherEntry, clientReader, clientSalt, timeToCipher, keyErr := findAccessKey(clientConn, remoteIP(clientConn), ciphers)
 		metrics.AddTCPCipherSearch(keyErr == nil, timeToCipher)
+		if errors.Is(keyErr, errNoKeys) {
+			return "", nil, onet.NewConnectionError("ERR_NO_KEYS", "No access keys are loaded", keyErr)
+		}
+		if errors.Is(keyErr, errTruncatedHandshake) {
+			return "", nil, onet.NewConnectionError("ERR_PROBE_TRUNCATED", "Handshake too short to find a cipher", keyErr)
+		}
 		if keyErr != nil {
 			const status = "ERR_CIPHER"
 			return "", nil, onet.NewConnectionError(status, "Failed to find a valid cipher", keyErr)
@@ -144,7 +221,7 @@ func NewShadowsocksStreamAuthenticator(ciphers CipherList, replayCache *ReplayCa
 		// Check if the connection is a replay.
 		isServerSalt := cipherEntry.SaltGenerator.IsServerSalt(clientSalt)
 		// Only check the cache if findAccessKey succeeded and the salt is unrecognized.
-		if isServerSalt || !replayCache.Add(cipherEntry.ID, clientSalt) {
+		if isServerSalt || (replayCache != nil && !replayCache.Add(cipherEntry.ID, clientSalt)) {
 			var status string
 			if isServerSalt {
 				status = "ERR_REPLAY_SERVER"
@@ -165,22 +242,240 @@ type tcpHandler struct {
 	port         int
 	m            TCPMetrics
 	readTimeout  time.Duration
-	authenticate StreamAuthenticateFunc
-	dialer       transport.StreamDialer
+	authenticate atomic.Value // Holds a StreamAuthenticateFunc.
+	// The dialer set with SetTargetDialer, and the one used, which sets SO_MARK.
+	baseDialer transport.StreamDialer
+	dialer     transport.StreamDialer
+	socketMark uint32
+	// SO_LINGER timeout in seconds for target connections, or -1 for the OS default.
+	targetLinger int
+	diagnostics  *DiagnosticConfig
+	dnsCache     *dnsCache
+	overloaded   LoadSignal
+	goroutines   *GoroutineLimiter
+	reputation   IPReputation
+	ipConns      *IPConnectionLimiter
+	ipFamily     IPFamily
+	quiescer     *Quiescer
+	// Number of attempts to dial a target, time to wait between them, and time
+	// allowed for each, if positive.
+	dialAttempts int
+	dialBackoff  time.Duration
+	dialTimeout  time.Duration
+	dscp         DSCPClassifier
+	dscpClient   bool
+	limiter      *BandwidthLimiter
+	breaker      *circuitBreaker
+	// Dials that take at least this long are logged and reported, if positive.
+	slowDialThreshold time.Duration
+	idleTimeout       IdleTimeout
+	events            *EventEmitter
+	// Longest target domain name accepted, in bytes.
+	maxDomainLength int
+	newFilter       NewStreamFilterFunc
+	parseHandshake  HandshakeParser
+	probeResponse   ProbeResponse
+	probeDecoy      []byte
+	// Whether to set TCP_NODELAY on client and target connections.
+	noDelayClient bool
+	noDelayTarget bool
+}
+
+// TCPHandlerOptions configures the optional behavior of a [TCPHandler] made by
+// [NewTCPHandlerWithOptions]. The zero value of each field keeps the default,
+// except for TargetLingerSecs, so start from [DefaultTCPHandlerOptions].
+type TCPHandlerOptions struct {
+	// TargetSocketMark sets the SO_MARK option of the sockets of target connections,
+	// so that Linux policy routing can send them through a given routing table, as
+	// VPN kill switches and split tunneling do. It applies to the default dialer and
+	// to dialers of type *transport.TCPDialer. Setting the option needs the
+	// CAP_NET_ADMIN capability, and a dial fails if it can't be set, including on
+	// other systems, rather than connect outside the policy. 0 disables it.
+	TargetSocketMark uint32
+	// TargetLingerSecs sets the SO_LINGER timeout of connections to target addresses,
+	// in seconds. -1 keeps the OS default. 0 makes closing a target connection
+	// discard any unsent data and send a RST, releasing its resources immediately
+	// instead of going through the normal shutdown. Note that, unlike the other
+	// fields, its zero value isn't the default, see [DefaultTCPHandlerOptions].
+	//
+	// The default shutdown is graceful: the target gets every byte and a FIN, but the
+	// socket stays in TIME_WAIT for a minute or two, holding its ephemeral port, which
+	// can run out under high churn. A reset frees the port right away, but the target
+	// may see an error instead of a clean close, and the tail of the data may be lost
+	// if the target hasn't read it. A positive value makes the close wait up to that
+	// many seconds for the data to be sent on some systems, including Linux, which
+	// holds up the relay goroutine.
+	TargetLingerSecs int
+	// ClientNagle and TargetNagle clear TCP_NODELAY on client and target connections,
+	// to enable Nagle's algorithm, which saves packets for bulk transfers. By default,
+	// as Go does on all TCP connections, TCP_NODELAY is set, so that small writes,
+	// like keystrokes in SSH or game updates, are sent without delay. Connections
+	// that don't support it are left as they are.
+	ClientNagle bool
+	TargetNagle bool
+	// Diagnostics enables the diagnostic responder, which lets clients verify their
+	// configuration end-to-end: authenticated requests for the configured target
+	// address get a JSON [DiagnosticReport] instead of being relayed. Don't enable it
+	// on servers that must not reveal this information to their users.
+	Diagnostics *DiagnosticConfig
+	// TargetDNSCacheTTL enables caching the IP addresses of target hostnames for that
+	// long, up to TargetDNSCacheSize hostnames, to save a DNS lookup on connections
+	// to popular targets. Names that don't exist are cached for a tenth of the TTL.
+	TargetDNSCacheTTL  time.Duration
+	TargetDNSCacheSize int
+	// LoadShedding makes the handler close new connections right away, with status
+	// "ERR_OVERLOADED", while it returns true. Shed connections skip the trial
+	// decryption, which keeps established connections responsive during a spike.
+	// Note that closing early is observable by probes, unlike the normal handling of
+	// unauthenticated connections.
+	LoadShedding LoadSignal
+	// GoroutineLimiter makes the handler count the goroutines of each connection in
+	// it, and close new connections with status "ERR_OVERLOADED" while it's full,
+	// before the trial decryption.
+	GoroutineLimiter *GoroutineLimiter
+	// IPReputation makes the handler close connections from the client addresses that
+	// it blocks right away, with status "ERR_IP_BLOCKED", before the trial decryption.
+	IPReputation IPReputation
+	// IPConnectionLimiter makes the handler count the open connections from each
+	// client address in it, and close new ones right away, with status
+	// "ERR_IP_CONN_LIMIT", from addresses that have the maximum, before the trial
+	// decryption.
+	IPConnectionLimiter *IPConnectionLimiter
+	// ClientIPFamily makes the handler close connections from clients of the other IP
+	// version right away, with status "ERR_IP_BLOCKED", for deployments that handle
+	// IPv4 and IPv6 clients on separate listeners.
+	ClientIPFamily IPFamily
+	// Quiescer makes the handler close new connections right away, with status
+	// "ERR_QUIESCED", while it's quiesced, and keep relaying the connections it has.
+	Quiescer *Quiescer
+	// TargetDialAttempts makes the handler try to dial a target up to that many times,
+	// waiting TargetDialBackoff between attempts, if the dial times out or the
+	// connection is refused. Other errors, including blocked targets, fail right away.
+	// The client waits for the retries, so keep the total time short. Values below 2
+	// disable retries.
+	TargetDialAttempts int
+	TargetDialBackoff  time.Duration
+	// TargetDialTimeout limits the time that each attempt to dial a target can take,
+	// after which it fails with status "ERR_CONNECT", or is retried. It's separate
+	// from the handshake timeout, since targets may be far away. Zero leaves it to the
+	// dialer and the OS.
+	TargetDialTimeout time.Duration
+	// DSCP marks the target connections of each access key with the DSCP value that
+	// it returns, so the network can prioritize them, and also the client connections
+	// if DSCPMarkClient is true. Marking is skipped, and logged at debug level, where
+	// the platform or connection doesn't support it. The value applied to each
+	// connection is also logged at debug level.
+	DSCP           DSCPClassifier
+	DSCPMarkClient bool
+	// BandwidthLimiter limits the throughput of the relayed data, in both directions,
+	// to that allowed by the limiter, which may be shared with other handlers.
+	BandwidthLimiter *BandwidthLimiter
+	// CircuitBreakerThreshold makes the handler stop dialing a target address after
+	// that many consecutive failed dials, rejecting its connections right away with
+	// status "ERR_CIRCUIT_OPEN" until CircuitBreakerReset elapses. Then one dial is
+	// let through, which closes the circuit if it succeeds.
+	CircuitBreakerThreshold int
+	CircuitBreakerReset     time.Duration
+	// SlowDialThreshold makes the handler log and report any dial to a target that
+	// takes at least that long, including retries, whether it succeeds or not. Slow
+	// successful dials point to backends that are degrading before they start timing
+	// out.
+	SlowDialThreshold time.Duration
+	// IdleTimeout makes the handler close relays that are idle, with status
+	// "ERR_IDLE_TIMEOUT". Each direction is tracked separately, so a relay can be
+	// closed when either direction is idle, or only when both are.
+	IdleTimeout IdleTimeout
+	// EventEmitter makes the handler emit an event when a connection is connected to
+	// its target, and another when it closes.
+	EventEmitter *EventEmitter
+	// MaxDomainLength makes the handler close connections to target domain names
+	// longer than that many bytes with status "ERR_BAD_HOST", before resolving them.
+	// Empty names and names with control characters are always rejected. Zero means
+	// 255, the longest name that the address format allows.
+	MaxDomainLength int
+	// StreamFilter passes the data that clients send to their targets through the
+	// [StreamFilter] that it returns for each connection, which may modify it or
+	// close the connection. See [StreamFilter] for the caveats.
+	StreamFilter NewStreamFilterFunc
+	// HandshakeParser replaces the authentication and the reading of the target
+	// address of new connections, for protocol extensions. The authenticator is then
+	// not used, unless the parser calls it, for instance through
+	// [NewDefaultHandshakeParser]. Connections that fail to parse are drained until
+	// the read timeout, like those that fail to authenticate, so that probes can't
+	// tell the errors apart.
+	HandshakeParser HandshakeParser
+	// ProbeResponse is what is done with connections that fail the handshake, which
+	// is to hang by default. ProbeDecoy is what [ProbeResponseDecoy] sends.
+	ProbeResponse ProbeResponse
+	ProbeDecoy    []byte
+}
+
+// DefaultTCPHandlerOptions returns the options of the handlers made by
+// [NewTCPHandler].
+func DefaultTCPHandlerOptions() TCPHandlerOptions {
+	return TCPHandlerOptions{TargetLingerSecs: -1}
 }
 
 // NewTCPService creates a TCPService
 func NewTCPHandler(port int, authenticate StreamAuthenticateFunc, m TCPMetrics, timeout time.Duration) TCPHandler {
-	return &tcpHandler{
+	return NewTCPHandlerWithOptions(port, authenticate, m, timeout, DefaultTCPHandlerOptions())
+}
+
+// NewTCPHandlerWithOptions creates a [TCPHandler] configured by `opts`. Clients have
+// `timeout` to complete the handshake, after which the connection is handled as a
+// probe. It doesn't apply to the dial to the target, see
+// [TCPHandlerOptions.TargetDialTimeout].
+func NewTCPHandlerWithOptions(port int, authenticate StreamAuthenticateFunc, m TCPMetrics, timeout time.Duration, opts TCPHandlerOptions) TCPHandler {
+	h := &tcpHandler{
 		port:         port,
 		m:            m,
 		readTimeout:  timeout,
-		authenticate: authenticate,
-		dialer:       defaultDialer,
+		baseDialer:   defaultDialer,
+		dialer:       markDialer(defaultDialer, opts.TargetSocketMark),
+		socketMark:   opts.TargetSocketMark,
+		targetLinger: opts.TargetLingerSecs,
+		dialAttempts: 1,
+		diagnostics:  opts.Diagnostics,
+		overloaded:   opts.LoadShedding,
+		goroutines:   opts.GoroutineLimiter,
+		reputation:   opts.IPReputation,
+		ipConns:      opts.IPConnectionLimiter,
+		ipFamily:     opts.ClientIPFamily,
+		quiescer:     opts.Quiescer,
+		dialBackoff:  opts.TargetDialBackoff,
+		dialTimeout:  opts.TargetDialTimeout,
+		dscp:         opts.DSCP,
+		dscpClient:   opts.DSCPMarkClient,
+		limiter:      opts.BandwidthLimiter,
+
+		slowDialThreshold: opts.SlowDialThreshold,
+		idleTimeout:       opts.IdleTimeout,
+		events:            opts.EventEmitter,
+		maxDomainLength:   opts.MaxDomainLength,
+		newFilter:         opts.StreamFilter,
+		parseHandshake:    opts.HandshakeParser,
+		probeResponse:     opts.ProbeResponse,
+		probeDecoy:        opts.ProbeDecoy,
+		noDelayClient:     !opts.ClientNagle,
+		noDelayTarget:     !opts.TargetNagle,
+	}
+	if opts.TargetDNSCacheTTL > 0 {
+		h.dnsCache = newDNSCache(opts.TargetDNSCacheTTL, opts.TargetDNSCacheSize)
+	}
+	if opts.TargetDialAttempts > 1 {
+		h.dialAttempts = opts.TargetDialAttempts
+	}
+	if opts.CircuitBreakerThreshold > 0 {
+		h.breaker = newCircuitBreaker(opts.CircuitBreakerThreshold, opts.CircuitBreakerReset)
 	}
+	if h.maxDomainLength == 0 {
+		h.maxDomainLength = defaultMaxDomainLength
+	}
+	h.SetAuthenticator(authenticate)
+	return h
 }
 
-var defaultDialer = makeValidatingTCPStreamDialer(onet.RequirePublicIP)
+var defaultDialer = makeValidatingTCPStreamDialer(onet.NewDefaultPrivateBlocker().Validate)
 
 func makeValidatingTCPStreamDialer(targetIPValidator onet.TargetIPValidator) transport.StreamDialer {
 	return &transport.TCPDialer{Dialer: net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
@@ -190,14 +485,42 @@ func makeValidatingTCPStreamDialer(targetIPValidator onet.TargetIPValidator) tra
 }
 
 // TCPService is a Shadowsocks TCP service that can be started and stopped.
+// Its optional behavior is set when it's made, see [TCPHandlerOptions].
 type TCPHandler interface {
 	Handle(ctx context.Context, conn transport.StreamConn)
 	// SetTargetDialer sets the [transport.StreamDialer] to be used to connect to target addresses.
+	// It must be called before Handle.
 	SetTargetDialer(dialer transport.StreamDialer)
 }
 
+// AuthenticatorSetter is implemented by the [TCPHandler] made by [NewTCPHandler]
+// and [NewTCPHandlerWithOptions].
+type AuthenticatorSetter interface {
+	// SetAuthenticator replaces the function that authenticates new connections, for
+	// instance with one made by [NewShadowsocksStreamAuthenticator] for a new
+	// [CipherList], when the change is too large for [CipherList.Update]. It's safe
+	// to call while connections are handled: those that have started authenticating
+	// finish with the previous function.
+	SetAuthenticator(authenticate StreamAuthenticateFunc)
+}
+
+func (s *tcpHandler) SetAuthenticator(authenticate StreamAuthenticateFunc) {
+	s.authenticate.Store(authenticate)
+}
+
 func (s *tcpHandler) SetTargetDialer(dialer transport.StreamDialer) {
-	s.dialer = dialer
+	s.baseDialer = dialer
+	s.dialer = markDialer(dialer, s.socketMark)
+}
+
+// setNoDelay sets TCP_NODELAY on `conn`, which is the `side` connection, if it
+// supports it.
+func setNoDelay(conn transport.StreamConn, noDelay bool, side string) {
+	if noDelayConn, ok := conn.(interface{ SetNoDelay(noDelay bool) error }); ok {
+		if err := noDelayConn.SetNoDelay(noDelay); err != nil {
+			logger.Debugf("Failed to set TCP_NODELAY on %v connection: %v", side, err)
+		}
+	}
 }
 
 func ensureConnectionError(err error, fallbackStatus string, fallbackMsg string) *onet.ConnectionError {
@@ -254,18 +577,62 @@ func StreamServe(accept StreamListener, handle StreamHandler) {
 	}
 }
 
+// ServeListener is like [StreamServe], but accepts the connections from `listener`,
+// which may wrap another transport, like TLS or WebSocket, rather than TCP. Close
+// the listener to stop serving.
+//
+// Connections that can't half-close are still relayed, but only the client can end
+// a relay cleanly: closing the target's direction of the relay is a no-op, so the
+// client doesn't get an EOF when the target is done.
+func ServeListener(listener net.Listener, handle StreamHandler) {
+	StreamServe(func() (transport.StreamConn, error) {
+		conn, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		return asStreamConn(conn), nil
+	}, handle)
+}
+
+// asStreamConn returns `conn` as a [transport.StreamConn], adding the half-close
+// methods it lacks.
+func asStreamConn(conn net.Conn) transport.StreamConn {
+	if streamConn, ok := conn.(transport.StreamConn); ok {
+		return streamConn
+	}
+	return &netStreamConn{conn}
+}
+
+type netStreamConn struct {
+	net.Conn
+}
+
+func (c *netStreamConn) CloseRead() error {
+	return nil
+}
+
+// CloseWrite sends an EOF if the connection supports it, as [tls.Conn] does.
+func (c *netStreamConn) CloseWrite() error {
+	if closeWriter, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closeWriter.CloseWrite()
+	}
+	return nil
+}
+
 func (h *tcpHandler) Handle(ctx context.Context, clientConn transport.StreamConn) {
-	clientInfo, err := ipinfo.GetIPInfoFromAddr(h.m, clientConn.RemoteAddr())
+	clientAddr := anonymizeAddr(clientConn.RemoteAddr())
+	clientInfo, err := ipinfo.GetIPInfoFromAddr(h.m, clientAddr)
 	if err != nil {
 		logger.Warningf("Failed client info lookup: %v", err)
 	}
-	logger.Debugf("Got info \"%#v\" for IP %v", clientInfo, clientConn.RemoteAddr().String())
+	logger.Debugf("Got info \"%#v\" for IP %v", clientInfo, clientAddr.String())
 	h.m.AddOpenTCPConnection(clientInfo)
+	setNoDelay(clientConn, h.noDelayClient, "client")
 	var proxyMetrics metrics.ProxyMetrics
 	measuredClientConn := metrics.MeasureConn(clientConn, &proxyMetrics.ProxyClient, &proxyMetrics.ClientProxy)
 	connStart := time.Now()
 
-	id, connError := h.handleConnection(ctx, measuredClientConn, &proxyMetrics)
+	id, connError := h.handleConnection(ctx, clientConn, measuredClientConn, &proxyMetrics)
 
 	connDuration := time.Since(connStart)
 	status := "OK"
@@ -273,21 +640,57 @@ func (h *tcpHandler) Handle(ctx context.Context, clientConn transport.StreamConn
 		status = connError.Status
 		logger.Debugf("TCP Error: %v: %v", connError.Message, connError.Cause)
 	}
-	h.m.AddClosedTCPConnection(clientInfo, clientConn.RemoteAddr(), id, status, proxyMetrics, connDuration)
+	h.m.AddClosedTCPConnection(clientInfo, clientAddr, id, status, proxyMetrics, connDuration)
 	measuredClientConn.Close() // Closing after the metrics are added aids integration testing.
 	logger.Debugf("Done with status %v, duration %v", status, connDuration)
 }
 
-func getProxyRequest(clientConn transport.StreamConn) (string, error) {
+func getProxyRequest(clientConn transport.StreamConn) (socks.Addr, error) {
 	// TODO(fortuna): Use Shadowsocks proxy, HTTP CONNECT or SOCKS5 based on first byte:
 	// case 1, 3 or 4: Shadowsocks (address type)
 	// case 5: SOCKS5 (protocol version)
 	// case "C": HTTP CONNECT (first char of method)
-	tgtAddr, err := socks.ReadAddr(clientConn)
+	return socks.ReadAddr(clientConn)
+}
+
+// defaultMaxDomainLength is the longest domain name that a SOCKS address can hold.
+const defaultMaxDomainLength = 255
+
+// checkTargetDomain returns an error if `addr` holds a domain name that is empty,
+// longer than `maxLen` bytes, or has control characters, which no real hostname
+// has. It's meant to reject such names before they are resolved.
+func checkTargetDomain(addr socks.Addr, maxLen int) error {
+	if addr[0] != socks.AtypDomainName {
+		return nil
+	}
+	host := addr[2 : 2+int(addr[1])]
+	if len(host) == 0 {
+		return errors.New("domain name is empty")
+	}
+	if len(host) > maxLen {
+		return fmt.Errorf("domain name has %v bytes, more than the limit of %v", len(host), maxLen)
+	}
+	for _, c := range host {
+		if c < 0x20 || c == 0x7f {
+			return fmt.Errorf("domain name has control character %#x", c)
+		}
+	}
+	return nil
+}
+
+// errorRecordingWriter keeps the error of the last failed write, to tell failures
+// to write from failures to read in an [io.Copy].
+type errorRecordingWriter struct {
+	io.Writer
+	err error
+}
+
+func (w *errorRecordingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
 	if err != nil {
-		return "", err
+		w.err = err
 	}
-	return tgtAddr.String(), nil
+	return n, err
 }
 
 func proxyConnection(ctx context.Context, dialer transport.StreamDialer, tgtAddr string, clientConn transport.StreamConn) *onet.ConnectionError {
@@ -297,13 +700,19 @@ func proxyConnection(ctx context.Context, dialer transport.StreamDialer, tgtAddr
 		return ensureConnectionError(dialErr, "ERR_CONNECT", "Failed to connect to target")
 	}
 	defer tgtConn.Close()
-	logger.Debugf("proxy %s <-> %s", clientConn.RemoteAddr().String(), tgtConn.RemoteAddr().String())
+	logger.Debugf("proxy %s <-> %s", anonymizeAddr(clientConn.RemoteAddr()).String(), tgtConn.RemoteAddr().String())
 
 	fromClientErrCh := make(chan error)
 	go func() {
-		_, fromClientErr := io.Copy(tgtConn, clientConn)
-		if fromClientErr != nil {
-			// Drain to prevent a close in the case of a cipher error.
+		toTarget := &errorRecordingWriter{Writer: tgtConn}
+		_, fromClientErr := io.Copy(toTarget, clientConn)
+		if toTarget.err != nil {
+			// The target failed, rather than the client, so there's nothing to hide
+			// by draining.
+			fromClientErr = onet.NewConnectionError("ERR_RELAY_TARGET", "Failed to relay traffic to target", toTarget.err)
+		} else if fromClientErr != nil {
+			// Drain to prevent a close in the case of a cipher error. A filtered
+			// connection returns the filter error again, so it's not drained.
 			io.Copy(io.Discard, clientConn)
 		}
 		clientConn.CloseRead()
@@ -320,7 +729,7 @@ func proxyConnection(ctx context.Context, dialer transport.StreamDialer, tgtAddr
 
 	fromClientErr := <-fromClientErrCh
 	if fromClientErr != nil {
-		return onet.NewConnectionError("ERR_RELAY_CLIENT", "Failed to relay traffic from client", fromClientErr)
+		return ensureConnectionError(fromClientErr, "ERR_RELAY_CLIENT", "Failed to relay traffic from client")
 	}
 	if fromTargetErr != nil {
 		return onet.NewConnectionError("ERR_RELAY_TARGET", "Failed to relay traffic from target", fromTargetErr)
@@ -328,7 +737,8 @@ func proxyConnection(ctx context.Context, dialer transport.StreamDialer, tgtAddr
 	return nil
 }
 
-func (h *tcpHandler) handleConnection(ctx context.Context, outerConn transport.StreamConn, proxyMetrics *metrics.ProxyMetrics) (string, *onet.ConnectionError) {
+// handleConnection relays outerConn, which wraps clientConn to measure it.
+func (h *tcpHandler) handleConnection(ctx context.Context, clientConn, outerConn transport.StreamConn, proxyMetrics *metrics.ProxyMetrics) (string, *onet.ConnectionError) {
 	// Set a deadline to receive the address to the target.
 	readDeadline := time.Now().Add(h.readTimeout)
 	if deadline, ok := ctx.Deadline(); ok {
@@ -339,16 +749,57 @@ func (h *tcpHandler) handleConnection(ctx context.Context, outerConn transport.S
 	}
 	outerConn.SetReadDeadline(readDeadline)
 
-	id, innerConn, authErr := h.authenticate(outerConn)
+	if h.quiescer != nil && h.quiescer.Quiesced() {
+		return "", onet.NewConnectionError("ERR_QUIESCED", "Server is quiesced", nil)
+	}
+	if clientIP := remoteIP(clientConn); !h.ipFamily.allows(clientIP) {
+		return "", onet.NewConnectionError("ERR_IP_BLOCKED", "Client IP version is not accepted", nil)
+	} else if h.reputation != nil && h.reputation.Blocked(clientIP) {
+		return "", onet.NewConnectionError("ERR_IP_BLOCKED", "Client IP address is blocked", nil)
+	} else if h.ipConns != nil {
+		ipConn, ok := h.ipConns.acquire(clientIP)
+		if !ok {
+			return "", onet.NewConnectionError("ERR_IP_CONN_LIMIT", "Client IP address has too many connections", nil)
+		}
+		defer h.ipConns.release(ipConn)
+	}
+	if h.overloaded != nil && h.overloaded() {
+		return "", onet.NewConnectionError("ERR_OVERLOADED", "Server is overloaded", nil)
+	}
+	if h.goroutines != nil {
+		if !h.goroutines.acquire(tcpConnectionGoroutines) {
+			return "", onet.NewConnectionError("ERR_OVERLOADED", "Goroutine limit reached", nil)
+		}
+		defer h.goroutines.release(tcpConnectionGoroutines)
+	}
+
+	if h.parseHandshake != nil {
+		id, tgtAddr, innerConn, parseErr := h.parseHandshake(outerConn)
+		if parseErr != nil {
+			// Drain to protect against probing attacks.
+			h.absorbProbe(outerConn, parseErr.Status, proxyMetrics)
+			return id, parseErr
+		}
+		outerConn.SetReadDeadline(time.Time{})
+		tgtSocksAddr := socks.ParseAddr(tgtAddr)
+		if tgtSocksAddr == nil {
+			return id, onet.NewConnectionError("ERR_BAD_HOST", "Invalid target address", nil)
+		}
+		h.m.AddAuthenticatedTCPConnection(anonymizeAddr(outerConn.RemoteAddr()), id)
+		return h.relayToTarget(ctx, clientConn, outerConn, innerConn, id, tgtSocksAddr, proxyMetrics)
+	}
+
+	authenticate := h.authenticate.Load().(StreamAuthenticateFunc)
+	id, innerConn, authErr := authenticate(outerConn)
 	if authErr != nil {
 		// Drain to protect against probing attacks.
 		h.absorbProbe(outerConn, authErr.Status, proxyMetrics)
 		return id, authErr
 	}
-	h.m.AddAuthenticatedTCPConnection(outerConn.RemoteAddr(), id)
+	h.m.AddAuthenticatedTCPConnection(anonymizeAddr(outerConn.RemoteAddr()), id)
 
 	// Read target address and dial it.
-	tgtAddr, err := getProxyRequest(innerConn)
+	tgtSocksAddr, err := getProxyRequest(innerConn)
 	// Clear the deadline for the target address
 	outerConn.SetReadDeadline(time.Time{})
 	if err != nil {
@@ -356,26 +807,218 @@ func (h *tcpHandler) handleConnection(ctx context.Context, outerConn transport.S
 		io.Copy(io.Discard, outerConn)
 		return id, onet.NewConnectionError("ERR_READ_ADDRESS", "Failed to get target address", err)
 	}
+	return h.relayToTarget(ctx, clientConn, outerConn, innerConn, id, tgtSocksAddr, proxyMetrics)
+}
 
+// relayToTarget connects the authenticated connection `innerConn` of access key
+// `id` to the target and relays it.
+func (h *tcpHandler) relayToTarget(ctx context.Context, clientConn, outerConn, innerConn transport.StreamConn, id string, tgtSocksAddr socks.Addr, proxyMetrics *metrics.ProxyMetrics) (string, *onet.ConnectionError) {
+	clientAddr := anonymizeAddr(outerConn.RemoteAddr())
+	dscp := -1
+	if h.dscp != nil {
+		dscp = h.dscp(id)
+	}
+	if dscp >= 0 && h.dscpClient {
+		markDSCP(clientConn, dscp, "client")
+	}
+	if err := checkTargetDomain(tgtSocksAddr, h.maxDomainLength); err != nil {
+		return id, onet.NewConnectionError("ERR_BAD_HOST", "Invalid target host", err)
+	}
+	tgtAddr := tgtSocksAddr.String()
+	if h.diagnostics != nil && tgtAddr == h.diagnostics.TargetAddress {
+		return id, h.writeDiagnosticReport(innerConn, outerConn.RemoteAddr(), id)
+	}
+
+	// Set when the target is connected, if events are enabled.
+	var openTime time.Time
+	var idle *idleMonitor
+	stopIdle := make(chan struct{})
+	if h.idleTimeout != (IdleTimeout{}) {
+		idle = newIdleMonitor(h.idleTimeout, time.Now())
+	}
 	dialer := transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
-		tgtConn, err := h.dialer.DialStream(ctx, tgtAddr)
+		dialStart := time.Now()
+		tgtConn, err := h.dialTargetWithBreaker(ctx, tgtAddr)
+		h.checkSlowDial(tgtAddr, time.Since(dialStart), err)
 		if err != nil {
 			return nil, err
 		}
+		if h.events != nil {
+			openTime = time.Now()
+			h.events.Emit(ConnectionEvent{
+				Type:       ConnectionOpened,
+				Protocol:   "tcp",
+				Time:       openTime,
+				AccessKey:  id,
+				ClientAddr: clientAddr.String(),
+				TargetAddr: tgtAddr,
+			})
+		}
+		if h.targetLinger >= 0 {
+			// Custom dialers may return connections that don't support SO_LINGER.
+			if lingerConn, ok := tgtConn.(interface{ SetLinger(sec int) error }); ok {
+				if err := lingerConn.SetLinger(h.targetLinger); err != nil {
+					logger.Debugf("Failed to set linger on target connection: %v", err)
+				}
+			}
+		}
+		setNoDelay(tgtConn, h.noDelayTarget, "target")
+		if dscp >= 0 {
+			markDSCP(tgtConn, dscp, "target")
+		}
 		tgtConn = metrics.MeasureConn(tgtConn, &proxyMetrics.ProxyTarget, &proxyMetrics.TargetProxy)
+		if h.limiter != nil {
+			tgtConn = transport.WrapConn(tgtConn, &limitedReader{tgtConn, h.limiter, id}, tgtConn)
+		}
+		if idle != nil {
+			// The time spent dialing doesn't count as idle.
+			now := time.Now().UnixNano()
+			idle.lastUpload.Store(now)
+			idle.lastDownload.Store(now)
+			tgtConn = transport.WrapConn(tgtConn, &idleReader{tgtConn, &idle.lastDownload}, tgtConn)
+			go idle.run(stopIdle, func() {
+				tgtConn.Close()
+				clientConn.Close()
+			})
+		}
 		return tgtConn, nil
 	})
-	return id, proxyConnection(ctx, dialer, tgtAddr, innerConn)
+	if h.limiter != nil {
+		innerConn = transport.WrapConn(innerConn, &limitedReader{innerConn, h.limiter, id}, innerConn)
+	}
+	if idle != nil {
+		innerConn = transport.WrapConn(innerConn, &idleReader{innerConn, &idle.lastUpload}, innerConn)
+	}
+	if h.newFilter != nil {
+		if filter := h.newFilter(id, tgtAddr); filter != nil {
+			innerConn = transport.WrapConn(innerConn, &filteredReader{Reader: innerConn, filter: filter}, innerConn)
+		}
+	}
+	proxyErr := proxyConnection(ctx, dialer, tgtAddr, innerConn)
+	close(stopIdle)
+	if idle != nil && idle.timedOut.Load() {
+		proxyErr = onet.NewConnectionError("ERR_IDLE_TIMEOUT", "Relay was idle", nil)
+	}
+	if !openTime.IsZero() {
+		status := "OK"
+		if proxyErr != nil {
+			status = proxyErr.Status
+		}
+		closeTime := time.Now()
+		h.events.Emit(ConnectionEvent{
+			Type:            ConnectionClosed,
+			Protocol:        "tcp",
+			Time:            closeTime,
+			AccessKey:       id,
+			ClientAddr:      clientAddr.String(),
+			TargetAddr:      tgtAddr,
+			Status:          status,
+			BytesFromClient: proxyMetrics.ClientProxy,
+			BytesToClient:   proxyMetrics.ProxyClient,
+			Duration:        closeTime.Sub(openTime),
+		})
+	}
+	return id, proxyErr
+}
+
+// isRetriableDialError returns whether a failed dial may succeed if tried again.
+func isRetriableDialError(err error) bool {
+	var connErr *onet.ConnectionError
+	if errors.As(err, &connErr) {
+		// The target was rejected by the IP validator.
+		return false
+	}
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// checkSlowDial logs and reports the dial to `tgtAddr` if it took longer than the
+// slow dial threshold.
+func (h *tcpHandler) checkSlowDial(tgtAddr string, elapsed time.Duration, err error) {
+	if h.slowDialThreshold <= 0 || elapsed < h.slowDialThreshold {
+		return
+	}
+	if err != nil {
+		logger.Infof("Slow dial to %v failed after %v: %v", tgtAddr, elapsed, err)
+	} else {
+		logger.Infof("Slow dial to %v took %v", tgtAddr, elapsed)
+	}
+	h.m.AddTCPSlowDial(tgtAddr, elapsed)
 }
 
-// Keep the connection open until we hit the authentication deadline to protect against probing attacks
-// `proxyMetrics` is a pointer because its value is being mutated by `clientConn`.
-func (h *tcpHandler) absorbProbe(clientConn io.ReadCloser, status string, proxyMetrics *metrics.ProxyMetrics) {
-	// This line updates proxyMetrics.ClientProxy before it's used in AddTCPProbe.
-	_, drainErr := io.Copy(io.Discard, clientConn) // drain socket
-	drainResult := drainErrToString(drainErr)
-	logger.Debugf("Drain error: %v, drain result: %v", drainErr, drainResult)
-	h.m.AddTCPProbe(status, drainResult, h.port, proxyMetrics.ClientProxy)
+// dialTargetWithBreaker calls dialTargetWithRetry, unless the circuit breaker is
+// open for the target.
+func (h *tcpHandler) dialTargetWithBreaker(ctx context.Context, tgtAddr string) (transport.StreamConn, error) {
+	if h.breaker == nil {
+		return h.dialTargetWithRetry(ctx, tgtAddr)
+	}
+	if !h.breaker.Allow(tgtAddr) {
+		return nil, onet.NewConnectionError("ERR_CIRCUIT_OPEN", "Target is failing, not dialing", nil)
+	}
+	tgtConn, err := h.dialTargetWithRetry(ctx, tgtAddr)
+	var connErr *onet.ConnectionError
+	if errors.As(err, &connErr) || ctx.Err() != nil {
+		// Blocked targets and clients that went away say nothing about the target.
+		return tgtConn, err
+	}
+	if h.breaker.Record(tgtAddr, err) {
+		logger.Debugf("Circuit breaker open for %v: %v", tgtAddr, err)
+		h.m.AddTCPCircuitBreakerOpen(tgtAddr)
+	}
+	return tgtConn, err
+}
+
+// dialTargetWithRetry calls dialTarget up to h.dialAttempts times, while the errors are
+// retriable. Attempts that run out of h.dialTimeout are retriable too.
+func (h *tcpHandler) dialTargetWithRetry(ctx context.Context, tgtAddr string) (transport.StreamConn, error) {
+	for attempt := 1; ; attempt++ {
+		tgtConn, err := h.dialTargetWithTimeout(ctx, tgtAddr)
+		timedOut := errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil
+		if err == nil || attempt >= h.dialAttempts || !(timedOut || isRetriableDialError(err)) {
+			return tgtConn, err
+		}
+		logger.Debugf("Failed to dial %v (attempt %v of %v): %v", tgtAddr, attempt, h.dialAttempts, err)
+		timer := time.NewTimer(h.dialBackoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+// dialTargetWithTimeout calls dialTarget, giving up after h.dialTimeout if positive.
+func (h *tcpHandler) dialTargetWithTimeout(ctx context.Context, tgtAddr string) (transport.StreamConn, error) {
+	if h.dialTimeout <= 0 {
+		return h.dialTarget(ctx, tgtAddr)
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, h.dialTimeout)
+	defer cancel()
+	return h.dialTarget(dialCtx, tgtAddr)
+}
+
+// dialTarget dials the target address, resolving the hostname with the DNS cache if enabled.
+func (h *tcpHandler) dialTarget(ctx context.Context, tgtAddr string) (transport.StreamConn, error) {
+	if h.dnsCache == nil {
+		return h.dialer.DialStream(ctx, tgtAddr)
+	}
+	host, port, err := net.SplitHostPort(tgtAddr)
+	if err != nil || net.ParseIP(host) != nil {
+		return h.dialer.DialStream(ctx, tgtAddr)
+	}
+	ips, err := h.dnsCache.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	err = fmt.Errorf("no addresses found for %v", host)
+	for _, ip := range ips {
+		tgtConn, dialErr := h.dialer.DialStream(ctx, net.JoinHostPort(ip.String(), port))
+		if dialErr == nil {
+			return tgtConn, nil
+		}
+		err = dialErr
+	}
+	return nil, err
 }
 
 func drainErrToString(drainErr error) string {
@@ -406,4 +1049,10 @@ func (m *NoOpTCPMetrics) AddAuthenticatedTCPConnection(clientAddr net.Addr, acce
 }
 func (m *NoOpTCPMetrics) AddTCPProbe(status, drainResult string, port int, clientProxyBytes int64) {
 }
+func (m *NoOpTCPMetrics) AddTCPCircuitBreakerOpen(target string) {
+}
+func (m *NoOpTCPMetrics) AddTCPSlowDial(target string, elapsed time.Duration) {
+}
+func (m *NoOpTCPMetrics) AddTCPProbeResponse(response string) {
+}
 func (m *NoOpTCPMetrics) AddTCPCipherSearch(accessKeyFound bool, timeToCipher time.Duration) {}
@@ -16,19 +16,27 @@ package service
 
 import (
 	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"net/netip"
+	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/Jigsaw-Code/outline-sdk/transport"
 	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
 	"github.com/Jigsaw-Code/outline-ss-server/ipinfo"
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
 	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
 	logging "github.com/op/go-logging"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
@@ -183,6 +191,15 @@ func (c *conn) CloseWrite() error {
 // Simulates receiving valid TCP connection attempts from 100 different users,
 // each with their own cipher and their own IP address.
 func BenchmarkTCPFindCipherRepeat(b *testing.B) {
+	benchmarkTCPFindCipherRepeat(b, false)
+}
+
+// Same as BenchmarkTCPFindCipherRepeat, but every search tries all the ciphers.
+func BenchmarkTCPFindCipherRepeatConstantTime(b *testing.B) {
+	benchmarkTCPFindCipherRepeat(b, true)
+}
+
+func benchmarkTCPFindCipherRepeat(b *testing.B, constantTime bool) {
 	b.StopTimer()
 	b.ResetTimer()
 
@@ -191,6 +208,7 @@ func BenchmarkTCPFindCipherRepeat(b *testing.B) {
 	if err != nil {
 		b.Fatal(err)
 	}
+	cipherList.SetConstantTime(constantTime)
 	cipherEntries := [numCiphers]*CipherEntry{}
 	snapshot := cipherList.SnapshotForClientIP(netip.Addr{})
 	for cipherNumber, element := range snapshot {
@@ -214,12 +232,94 @@ func BenchmarkTCPFindCipherRepeat(b *testing.B) {
 	}
 }
 
+func TestFindAccessKeyConstantTime(t *testing.T) {
+	cipherList, err := MakeTestCiphers(makeTestSecrets(3))
+	require.NoError(t, err)
+	cipherList.SetConstantTime(true)
+	require.True(t, cipherList.ConstantTime())
+	snapshot := cipherList.SnapshotForClientIP(netip.Addr{})
+	clientIP := netip.MustParseAddr("192.0.2.1")
+
+	for _, element := range snapshot {
+		expected := element.Value.(*CipherEntry)
+		reader, writer := io.Pipe()
+		c := conn{clientAddr: net.TCPAddrFromAddrPort(netip.AddrPortFrom(clientIP, 54321)), reader: reader, writer: writer}
+		go shadowsocks.NewWriter(writer, expected.CryptoKey).Write(makeTestPayload(50))
+		entry, _, _, _, err := findAccessKey(&c, clientIP, cipherList)
+		require.NoError(t, err)
+		require.Equal(t, expected.ID, entry.ID)
+		c.Close()
+	}
+	// The list order is unaffected by the matches.
+	require.Equal(t, []string{"id-0", "id-1", "id-2"}, snapshotIDs(cipherList.SnapshotForClientIP(clientIP)))
+}
+
+// Counts the snapshots taken of a CipherList.
+type snapshotCountingCipherList struct {
+	CipherList
+	snapshots int
+}
+
+func (cl *snapshotCountingCipherList) SnapshotForClientIP(clientIP netip.Addr) []*list.Element {
+	cl.snapshots++
+	return cl.CipherList.SnapshotForClientIP(clientIP)
+}
+
+func TestFindAccessKeyTruncated(t *testing.T) {
+	ciphers, err := MakeTestCiphers(makeTestSecrets(3))
+	require.NoError(t, err)
+	cipherList := &snapshotCountingCipherList{CipherList: ciphers}
+	for _, size := range []int{0, 1, minHandshakeSize - 1} {
+		_, _, _, timeToCipher, err := findAccessKey(bytes.NewReader(makeTestPayload(size)), netip.Addr{}, cipherList)
+		require.ErrorIs(t, err, errTruncatedHandshake, "size %v", size)
+		require.Zero(t, timeToCipher)
+	}
+	// Longer handshakes could be valid, so they count as failures to find a cipher.
+	_, _, _, _, err = findAccessKey(bytes.NewReader(makeTestPayload(minHandshakeSize)), netip.Addr{}, cipherList)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, errTruncatedHandshake)
+	// So do timeouts, whatever was sent.
+	timeoutReader := io.MultiReader(bytes.NewReader(makeTestPayload(1)), iotest.ErrReader(os.ErrDeadlineExceeded))
+	_, _, _, _, err = findAccessKey(timeoutReader, netip.Addr{}, cipherList)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.NotErrorIs(t, err, errTruncatedHandshake)
+	require.Zero(t, cipherList.snapshots)
+}
+
+// Delays each snapshot of the list.
+type slowSnapshotCipherList struct {
+	CipherList
+	delay time.Duration
+}
+
+func (cl *slowSnapshotCipherList) SnapshotForClientIP(clientIP netip.Addr) []*list.Element {
+	time.Sleep(cl.delay)
+	return cl.CipherList.SnapshotForClientIP(clientIP)
+}
+
+func TestFindAccessKeyTimeIncludesSnapshot(t *testing.T) {
+	ciphers, err := MakeTestCiphers(makeTestSecrets(3))
+	require.NoError(t, err)
+	cipherList := &slowSnapshotCipherList{CipherList: ciphers, delay: 20 * time.Millisecond}
+	clientBytes := makeClientBytesBasic(t, firstCipher(ciphers), "192.0.2.1:80")
+	entry, _, _, timeToCipher, err := findAccessKey(bytes.NewReader(clientBytes), netip.Addr{}, cipherList)
+	require.NoError(t, err)
+	require.NotNil(t, entry)
+	require.GreaterOrEqual(t, timeToCipher, cipherList.delay)
+}
+
 // Stub metrics implementation for testing replay defense.
 type probeTestMetrics struct {
 	mu          sync.Mutex
 	probeData   []int64
 	probeStatus []string
+	probeDrain  []string
 	closeStatus []string
+	closeData   []metrics.ProxyMetrics
+	// Targets whose circuit breaker opened.
+	circuitBreakerOpens []string
+	slowDials           []string
+	probeResponses      []string
 }
 
 var _ TCPMetrics = (*probeTestMetrics)(nil)
@@ -227,6 +327,7 @@ var _ TCPMetrics = (*probeTestMetrics)(nil)
 func (m *probeTestMetrics) AddClosedTCPConnection(clientInfo ipinfo.IPInfo, clientAddr net.Addr, accessKey string, status string, data metrics.ProxyMetrics, duration time.Duration) {
 	m.mu.Lock()
 	m.closeStatus = append(m.closeStatus, status)
+	m.closeData = append(m.closeData, data)
 	m.mu.Unlock()
 }
 
@@ -243,6 +344,25 @@ func (m *probeTestMetrics) AddTCPProbe(status, drainResult string, port int, cli
 	m.mu.Lock()
 	m.probeData = append(m.probeData, clientProxyBytes)
 	m.probeStatus = append(m.probeStatus, status)
+	m.probeDrain = append(m.probeDrain, drainResult)
+	m.mu.Unlock()
+}
+
+func (m *probeTestMetrics) AddTCPCircuitBreakerOpen(target string) {
+	m.mu.Lock()
+	m.circuitBreakerOpens = append(m.circuitBreakerOpens, target)
+	m.mu.Unlock()
+}
+
+func (m *probeTestMetrics) AddTCPSlowDial(target string, elapsed time.Duration) {
+	m.mu.Lock()
+	m.slowDials = append(m.slowDials, target)
+	m.mu.Unlock()
+}
+
+func (m *probeTestMetrics) AddTCPProbeResponse(response string) {
+	m.mu.Lock()
+	m.probeResponses = append(m.probeResponses, response)
 	m.mu.Unlock()
 }
 
@@ -301,6 +421,110 @@ func TestProbeRandom(t *testing.T) {
 	require.Equal(t, len(buf), len(testMetrics.probeData))
 }
 
+func TestProbeMetricsFault(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	testMetrics := &probeTestMetrics{}
+	faultyMetrics := NewFaultInjectingMetrics(testMetrics, &NoOpUDPMetrics{}, NewDeterministicFaultInjector([]string{"AddTCPProbe"}))
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, faultyMetrics)
+	handler := NewTCPHandler(listener.Addr().(*net.TCPAddr).Port, authFunc, faultyMetrics, 200*time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	buf := make([]byte, 100)
+	for numBytesToSend := 0; numBytesToSend < len(buf); numBytesToSend += 10 {
+		bytesToSend := buf[:numBytesToSend]
+		rand.Read(bytesToSend)
+		err := probe(listener.Addr().(*net.TCPAddr), bytesToSend)
+		require.NoError(t, err, "Failed on byte %v: %v", numBytesToSend, err)
+	}
+	require.Nil(t, listener.Close())
+	<-done
+	// The probes were handled and closed, but not reported.
+	require.Empty(t, testMetrics.probeData)
+	require.Len(t, testMetrics.closeStatus, 10)
+}
+
+func TestProbeNoKeys(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(NewCipherList(), nil, testMetrics)
+	handler := NewTCPHandler(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	buf := make([]byte, 100)
+	rand.Read(buf)
+	// The connection is handled like a probe, so clients can't tell the difference.
+	require.NoError(t, probe(listener.Addr().(*net.TCPAddr), buf))
+	require.Nil(t, listener.Close())
+	<-done
+	require.Equal(t, []string{"ERR_NO_KEYS"}, testMetrics.probeStatus)
+	require.Equal(t, []int64{100}, testMetrics.probeData)
+}
+
+func TestProbeResponse(t *testing.T) {
+	decoy := []byte("SSH-2.0-OpenSSH_9.6\r\n")
+	for _, tc := range []struct {
+		response ProbeResponse
+		received []byte
+		drain    string
+	}{
+		{ProbeResponseHang, nil, "eof"},
+		{ProbeResponseClose, nil, "closed"},
+		{ProbeResponseDecoy, decoy, "eof"},
+	} {
+		t.Run(tc.response.String(), func(t *testing.T) {
+			listener := makeLocalhostListener(t)
+			cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+			require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+			testMetrics := &probeTestMetrics{}
+			authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+			handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, TCPHandlerOptions{ProbeResponse: tc.response, ProbeDecoy: decoy})
+			done := make(chan struct{})
+			go func() {
+				StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+				done <- struct{}{}
+			}()
+
+			conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+			require.NoError(t, err)
+			probeBytes := make([]byte, 40)
+			rand.Read(probeBytes)
+			_, err = conn.Write(probeBytes)
+			require.NoError(t, err)
+			conn.CloseWrite()
+			received, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			conn.Close()
+			require.Nil(t, listener.Close())
+			<-done
+
+			require.Equal(t, len(tc.received), len(received))
+			require.Equal(t, string(tc.received), string(received))
+			require.Equal(t, []string{tc.drain}, testMetrics.probeDrain)
+			require.Equal(t, []string{tc.response.String()}, testMetrics.probeResponses)
+		})
+	}
+}
+
+func TestParseProbeResponse(t *testing.T) {
+	for _, response := range []ProbeResponse{ProbeResponseHang, ProbeResponseClose, ProbeResponseDecoy} {
+		parsed, err := ParseProbeResponse(response.String())
+		require.NoError(t, err)
+		require.Equal(t, response, parsed)
+	}
+	_, err := ParseProbeResponse("echo")
+	require.Error(t, err)
+}
+
 func makeClientBytesBasic(t *testing.T, cryptoKey *shadowsocks.EncryptionKey, targetAddr string) []byte {
 	var buffer bytes.Buffer
 	socksTargetAddr := socks.ParseAddr(targetAddr)
@@ -376,7 +600,10 @@ func TestProbeClientBytesBasicTruncated(t *testing.T) {
 	listener.Close()
 	<-done
 	statusCount := testMetrics.countStatuses()
-	require.Equal(t, 50, statusCount["ERR_CIPHER"])
+	// Handshakes too short for any cipher are truncated, and the longer ones that
+	// are shorter than bytesForKeyFinding can't find a cipher.
+	require.Equal(t, minHandshakeSize, statusCount["ERR_PROBE_TRUNCATED"])
+	require.Equal(t, 50-minHandshakeSize, statusCount["ERR_CIPHER"])
 	require.Equal(t, 7+16, statusCount["ERR_READ_ADDRESS"])
 	require.Equal(t, 2, statusCount["OK"]) // On the chunk boundaries.
 	require.Equal(t, len(initialBytes)-50-7-16-2, statusCount["ERR_RELAY_CLIENT"])
@@ -495,177 +722,1229 @@ func TestProbeServerBytesModified(t *testing.T) {
 	require.Equal(t, 50, len(testMetrics.probeData))
 }
 
-func TestReplayDefense(t *testing.T) {
-	listener := makeLocalhostListener(t)
-	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
-	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
-	replayCache := NewReplayCache(5)
-	testMetrics := &probeTestMetrics{}
-	const testTimeout = 200 * time.Millisecond
-	authFunc := NewShadowsocksStreamAuthenticator(cipherList, &replayCache, testMetrics)
-	handler := NewTCPHandler(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, testTimeout)
-	snapshot := cipherList.SnapshotForClientIP(netip.Addr{})
-	cipherEntry := snapshot[0].Value.(*CipherEntry)
-	cipher := cipherEntry.CryptoKey
-	reader, writer := io.Pipe()
-	go shadowsocks.NewWriter(writer, cipher).Write([]byte{0})
-	preamble := make([]byte, cipher.SaltSize()+2+cipher.TagSize())
-	if _, err := io.ReadFull(reader, preamble); err != nil {
-		t.Fatal(err)
+// Records the linger values set on a target connection.
+type lingerRecordingConn struct {
+	*net.TCPConn
+	mu      *sync.Mutex
+	lingers *[]int
+}
+
+func (c *lingerRecordingConn) SetLinger(sec int) error {
+	c.mu.Lock()
+	*c.lingers = append(*c.lingers, sec)
+	c.mu.Unlock()
+	return c.TCPConn.SetLinger(sec)
+}
+
+func TestTCPTargetLinger(t *testing.T) {
+	for _, secs := range []int{-1, 0, 5} {
+		listener := makeLocalhostListener(t)
+		cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+		require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+		cipher := firstCipher(cipherList)
+		testMetrics := &probeTestMetrics{}
+		authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+		handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, TCPHandlerOptions{TargetLingerSecs: secs})
+		var mu sync.Mutex
+		var lingers []int
+		baseDialer := makeValidatingTCPStreamDialer(allowAll)
+		handler.SetTargetDialer(transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+			conn, err := baseDialer.DialStream(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &lingerRecordingConn{TCPConn: conn.(*net.TCPConn), mu: &mu, lingers: &lingers}, nil
+		}))
+		done := make(chan struct{})
+		go func() {
+			StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+			done <- struct{}{}
+		}()
+
+		discardListener, discardWait := startDiscardServer(t)
+		initialBytes := makeClientBytesCoalesced(t, cipher, discardListener.Addr().String())
+		require.NoError(t, probe(listener.Addr().(*net.TCPAddr), initialBytes))
+		listener.Close()
+		<-done
+		discardListener.Close()
+		discardWait.Wait()
+
+		require.Equal(t, 1, testMetrics.countStatuses()["OK"])
+		if secs < 0 {
+			require.Empty(t, lingers)
+		} else {
+			require.Equal(t, []int{secs}, lingers)
+		}
 	}
+}
 
-	run := func() *net.TCPConn {
-		conn, err := net.DialTCP(listener.Addr().Network(), nil, listener.Addr().(*net.TCPAddr))
+// runIdleTarget relays a connection to a target that waits for data that never
+// comes, until the relay is closed for being idle. It returns the error that the
+// target got reading.
+func runIdleTarget(t *testing.T, lingerSecs int) error {
+	targetListener := makeLocalhostListener(t)
+	defer targetListener.Close()
+	targetErr := make(chan error, 1)
+	go func() {
+		targetConn, err := targetListener.AcceptTCP()
 		if err != nil {
-			t.Fatal(err)
-		}
-		n, err := conn.Write(preamble)
-		if n < len(preamble) {
-			t.Error(err)
+			targetErr <- err
+			return
 		}
-		return conn
-	}
+		defer targetConn.Close()
+		_, err = io.Copy(io.Discard, targetConn)
+		targetErr <- err
+	}()
 
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	opts := DefaultTCPHandlerOptions()
+	opts.TargetLingerSecs = lingerSecs
+	opts.IdleTimeout = IdleTimeout{Upload: 50 * time.Millisecond, Download: 50 * time.Millisecond}
+	handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, opts)
+	handler.SetTargetDialer(makeValidatingTCPStreamDialer(allowAll))
 	done := make(chan struct{})
 	go func() {
 		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
 		done <- struct{}{}
 	}()
 
-	// First run.
-	conn1 := run()
-	// Wait for the close.  This ensures that conn1 and conn2 can't be
-	// processed out of order at the proxy.
-	conn1.CloseWrite()
-	conn1.Read(make([]byte, 1))
-	if len(testMetrics.probeData) != 0 {
-		t.Errorf("First connection should not have triggered probe detection: %v", testMetrics.probeData[0])
-	}
-
-	// Replay.
-	conn2 := run()
-	// Wait for the connection to be closed by the proxy after testTimeout.
-	conn2.CloseWrite()
-	conn2.Read(make([]byte, 1))
-
-	conn1.Close()
+	dialer, err := shadowsocks.NewStreamDialer(&transport.TCPEndpoint{Address: listener.Addr().String()}, firstCipher(cipherList))
+	require.NoError(t, err)
+	conn, err := dialer.DialStream(context.Background(), targetListener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("request"))
+	require.NoError(t, err)
+	err = <-targetErr
 	listener.Close()
 	<-done
+	return err
+}
 
-	if len(testMetrics.probeData) == 1 {
-		clientProxyData := testMetrics.probeData[0]
-		if clientProxyData != int64(len(preamble)) {
-			t.Errorf("Unexpected probe data: %v", clientProxyData)
-		}
-		status := testMetrics.probeStatus[0]
-		if status != "ERR_REPLAY_CLIENT" {
-			t.Errorf("Unexpected TCP probe status: %s", status)
-		}
-	} else {
-		t.Error("Replay should have triggered probe detection")
+func TestTCPTargetLingerReset(t *testing.T) {
+	// The target sees a clean close by default, and a reset with a zero timeout.
+	require.NoError(t, runIdleTarget(t, -1))
+	require.ErrorIs(t, runIdleTarget(t, 0), syscall.ECONNRESET)
+}
+
+// Records the TCP_NODELAY values set on a connection.
+type noDelayRecordingConn struct {
+	*net.TCPConn
+	mu       *sync.Mutex
+	noDelays *[]bool
+}
+
+func (c *noDelayRecordingConn) SetNoDelay(noDelay bool) error {
+	c.mu.Lock()
+	*c.noDelays = append(*c.noDelays, noDelay)
+	c.mu.Unlock()
+	return c.TCPConn.SetNoDelay(noDelay)
+}
+
+func TestTCPNoDelay(t *testing.T) {
+	for _, tc := range []struct {
+		clientSide, targetSide bool
+	}{{true, true}, {false, true}, {true, false}} {
+		listener := makeLocalhostListener(t)
+		cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+		require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+		cipher := firstCipher(cipherList)
+		testMetrics := &probeTestMetrics{}
+		authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+		handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, TCPHandlerOptions{ClientNagle: !tc.clientSide, TargetNagle: !tc.targetSide})
+		var mu sync.Mutex
+		var clientNoDelays, targetNoDelays []bool
+		baseDialer := makeValidatingTCPStreamDialer(allowAll)
+		handler.SetTargetDialer(transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+			conn, err := baseDialer.DialStream(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &noDelayRecordingConn{TCPConn: conn.(*net.TCPConn), mu: &mu, noDelays: &targetNoDelays}, nil
+		}))
+		done := make(chan struct{})
+		go func() {
+			StreamServe(func() (transport.StreamConn, error) {
+				conn, err := listener.AcceptTCP()
+				if err != nil {
+					return nil, err
+				}
+				return &noDelayRecordingConn{TCPConn: conn, mu: &mu, noDelays: &clientNoDelays}, nil
+			}, handler.Handle)
+			done <- struct{}{}
+		}()
+
+		discardListener, discardWait := startDiscardServer(t)
+		initialBytes := makeClientBytesCoalesced(t, cipher, discardListener.Addr().String())
+		require.NoError(t, probe(listener.Addr().(*net.TCPAddr), initialBytes))
+		listener.Close()
+		<-done
+		discardListener.Close()
+		discardWait.Wait()
+
+		require.Equal(t, 1, testMetrics.countStatuses()["OK"])
+		require.Equal(t, []bool{tc.clientSide}, clientNoDelays)
+		require.Equal(t, []bool{tc.targetSide}, targetNoDelays)
 	}
-	if len(testMetrics.closeStatus) == 2 {
-		status := testMetrics.closeStatus[1]
-		if status != "ERR_REPLAY_CLIENT" {
-			t.Errorf("Unexpected TCP close status: %s", status)
-		}
-	} else {
-		t.Error("Replay should have reported an error status")
+}
+
+func TestTCPTargetDialRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		err         error
+		maxAttempts int
+		status      string
+		dials       int
+	}{
+		{"Refused", syscall.ECONNREFUSED, 3, "OK", 3},
+		{"Timeout", os.ErrDeadlineExceeded, 3, "OK", 3},
+		{"TooFewAttempts", syscall.ECONNREFUSED, 2, "ERR_CONNECT", 2},
+		{"Blocked", onet.NewConnectionError("ERR_ADDRESS_PRIVATE", "blocked", nil), 3, "ERR_ADDRESS_PRIVATE", 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			listener := makeLocalhostListener(t)
+			cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+			require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+			cipher := firstCipher(cipherList)
+			testMetrics := &probeTestMetrics{}
+			authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+			handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, TCPHandlerOptions{TargetDialAttempts: tc.maxAttempts, TargetDialBackoff: time.Millisecond})
+			// The target fails the first 2 dials.
+			var dials atomic.Int32
+			baseDialer := makeValidatingTCPStreamDialer(allowAll)
+			handler.SetTargetDialer(transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+				if dials.Add(1) <= 2 {
+					return nil, &net.OpError{Op: "dial", Net: "tcp", Err: tc.err}
+				}
+				return baseDialer.DialStream(ctx, addr)
+			}))
+			done := make(chan struct{})
+			go func() {
+				StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+				done <- struct{}{}
+			}()
+
+			discardListener, discardWait := startDiscardServer(t)
+			initialBytes := makeClientBytesCoalesced(t, cipher, discardListener.Addr().String())
+			err = probe(listener.Addr().(*net.TCPAddr), initialBytes)
+			if tc.status == "OK" {
+				require.NoError(t, err)
+			}
+			listener.Close()
+			<-done
+			discardListener.Close()
+			discardWait.Wait()
+
+			require.Equal(t, 1, testMetrics.countStatuses()[tc.status])
+			require.Equal(t, int32(tc.dials), dials.Load())
+		})
 	}
 }
 
-func TestReverseReplayDefense(t *testing.T) {
+func TestTCPHandshakeTimeout(t *testing.T) {
 	listener := makeLocalhostListener(t)
 	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
 	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
-	replayCache := NewReplayCache(5)
+	cipher := firstCipher(cipherList)
 	testMetrics := &probeTestMetrics{}
-	const testTimeout = 200 * time.Millisecond
-	authFunc := NewShadowsocksStreamAuthenticator(cipherList, &replayCache, testMetrics)
-	handler := NewTCPHandler(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, testTimeout)
-	snapshot := cipherList.SnapshotForClientIP(netip.Addr{})
-	cipherEntry := snapshot[0].Value.(*CipherEntry)
-	cipher := cipherEntry.CryptoKey
-	reader, writer := io.Pipe()
-	ssWriter := shadowsocks.NewWriter(writer, cipher)
-	// Use a server-marked salt in the client's preamble.
-	ssWriter.SetSaltGenerator(cipherEntry.SaltGenerator)
-	go ssWriter.Write([]byte{0})
-	preamble := make([]byte, 32+2+16)
-	if _, err := io.ReadFull(reader, preamble); err != nil {
-		t.Fatal(err)
-	}
-
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 100*time.Millisecond, TCPHandlerOptions{TargetDialTimeout: 10 * time.Second})
+	var dials atomic.Int32
+	baseDialer := makeValidatingTCPStreamDialer(allowAll)
+	handler.SetTargetDialer(transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		dials.Add(1)
+		return baseDialer.DialStream(ctx, addr)
+	}))
 	done := make(chan struct{})
 	go func() {
 		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
 		done <- struct{}{}
 	}()
 
-	conn, err := net.Dial(listener.Addr().Network(), listener.Addr().String())
-	if err != nil {
-		t.Fatal(err)
-	}
-	n, err := conn.Write(preamble)
-	if n < len(preamble) {
-		t.Error(err)
-	}
+	discardListener, discardWait := startDiscardServer(t)
+	initialBytes := makeClientBytesCoalesced(t, cipher, discardListener.Addr().String())
+	start := time.Now()
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	// The client starts the handshake, but never finishes it.
+	_, err = conn.Write(initialBytes[:10])
+	require.NoError(t, err)
+	io.Copy(io.Discard, conn)
+	elapsed := time.Since(start)
 	conn.Close()
 	listener.Close()
 	<-done
+	discardListener.Close()
+	discardWait.Wait()
 
-	// The preamble should have been marked as a server replay.
-	if len(testMetrics.probeData) == 1 {
-		clientProxyData := testMetrics.probeData[0]
-		if clientProxyData != int64(len(preamble)) {
-			t.Errorf("Unexpected probe data: %v", clientProxyData)
-		}
-		status := testMetrics.probeStatus[0]
-		if status != "ERR_REPLAY_SERVER" {
-			t.Errorf("Unexpected TCP probe status: %s", status)
-		}
-	} else {
-		t.Error("Replay should have triggered probe detection")
-	}
-	if len(testMetrics.closeStatus) == 1 {
-		status := testMetrics.closeStatus[0]
-		if status != "ERR_REPLAY_SERVER" {
-			t.Errorf("Unexpected TCP close status: %s", status)
-		}
-	} else {
-		t.Error("Replay should have reported an error status")
-	}
-}
-
-// Test 49, 50, and 51 bytes to ensure they have the same behavior.
-// 50 bytes used to be the cutoff for different behavior.
-func TestTCPProbeTimeout(t *testing.T) {
-	probeExpectTimeout(t, 49)
-	probeExpectTimeout(t, 50)
-	probeExpectTimeout(t, 51)
+	require.GreaterOrEqual(t, elapsed, 100*time.Millisecond)
+	require.Less(t, elapsed, 5*time.Second)
+	require.Equal(t, []string{"timeout"}, testMetrics.probeDrain)
+	require.Equal(t, int32(0), dials.Load())
 }
 
-func probeExpectTimeout(t *testing.T, payloadSize int) {
-	const testTimeout = 200 * time.Millisecond
-
+func TestTCPTargetDialTimeout(t *testing.T) {
 	listener := makeLocalhostListener(t)
-	cipherList, err := MakeTestCiphers(makeTestSecrets(5))
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
 	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	cipher := firstCipher(cipherList)
 	testMetrics := &probeTestMetrics{}
 	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
-	handler := NewTCPHandler(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, testTimeout)
-
+	handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 10*time.Second, TCPHandlerOptions{
+		TargetDialTimeout:  100 * time.Millisecond,
+		TargetDialAttempts: 2,
+		TargetDialBackoff:  time.Millisecond,
+	})
+	// The target never answers.
+	var dials atomic.Int32
+	handler.SetTargetDialer(transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		dials.Add(1)
+		<-ctx.Done()
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: ctx.Err()}
+	}))
 	done := make(chan struct{})
 	go func() {
 		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
 		done <- struct{}{}
 	}()
 
-	testPayload := makeTestPayload(payloadSize)
-	timerStart := time.Now()
-	conn, err := net.Dial("tcp", listener.Addr().String())
-	if err != nil {
-		t.Fatalf("Failed to dial %v: %v", listener.Addr(), err)
+	initialBytes := makeClientBytesCoalesced(t, cipher, "192.0.2.1:80")
+	start := time.Now()
+	// The server closes without reading all the data, which may reset the connection.
+	probe(listener.Addr().(*net.TCPAddr), initialBytes)
+	elapsed := time.Since(start)
+	listener.Close()
+	<-done
+
+	// Each attempt times out, well before the handshake timeout.
+	require.GreaterOrEqual(t, elapsed, 200*time.Millisecond)
+	require.Less(t, elapsed, 5*time.Second)
+	require.Equal(t, int32(2), dials.Load())
+	require.Equal(t, map[string]int{"ERR_CONNECT": 1}, testMetrics.countStatuses())
+}
+
+func TestTCPCircuitBreaker(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	cipher := firstCipher(cipherList)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, TCPHandlerOptions{CircuitBreakerThreshold: 5, CircuitBreakerReset: time.Hour})
+	var dials atomic.Int32
+	handler.SetTargetDialer(transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		dials.Add(1)
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}))
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	const target = "192.0.2.2:80"
+	for i := 0; i < 6; i++ {
+		probe(listener.Addr().(*net.TCPAddr), makeClientBytesBasic(t, cipher, target))
+	}
+	listener.Close()
+	<-done
+
+	// The sixth connection is rejected without dialing.
+	require.Equal(t, int32(5), dials.Load())
+	require.Equal(t, map[string]int{"ERR_CONNECT": 5, "ERR_CIRCUIT_OPEN": 1}, testMetrics.countStatuses())
+	require.Equal(t, []string{target}, testMetrics.circuitBreakerOpens)
+}
+
+func TestTCPSlowDial(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	cipher := firstCipher(cipherList)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, TCPHandlerOptions{SlowDialThreshold: 20 * time.Millisecond})
+	baseDialer := makeValidatingTCPStreamDialer(allowAll)
+	var dials atomic.Int32
+	handler.SetTargetDialer(transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		// Only the second dial is slow.
+		if dials.Add(1) == 2 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return baseDialer.DialStream(ctx, addr)
+	}))
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	discardListener, discardWait := startDiscardServer(t)
+	for i := 0; i < 2; i++ {
+		conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+		require.NoError(t, err)
+		_, err = conn.Write(makeClientBytesCoalesced(t, cipher, discardListener.Addr().String()))
+		require.NoError(t, err)
+		conn.CloseWrite()
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}
+	listener.Close()
+	<-done
+	discardListener.Close()
+	discardWait.Wait()
+
+	// Slow dials are reported even if they succeed.
+	require.Equal(t, map[string]int{"OK": 2}, testMetrics.countStatuses())
+	require.Equal(t, []string{discardListener.Addr().String()}, testMetrics.slowDials)
+}
+
+// plainListener hides the half-close methods of its TCP connections, like the
+// listeners of transports that can't half-close.
+type plainListener struct {
+	*net.TCPListener
+}
+
+func (l plainListener) Accept() (net.Conn, error) {
+	conn, err := l.TCPListener.Accept()
+	return struct{ net.Conn }{conn}, err
+}
+
+func TestServeListener(t *testing.T) {
+	targetListener := makeLocalhostListener(t)
+	go func() {
+		targetConn, err := targetListener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		defer targetConn.Close()
+		io.ReadFull(targetConn, make([]byte, 4))
+		targetConn.Write([]byte("pong"))
+	}()
+	defer targetListener.Close()
+
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	handler := NewTCPHandler(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond)
+	handler.SetTargetDialer(makeValidatingTCPStreamDialer(allowAll))
+	done := make(chan struct{})
+	go func() {
+		ServeListener(plainListener{listener}, handler.Handle)
+		done <- struct{}{}
+	}()
+
+	dialer, err := shadowsocks.NewStreamDialer(&transport.TCPEndpoint{Address: listener.Addr().String()}, firstCipher(cipherList))
+	require.NoError(t, err)
+	conn, err := dialer.DialStream(context.Background(), targetListener.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(reply))
+	conn.Close()
+
+	listener.Close()
+	<-done
+	require.Equal(t, map[string]int{"OK": 1}, testMetrics.countStatuses())
+}
+
+func TestTCPHandshakeParser(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	testMetrics := &probeTestMetrics{}
+	authFunc := func(clientConn transport.StreamConn) (string, transport.StreamConn, *onet.ConnectionError) {
+		t.Error("Authenticator should not be called")
+		return "", nil, onet.NewConnectionError("ERR_CIPHER", "Unexpected authentication", nil)
+	}
+	discardListener, discardWait := startDiscardServer(t)
+	// A trivial plaintext protocol: one magic byte, followed by the payload for
+	// the discard server.
+	var parses atomic.Int32
+	parse := func(clientConn transport.StreamConn) (string, string, transport.StreamConn, *onet.ConnectionError) {
+		parses.Add(1)
+		magic := make([]byte, 1)
+		if _, err := io.ReadFull(clientConn, magic); err != nil || magic[0] != 'P' {
+			return "", "", nil, onet.NewConnectionError("ERR_MAGIC", "Bad magic byte", err)
+		}
+		return "plain", discardListener.Addr().String(), clientConn, nil
+	}
+	handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, TCPHandlerOptions{HandshakeParser: parse})
+	handler.SetTargetDialer(makeValidatingTCPStreamDialer(allowAll))
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	require.NoError(t, probe(listener.Addr().(*net.TCPAddr), []byte("Ppayload")))
+	require.NoError(t, probe(listener.Addr().(*net.TCPAddr), []byte("Xpayload")))
+	listener.Close()
+	<-done
+	discardListener.Close()
+	discardWait.Wait()
+
+	require.Equal(t, int32(2), parses.Load())
+	require.Equal(t, map[string]int{"OK": 1, "ERR_MAGIC": 1}, testMetrics.countStatuses())
+	// Connections that fail to parse are treated as probes.
+	require.Equal(t, []string{"ERR_MAGIC"}, testMetrics.probeStatus)
+}
+
+func TestDefaultHandshakeParser(t *testing.T) {
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	cipher := firstCipher(cipherList)
+	parse := NewDefaultHandshakeParser(NewShadowsocksStreamAuthenticator(cipherList, nil, &probeTestMetrics{}))
+
+	reader, writer := io.Pipe()
+	clientConn := &conn{clientAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.9"), Port: 54321}, reader: reader, writer: writer}
+	go func() {
+		shadowsocks.NewWriter(writer, cipher).Write(append(socks.ParseAddr("192.0.2.1:80"), []byte("payload")...))
+		writer.Close()
+	}()
+	id, tgtAddr, innerConn, parseErr := parse(clientConn)
+	require.Nil(t, parseErr)
+	require.Equal(t, "id-0", id)
+	require.Equal(t, "192.0.2.1:80", tgtAddr)
+	// The rest of the stream is left for the relay.
+	payload, err := io.ReadAll(innerConn)
+	require.NoError(t, err)
+	require.Equal(t, "payload", string(payload))
+}
+
+// runLongPoll relays a long poll, where the client sends a request and then waits
+// quietly, while the target sends 10 updates, 30ms apart. It returns the status of
+// the relay and the bytes that the client received.
+func runLongPoll(t *testing.T, timeout IdleTimeout) (map[string]int, int) {
+	targetListener := makeLocalhostListener(t)
+	go func() {
+		targetConn, err := targetListener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		defer targetConn.Close()
+		io.ReadFull(targetConn, make([]byte, 4))
+		for i := 0; i < 10; i++ {
+			time.Sleep(30 * time.Millisecond)
+			if _, err := targetConn.Write([]byte{byte(i)}); err != nil {
+				return
+			}
+		}
+	}()
+	defer targetListener.Close()
+
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, TCPHandlerOptions{IdleTimeout: timeout})
+	handler.SetTargetDialer(makeValidatingTCPStreamDialer(allowAll))
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	dialer, err := shadowsocks.NewStreamDialer(&transport.TCPEndpoint{Address: listener.Addr().String()}, firstCipher(cipherList))
+	require.NoError(t, err)
+	conn, err := dialer.DialStream(context.Background(), targetListener.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("poll"))
+	require.NoError(t, err)
+	received, _ := io.ReadAll(conn)
+	conn.Close()
+
+	listener.Close()
+	<-done
+	require.Eventually(t, func() bool {
+		testMetrics.mu.Lock()
+		defer testMetrics.mu.Unlock()
+		return len(testMetrics.closeStatus) == 1
+	}, time.Second, 10*time.Millisecond)
+	testMetrics.mu.Lock()
+	defer testMetrics.mu.Unlock()
+	return testMetrics.countStatuses(), len(received)
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	// The client is quiet for longer than the upload timeout, so the relay is
+	// closed if either direction being idle is enough.
+	statuses, received := runLongPoll(t, IdleTimeout{Upload: 100 * time.Millisecond, Download: 100 * time.Millisecond})
+	require.Equal(t, map[string]int{"ERR_IDLE_TIMEOUT": 1}, statuses)
+	require.Less(t, received, 10)
+
+	// The relay is kept while the target is active.
+	statuses, received = runLongPoll(t, IdleTimeout{Upload: 100 * time.Millisecond, Download: 100 * time.Millisecond, BothIdle: true})
+	require.Equal(t, map[string]int{"OK": 1}, statuses)
+	require.Equal(t, 10, received)
+
+	// The download timeout is longer than the gaps between updates.
+	statuses, received = runLongPoll(t, IdleTimeout{Download: 100 * time.Millisecond})
+	require.Equal(t, map[string]int{"OK": 1}, statuses)
+	require.Equal(t, 10, received)
+}
+
+// failingWriter fails once `remaining` bytes have been written.
+type failingWriter struct {
+	io.Writer
+	remaining int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) <= w.remaining {
+		n, err := w.Writer.Write(p)
+		w.remaining -= n
+		return n, err
+	}
+	n, _ := w.Writer.Write(p[:w.remaining])
+	w.remaining -= n
+	return n, errors.New("target failed")
+}
+
+func TestTCPTargetWriteFailure(t *testing.T) {
+	targetListener := makeLocalhostListener(t)
+	go func() {
+		targetConn, err := targetListener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		defer targetConn.Close()
+		io.Copy(io.Discard, targetConn)
+	}()
+	defer targetListener.Close()
+
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	handler := NewTCPHandler(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond)
+	handler.SetTargetDialer(transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		tgtConn, err := (&transport.TCPDialer{}).DialStream(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return transport.WrapConn(tgtConn, tgtConn, &failingWriter{Writer: tgtConn, remaining: 100}), nil
+	}))
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	dialer, err := shadowsocks.NewStreamDialer(&transport.TCPEndpoint{Address: listener.Addr().String()}, firstCipher(cipherList))
+	require.NoError(t, err)
+	conn, err := dialer.DialStream(context.Background(), targetListener.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write(make([]byte, 1000))
+	require.NoError(t, err)
+	io.ReadAll(conn)
+	conn.Close()
+
+	listener.Close()
+	<-done
+	require.Eventually(t, func() bool {
+		testMetrics.mu.Lock()
+		defer testMetrics.mu.Unlock()
+		return len(testMetrics.closeStatus) == 1
+	}, time.Second, 10*time.Millisecond)
+	testMetrics.mu.Lock()
+	defer testMetrics.mu.Unlock()
+	// The status tells the target failed, and the metrics how far the relay got.
+	require.Equal(t, map[string]int{"ERR_RELAY_TARGET": 1}, testMetrics.countStatuses())
+	require.Equal(t, int64(100), testMetrics.closeData[0].ProxyTarget)
+}
+
+func TestCheckTargetDomain(t *testing.T) {
+	require.NoError(t, checkTargetDomain(socks.ParseAddr("192.0.2.1:80"), 5))
+	require.NoError(t, checkTargetDomain(socks.ParseAddr("[2001:db8::1]:80"), 5))
+	require.NoError(t, checkTargetDomain(socks.ParseAddr("example.com:443"), 11))
+	require.Error(t, checkTargetDomain(socks.ParseAddr("example.com:443"), 10))
+	require.Error(t, checkTargetDomain(socks.ParseAddr("exa\x00mple.com:443"), 255))
+	require.Error(t, checkTargetDomain(socks.ParseAddr("example.com\n:443"), 255))
+	require.Error(t, checkTargetDomain(socks.Addr{socks.AtypDomainName, 0, 0, 80}, 255))
+}
+
+func TestTCPBadHost(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	cipher := firstCipher(cipherList)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, TCPHandlerOptions{MaxDomainLength: 20})
+	var dials atomic.Int32
+	handler.SetTargetDialer(transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		dials.Add(1)
+		return nil, errors.New("unexpected dial")
+	}))
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	var initialBytes bytes.Buffer
+	ssw := shadowsocks.NewWriter(&initialBytes, cipher)
+	_, err = ssw.Write(append(socks.ParseAddr("a-long-hostname.example:80"), []byte("payload")...))
+	require.NoError(t, err)
+	probe(listener.Addr().(*net.TCPAddr), initialBytes.Bytes())
+	listener.Close()
+	<-done
+
+	require.Equal(t, map[string]int{"ERR_BAD_HOST": 1}, testMetrics.countStatuses())
+	require.Equal(t, int32(0), dials.Load())
+}
+
+func TestTCPBandwidthLimiter(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	cipher := firstCipher(cipherList)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	limiter := NewBandwidthLimiter(1000000)
+	handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, TCPHandlerOptions{BandwidthLimiter: limiter})
+	handler.SetTargetDialer(makeValidatingTCPStreamDialer(allowAll))
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	discardListener, discardWait := startDiscardServer(t)
+	initialBytes := makeClientBytesBasic(t, cipher, discardListener.Addr().String())
+	require.NoError(t, probe(listener.Addr().(*net.TCPAddr), initialBytes))
+	listener.Close()
+	<-done
+	discardListener.Close()
+	discardWait.Wait()
+
+	require.Equal(t, 1, testMetrics.countStatuses()["OK"])
+	// Only the payload after the target address is relayed.
+	require.Equal(t, int64(100), limiter.Bytes())
+}
+
+func TestTCPStreamFilter(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	cipher := firstCipher(cipherList)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	var mu sync.Mutex
+	var filtered []string
+	newFilter := func(accessKey, targetAddr string) StreamFilter {
+		mu.Lock()
+		filtered = append(filtered, accessKey+" "+targetAddr)
+		mu.Unlock()
+		return funcStreamFilter(func(data []byte) ([]byte, error) {
+			return nil, errors.New("rejected")
+		})
+	}
+	handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, TCPHandlerOptions{StreamFilter: newFilter})
+	handler.SetTargetDialer(makeValidatingTCPStreamDialer(allowAll))
+	discardListener, discardWait := startDiscardServer(t)
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	initialBytes := makeClientBytesBasic(t, cipher, discardListener.Addr().String())
+	require.NoError(t, probe(listener.Addr().(*net.TCPAddr), initialBytes))
+	listener.Close()
+	<-done
+	discardListener.Close()
+	discardWait.Wait()
+
+	require.Equal(t, map[string]int{"ERR_FILTERED": 1}, testMetrics.countStatuses())
+	require.Equal(t, []string{"id-0 " + discardListener.Addr().String()}, filtered)
+}
+
+func TestTCPDiagnostics(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	cipher := firstCipher(cipherList)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, TCPHandlerOptions{
+		Diagnostics: &DiagnosticConfig{
+			TargetAddress: "diagnostics.invalid:1",
+			ServerVersion: "1.2.3",
+			CipherName: func(accessKey string) string {
+				return "cipher-for-" + accessKey
+			},
+		},
+	})
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	dialer, err := shadowsocks.NewStreamDialer(&transport.TCPEndpoint{Address: listener.Addr().String()}, cipher)
+	require.NoError(t, err)
+	conn, err := dialer.DialStream(context.Background(), "diagnostics.invalid:1")
+	require.NoError(t, err)
+	var report DiagnosticReport
+	require.NoError(t, json.NewDecoder(conn).Decode(&report))
+	conn.Close()
+	listener.Close()
+	<-done
+
+	require.Equal(t, "127.0.0.1", report.ClientIP)
+	require.Equal(t, "id-0", report.AccessKey)
+	require.Equal(t, "cipher-for-id-0", report.Cipher)
+	require.Equal(t, "1.2.3", report.ServerVersion)
+	require.Equal(t, 1, testMetrics.countStatuses()["OK"])
+}
+
+func TestTCPTargetDNSCache(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	cipher := firstCipher(cipherList)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, TCPHandlerOptions{TargetDNSCacheTTL: time.Minute, TargetDNSCacheSize: 10})
+	handler.SetTargetDialer(makeValidatingTCPStreamDialer(allowAll))
+	lookups := 0
+	handler.(*tcpHandler).dnsCache.lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		lookups++
+		return []net.IP{net.ParseIP("127.0.0.1")}, nil
+	}
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	discardListener, discardWait := startDiscardServer(t)
+	_, port, err := net.SplitHostPort(discardListener.Addr().String())
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		var buffer bytes.Buffer
+		ssw := shadowsocks.NewWriter(&buffer, cipher)
+		_, err := ssw.Write(append(socks.ParseAddr(net.JoinHostPort("example.test", port)), "data"...))
+		require.NoError(t, err)
+		require.NoError(t, probe(listener.Addr().(*net.TCPAddr), buffer.Bytes()))
+	}
+	listener.Close()
+	<-done
+	discardListener.Close()
+	discardWait.Wait()
+
+	require.Equal(t, 2, testMetrics.countStatuses()["OK"])
+	require.Equal(t, 1, lookups)
+}
+
+func TestTCPLoadShedding(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	cipher := firstCipher(cipherList)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	var overloaded atomic.Bool
+	handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, TCPHandlerOptions{LoadShedding: overloaded.Load})
+	handler.SetTargetDialer(makeValidatingTCPStreamDialer(allowAll))
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	discardListener, discardWait := startDiscardServer(t)
+	initialBytes := makeClientBytesCoalesced(t, cipher, discardListener.Addr().String())
+	require.NoError(t, probe(listener.Addr().(*net.TCPAddr), initialBytes))
+	overloaded.Store(true)
+	// The server closes without reading, which may reset the connection.
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	conn.Write(initialBytes)
+	n, _ := conn.Read(make([]byte, 1))
+	require.Equal(t, 0, n)
+	conn.Close()
+	listener.Close()
+	<-done
+	discardListener.Close()
+	discardWait.Wait()
+
+	require.Equal(t, map[string]int{"OK": 1, "ERR_OVERLOADED": 1}, testMetrics.countStatuses())
+	// Shed connections are not drained like probes.
+	require.Empty(t, testMetrics.probeData)
+}
+
+func TestGoroutineLoadSignal(t *testing.T) {
+	require.False(t, GoroutineLoadSignal(1_000_000)())
+	require.True(t, GoroutineLoadSignal(0)())
+}
+
+func TestTCPGoroutineLimiter(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	cipher := firstCipher(cipherList)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	// Room for one connection only.
+	limiter := NewGoroutineLimiter(3)
+	handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, TCPHandlerOptions{GoroutineLimiter: limiter})
+	handler.SetTargetDialer(makeValidatingTCPStreamDialer(allowAll))
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	discardListener, discardWait := startDiscardServer(t)
+	initialBytes := makeClientBytesCoalesced(t, cipher, discardListener.Addr().String())
+	first, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	_, err = first.Write(initialBytes)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return limiter.Running() == 2 }, time.Second, time.Millisecond)
+
+	// The server closes without reading, which may reset the connection.
+	second, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	second.Write(initialBytes)
+	n, _ := second.Read(make([]byte, 1))
+	require.Equal(t, 0, n)
+	second.Close()
+
+	first.Close()
+	require.Eventually(t, func() bool { return limiter.Running() == 0 }, time.Second, time.Millisecond)
+	listener.Close()
+	<-done
+	discardListener.Close()
+	discardWait.Wait()
+
+	require.Equal(t, int64(1), limiter.Shed())
+	require.Equal(t, 1, testMetrics.countStatuses()["ERR_OVERLOADED"])
+}
+
+// runTCPConnectionFromLocalhost sends a valid connection from 127.0.0.1 to a
+// handler configured by `opts`, and returns the statuses it reported.
+func runTCPConnectionFromLocalhost(t *testing.T, opts TCPHandlerOptions) map[string]int {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	cipher := firstCipher(cipherList)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	handler := NewTCPHandlerWithOptions(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond, opts)
+	handler.SetTargetDialer(makeValidatingTCPStreamDialer(allowAll))
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	discardListener, discardWait := startDiscardServer(t)
+	initialBytes := makeClientBytesCoalesced(t, cipher, discardListener.Addr().String())
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	// A rejected connection is closed without reading, which may reset it.
+	conn.Write(initialBytes)
+	conn.CloseWrite()
+	io.Copy(io.Discard, conn)
+	conn.Close()
+
+	listener.Close()
+	<-done
+	discardListener.Close()
+	discardWait.Wait()
+	return testMetrics.countStatuses()
+}
+
+func TestTCPIPReputation(t *testing.T) {
+	statuses := runTCPConnectionFromLocalhost(t, TCPHandlerOptions{IPReputation: NewIPBlocklist([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})})
+	require.Equal(t, map[string]int{"ERR_IP_BLOCKED": 1}, statuses)
+}
+
+func TestTCPIPConnectionLimiter(t *testing.T) {
+	limiter := NewIPConnectionLimiter(1, 10)
+	statuses := runTCPConnectionFromLocalhost(t, TCPHandlerOptions{IPConnectionLimiter: limiter})
+	require.Equal(t, map[string]int{"OK": 1}, statuses)
+	require.Equal(t, 0, limiter.Tracked())
+
+	// Another connection from 127.0.0.1 is open.
+	conn, ok := limiter.acquire(netip.MustParseAddr("127.0.0.1"))
+	require.True(t, ok)
+	defer limiter.release(conn)
+	statuses = runTCPConnectionFromLocalhost(t, TCPHandlerOptions{IPConnectionLimiter: limiter})
+	require.Equal(t, map[string]int{"ERR_IP_CONN_LIMIT": 1}, statuses)
+	require.Equal(t, int64(1), limiter.Rejected())
+}
+
+func TestTCPClientIPFamily(t *testing.T) {
+	statuses := runTCPConnectionFromLocalhost(t, TCPHandlerOptions{ClientIPFamily: IPFamilyIPv6})
+	require.Equal(t, map[string]int{"ERR_IP_BLOCKED": 1}, statuses)
+
+	statuses = runTCPConnectionFromLocalhost(t, TCPHandlerOptions{ClientIPFamily: IPFamilyIPv4})
+	require.Equal(t, map[string]int{"OK": 1}, statuses)
+}
+
+func TestTCPQuiescer(t *testing.T) {
+	var quiescer Quiescer
+	quiescer.Quiesce()
+	statuses := runTCPConnectionFromLocalhost(t, TCPHandlerOptions{Quiescer: &quiescer})
+	require.Equal(t, map[string]int{"ERR_QUIESCED": 1}, statuses)
+
+	quiescer.Resume()
+	statuses = runTCPConnectionFromLocalhost(t, TCPHandlerOptions{Quiescer: &quiescer})
+	require.Equal(t, map[string]int{"OK": 1}, statuses)
+}
+
+func TestTCPTargetSocketMark(t *testing.T) {
+	var marks []uint32
+	var markErr error
+	defer func(f func(fd uintptr, mark uint32) error) { setSocketMark = f }(setSocketMark)
+	setSocketMark = func(fd uintptr, mark uint32) error {
+		marks = append(marks, mark)
+		return markErr
+	}
+
+	statuses := runTCPConnectionFromLocalhost(t, TCPHandlerOptions{TargetSocketMark: 42})
+	require.Equal(t, map[string]int{"OK": 1}, statuses)
+	require.Equal(t, []uint32{42}, marks)
+
+	// The dial fails if the mark can't be set.
+	markErr = errors.New("operation not permitted")
+	statuses = runTCPConnectionFromLocalhost(t, TCPHandlerOptions{TargetSocketMark: 43})
+	require.Equal(t, map[string]int{"ERR_CONNECT": 1}, statuses)
+	require.Equal(t, []uint32{42, 43}, marks)
+}
+
+func TestMarkDialer(t *testing.T) {
+	dialer := &transport.TCPDialer{}
+	require.Same(t, dialer, markDialer(dialer, 0))
+	marked := markDialer(dialer, 1)
+	require.NotSame(t, dialer, marked)
+	// The original dialer is left unchanged.
+	require.Nil(t, dialer.Dialer.Control)
+
+	other := transport.FuncStreamDialer(func(ctx context.Context, addr string) (transport.StreamConn, error) {
+		return nil, errors.New("not dialing")
+	})
+	require.IsType(t, other, markDialer(other, 1))
+}
+
+func TestReplayDefense(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	replayCache := NewReplayCache(5)
+	testMetrics := &probeTestMetrics{}
+	const testTimeout = 200 * time.Millisecond
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, &replayCache, testMetrics)
+	handler := NewTCPHandler(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, testTimeout)
+	snapshot := cipherList.SnapshotForClientIP(netip.Addr{})
+	cipherEntry := snapshot[0].Value.(*CipherEntry)
+	cipher := cipherEntry.CryptoKey
+	reader, writer := io.Pipe()
+	go shadowsocks.NewWriter(writer, cipher).Write([]byte{0})
+	preamble := make([]byte, cipher.SaltSize()+2+cipher.TagSize())
+	if _, err := io.ReadFull(reader, preamble); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func() *net.TCPConn {
+		conn, err := net.DialTCP(listener.Addr().Network(), nil, listener.Addr().(*net.TCPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := conn.Write(preamble)
+		if n < len(preamble) {
+			t.Error(err)
+		}
+		return conn
+	}
+
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	// First run.
+	conn1 := run()
+	// Wait for the close.  This ensures that conn1 and conn2 can't be
+	// processed out of order at the proxy.
+	conn1.CloseWrite()
+	conn1.Read(make([]byte, 1))
+	if len(testMetrics.probeData) != 0 {
+		t.Errorf("First connection should not have triggered probe detection: %v", testMetrics.probeData[0])
+	}
+
+	// Replay.
+	conn2 := run()
+	// Wait for the connection to be closed by the proxy after testTimeout.
+	conn2.CloseWrite()
+	conn2.Read(make([]byte, 1))
+
+	conn1.Close()
+	listener.Close()
+	<-done
+
+	if len(testMetrics.probeData) == 1 {
+		clientProxyData := testMetrics.probeData[0]
+		if clientProxyData != int64(len(preamble)) {
+			t.Errorf("Unexpected probe data: %v", clientProxyData)
+		}
+		status := testMetrics.probeStatus[0]
+		if status != "ERR_REPLAY_CLIENT" {
+			t.Errorf("Unexpected TCP probe status: %s", status)
+		}
+	} else {
+		t.Error("Replay should have triggered probe detection")
+	}
+	if len(testMetrics.closeStatus) == 2 {
+		status := testMetrics.closeStatus[1]
+		if status != "ERR_REPLAY_CLIENT" {
+			t.Errorf("Unexpected TCP close status: %s", status)
+		}
+	} else {
+		t.Error("Replay should have reported an error status")
+	}
+}
+
+func TestConcurrentReplayDefense(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	replayCache := NewReplayCache(5)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, &replayCache, testMetrics)
+	handler := NewTCPHandler(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, 200*time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	// Connections with the same salt, sent at the same time.
+	initialBytes := makeClientBytesBasic(t, firstCipher(cipherList), "127.0.0.1:9")
+	const numConns = 8
+	var wg sync.WaitGroup
+	for i := 0; i < numConns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probe(listener.Addr().(*net.TCPAddr), initialBytes)
+		}()
+	}
+	wg.Wait()
+	listener.Close()
+	<-done
+
+	statuses := testMetrics.countStatuses()
+	require.Equal(t, numConns-1, statuses["ERR_REPLAY_CLIENT"], "statuses: %v", statuses)
+	require.Equal(t, numConns, len(testMetrics.closeStatus))
+}
+
+func TestReverseReplayDefense(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	replayCache := NewReplayCache(5)
+	testMetrics := &probeTestMetrics{}
+	const testTimeout = 200 * time.Millisecond
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, &replayCache, testMetrics)
+	handler := NewTCPHandler(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, testTimeout)
+	snapshot := cipherList.SnapshotForClientIP(netip.Addr{})
+	cipherEntry := snapshot[0].Value.(*CipherEntry)
+	cipher := cipherEntry.CryptoKey
+	reader, writer := io.Pipe()
+	ssWriter := shadowsocks.NewWriter(writer, cipher)
+	// Use a server-marked salt in the client's preamble.
+	ssWriter.SetSaltGenerator(cipherEntry.SaltGenerator)
+	go ssWriter.Write([]byte{0})
+	preamble := make([]byte, 32+2+16)
+	if _, err := io.ReadFull(reader, preamble); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	conn, err := net.Dial(listener.Addr().Network(), listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := conn.Write(preamble)
+	if n < len(preamble) {
+		t.Error(err)
+	}
+	conn.Close()
+	listener.Close()
+	<-done
+
+	// The preamble should have been marked as a server replay.
+	if len(testMetrics.probeData) == 1 {
+		clientProxyData := testMetrics.probeData[0]
+		if clientProxyData != int64(len(preamble)) {
+			t.Errorf("Unexpected probe data: %v", clientProxyData)
+		}
+		status := testMetrics.probeStatus[0]
+		if status != "ERR_REPLAY_SERVER" {
+			t.Errorf("Unexpected TCP probe status: %s", status)
+		}
+	} else {
+		t.Error("Replay should have triggered probe detection")
+	}
+	if len(testMetrics.closeStatus) == 1 {
+		status := testMetrics.closeStatus[0]
+		if status != "ERR_REPLAY_SERVER" {
+			t.Errorf("Unexpected TCP close status: %s", status)
+		}
+	} else {
+		t.Error("Replay should have reported an error status")
+	}
+}
+
+// Test 49, 50, and 51 bytes to ensure they have the same behavior.
+// 50 bytes used to be the cutoff for different behavior.
+func TestTCPProbeTimeout(t *testing.T) {
+	probeExpectTimeout(t, 49, "ERR_CIPHER")
+	probeExpectTimeout(t, 50, "ERR_CIPHER")
+	probeExpectTimeout(t, 51, "ERR_CIPHER")
+}
+
+func probeExpectTimeout(t *testing.T, payloadSize int, wantStatus string) {
+	const testTimeout = 200 * time.Millisecond
+
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(makeTestSecrets(5))
+	require.NoError(t, err, "MakeTestCiphers failed: %v", err)
+	testMetrics := &probeTestMetrics{}
+	authFunc := NewShadowsocksStreamAuthenticator(cipherList, nil, testMetrics)
+	handler := NewTCPHandler(listener.Addr().(*net.TCPAddr).Port, authFunc, testMetrics, testTimeout)
+
+	done := make(chan struct{})
+	go func() {
+		StreamServe(WrapStreamListener(listener.AcceptTCP), handler.Handle)
+		done <- struct{}{}
+	}()
+
+	testPayload := makeTestPayload(payloadSize)
+	timerStart := time.Now()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial %v: %v", listener.Addr(), err)
 	}
 	conn.Write(testPayload)
 	buf := make([]byte, 1024)
@@ -695,16 +1974,16 @@ func probeExpectTimeout(t *testing.T, payloadSize int) {
 	}
 	if len(testMetrics.probeStatus) == 1 {
 		status := testMetrics.probeStatus[0]
-		if status != "ERR_CIPHER" {
-			t.Errorf("Unexpected TCP probe status: %s", status)
+		if status != wantStatus {
+			t.Errorf("Unexpected TCP probe status: %s, expected %s", status, wantStatus)
 		}
 	} else {
 		t.Error("Bad handshake should have reported an error status")
 	}
 	if len(testMetrics.closeStatus) == 1 {
 		status := testMetrics.closeStatus[0]
-		if status != "ERR_CIPHER" {
-			t.Errorf("Unexpected TCP close status: %s", status)
+		if status != wantStatus {
+			t.Errorf("Unexpected TCP close status: %s, expected %s", status, wantStatus)
 		}
 	} else {
 		t.Error("Bad handshake should have reported an error status")
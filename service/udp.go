@@ -15,21 +15,35 @@
 package service
 
 import (
+	"container/list"
 	"errors"
 	"fmt"
 	"net"
 	"net/netip"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/Jigsaw-Code/outline-ss-server/internal/slicepool"
 	"github.com/Jigsaw-Code/outline-ss-server/ipinfo"
 	onet "github.com/Jigsaw-Code/outline-ss-server/net"
 	logging "github.com/op/go-logging"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
+// UDPPacketEventHook is notified of the packets relayed by a [PacketHandler]. Its
+// methods are called synchronously by the goroutine that relays the packet, so they
+// must return quickly. `bytes` is the size of the payload, without the Shadowsocks
+// header and encryption overhead. Packets that fail to be relayed are not reported.
+type UDPPacketEventHook interface {
+	// OnPacketFromClient is called after a packet from the client is sent to its target.
+	OnPacketFromClient(keyID, clientAddr string, bytes int)
+	// OnPacketFromTarget is called after a packet from `targetAddr` is sent to the client.
+	OnPacketFromTarget(keyID, targetAddr string, bytes int)
+}
+
 // UDPMetrics is used to report metrics on UDP connections.
 type UDPMetrics interface {
 	ipinfo.IPInfoMap
@@ -39,6 +53,10 @@ type UDPMetrics interface {
 	AddUDPPacketFromTarget(clientInfo ipinfo.IPInfo, accessKey, status string, targetProxyBytes, proxyClientBytes int)
 	AddUDPNatEntry(clientAddr net.Addr, accessKey string)
 	RemoveUDPNatEntry(clientAddr net.Addr, accessKey string)
+	AddUDPDeduplication()
+	AddUDPAmplificationDrop()
+	AddUDPConnectionMigration(accessKey string)
+	AddUDPClientDuplicate(accessKey string)
 
 	// Shadowsocks metrics
 	AddUDPCipherSearch(accessKeyFound bool, timeToCipher time.Duration)
@@ -47,6 +65,18 @@ type UDPMetrics interface {
 // Max UDP buffer size for the server code.
 const serverUDPBufferSize = 64 * 1024
 
+// MaxUDPPayloadSize is the largest payload that a UDP packet over IPv4 can carry:
+// 65535 bytes, minus the IPv4 and UDP headers. It's the default limit on the size
+// of the packets from clients.
+const MaxUDPPayloadSize = 65507
+
+// RecommendedUDPAmplificationFactor is a limit on the ratio of the bytes sent to a
+// client to the bytes received from it, per NAT entry, to use with
+// [PacketHandlerOptions.MaxAmplification]. Ordinary traffic stays well below it,
+// including downloads over QUIC, where the client sends about one small ACK for
+// every few full-size packets.
+const RecommendedUDPAmplificationFactor = 50
+
 // Wrapper for logger.Debugf during UDP proxying.
 func debugUDP(tag string, template string, val interface{}) {
 	// This is an optimization to reduce unnecessary allocations due to an interaction
@@ -59,7 +89,7 @@ func debugUDP(tag string, template string, val interface{}) {
 func debugUDPAddr(addr net.Addr, template string, val interface{}) {
 	if logger.IsEnabledFor(logging.DEBUG) {
 		// Avoid calling addr.String() unless debugging is enabled.
-		debugUDP(addr.String(), template, val)
+		debugUDP(anonymizeAddr(addr).String(), template, val)
 	}
 }
 
@@ -69,31 +99,239 @@ func findAccessKeyUDP(clientIP netip.Addr, dst, src []byte, cipherList CipherLis
 	// Try each cipher until we find one that authenticates successfully. This assumes that all ciphers are AEAD.
 	// We snapshot the list because it may be modified while we use it.
 	snapshot := cipherList.SnapshotForClientIP(clientIP)
-	for ci, entry := range snapshot {
-		id, cryptoKey := entry.Value.(*CipherEntry).ID, entry.Value.(*CipherEntry).CryptoKey
-		buf, err := shadowsocks.Unpack(dst, src, cryptoKey)
+	if len(snapshot) == 0 {
+		warnNoKeys()
+		return nil, "", nil, errNoKeys
+	}
+	if !isConstantTime(cipherList) {
+		for ci, entry := range snapshot {
+			id, cryptoKey := entry.Value.(*CipherEntry).ID, entry.Value.(*CipherEntry).CryptoKey
+			buf, err := shadowsocks.Unpack(dst, src, cryptoKey)
+			if err != nil {
+				debugUDP(id, "Failed to unpack: %v", err)
+				continue
+			}
+			debugUDP(id, "Found cipher at index %d", ci)
+			// Move the active cipher to the front, so that the search is quicker next time.
+			cipherList.MarkUsedByClientIP(entry, clientIP)
+			return buf, id, cryptoKey, nil
+		}
+		return nil, "", nil, errors.New("could not find valid UDP cipher")
+	}
+	// In constant-time mode we try every cipher, even after finding a match. The
+	// trials are decrypted into a scratch buffer, and the plaintext of the first
+	// match is copied to dst, so that a match doesn't cost another decryption.
+	lazySlice := trialBufPool.LazySlice()
+	scratch := lazySlice.Acquire()
+	defer lazySlice.Release()
+	var match *list.Element
+	var matchLen int
+	for _, entry := range snapshot {
+		buf, err := shadowsocks.Unpack(scratch, src, entry.Value.(*CipherEntry).CryptoKey)
 		if err != nil {
-			debugUDP(id, "Failed to unpack: %v", err)
 			continue
 		}
-		debugUDP(id, "Found cipher at index %d", ci)
-		// Move the active cipher to the front, so that the search is quicker next time.
-		cipherList.MarkUsedByClientIP(entry, clientIP)
-		return buf, id, cryptoKey, nil
+		if match == nil {
+			match = entry
+			matchLen = copy(dst, buf)
+		}
 	}
-	return nil, "", nil, errors.New("could not find valid UDP cipher")
+	if match == nil {
+		return nil, "", nil, errors.New("could not find valid UDP cipher")
+	}
+	// This only counts the use, as the order is fixed in constant-time mode.
+	cipherList.MarkUsedByClientIP(match, clientIP)
+	entry := match.Value.(*CipherEntry)
+	return dst[:matchLen], entry.ID, entry.CryptoKey, nil
 }
 
+// Buffer pool for the trial decryptions of constant-time mode.
+var trialBufPool = slicepool.MakePool(serverUDPBufferSize)
+
 type packetHandler struct {
 	natTimeout        time.Duration
-	ciphers           CipherList
+	ciphers           atomic.Value // Holds a cipherListValue.
 	m                 UDPMetrics
 	targetIPValidator onet.TargetIPValidator
+	dedup             *packetDeduplicator
+	replays           *udpReplayFilter
+	migration         bool
+	hook              UDPPacketEventHook
+	accessLog         udpAccessLog
+	limiter           *BandwidthLimiter
+	sessions          bool
+	events            *EventEmitter
+	// Longest target domain name accepted, in bytes.
+	maxDomainLength int
+	// Local ports for target sockets, or nil for ephemeral ports.
+	sourcePorts *sourcePortRange
+	// Largest packet accepted from clients, in bytes.
+	maxPacketSize int
+	// Limit on the ratio of reply bytes to request bytes, or 0 for no limit.
+	maxAmplification float64
+	goroutines       *GoroutineLimiter
+	reputation       IPReputation
+	ipFamily         IPFamily
+	quiescer         *Quiescer
+	// Window to detect duplicate packets from clients in, if positive.
+	duplicateWindow time.Duration
+
+	// The NAT tables of the running calls to Handle.
+	natmapsMu sync.Mutex
+	natmaps   map[*natmap]bool
+}
+
+// PacketHandlerOptions configures the optional behavior of a [PacketHandler] made by
+// [NewPacketHandlerWithOptions]. The zero value of each field keeps the default.
+type PacketHandlerOptions struct {
+	// Deduplication enables dropping packets from a client that are identical to one
+	// it sent less than that long ago, such as DNS retransmissions that would
+	// otherwise both be forwarded.
+	Deduplication time.Duration
+	// ReplayProtection enables dropping packets whose salt was already used with the
+	// same access key in that long, with status "ERR_REPLAY_CLIENT", so that captured
+	// packets can't be sent again. Clients encrypt each packet with a new salt,
+	// retransmissions included, so no legitimate packet is dropped. Replays older than
+	// the window get through, and the filter keeps a record of every packet in the
+	// window, so its memory grows with the packet rate times the window.
+	ReplayProtection time.Duration
+	// DuplicateDetection enables counting the packets from a client that are exact
+	// copies of one of the last 16 it sent to the same NAT entry less than that long
+	// ago, with the AddUDPClientDuplicate metric. Such copies are most likely
+	// retransmitted by a lossy network rather than replayed by an attacker. They are
+	// still forwarded, unless deduplication or replay protection drops them.
+	DuplicateDetection time.Duration
+	// ConnectionMigration enables moving a client's NAT entry to its new address when
+	// it changes IP address, as mobile clients do when switching networks. A packet
+	// from an unknown address that decrypts with the key of an existing entry from
+	// another IP takes over that entry, if it's the only one for the key. Without
+	// migration, the client gets a new entry and loses in-flight replies. Migration
+	// only happens with ReplayProtection, with a window that covers the NAT timeout,
+	// since otherwise a captured packet sent from another address would take over the
+	// client's entry.
+	ConnectionMigration bool
+	// Sessions enables UDP sessions, which let a client keep its NAT entry when its
+	// address changes, even if it shares its access key with other clients. The client
+	// opts in by prefixing the plaintext of its packets, before the SOCKS address, with
+	// a session header: the byte 0x7F followed by a random 8-byte session ID. A packet
+	// from a new address with the access key and session ID of an existing entry moves
+	// that entry to the new address. Packets without the header are handled as usual.
+	// Like connection migration, entries only move with ReplayProtection, so that a
+	// captured packet can't move the session to the sender's address.
+	Sessions bool
+	// PacketEventHook is notified of every packet that is relayed, for purposes such
+	// as billing or rate limiting.
+	PacketEventHook UDPPacketEventHook
+	// AccessLog is called for every packet that is relayed, in either direction.
+	// AccessLogSampleRate is the fraction of them, between 0 and 1, that are passed
+	// to it, to reduce its overhead on busy servers. Zero means 1, which logs every
+	// packet.
+	AccessLog           AccessLogger
+	AccessLogSampleRate float64
+	// MaxAmplification limits the bytes sent back to a client, per NAT entry, to that
+	// many times the bytes received from it, counting the Shadowsocks overhead.
+	// Replies over the limit are dropped, so that small requests for large answers
+	// (DNS ANY, NTP monlist) can't turn the proxy into a reflection amplifier, and
+	// counted with AddUDPAmplificationDrop. See [RecommendedUDPAmplificationFactor].
+	MaxAmplification float64
+	// GoroutineLimiter makes the handler count the goroutine of each NAT entry in it,
+	// and drop the packets that would create a new entry, with status
+	// "ERR_OVERLOADED", while it's full.
+	GoroutineLimiter *GoroutineLimiter
+	// IPReputation makes the handler drop the packets that would create a NAT entry
+	// for a client address that it blocks, with status "ERR_IP_BLOCKED", before the
+	// trial decryption.
+	IPReputation IPReputation
+	// ClientIPFamily makes the handler drop the packets that would create a NAT entry
+	// for a client of the other IP version, with status "ERR_IP_BLOCKED".
+	ClientIPFamily IPFamily
+	// Quiescer makes the handler drop the packets that would create a NAT entry, with
+	// status "ERR_QUIESCED", while it's quiesced. Packets of existing entries are
+	// still relayed, including those that migrate an entry to a new client address.
+	Quiescer *Quiescer
+	// BandwidthLimiter limits the throughput of the relayed packets, in both
+	// directions, to that allowed by the limiter, which may be shared with other
+	// handlers. Packets from clients that would go over the limit are dropped, with
+	// status "ERR_BANDWIDTH_LIMIT", since they are all read by one goroutine and
+	// waiting for one key would delay every other. Replies wait in the goroutine of
+	// their NAT entry instead.
+	BandwidthLimiter *BandwidthLimiter
+	// EventEmitter makes the handler emit an event when a NAT entry is created, and
+	// another when it's removed.
+	EventEmitter *EventEmitter
+	// MaxDomainLength makes the handler drop packets to target domain names longer
+	// than that many bytes with status "ERR_BAD_HOST", before resolving them. Empty
+	// names and names with control characters are always dropped. Zero means 255, the
+	// longest name that the address format allows.
+	MaxDomainLength int
+	// TargetSourcePortFirst and TargetSourcePortLast bind the target socket of each
+	// NAT entry to a local port in that range, inclusive, for targets that expect
+	// replies to keep the same source port. The client's own source port is used if
+	// it's in the range, and otherwise a port derived from the client address, so a
+	// client keeps its port across NAT entries. If that port is in use, the following
+	// ones in the range are tried, and then an ephemeral port is used. An empty or
+	// invalid range disables it.
+	TargetSourcePortFirst int
+	TargetSourcePortLast  int
+	// MaxPacketSize makes the handler drop packets from clients larger than that many
+	// bytes, with status "ERR_PACKET_SIZE", for networks whose MTU is reduced by
+	// tunneling, such as VXLAN or GRE. Empty packets are always dropped. Zero means
+	// [MaxUDPPayloadSize], which is also the largest value allowed.
+	MaxPacketSize int
 }
 
 // NewPacketHandler creates a UDPService
 func NewPacketHandler(natTimeout time.Duration, cipherList CipherList, m UDPMetrics) PacketHandler {
-	return &packetHandler{natTimeout: natTimeout, ciphers: cipherList, m: m, targetIPValidator: onet.RequirePublicIP}
+	return NewPacketHandlerWithOptions(natTimeout, cipherList, m, PacketHandlerOptions{})
+}
+
+// NewPacketHandlerWithOptions creates a [PacketHandler] configured by `opts`.
+func NewPacketHandlerWithOptions(natTimeout time.Duration, cipherList CipherList, m UDPMetrics, opts PacketHandlerOptions) PacketHandler {
+	h := &packetHandler{
+		natTimeout:        natTimeout,
+		m:                 m,
+		targetIPValidator: onet.NewDefaultPrivateBlocker().Validate,
+		migration:         opts.ConnectionMigration,
+		sessions:          opts.Sessions,
+		hook:              opts.PacketEventHook,
+		accessLog:         udpAccessLog{logger: opts.AccessLog, sampleRate: opts.AccessLogSampleRate},
+		maxAmplification:  opts.MaxAmplification,
+		goroutines:        opts.GoroutineLimiter,
+		reputation:        opts.IPReputation,
+		ipFamily:          opts.ClientIPFamily,
+		quiescer:          opts.Quiescer,
+		limiter:           opts.BandwidthLimiter,
+		events:            opts.EventEmitter,
+		maxDomainLength:   opts.MaxDomainLength,
+		maxPacketSize:     opts.MaxPacketSize,
+		duplicateWindow:   opts.DuplicateDetection,
+	}
+	if opts.Deduplication > 0 {
+		h.dedup = newPacketDeduplicator(opts.Deduplication)
+	}
+	if opts.ReplayProtection > 0 {
+		h.replays = newUDPReplayFilter(opts.ReplayProtection)
+	}
+	if first, last := opts.TargetSourcePortFirst, opts.TargetSourcePortLast; first >= 1 && last <= 65535 && first <= last {
+		h.sourcePorts = &sourcePortRange{first: first, last: last}
+	}
+	if h.accessLog.sampleRate == 0 {
+		h.accessLog.sampleRate = 1
+	}
+	if h.maxDomainLength == 0 {
+		h.maxDomainLength = defaultMaxDomainLength
+	}
+	if h.maxPacketSize <= 0 || h.maxPacketSize > MaxUDPPayloadSize {
+		h.maxPacketSize = MaxUDPPayloadSize
+	}
+	h.SetCipherList(cipherList)
+	return h
+}
+
+// cipherListValue wraps a CipherList, since an atomic.Value must always hold the
+// same concrete type.
+type cipherListValue struct {
+	CipherList
 }
 
 // PacketHandler is a running UDP shadowsocks proxy that can be stopped.
@@ -104,17 +342,98 @@ type PacketHandler interface {
 	Handle(clientConn net.PacketConn)
 }
 
+// NATEntryCloser is implemented by the [PacketHandler] made by [NewPacketHandler]
+// and [NewPacketHandlerWithOptions].
+type NATEntryCloser interface {
+	// CloseNatEntry closes the NAT entry of `clientAddr` without waiting for it to
+	// time out, and reports whether there was one. The client can still start a
+	// new entry by sending another packet.
+	CloseNatEntry(clientAddr net.Addr) bool
+}
+
+// CipherListSetter is implemented by the [PacketHandler] made by [NewPacketHandler]
+// and [NewPacketHandlerWithOptions].
+type CipherListSetter interface {
+	// SetCipherList replaces the list of access keys used to identify new clients,
+	// for changes too large to apply with [CipherList.Update]. It's safe to call while
+	// packets are handled: existing NAT entries keep the key they were created with,
+	// and the packets that are being decrypted finish with the previous list.
+	SetCipherList(ciphers CipherList)
+}
+
+func (h *packetHandler) SetCipherList(ciphers CipherList) {
+	h.ciphers.Store(cipherListValue{ciphers})
+}
+
 func (h *packetHandler) SetTargetIPValidator(targetIPValidator onet.TargetIPValidator) {
 	h.targetIPValidator = targetIPValidator
 }
 
+// checkDuplicate records the packet with hash `packetHash` in the recent packets of
+// the NAT entry, and reports it if it's a copy of one of them, if duplicate
+// detection is enabled. It must be called after the packet is authenticated.
+func (h *packetHandler) checkDuplicate(targetConn *natconn, packetHash uint64) {
+	if h.duplicateWindow <= 0 {
+		return
+	}
+	if targetConn.recent == nil {
+		targetConn.recent = newRecentPackets(h.duplicateWindow)
+	}
+	if targetConn.recent.IsDuplicate(packetHash, time.Now()) {
+		debugUDPAddr(targetConn.ClientAddr(), "Duplicate packet for key %v", targetConn.keyID)
+		h.m.AddUDPClientDuplicate(targetConn.keyID)
+	}
+}
+
+// isReplay reports whether the packet's salt was seen recently, if replay
+// protection is enabled. It must be called after the packet is authenticated.
+func (h *packetHandler) isReplay(keyID string, cipherData []byte, cryptoKey *shadowsocks.EncryptionKey) bool {
+	return h.replays != nil && h.replays.IsReplay(keyID, cipherData[:cryptoKey.SaltSize()], time.Now())
+}
+
+func (h *packetHandler) CloseNatEntry(clientAddr net.Addr) bool {
+	h.natmapsMu.Lock()
+	defer h.natmapsMu.Unlock()
+	for nm := range h.natmaps {
+		if nm.CloseEntry(clientAddr.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *packetHandler) addNATmap(nm *natmap) {
+	h.natmapsMu.Lock()
+	defer h.natmapsMu.Unlock()
+	if h.natmaps == nil {
+		h.natmaps = make(map[*natmap]bool)
+	}
+	h.natmaps[nm] = true
+}
+
+func (h *packetHandler) removeNATmap(nm *natmap) {
+	h.natmapsMu.Lock()
+	defer h.natmapsMu.Unlock()
+	delete(h.natmaps, nm)
+}
+
 // Listen on addr for encrypted packets and basically do UDP NAT.
 // We take the ciphers as a pointer because it gets replaced on config updates.
 func (h *packetHandler) Handle(clientConn net.PacketConn) {
 	var running sync.WaitGroup
 
 	nm := newNATmap(h.natTimeout, h.m, &running)
+	nm.hook = h.hook
+	nm.accessLog = h.accessLog
+	nm.maxAmplification = h.maxAmplification
+	nm.goroutines = h.goroutines
+	nm.limiter = h.limiter
+	nm.events = h.events
+	// Runs after nm.Close, which stops the copy loops of the entries.
+	defer running.Wait()
 	defer nm.Close()
+	h.addNATmap(nm)
+	defer h.removeNATmap(nm)
 	cipherBuf := make([]byte, serverUDPBufferSize)
 	textBuf := make([]byte, serverUDPBufferSize)
 
@@ -140,45 +459,101 @@ func (h *packetHandler) Handle(clientConn net.PacketConn) {
 			if err != nil {
 				return onet.NewConnectionError("ERR_READ", "Failed to read from client", err)
 			}
+			if clientProxyBytes == 0 || clientProxyBytes > h.maxPacketSize {
+				return onet.NewConnectionError("ERR_PACKET_SIZE", "Invalid packet size", fmt.Errorf("packet has %v bytes, the limit is %v", clientProxyBytes, h.maxPacketSize))
+			}
 			if logger.IsEnabledFor(logging.DEBUG) {
-				defer logger.Debugf("UDP(%v): done", clientAddr)
-				logger.Debugf("UDP(%v): Outbound packet has %d bytes", clientAddr, clientProxyBytes)
+				reportedAddr := anonymizeAddr(clientAddr)
+				defer logger.Debugf("UDP(%v): done", reportedAddr)
+				logger.Debugf("UDP(%v): Outbound packet has %d bytes", reportedAddr, clientProxyBytes)
 			}
 
 			cipherData := cipherBuf[:clientProxyBytes]
+			var packetHash uint64
+			if h.duplicateWindow > 0 {
+				// Hashed before decryption, which may happen in place.
+				packetHash = hashPacket(cipherData)
+			}
 			var payload []byte
 			var tgtUDPAddr *net.UDPAddr
 			targetConn := nm.Get(clientAddr.String())
 			if targetConn == nil {
 				var locErr error
-				clientInfo, locErr = ipinfo.GetIPInfoFromAddr(h.m, clientAddr)
+				clientInfo, locErr = ipinfo.GetIPInfoFromAddr(h.m, anonymizeAddr(clientAddr))
 				if locErr != nil {
 					logger.Warningf("Failed client info lookup: %v", locErr)
 				}
 				debugUDPAddr(clientAddr, "Got info \"%#v\"", clientInfo)
 
-				ip := clientAddr.(*net.UDPAddr).AddrPort().Addr()
+				ip := addrIP(clientAddr)
+				if !h.ipFamily.allows(ip) {
+					return onet.NewConnectionError("ERR_IP_BLOCKED", "Client IP version is not accepted", nil)
+				}
+				if h.reputation != nil && h.reputation.Blocked(ip) {
+					return onet.NewConnectionError("ERR_IP_BLOCKED", "Client IP address is blocked", nil)
+				}
 				var textData []byte
 				var cryptoKey *shadowsocks.EncryptionKey
 				unpackStart := time.Now()
-				textData, keyID, cryptoKey, err = findAccessKeyUDP(ip, textBuf, cipherData, h.ciphers)
+				textData, keyID, cryptoKey, err = findAccessKeyUDP(ip, textBuf, cipherData, h.ciphers.Load().(cipherListValue).CipherList)
 				timeToCipher := time.Since(unpackStart)
 				h.m.AddUDPCipherSearch(err == nil, timeToCipher)
 
+				if errors.Is(err, errNoKeys) {
+					return onet.NewConnectionError("ERR_NO_KEYS", "No access keys are loaded", err)
+				}
 				if err != nil {
 					return onet.NewConnectionError("ERR_CIPHER", "Failed to unpack initial packet", err)
 				}
+				if h.isReplay(keyID, cipherData, cryptoKey) {
+					return onet.NewConnectionError("ERR_REPLAY_CLIENT", "Replayed packet", nil)
+				}
 
+				var sessionID string
+				if h.sessions {
+					sessionID, textData = splitSessionHeader(textData)
+				}
 				var onetErr *onet.ConnectionError
 				if payload, tgtUDPAddr, onetErr = h.validatePacket(textData); onetErr != nil {
 					return onetErr
 				}
 
-				udpConn, err := net.ListenPacket("udp", "")
-				if err != nil {
-					return onet.NewConnectionError("ERR_CREATE_SOCKET", "Failed to create UDP socket", err)
+				// The replay check above is what keeps a copy of the client's packet from
+				// moving its entry to another address.
+				if sessionID != "" && h.replays != nil {
+					if targetConn = nm.MigrateSession(clientAddr, keyID, cryptoKey, sessionID); targetConn != nil {
+						debugUDPAddr(clientAddr, "Migrated NAT entry for session of key %v", keyID)
+						h.m.AddUDPConnectionMigration(keyID)
+					}
+				}
+				if targetConn == nil && h.migration && h.replays != nil {
+					if targetConn = nm.Migrate(clientAddr, keyID, cryptoKey); targetConn != nil {
+						debugUDPAddr(clientAddr, "Migrated NAT entry for key %v", keyID)
+						h.m.AddUDPConnectionMigration(keyID)
+					}
+				}
+				if targetConn == nil {
+					// Checked after the migrations, which keep existing associations.
+					if h.quiescer != nil && h.quiescer.Quiesced() {
+						return onet.NewConnectionError("ERR_QUIESCED", "Server is quiesced", nil)
+					}
+					// Released by the NAT entry when its goroutine exits.
+					if h.goroutines != nil && !h.goroutines.acquire(1) {
+						return onet.NewConnectionError("ERR_OVERLOADED", "Goroutine limit reached", nil)
+					}
+					udpConn, err := listenTargetUDP(h.sourcePorts, clientAddr)
+					if err != nil {
+						if h.goroutines != nil {
+							h.goroutines.release(1)
+						}
+						return onet.NewConnectionError("ERR_CREATE_SOCKET", "Failed to create UDP socket", err)
+					}
+					targetConn = nm.Add(clientAddr, clientConn, cryptoKey, udpConn, clientInfo, keyID)
+					if sessionID != "" {
+						nm.SetSession(targetConn, sessionID)
+					}
 				}
-				targetConn = nm.Add(clientAddr, clientConn, cryptoKey, udpConn, clientInfo, keyID)
+				h.checkDuplicate(targetConn, packetHash)
 			} else {
 				clientInfo = targetConn.clientInfo
 
@@ -193,18 +568,40 @@ func (h *packetHandler) Handle(clientConn net.PacketConn) {
 
 				// The key ID is known with confidence once decryption succeeds.
 				keyID = targetConn.keyID
+				h.checkDuplicate(targetConn, packetHash)
+				if h.isReplay(keyID, cipherData, targetConn.cryptoKey) {
+					return onet.NewConnectionError("ERR_REPLAY_CLIENT", "Replayed packet", nil)
+				}
 
+				if h.sessions {
+					_, textData = splitSessionHeader(textData)
+				}
 				var onetErr *onet.ConnectionError
 				if payload, tgtUDPAddr, onetErr = h.validatePacket(textData); onetErr != nil {
 					return onetErr
 				}
 			}
 
+			if h.dedup != nil && h.dedup.IsDuplicate(keyID, clientAddr.String(), tgtUDPAddr.String(), payload, time.Now()) {
+				debugUDPAddr(clientAddr, "Dropping duplicate packet to %v", tgtUDPAddr)
+				h.m.AddUDPDeduplication()
+				return nil
+			}
+
+			if h.limiter != nil && !h.limiter.allowKey(keyID, len(payload), time.Now()) {
+				return onet.NewConnectionError("ERR_BANDWIDTH_LIMIT", "Bandwidth limit reached", nil)
+			}
 			debugUDPAddr(clientAddr, "Proxy exit %v", targetConn.LocalAddr())
+			// Counted before the write, since the amplification limit of the reply depends on it.
+			targetConn.bytesFromClient.Add(int64(clientProxyBytes))
 			proxyTargetBytes, err = targetConn.WriteTo(payload, tgtUDPAddr) // accept only UDPAddr despite the signature
 			if err != nil {
 				return onet.NewConnectionError("ERR_WRITE", "Failed to write to target", err)
 			}
+			if h.hook != nil {
+				h.hook.OnPacketFromClient(keyID, anonymizeAddr(clientAddr).String(), proxyTargetBytes)
+			}
+			h.accessLog.log(keyID, clientAddr, tgtUDPAddr, DirectionUpstream, proxyTargetBytes)
 			return nil
 		}()
 
@@ -217,6 +614,35 @@ func (h *packetHandler) Handle(clientConn net.PacketConn) {
 	}
 }
 
+// sessionHeaderType marks a UDP session header. It's not a valid SOCKS address type,
+// so packets without a header are never mistaken for packets with one.
+const sessionHeaderType = 0x7f
+
+const sessionIDLen = 8
+
+// splitSessionHeader returns the session ID in the header of `textData`, if any,
+// and the rest of `textData`. The session ID is empty if there's no header.
+func splitSessionHeader(textData []byte) (string, []byte) {
+	if len(textData) < 1+sessionIDLen || textData[0] != sessionHeaderType {
+		return "", textData
+	}
+	return string(textData[1 : 1+sessionIDLen]), textData[1+sessionIDLen:]
+}
+
+// addrIP returns the IP of a client address. Packet connections other than
+// *net.UDPConn, such as those used in tests or simulations, may use other address
+// types, so the address is parsed as a string if it's not a *net.UDPAddr.
+func addrIP(addr net.Addr) netip.Addr {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.AddrPort().Addr()
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addrPort.Addr()
+}
+
 // Given the decrypted contents of a UDP packet, return
 // the payload and the destination address, or an error if
 // this packet cannot or should not be forwarded.
@@ -225,6 +651,9 @@ func (h *packetHandler) validatePacket(textData []byte) ([]byte, *net.UDPAddr, *
 	if tgtAddr == nil {
 		return nil, nil, onet.NewConnectionError("ERR_READ_ADDRESS", "Failed to get target address", nil)
 	}
+	if err := checkTargetDomain(tgtAddr, h.maxDomainLength); err != nil {
+		return nil, nil, onet.NewConnectionError("ERR_BAD_HOST", "Invalid target host", err)
+	}
 
 	tgtUDPAddr, err := net.ResolveUDPAddr("udp", tgtAddr.String())
 	if err != nil {
@@ -247,9 +676,20 @@ type natconn struct {
 	net.PacketConn
 	cryptoKey *shadowsocks.EncryptionKey
 	keyID     string
+	// The address of the client, which changes if the client migrates.
+	// Only modified with the natmap lock held.
+	clientAddr atomic.Pointer[net.Addr]
+	// The key of the entry in natmap.sessions, if any. Guarded by the natmap lock.
+	sessionKey string
+	// Bytes received from and sent to the client, for the close event.
+	bytesFromClient atomic.Int64
+	bytesToClient   atomic.Int64
 	// We store the client information in the NAT map to avoid recomputing it
 	// for every downstream packet in a UDP-based connection.
 	clientInfo ipinfo.IPInfo
+	// Packets recently received from the client, if duplicate detection is enabled.
+	// Only used by the goroutine that reads from clients.
+	recent *recentPackets
 	// NAT timeout to apply for non-DNS packets.
 	defaultTimeout time.Duration
 	// Current read deadline of PacketConn.  Used to avoid decreasing the
@@ -260,6 +700,11 @@ type natconn struct {
 	fastClose sync.Once
 }
 
+// ClientAddr returns the current address of the client.
+func (c *natconn) ClientAddr() net.Addr {
+	return *c.clientAddr.Load()
+}
+
 func (c *natconn) onWrite(addr net.Addr) {
 	// Fast close is only allowed if there has been exactly one write,
 	// and it was a DNS query.
@@ -309,14 +754,25 @@ func (c *natconn) ReadFrom(buf []byte) (int, net.Addr, error) {
 type natmap struct {
 	sync.RWMutex
 	keyConn map[string]*natconn
-	timeout time.Duration
-	metrics UDPMetrics
-	running *sync.WaitGroup
+	// Entries by access key and session ID.
+	sessions  map[string]*natconn
+	timeout   time.Duration
+	metrics   UDPMetrics
+	hook      UDPPacketEventHook
+	accessLog udpAccessLog
+	// Limit on the ratio of reply bytes to request bytes, or 0 for no limit.
+	maxAmplification float64
+	// Counts the goroutine of each entry, if not nil.
+	goroutines *GoroutineLimiter
+	limiter    *BandwidthLimiter
+	events     *EventEmitter
+	running    *sync.WaitGroup
 }
 
 func newNATmap(timeout time.Duration, sm UDPMetrics, running *sync.WaitGroup) *natmap {
 	m := &natmap{metrics: sm, running: running}
 	m.keyConn = make(map[string]*natconn)
+	m.sessions = make(map[string]*natconn)
 	m.timeout = timeout
 	return m
 }
@@ -327,7 +783,7 @@ func (m *natmap) Get(key string) *natconn {
 	return m.keyConn[key]
 }
 
-func (m *natmap) set(key string, pc net.PacketConn, cryptoKey *shadowsocks.EncryptionKey, keyID string, clientInfo ipinfo.IPInfo) *natconn {
+func (m *natmap) set(clientAddr net.Addr, pc net.PacketConn, cryptoKey *shadowsocks.EncryptionKey, keyID string, clientInfo ipinfo.IPInfo) *natconn {
 	entry := &natconn{
 		PacketConn:     pc,
 		cryptoKey:      cryptoKey,
@@ -335,42 +791,154 @@ func (m *natmap) set(key string, pc net.PacketConn, cryptoKey *shadowsocks.Encry
 		clientInfo:     clientInfo,
 		defaultTimeout: m.timeout,
 	}
+	entry.clientAddr.Store(&clientAddr)
 
 	m.Lock()
 	defer m.Unlock()
 
-	m.keyConn[key] = entry
+	m.keyConn[clientAddr.String()] = entry
 	return entry
 }
 
-func (m *natmap) del(key string) net.PacketConn {
+func (m *natmap) del(entry *natconn) net.PacketConn {
 	m.Lock()
 	defer m.Unlock()
 
-	entry, ok := m.keyConn[key]
-	if ok {
+	if entry.sessionKey != "" && m.sessions[entry.sessionKey] == entry {
+		delete(m.sessions, entry.sessionKey)
+	}
+	key := entry.ClientAddr().String()
+	if m.keyConn[key] == entry {
 		delete(m.keyConn, key)
 		return entry
 	}
 	return nil
 }
 
+func sessionKey(keyID, sessionID string) string {
+	return keyID + "/" + sessionID
+}
+
+// SetSession associates the entry with a session ID, replacing any previous entry
+// of the same session.
+func (m *natmap) SetSession(entry *natconn, sessionID string) {
+	m.Lock()
+	defer m.Unlock()
+	entry.sessionKey = sessionKey(entry.keyID, sessionID)
+	m.sessions[entry.sessionKey] = entry
+}
+
+// MigrateSession moves the entry of the given session, if any, to `clientAddr`,
+// and returns it.
+func (m *natmap) MigrateSession(clientAddr net.Addr, keyID string, cryptoKey *shadowsocks.EncryptionKey, sessionID string) *natconn {
+	m.Lock()
+	defer m.Unlock()
+	entry := m.sessions[sessionKey(keyID, sessionID)]
+	if entry == nil || entry.cryptoKey != cryptoKey {
+		return nil
+	}
+	m.moveLocked(entry, clientAddr)
+	return entry
+}
+
+// moveLocked changes the client address of an entry. The caller must hold the lock.
+func (m *natmap) moveLocked(entry *natconn, clientAddr net.Addr) {
+	if oldKey := entry.ClientAddr().String(); m.keyConn[oldKey] == entry {
+		delete(m.keyConn, oldKey)
+	}
+	m.keyConn[clientAddr.String()] = entry
+	entry.clientAddr.Store(&clientAddr)
+}
+
+// Migrate moves the NAT entry of a client that changed its IP address to
+// `clientAddr`, and returns it. The entry must be the only one for the access key
+// and crypto key, otherwise it's not clear which client moved, and Migrate returns
+// nil. Entries from the same IP are not considered, since they are more likely to
+// be different sockets on the same device than a device that moved.
+func (m *natmap) Migrate(clientAddr net.Addr, keyID string, cryptoKey *shadowsocks.EncryptionKey) *natconn {
+	clientIP := addrIP(clientAddr)
+	m.Lock()
+	defer m.Unlock()
+
+	var found *natconn
+	for _, entry := range m.keyConn {
+		if entry.keyID != keyID || entry.cryptoKey != cryptoKey {
+			continue
+		}
+		if found != nil {
+			return nil
+		}
+		found = entry
+	}
+	if found == nil || addrIP(found.ClientAddr()) == clientIP {
+		return nil
+	}
+	m.moveLocked(found, clientAddr)
+	return found
+}
+
 func (m *natmap) Add(clientAddr net.Addr, clientConn net.PacketConn, cryptoKey *shadowsocks.EncryptionKey, targetConn net.PacketConn, clientInfo ipinfo.IPInfo, keyID string) *natconn {
-	entry := m.set(clientAddr.String(), targetConn, cryptoKey, keyID, clientInfo)
+	entry := m.set(clientAddr, targetConn, cryptoKey, keyID, clientInfo)
 
-	m.metrics.AddUDPNatEntry(clientAddr, keyID)
+	reportedAddr := anonymizeAddr(clientAddr)
+	m.metrics.AddUDPNatEntry(reportedAddr, keyID)
+	openTime := time.Now()
+	if m.events != nil {
+		m.events.Emit(ConnectionEvent{
+			Type:       ConnectionOpened,
+			Protocol:   "udp",
+			Time:       openTime,
+			AccessKey:  keyID,
+			ClientAddr: reportedAddr.String(),
+		})
+	}
 	m.running.Add(1)
 	go func() {
-		timedCopy(clientAddr, clientConn, entry, keyID, m.metrics)
-		m.metrics.RemoveUDPNatEntry(clientAddr, keyID)
-		if pc := m.del(clientAddr.String()); pc != nil {
+		// Deferred first so that the limiter slot is released before Handle
+		// stops waiting.
+		defer m.running.Done()
+		if m.goroutines != nil {
+			defer m.goroutines.release(1)
+		}
+		timedCopy(clientConn, entry, keyID, m.metrics, m.hook, m.accessLog, m.limiter, m.maxAmplification)
+		if m.events != nil {
+			closeTime := time.Now()
+			m.events.Emit(ConnectionEvent{
+				Type:            ConnectionClosed,
+				Protocol:        "udp",
+				Time:            closeTime,
+				AccessKey:       keyID,
+				ClientAddr:      anonymizeAddr(entry.ClientAddr()).String(),
+				BytesFromClient: entry.bytesFromClient.Load(),
+				BytesToClient:   entry.bytesToClient.Load(),
+				Duration:        closeTime.Sub(openTime),
+			})
+		}
+		// Report the same address as AddUDPNatEntry, even if the client migrated.
+		m.metrics.RemoveUDPNatEntry(reportedAddr, keyID)
+		if pc := m.del(entry); pc != nil {
 			pc.Close()
 		}
-		m.running.Done()
 	}()
 	return entry
 }
 
+// CloseEntry removes the entry with the given key, if any, and closes its socket,
+// which stops its copy loop. The loop reports the removal to the metrics.
+func (m *natmap) CloseEntry(key string) bool {
+	entry := m.Get(key)
+	if entry == nil {
+		return false
+	}
+	// The entry may have been removed since Get, by a timeout or another call.
+	pc := m.del(entry)
+	if pc == nil {
+		return false
+	}
+	pc.Close()
+	return true
+}
+
 func (m *natmap) Close() error {
 	m.Lock()
 	defer m.Unlock()
@@ -389,13 +957,20 @@ func (m *natmap) Close() error {
 // and serializing an IPv6 address from the example range.
 var maxAddrLen int = len(socks.ParseAddr("[2001:db8::1]:12345"))
 
+// Buffer pool used for encrypting UDP replies, so that NAT entries that come and
+// go don't each allocate a new buffer.
+var replyBufPool = slicepool.MakePool(serverUDPBufferSize)
+
 // copy from target to client until read timeout
-func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natconn,
-	keyID string, sm UDPMetrics) {
+func timedCopy(clientConn net.PacketConn, targetConn *natconn, keyID string, sm UDPMetrics, hook UDPPacketEventHook, accessLog udpAccessLog, limiter *BandwidthLimiter, maxAmplification float64) {
 	// pkt is used for in-place encryption of downstream UDP packets, with the layout
 	// [padding?][salt][address][body][tag][extra]
 	// Padding is only used if the address is IPv4.
-	pkt := make([]byte, serverUDPBufferSize)
+	// It is returned to the pool when the copy loop exits, since every write to the
+	// client completes before the next read.
+	lazySlice := replyBufPool.LazySlice()
+	pkt := lazySlice.Acquire()
+	defer lazySlice.Release()
 
 	saltSize := targetConn.cryptoKey.SaltSize()
 	// Leave enough room at the beginning of the packet for a max-length header (i.e. IPv6).
@@ -421,9 +996,18 @@ func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natco
 						return nil
 					}
 				}
+				// The entry was closed with natmap.CloseEntry.
+				if errors.Is(err, net.ErrClosed) {
+					expired = true
+					return nil
+				}
 				return onet.NewConnectionError("ERR_READ", "Failed to read from target", err)
 			}
 
+			if limiter != nil {
+				limiter.waitKey(keyID, bodyLen)
+			}
+			clientAddr := targetConn.ClientAddr()
 			debugUDPAddr(clientAddr, "Got response from %v", raddr)
 			srcAddr := socks.ParseAddr(raddr.String())
 			addrStart := bodyStart - len(srcAddr)
@@ -445,10 +1029,20 @@ func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natco
 			if err != nil {
 				return onet.NewConnectionError("ERR_PACK", "Failed to pack data to client", err)
 			}
+			if maxAmplification > 0 && float64(targetConn.bytesToClient.Load()+int64(len(buf))) > maxAmplification*float64(targetConn.bytesFromClient.Load()) {
+				debugUDPAddr(clientAddr, "Dropping reply from %v over the amplification limit", raddr)
+				sm.AddUDPAmplificationDrop()
+				return onet.NewConnectionError("ERR_AMPLIFICATION", "Reply exceeds the amplification limit", nil)
+			}
 			proxyClientBytes, err = clientConn.WriteTo(buf, clientAddr)
 			if err != nil {
 				return onet.NewConnectionError("ERR_WRITE", "Failed to write to client", err)
 			}
+			targetConn.bytesToClient.Add(int64(proxyClientBytes))
+			if hook != nil {
+				hook.OnPacketFromTarget(keyID, raddr.String(), bodyLen)
+			}
+			accessLog.log(keyID, clientAddr, raddr, DirectionDownstream, bodyLen)
 			return nil
 		}()
 		status := "OK"
@@ -480,4 +1074,12 @@ func (m *NoOpUDPMetrics) AddUDPNatEntry(clientAddr net.Addr, accessKey string) {
 }
 func (m *NoOpUDPMetrics) RemoveUDPNatEntry(clientAddr net.Addr, accessKey string) {
 }
+func (m *NoOpUDPMetrics) AddUDPDeduplication() {
+}
+func (m *NoOpUDPMetrics) AddUDPAmplificationDrop() {
+}
+func (m *NoOpUDPMetrics) AddUDPConnectionMigration(accessKey string) {
+}
+func (m *NoOpUDPMetrics) AddUDPClientDuplicate(accessKey string) {
+}
 func (m *NoOpUDPMetrics) AddUDPCipherSearch(accessKeyFound bool, timeToCipher time.Duration) {}
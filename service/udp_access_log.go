@@ -0,0 +1,66 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"math/rand"
+	"net"
+)
+
+// Direction is the direction in which a packet is relayed.
+type Direction int
+
+const (
+	// DirectionUpstream is from the client to the target.
+	DirectionUpstream Direction = iota
+	// DirectionDownstream is from the target to the client.
+	DirectionDownstream
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionUpstream:
+		return "upstream"
+	case DirectionDownstream:
+		return "downstream"
+	default:
+		return "unknown"
+	}
+}
+
+// AccessLogger records the packets relayed by a [PacketHandler], for debugging
+// without a packet capture. Like [UDPPacketEventHook], it's called synchronously
+// by the relaying goroutine, only for packets that were relayed, and `bytes` is
+// the size of the payload.
+type AccessLogger interface {
+	LogUDPPacket(keyID, clientAddr, targetAddr string, direction Direction, bytes int)
+}
+
+// udpAccessLog passes a sample of the relayed packets to an AccessLogger.
+type udpAccessLog struct {
+	logger AccessLogger
+	// Fraction of the packets that are logged, between 0 and 1.
+	sampleRate float64
+}
+
+func (l udpAccessLog) log(keyID string, clientAddr, targetAddr net.Addr, direction Direction, bytes int) {
+	if l.logger == nil {
+		return
+	}
+	if l.sampleRate < 1 && rand.Float64() >= l.sampleRate {
+		return
+	}
+	l.logger.LogUDPPacket(keyID, anonymizeAddr(clientAddr).String(), targetAddr.String(), direction, bytes)
+}
@@ -0,0 +1,51 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type countingAccessLogger struct {
+	count int
+}
+
+func (l *countingAccessLogger) LogUDPPacket(keyID, clientAddr, targetAddr string, direction Direction, bytes int) {
+	l.count++
+}
+
+func TestUDPAccessLogSampling(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	for _, tc := range []struct {
+		rate     float64
+		min, max int
+	}{{1, 1000, 1000}, {0, 0, 0}, {0.5, 350, 650}} {
+		logger := &countingAccessLogger{}
+		accessLog := udpAccessLog{logger: logger, sampleRate: tc.rate}
+		for i := 0; i < 1000; i++ {
+			accessLog.log("id", addr, addr, DirectionUpstream, 10)
+		}
+		require.GreaterOrEqual(t, logger.count, tc.min, "rate %v", tc.rate)
+		require.LessOrEqual(t, logger.count, tc.max, "rate %v", tc.rate)
+	}
+}
+
+func TestDirectionString(t *testing.T) {
+	require.Equal(t, "upstream", DirectionUpstream.String())
+	require.Equal(t, "downstream", DirectionDownstream.String())
+}
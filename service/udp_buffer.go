@@ -0,0 +1,80 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// UDPBufferSizes are the sizes, in bytes, of the kernel buffers of a UDP socket.
+// Read is SO_RCVBUF, which holds packets that arrived but that the server hasn't
+// read yet, and Write is SO_SNDBUF.
+type UDPBufferSizes struct {
+	Read  int
+	Write int
+}
+
+// bufferedPacketConn is implemented by [net.UDPConn].
+type bufferedPacketConn interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+	SyscallConn() (syscall.RawConn, error)
+}
+
+// SetUDPBufferSizes requests new kernel buffer sizes for a UDP socket, and returns
+// the sizes that the kernel reports afterwards. A size of zero leaves that buffer
+// unchanged. A larger read buffer lets the socket absorb bursts of packets instead
+// of dropping them while the read loop catches up.
+//
+// The kernel interprets the request in a platform-specific way, which is why the
+// granted sizes are returned:
+//   - Linux doubles the requested size, to account for its bookkeeping overhead, and
+//     reports the doubled value. Requests are capped at net.core.rmem_max and
+//     net.core.wmem_max, so raise those sysctls to get buffers above a few hundred KB.
+//   - macOS and the BSDs use the size as is, up to the kern.ipc.maxsockbuf limit.
+//   - Windows uses the size as is, but the granted sizes can't be read back, and
+//     are reported as zero.
+func SetUDPBufferSizes(conn net.PacketConn, sizes UDPBufferSizes) (UDPBufferSizes, error) {
+	bufConn, ok := conn.(bufferedPacketConn)
+	if !ok {
+		return UDPBufferSizes{}, errors.New("connection does not support setting buffer sizes")
+	}
+	if sizes.Read > 0 {
+		if err := bufConn.SetReadBuffer(sizes.Read); err != nil {
+			return UDPBufferSizes{}, fmt.Errorf("failed to set read buffer: %w", err)
+		}
+	}
+	if sizes.Write > 0 {
+		if err := bufConn.SetWriteBuffer(sizes.Write); err != nil {
+			return UDPBufferSizes{}, fmt.Errorf("failed to set write buffer: %w", err)
+		}
+	}
+	rawConn, err := bufConn.SyscallConn()
+	if err != nil {
+		return UDPBufferSizes{}, err
+	}
+	var granted UDPBufferSizes
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) { granted, sockErr = getBufferSizes(fd) }); err != nil {
+		return UDPBufferSizes{}, err
+	}
+	if sockErr != nil {
+		return UDPBufferSizes{}, fmt.Errorf("failed to get buffer sizes: %w", sockErr)
+	}
+	return granted, nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetUDPBufferSizes(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	before, err := SetUDPBufferSizes(conn, UDPBufferSizes{})
+	require.NoError(t, err)
+	granted, err := SetUDPBufferSizes(conn, UDPBufferSizes{Read: 32 * 1024})
+	require.NoError(t, err)
+	require.Equal(t, before.Write, granted.Write)
+	switch runtime.GOOS {
+	case "linux":
+		require.Equal(t, 64*1024, granted.Read)
+	case "windows":
+		require.Equal(t, UDPBufferSizes{}, granted)
+	default:
+		require.Equal(t, 32*1024, granted.Read)
+	}
+}
+
+func TestSetUDPBufferSizesUnsupported(t *testing.T) {
+	_, err := SetUDPBufferSizes(makePacketConn(), UDPBufferSizes{Read: 1024})
+	require.Error(t, err)
+}
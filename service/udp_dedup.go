@@ -0,0 +1,76 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+type dedupKey struct {
+	keyID      string
+	clientAddr string
+	targetAddr string
+	payload    uint64
+}
+
+type dedupRecord struct {
+	key  dedupKey
+	seen time.Time
+}
+
+// packetDeduplicator detects client packets that are identical to one seen less
+// than `ttl` ago from the same client address and access key. Packets are compared
+// after decryption, since retransmissions are encrypted with a different salt.
+type packetDeduplicator struct {
+	ttl  time.Duration
+	seed maphash.Seed
+
+	mu   sync.Mutex
+	seen map[dedupKey]time.Time
+	// Records in the order they were added, which is also the order they expire in.
+	records []dedupRecord
+}
+
+func newPacketDeduplicator(ttl time.Duration) *packetDeduplicator {
+	return &packetDeduplicator{
+		ttl:  ttl,
+		seed: maphash.MakeSeed(),
+		seen: make(map[dedupKey]time.Time),
+	}
+}
+
+// IsDuplicate reports whether the packet is a duplicate, and records it otherwise.
+func (d *packetDeduplicator) IsDuplicate(keyID, clientAddr, targetAddr string, payload []byte, now time.Time) bool {
+	key := dedupKey{keyID, clientAddr, targetAddr, maphash.Bytes(d.seed, payload)}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire(now)
+	if _, ok := d.seen[key]; ok {
+		return true
+	}
+	d.seen[key] = now
+	d.records = append(d.records, dedupRecord{key, now})
+	return false
+}
+
+func (d *packetDeduplicator) expire(now time.Time) {
+	i := 0
+	for ; i < len(d.records) && now.Sub(d.records[i].seen) >= d.ttl; i++ {
+		delete(d.seen, d.records[i].key)
+	}
+	d.records = d.records[i:]
+}
@@ -0,0 +1,42 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacketDeduplicator(t *testing.T) {
+	d := newPacketDeduplicator(100 * time.Millisecond)
+	start := time.Now()
+	payload := []byte("query")
+
+	require.False(t, d.IsDuplicate("id-0", "192.0.2.1:1000", "198.51.100.1:53", payload, start))
+	require.True(t, d.IsDuplicate("id-0", "192.0.2.1:1000", "198.51.100.1:53", payload, start.Add(50*time.Millisecond)))
+
+	// Any difference makes it a different packet.
+	require.False(t, d.IsDuplicate("id-1", "192.0.2.1:1000", "198.51.100.1:53", payload, start))
+	require.False(t, d.IsDuplicate("id-0", "192.0.2.2:1000", "198.51.100.1:53", payload, start))
+	require.False(t, d.IsDuplicate("id-0", "192.0.2.1:1000", "198.51.100.2:53", payload, start))
+	require.False(t, d.IsDuplicate("id-0", "192.0.2.1:1000", "198.51.100.1:53", []byte("other"), start))
+
+	// The duplicate did not extend the lifetime of the record.
+	require.False(t, d.IsDuplicate("id-0", "192.0.2.1:1000", "198.51.100.1:53", payload, start.Add(100*time.Millisecond)))
+	require.Len(t, d.seen, 1)
+	require.Len(t, d.records, 1)
+}
@@ -0,0 +1,65 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"hash/maphash"
+	"time"
+)
+
+// Number of recent packets that a NAT entry remembers to detect duplicates, which
+// bounds the memory used per entry.
+const recentPacketsLen = 16
+
+var recentPacketsSeed = maphash.MakeSeed()
+
+type recentPacket struct {
+	hash uint64
+	seen time.Time
+}
+
+// recentPackets remembers the last few packets that a client sent to a NAT entry, to
+// detect exact copies of them within `window`. Unlike a replay, a copy from the same
+// client address shortly after the original is likely a retransmission by a lossy
+// network, like a bad Wi-Fi link, so it's worth counting apart. It's only used by
+// the goroutine that reads from clients.
+type recentPackets struct {
+	window  time.Duration
+	packets [recentPacketsLen]recentPacket
+	next    int
+}
+
+func newRecentPackets(window time.Duration) *recentPackets {
+	return &recentPackets{window: window}
+}
+
+// hashPacket returns the hash of an encrypted packet, which is the same for any
+// copy of it, since a copy has the same salt and payload.
+func hashPacket(cipherData []byte) uint64 {
+	return maphash.Bytes(recentPacketsSeed, cipherData)
+}
+
+// IsDuplicate reports whether a packet with this hash was seen in the window, and
+// records it otherwise.
+func (r *recentPackets) IsDuplicate(hash uint64, now time.Time) bool {
+	for _, p := range r.packets {
+		if p.hash == hash && !p.seen.IsZero() && now.Sub(p.seen) < r.window {
+			return true
+		}
+	}
+	r.packets[r.next] = recentPacket{hash, now}
+	r.next = (r.next + 1) % recentPacketsLen
+	return false
+}
@@ -0,0 +1,51 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecentPackets(t *testing.T) {
+	r := newRecentPackets(100 * time.Millisecond)
+	start := time.Now()
+	packet := hashPacket([]byte("salt and payload"))
+
+	require.False(t, r.IsDuplicate(packet, start))
+	require.True(t, r.IsDuplicate(packet, start.Add(50*time.Millisecond)))
+	require.False(t, r.IsDuplicate(hashPacket([]byte("another packet")), start))
+
+	// Copies outside the window are not duplicates, and are recorded again.
+	require.False(t, r.IsDuplicate(packet, start.Add(100*time.Millisecond)))
+	require.True(t, r.IsDuplicate(packet, start.Add(150*time.Millisecond)))
+}
+
+func TestRecentPacketsBounded(t *testing.T) {
+	r := newRecentPackets(time.Minute)
+	now := time.Now()
+	first := hashPacket([]byte{0})
+	require.False(t, r.IsDuplicate(first, now))
+	for i := 1; i < recentPacketsLen; i++ {
+		require.False(t, r.IsDuplicate(hashPacket([]byte{byte(i)}), now))
+	}
+	require.True(t, r.IsDuplicate(first, now))
+
+	// The oldest packet is forgotten once the buffer wraps around.
+	require.False(t, r.IsDuplicate(hashPacket([]byte{recentPacketsLen}), now))
+	require.False(t, r.IsDuplicate(first, now))
+}
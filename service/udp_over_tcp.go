@@ -0,0 +1,161 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+// maxTunneledPacketSize is the largest packet that a stream packet conn accepts,
+// which is the largest UDP payload.
+const maxTunneledPacketSize = 65507
+
+// streamPacketConn carries packets over a stream, each one prefixed with its length
+// as a 4-byte big-endian integer.
+type streamPacketConn struct {
+	conn    net.Conn
+	header  [4]byte
+	readErr error
+	writeMu sync.Mutex
+}
+
+var _ net.PacketConn = (*streamPacketConn)(nil)
+
+// NewStreamPacketConn returns a [net.PacketConn] that sends and receives packets over
+// `conn`, for networks that block UDP. Each packet is sent as a 4-byte big-endian
+// length followed by the packet. Packets read from it come from the remote address of
+// `conn`, and the address given to WriteTo is ignored.
+//
+// The same framing is used on both ends: the client writes the packets made by
+// shadowsocks.Pack to it, and the server reads them with a [PacketHandler], see
+// [NewTunneledUDPHandler]. A packet longer than the buffer given to ReadFrom is
+// truncated, as with UDP. Once a read fails, the stream is closed.
+func NewStreamPacketConn(conn net.Conn) net.PacketConn {
+	return &streamPacketConn{conn: conn}
+}
+
+func (c *streamPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	n, err := c.readPacket(p)
+	if err != nil {
+		c.conn.Close()
+		// PacketHandler stops on net.ErrClosed, and a stream that ends between two
+		// packets is closed normally.
+		c.readErr = net.ErrClosed
+		if errors.Is(err, io.EOF) {
+			return 0, nil, c.readErr
+		}
+		return 0, nil, err
+	}
+	return n, c.conn.RemoteAddr(), nil
+}
+
+func (c *streamPacketConn) readPacket(p []byte) (int, error) {
+	if _, err := io.ReadFull(c.conn, c.header[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint32(c.header[:]))
+	if size > maxTunneledPacketSize {
+		return 0, fmt.Errorf("packet has %v bytes, the limit is %v", size, maxTunneledPacketSize)
+	}
+	n := size
+	if n > len(p) {
+		n = len(p)
+	}
+	if _, err := io.ReadFull(c.conn, p[:n]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	if _, err := io.CopyN(io.Discard, c.conn, int64(size-n)); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return n, nil
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, for streams that end in the
+// middle of a packet.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (c *streamPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if len(p) > maxTunneledPacketSize {
+		return 0, fmt.Errorf("packet has %v bytes, the limit is %v", len(p), maxTunneledPacketSize)
+	}
+	// A single write keeps the packets of concurrent writers apart.
+	frame := make([]byte, 4+len(p))
+	binary.BigEndian.PutUint32(frame, uint32(len(p)))
+	copy(frame[4:], p)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *streamPacketConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *streamPacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *streamPacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *streamPacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *streamPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// NewTunneledUDPHandler returns a [StreamHandler] that serves Shadowsocks UDP over each
+// stream with `handler`, using the framing of [NewStreamPacketConn]. Each stream gets
+// its own NAT table, which closes with the stream, so a client normally tunnels all its
+// packets over one stream. Serve it with [StreamServe] on a TCP listener of its own,
+// since the framing can't be told apart from Shadowsocks TCP.
+func NewTunneledUDPHandler(handler PacketHandler) StreamHandler {
+	return func(ctx context.Context, conn transport.StreamConn) {
+		packetConn := NewStreamPacketConn(conn)
+		handled := make(chan struct{})
+		defer close(handled)
+		go func() {
+			select {
+			case <-ctx.Done():
+				packetConn.Close()
+			case <-handled:
+			}
+		}()
+		handler.Handle(packetConn)
+	}
+}
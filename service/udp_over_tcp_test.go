@@ -0,0 +1,63 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamPacketConn(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	client := NewStreamPacketConn(clientConn)
+	server := NewStreamPacketConn(serverConn)
+
+	go func() {
+		client.WriteTo([]byte("hello"), nil)
+		client.WriteTo([]byte("truncated"), nil)
+		client.WriteTo([]byte("world"), nil)
+		client.Close()
+	}()
+	buf := make([]byte, 5)
+	for _, expected := range []string{"hello", "trunc", "world"} {
+		n, addr, err := server.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, expected, string(buf[:n]))
+		require.Equal(t, serverConn.RemoteAddr(), addr)
+	}
+	_, _, err := server.ReadFrom(buf)
+	require.ErrorIs(t, err, net.ErrClosed)
+	_, _, err = server.ReadFrom(buf)
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestStreamPacketConnTooLong(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	server := NewStreamPacketConn(serverConn)
+	go func() {
+		clientConn.Write(binary.BigEndian.AppendUint32(nil, maxTunneledPacketSize+1))
+	}()
+	_, _, err := server.ReadFrom(make([]byte, 10))
+	require.ErrorContains(t, err, "limit")
+	// The stream is out of sync, so it's closed.
+	_, _, err = server.ReadFrom(make([]byte, 10))
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	_, err = NewStreamPacketConn(clientConn).WriteTo(make([]byte, maxTunneledPacketSize+1), nil)
+	require.ErrorContains(t, err, "limit")
+}
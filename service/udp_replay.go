@@ -0,0 +1,76 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+type saltKey struct {
+	keyID string
+	salt  uint64
+}
+
+type saltRecord struct {
+	key  saltKey
+	seen time.Time
+}
+
+// udpReplayFilter detects client packets whose salt was already seen with the same
+// access key less than `window` ago. Every packet has a fresh random salt, including
+// the retransmissions of a client, so a repeated salt means that the packet was
+// captured and sent again. Unlike the packetDeduplicator, it tracks salts across
+// client addresses, since a replay usually comes from another address.
+type udpReplayFilter struct {
+	window time.Duration
+	seed   maphash.Seed
+
+	mu   sync.Mutex
+	seen map[saltKey]bool
+	// Records in the order they were added, which is also the order they expire in.
+	records []saltRecord
+}
+
+func newUDPReplayFilter(window time.Duration) *udpReplayFilter {
+	return &udpReplayFilter{
+		window: window,
+		seed:   maphash.MakeSeed(),
+		seen:   make(map[saltKey]bool),
+	}
+}
+
+// IsReplay reports whether the salt was seen in the window, and records it otherwise.
+func (f *udpReplayFilter) IsReplay(keyID string, salt []byte, now time.Time) bool {
+	key := saltKey{keyID, maphash.Bytes(f.seed, salt)}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expire(now)
+	if f.seen[key] {
+		return true
+	}
+	f.seen[key] = true
+	f.records = append(f.records, saltRecord{key, now})
+	return false
+}
+
+func (f *udpReplayFilter) expire(now time.Time) {
+	i := 0
+	for ; i < len(f.records) && now.Sub(f.records[i].seen) >= f.window; i++ {
+		delete(f.seen, f.records[i].key)
+	}
+	f.records = f.records[i:]
+}
@@ -0,0 +1,40 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDPReplayFilter(t *testing.T) {
+	f := newUDPReplayFilter(100 * time.Millisecond)
+	start := time.Now()
+	salt := []byte("0123456789abcdef")
+
+	require.False(t, f.IsReplay("id-0", salt, start))
+	require.True(t, f.IsReplay("id-0", salt, start.Add(50*time.Millisecond)))
+
+	// Salts are tracked per access key.
+	require.False(t, f.IsReplay("id-1", salt, start))
+	require.False(t, f.IsReplay("id-0", []byte("fedcba9876543210"), start))
+
+	// The replay did not extend the lifetime of the record.
+	require.False(t, f.IsReplay("id-0", salt, start.Add(100*time.Millisecond)))
+	require.Len(t, f.seen, 1)
+	require.Len(t, f.records, 1)
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ListenShardedUDP opens up to `numShards` UDP sockets bound to the same address,
+// so that a [PacketHandler] can read from each of them in parallel, instead of being
+// limited by a single reading goroutine. The kernel assigns each client address to
+// one of the sockets, so the NAT entry of a client always lives in the same shard,
+// and clients need no changes. This relies on SO_REUSEPORT load balancing, which is
+// only available on Linux. Elsewhere, or if `numShards` is below 2, a single socket
+// is returned.
+func ListenShardedUDP(addr *net.UDPAddr, numShards int) ([]net.PacketConn, error) {
+	if numShards < 2 || !canShardUDP {
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.PacketConn{conn}, nil
+	}
+	config := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) { sockErr = setReusePort(fd) }); err != nil {
+			return err
+		}
+		return sockErr
+	}}
+	conns := make([]net.PacketConn, 0, numShards)
+	for i := 0; i < numShards; i++ {
+		// The first socket may pick the port, which the others must then share.
+		shardAddr := addr.String()
+		if i > 0 {
+			shardAddr = conns[0].LocalAddr().String()
+		}
+		conn, err := config.ListenPacket(context.Background(), "udp", shardAddr)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, fmt.Errorf("failed to open UDP shard %v: %w", i, err)
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
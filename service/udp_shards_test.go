@@ -0,0 +1,71 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenShardedUDP(t *testing.T) {
+	conns, err := ListenShardedUDP(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, 4)
+	require.NoError(t, err)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	if !canShardUDP {
+		require.Len(t, conns, 1)
+		return
+	}
+	require.Len(t, conns, 4)
+	for _, conn := range conns[1:] {
+		require.Equal(t, conns[0].LocalAddr().String(), conn.LocalAddr().String())
+	}
+
+	// Every client is received by some shard, and always the same one.
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer client.Close()
+	received := make(chan int, 10)
+	for i, conn := range conns {
+		go func(i int, conn net.PacketConn) {
+			buf := make([]byte, 10)
+			for {
+				if _, _, err := conn.ReadFrom(buf); err != nil {
+					return
+				}
+				received <- i
+			}
+		}(i, conn)
+	}
+	var shards []int
+	for i := 0; i < 3; i++ {
+		_, err := client.WriteTo([]byte("ping"), conns[0].LocalAddr())
+		require.NoError(t, err)
+		shards = append(shards, <-received)
+	}
+	require.Equal(t, []int{shards[0], shards[0], shards[0]}, shards)
+}
+
+func TestListenShardedUDPSingle(t *testing.T) {
+	conns, err := ListenShardedUDP(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, 1)
+	require.NoError(t, err)
+	require.Len(t, conns, 1)
+	conns[0].Close()
+}
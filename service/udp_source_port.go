@@ -0,0 +1,63 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"hash/fnv"
+	"net"
+)
+
+// maxSourcePortAttempts is the number of ports in the range that are tried before
+// falling back to an ephemeral port, so that a busy range doesn't make every new
+// NAT entry scan it.
+const maxSourcePortAttempts = 16
+
+// sourcePortRange is the inclusive range of local ports for target sockets.
+type sourcePortRange struct {
+	first, last int
+}
+
+// preferredPort returns the port for the target socket of `clientAddr`: the client's
+// own port if it's in the range, or else one derived from its address.
+func (r *sourcePortRange) preferredPort(clientAddr net.Addr) int {
+	if udpAddr, ok := clientAddr.(*net.UDPAddr); ok && udpAddr.Port >= r.first && udpAddr.Port <= r.last {
+		return udpAddr.Port
+	}
+	h := fnv.New32a()
+	h.Write([]byte(clientAddr.String()))
+	return r.first + int(h.Sum32()%uint32(r.last-r.first+1))
+}
+
+// listenTargetUDP opens the target socket of a new NAT entry. If `ports` is set, it
+// binds to the preferred port of `clientAddr`, or the next free ones in the range.
+func listenTargetUDP(ports *sourcePortRange, clientAddr net.Addr) (net.PacketConn, error) {
+	if ports == nil {
+		return net.ListenPacket("udp", "")
+	}
+	size := ports.last - ports.first + 1
+	port := ports.preferredPort(clientAddr)
+	for i := 0; i < size && i < maxSourcePortAttempts; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err == nil {
+			return conn, nil
+		}
+		debugUDPAddr(clientAddr, "Failed to bind target socket: %v", err)
+		port++
+		if port > ports.last {
+			port = ports.first
+		}
+	}
+	return net.ListenPacket("udp", "")
+}
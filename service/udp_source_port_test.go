@@ -0,0 +1,86 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// freeUDPPort returns a port that was free a moment ago.
+func freeUDPPort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func localPort(conn net.PacketConn) int {
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestSourcePortPreferred(t *testing.T) {
+	ports := &sourcePortRange{first: 20000, last: 20099}
+	require.Equal(t, 20050, ports.preferredPort(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 20050}))
+
+	outside := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}
+	port := ports.preferredPort(outside)
+	require.GreaterOrEqual(t, port, 20000)
+	require.LessOrEqual(t, port, 20099)
+	require.Equal(t, port, ports.preferredPort(outside))
+}
+
+func TestListenTargetUDPPreservesPort(t *testing.T) {
+	port := freeUDPPort(t)
+	ports := &sourcePortRange{first: port, last: port}
+	conn, err := listenTargetUDP(ports, &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: port})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, port, localPort(conn))
+}
+
+func TestListenTargetUDPInUse(t *testing.T) {
+	// A one-port range whose port is taken falls back to an ephemeral port.
+	taken, err := net.ListenUDP("udp", &net.UDPAddr{})
+	require.NoError(t, err)
+	defer taken.Close()
+	port := localPort(taken)
+	conn, err := listenTargetUDP(&sourcePortRange{first: port, last: port}, &clientAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NotEqual(t, port, localPort(conn))
+
+	// In a wider range, the next port is used, wrapping around to the first.
+	second := freeUDPPort(t)
+	ports := &sourcePortRange{first: second, last: port}
+	if second > port {
+		ports = &sourcePortRange{first: port, last: second}
+	}
+	conn2, err := listenTargetUDP(ports, &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: port})
+	require.NoError(t, err)
+	defer conn2.Close()
+	require.GreaterOrEqual(t, localPort(conn2), ports.first)
+	require.LessOrEqual(t, localPort(conn2), ports.last)
+	require.NotEqual(t, port, localPort(conn2))
+}
+
+func TestListenTargetUDPEphemeral(t *testing.T) {
+	conn, err := listenTargetUDP(nil, &clientAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NotEqual(t, 0, localPort(conn))
+}
@@ -17,6 +17,7 @@ package service
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"net"
 	"net/netip"
 	"sync"
@@ -101,7 +102,11 @@ type udpReport struct {
 // Stub metrics implementation for testing NAT behaviors.
 type natTestMetrics struct {
 	natEntriesAdded int
-	upstreamPackets []udpReport
+	// Guards natEntriesRemoved, which is written by the goroutine of each NAT entry.
+	mu                 sync.Mutex
+	natEntriesRemoved  int
+	amplificationDrops int
+	upstreamPackets    []udpReport
 }
 
 var _ UDPMetrics = (*natTestMetrics)(nil)
@@ -118,6 +123,18 @@ func (m *natTestMetrics) AddUDPNatEntry(clientAddr net.Addr, accessKey string) {
 	m.natEntriesAdded++
 }
 func (m *natTestMetrics) RemoveUDPNatEntry(clientAddr net.Addr, accessKey string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.natEntriesRemoved++
+}
+func (m *natTestMetrics) AddUDPDeduplication() {
+}
+func (m *natTestMetrics) AddUDPAmplificationDrop() {
+	m.amplificationDrops++
+}
+func (m *natTestMetrics) AddUDPConnectionMigration(accessKey string) {
+}
+func (m *natTestMetrics) AddUDPClientDuplicate(accessKey string) {
 }
 func (m *natTestMetrics) AddUDPCipherSearch(accessKeyFound bool, timeToCipher time.Duration) {}
 
@@ -177,6 +194,149 @@ func TestIPFilter(t *testing.T) {
 	})
 }
 
+func TestUDPBadHost(t *testing.T) {
+	ciphers, err := MakeTestCiphers([]string{"asdf"})
+	require.NoError(t, err)
+	cipher := ciphers.SnapshotForClientIP(netip.Addr{})[0].Value.(*CipherEntry).CryptoKey
+	clientConn := makePacketConn()
+	metrics := &natTestMetrics{}
+	handler := NewPacketHandlerWithOptions(timeout, ciphers, metrics, PacketHandlerOptions{MaxDomainLength: 20})
+	done := make(chan struct{})
+	go func() {
+		handler.Handle(clientConn)
+		done <- struct{}{}
+	}()
+
+	for _, target := range []string{"a-long-hostname.example:53", "bad\x00host:53"} {
+		plaintext := append(socks.ParseAddr(target), []byte("payload")...)
+		ciphertext, err := shadowsocks.Pack(make([]byte, 1024), plaintext, cipher)
+		require.NoError(t, err)
+		clientConn.recv <- packet{addr: &clientAddr, payload: ciphertext}
+	}
+	clientConn.Close()
+	<-done
+
+	require.Equal(t, 0, metrics.natEntriesAdded)
+	require.Len(t, metrics.upstreamPackets, 2)
+	for _, report := range metrics.upstreamPackets {
+		require.Equal(t, "ERR_BAD_HOST", report.status)
+	}
+}
+
+func TestUDPPacketSize(t *testing.T) {
+	ciphers, err := MakeTestCiphers([]string{"asdf"})
+	require.NoError(t, err)
+	clientConn := makePacketConn()
+	metrics := &natTestMetrics{}
+	handler := NewPacketHandlerWithOptions(timeout, ciphers, metrics, PacketHandlerOptions{MaxPacketSize: 100})
+	done := make(chan struct{})
+	go func() {
+		handler.Handle(clientConn)
+		done <- struct{}{}
+	}()
+
+	clientConn.recv <- packet{addr: &clientAddr, payload: makeTestPayload(101)}
+	clientConn.recv <- packet{addr: &clientAddr, payload: []byte{}}
+	clientConn.Close()
+	<-done
+
+	require.Equal(t, 0, metrics.natEntriesAdded)
+	require.Len(t, metrics.upstreamPackets, 2)
+	for _, report := range metrics.upstreamPackets {
+		require.Equal(t, "ERR_PACKET_SIZE", report.status)
+	}
+}
+
+func TestUDPNoKeys(t *testing.T) {
+	clientConn := makePacketConn()
+	metrics := &natTestMetrics{}
+	handler := NewPacketHandler(timeout, NewCipherList(), metrics)
+	done := make(chan struct{})
+	go func() {
+		handler.Handle(clientConn)
+		done <- struct{}{}
+	}()
+
+	clientConn.recv <- packet{addr: &clientAddr, payload: makeTestPayload(100)}
+	clientConn.Close()
+	<-done
+
+	require.Len(t, metrics.upstreamPackets, 1)
+	require.Equal(t, "ERR_NO_KEYS", metrics.upstreamPackets[0].status)
+}
+
+// limitedSend sends a packet to the discard port for each access key in `keys`, from
+// a client address of its own, through a handler with `limiter`. It returns the
+// reports of the packets and how long the handler took to read them all.
+func limitedSend(t *testing.T, limiter *BandwidthLimiter, secrets []string, keys []int, payloadSize int) ([]udpReport, time.Duration) {
+	ciphers, err := MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	clientConn := makePacketConn()
+	metrics := &natTestMetrics{}
+	handler := NewPacketHandlerWithOptions(timeout, ciphers, metrics, PacketHandlerOptions{BandwidthLimiter: limiter})
+	handler.SetTargetIPValidator(allowAll)
+	done := make(chan struct{})
+	go func() {
+		handler.Handle(clientConn)
+		done <- struct{}{}
+	}()
+
+	plaintext := append(socks.ParseAddr("127.0.0.1:9"), make([]byte, payloadSize)...)
+	start := time.Now()
+	for _, key := range keys {
+		cryptoKey, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, secrets[key])
+		require.NoError(t, err)
+		ciphertext, err := shadowsocks.Pack(make([]byte, 2048), plaintext, cryptoKey)
+		require.NoError(t, err)
+		addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000 + key}
+		clientConn.recv <- packet{addr: addr, payload: ciphertext}
+	}
+	clientConn.Close()
+	<-done
+	return metrics.upstreamPackets, time.Since(start)
+}
+
+func TestUDPBandwidthLimit(t *testing.T) {
+	// 1 kB/s, with a burst of 1500 bytes.
+	limiter := NewBandwidthLimiter(1000)
+	reports, elapsed := limitedSend(t, limiter, []string{"asdf"}, []int{0, 0, 0}, 1000)
+
+	// The packets over the limit are dropped rather than delayed, which would have
+	// held up the reading of the packets behind them.
+	require.Len(t, reports, 3)
+	require.Equal(t, "OK", reports[0].status)
+	require.Equal(t, "ERR_BANDWIDTH_LIMIT", reports[1].status)
+	require.Equal(t, "ERR_BANDWIDTH_LIMIT", reports[2].status)
+	require.Less(t, elapsed, 500*time.Millisecond)
+	require.Equal(t, int64(1000), limiter.Bytes())
+	require.Equal(t, int64(2), limiter.Dropped())
+}
+
+func TestUDPBandwidthLimitPerKeyFairness(t *testing.T) {
+	for _, fair := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fair=%v", fair), func(t *testing.T) {
+			// 1 kB/s, with a burst of 1500 bytes.
+			limiter := NewBandwidthLimiter(1000)
+			limiter.SetPerKeyFairness(fair)
+			// The first key uses up the burst before the second one sends anything.
+			reports, elapsed := limitedSend(t, limiter, []string{"asdf", "qwer"}, []int{0, 0, 0, 1}, 600)
+
+			require.Len(t, reports, 4)
+			require.Equal(t, "OK", reports[0].status)
+			require.Equal(t, "OK", reports[1].status)
+			require.Equal(t, "ERR_BANDWIDTH_LIMIT", reports[2].status)
+			require.Equal(t, "id-1", reports[3].accessKey)
+			if fair {
+				// The throttled key doesn't hold back the other one.
+				require.Equal(t, "OK", reports[3].status)
+			} else {
+				require.Equal(t, "ERR_BANDWIDTH_LIMIT", reports[3].status)
+			}
+			require.Less(t, elapsed, 500*time.Millisecond)
+		})
+	}
+}
+
 func TestUpstreamMetrics(t *testing.T) {
 	// Test both the first-packet and subsequent-packet cases.
 	const N = 10
@@ -196,6 +356,40 @@ func TestUpstreamMetrics(t *testing.T) {
 	}
 }
 
+// An address type that isn't a *net.UDPAddr, as used by simulated packet conns.
+type simulatedAddr string
+
+func (a simulatedAddr) Network() string { return "sim" }
+func (a simulatedAddr) String() string  { return string(a) }
+
+func TestGenericClientAddr(t *testing.T) {
+	ciphers, err := MakeTestCiphers([]string{"asdf"})
+	require.NoError(t, err)
+	cipher := ciphers.SnapshotForClientIP(netip.Addr{})[0].Value.(*CipherEntry).CryptoKey
+	clientConn := makePacketConn()
+	metrics := &natTestMetrics{}
+	handler := NewPacketHandler(timeout, ciphers, metrics)
+	handler.SetTargetIPValidator(allowAll)
+	done := make(chan struct{})
+	go func() {
+		handler.Handle(clientConn)
+		done <- struct{}{}
+	}()
+
+	plaintext := append(socks.ParseAddr("127.0.0.1:9"), []byte("payload")...)
+	ciphertext := make([]byte, cipher.SaltSize()+len(plaintext)+cipher.TagSize())
+	shadowsocks.Pack(ciphertext, plaintext, cipher)
+	clientConn.recv <- packet{addr: simulatedAddr("192.0.2.1:54321"), payload: ciphertext}
+	clientConn.Close()
+	<-done
+
+	require.Equal(t, 1, metrics.natEntriesAdded)
+	require.Len(t, metrics.upstreamPackets, 1)
+	require.Equal(t, "OK", metrics.upstreamPackets[0].status)
+	require.Equal(t, netip.MustParseAddr("192.0.2.1"), addrIP(simulatedAddr("192.0.2.1:54321")))
+	require.Equal(t, netip.Addr{}, addrIP(simulatedAddr("pipe")))
+}
+
 func assertAlmostEqual(t *testing.T, a, b time.Time) {
 	delta := a.Sub(b)
 	limit := 100 * time.Millisecond
@@ -366,6 +560,24 @@ func TestNATNoFastClose_MultipleDNS(t *testing.T) {
 }
 
 // Implements net.Error
+func TestNATCloseEntry(t *testing.T) {
+	var running sync.WaitGroup
+	metrics := &natTestMetrics{}
+	nat := newNATmap(timeout, metrics, &running)
+	clientConn := makePacketConn()
+	targetConn := makePacketConn()
+	nat.Add(&clientAddr, clientConn, natCryptoKey, targetConn, ipinfo.IPInfo{CountryCode: "ZZ"}, "key id")
+
+	require.False(t, nat.CloseEntry("192.0.2.1:1"))
+	require.True(t, nat.CloseEntry(clientAddr.String()))
+	require.Nil(t, nat.Get(clientAddr.String()))
+	running.Wait()
+	_, ok := <-targetConn.send
+	require.False(t, ok, "targetConn should be closed")
+	require.Equal(t, 1, metrics.natEntriesRemoved)
+	require.False(t, nat.CloseEntry(clientAddr.String()))
+}
+
 type fakeTimeoutError struct {
 	error
 }
@@ -396,6 +608,80 @@ func TestNATTimeout(t *testing.T) {
 	assertAlmostEqual(t, before, time.Now())
 }
 
+func TestFindAccessKeyUDPConstantTime(t *testing.T) {
+	cipherList, err := MakeTestCiphers(makeTestSecrets(3))
+	require.NoError(t, err)
+	cipherList.SetConstantTime(true)
+	clientIP := netip.MustParseAddr("192.0.2.1")
+	plaintext := makeTestPayload(50)
+	textBuf := make([]byte, serverUDPBufferSize)
+
+	for _, element := range cipherList.SnapshotForClientIP(netip.Addr{}) {
+		expected := element.Value.(*CipherEntry)
+		packet, err := shadowsocks.Pack(make([]byte, serverUDPBufferSize), plaintext, expected.CryptoKey)
+		require.NoError(t, err)
+		buf, id, cryptoKey, err := findAccessKeyUDP(clientIP, textBuf, packet, cipherList)
+		require.NoError(t, err)
+		require.Equal(t, expected.ID, id)
+		require.Equal(t, expected.CryptoKey, cryptoKey)
+		require.Equal(t, plaintext, buf)
+	}
+	// The list order is unaffected by the matches, but they count as uses.
+	require.Equal(t, []string{"id-0", "id-1", "id-2"}, snapshotIDs(cipherList.SnapshotForClientIP(clientIP)))
+	stats := cipherList.Statistics()
+	require.Equal(t, 3, stats.ActiveKeys)
+	require.Equal(t, 0, stats.NeverUsedKeys)
+	require.Equal(t, 1.0, stats.AverageUsageCount)
+
+	_, _, _, err = findAccessKeyUDP(clientIP, textBuf, plaintext, cipherList)
+	require.Error(t, err)
+}
+
+// oneReplyPacketConn is a target connection that returns one reply and is then
+// closed, like a NAT entry for a single DNS query.
+type oneReplyPacketConn struct {
+	net.PacketConn
+	replied bool
+}
+
+func (c *oneReplyPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	if c.replied {
+		return 0, nil, net.ErrClosed
+	}
+	c.replied = true
+	return copy(p, "reply"), &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 53}, nil
+}
+
+func (c *oneReplyPacketConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// discardPacketConn is a client connection that discards what is written to it.
+type discardPacketConn struct {
+	net.PacketConn
+}
+
+func (c *discardPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return len(p), nil
+}
+
+// Simulates NAT entries that come and go, each relaying one reply, to measure the
+// allocations of timedCopy, whose reply buffer comes from replyBufPool.
+func BenchmarkUDPReplyChurn(b *testing.B) {
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(b, err)
+	cryptoKey := firstCipher(cipherList)
+	var clientAddr net.Addr = &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}
+	clientConn := &discardPacketConn{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		targetConn := &natconn{PacketConn: &oneReplyPacketConn{}, cryptoKey: cryptoKey}
+		targetConn.clientAddr.Store(&clientAddr)
+		timedCopy(clientConn, targetConn, "id-0", &NoOpUDPMetrics{}, nil, udpAccessLog{}, nil, 0)
+	}
+}
+
 // Simulates receiving invalid UDP packets on a server with 100 ciphers.
 func BenchmarkUDPUnpackFail(b *testing.B) {
 	cipherList, err := MakeTestCiphers(makeTestSecrets(100))
@@ -414,11 +700,21 @@ func BenchmarkUDPUnpackFail(b *testing.B) {
 // Simulates receiving valid UDP packets from 100 different users, each with
 // their own cipher and IP address.
 func BenchmarkUDPUnpackRepeat(b *testing.B) {
+	benchmarkUDPUnpackRepeat(b, false)
+}
+
+// Same as BenchmarkUDPUnpackRepeat, but every search tries all the ciphers.
+func BenchmarkUDPUnpackRepeatConstantTime(b *testing.B) {
+	benchmarkUDPUnpackRepeat(b, true)
+}
+
+func benchmarkUDPUnpackRepeat(b *testing.B, constantTime bool) {
 	const numCiphers = 100 // Must be <256
 	cipherList, err := MakeTestCiphers(makeTestSecrets(numCiphers))
 	if err != nil {
 		b.Fatal(err)
 	}
+	cipherList.SetConstantTime(constantTime)
 	testBuf := make([]byte, serverUDPBufferSize)
 	packets := [numCiphers][]byte{}
 	ips := [numCiphers]netip.Addr{}
@@ -0,0 +1,68 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+)
+
+type bufferedVerifyingReader struct {
+	source   io.Reader
+	key      *shadowsocks.EncryptionKey
+	maxBytes int64
+	// Verified plaintext, set on the first Read.
+	plaintext *bytes.Reader
+	err       error
+}
+
+// NewBufferedVerifyingReader is like [shadowsocks.NewReader], but reads the whole
+// stream, up to `maxBytes` of ciphertext, and authenticates every chunk before it
+// returns any plaintext. If a chunk fails to decrypt, or the stream ends in the middle
+// of a chunk or goes over `maxBytes`, Read returns the error and no data.
+//
+// It's meant for short messages like DNS queries, where waiting for the end of the
+// stream costs little. Note that Shadowsocks streams have no end marker, so a stream
+// cut at a chunk boundary still verifies.
+func NewBufferedVerifyingReader(r io.Reader, key *shadowsocks.EncryptionKey, maxBytes int64) io.Reader {
+	return &bufferedVerifyingReader{source: r, key: key, maxBytes: maxBytes}
+}
+
+func (r *bufferedVerifyingReader) Read(p []byte) (int, error) {
+	if r.plaintext == nil && r.err == nil {
+		r.err = r.verify()
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.plaintext.Read(p)
+}
+
+func (r *bufferedVerifyingReader) verify() error {
+	// Read one extra byte to tell whether the stream goes over the limit.
+	limited := &io.LimitedReader{R: r.source, N: r.maxBytes + 1}
+	plaintext, err := io.ReadAll(shadowsocks.NewReader(limited, r.key))
+	if limited.N == 0 {
+		return fmt.Errorf("stream is longer than %v bytes", r.maxBytes)
+	}
+	if err != nil {
+		return err
+	}
+	r.plaintext = bytes.NewReader(plaintext)
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/stretchr/testify/require"
+)
+
+func makeVerifyingReaderStream(t *testing.T, key *shadowsocks.EncryptionKey, chunks ...string) []byte {
+	var buf bytes.Buffer
+	writer := shadowsocks.NewWriter(&buf, key)
+	for _, chunk := range chunks {
+		_, err := writer.Write([]byte(chunk))
+		require.NoError(t, err)
+	}
+	return buf.Bytes()
+}
+
+func TestBufferedVerifyingReader(t *testing.T) {
+	key, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, "secret")
+	require.NoError(t, err)
+	stream := makeVerifyingReaderStream(t, key, "Hello ", "world")
+
+	plaintext, err := io.ReadAll(NewBufferedVerifyingReader(bytes.NewReader(stream), key, int64(len(stream))))
+	require.NoError(t, err)
+	require.Equal(t, "Hello world", string(plaintext))
+}
+
+func TestBufferedVerifyingReaderCorruptedLastChunk(t *testing.T) {
+	key, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, "secret")
+	require.NoError(t, err)
+	stream := makeVerifyingReaderStream(t, key, "Hello ", "world")
+	stream[len(stream)-1] ^= 0xff
+
+	reader := NewBufferedVerifyingReader(bytes.NewReader(stream), key, 1000)
+	buf := make([]byte, 100)
+	n, err := reader.Read(buf)
+	require.Error(t, err)
+	require.Equal(t, 0, n)
+	// The error sticks.
+	n, err = reader.Read(buf)
+	require.Error(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestBufferedVerifyingReaderTruncatedChunk(t *testing.T) {
+	key, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, "secret")
+	require.NoError(t, err)
+	stream := makeVerifyingReaderStream(t, key, "Hello ", "world")
+
+	plaintext, err := io.ReadAll(NewBufferedVerifyingReader(bytes.NewReader(stream[:len(stream)-1]), key, 1000))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Empty(t, plaintext)
+}
+
+func TestBufferedVerifyingReaderMaxBytes(t *testing.T) {
+	key, err := shadowsocks.NewEncryptionKey(shadowsocks.CHACHA20IETFPOLY1305, "secret")
+	require.NoError(t, err)
+	stream := makeVerifyingReaderStream(t, key, "Hello ", "world")
+
+	plaintext, err := io.ReadAll(NewBufferedVerifyingReader(bytes.NewReader(stream), key, int64(len(stream)-1)))
+	require.Error(t, err)
+	require.Empty(t, plaintext)
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"sort"
+	"time"
+)
+
+// MeasuredWriter records the size and duration of each write to an inner
+// writer, typically a Shadowsocks stream writer, where the duration is mostly
+// encryption. It's a profiling tool for development and tests, not meant for
+// production: it keeps every measurement and is not safe for concurrent use.
+type MeasuredWriter struct {
+	inner io.Writer
+	// Size of each write, in bytes, and the time the inner writer took for it.
+	ChunkSizes   []int
+	EncryptTimes []time.Duration
+}
+
+// NewMeasuredWriter returns a MeasuredWriter that writes to `inner`.
+func NewMeasuredWriter(inner io.Writer) *MeasuredWriter {
+	return &MeasuredWriter{inner: inner}
+}
+
+func (w *MeasuredWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.inner.Write(p)
+	w.ChunkSizes = append(w.ChunkSizes, len(p))
+	w.EncryptTimes = append(w.EncryptTimes, time.Since(start))
+	return n, err
+}
+
+// WriterSummary holds aggregate statistics of the writes to a [MeasuredWriter].
+// The percentiles use the nearest-rank method.
+type WriterSummary struct {
+	Chunks                                         int
+	MinChunkSize, MaxChunkSize, P99ChunkSize       int
+	MeanChunkSize                                  float64
+	MinEncryptTime, MaxEncryptTime, P99EncryptTime time.Duration
+	MeanEncryptTime                                time.Duration
+}
+
+// Summary returns the statistics of the writes so far, or a zero summary if
+// there were none.
+func (w *MeasuredWriter) Summary() WriterSummary {
+	var summary WriterSummary
+	summary.Chunks = len(w.ChunkSizes)
+	if summary.Chunks == 0 {
+		return summary
+	}
+	sizes := append([]int(nil), w.ChunkSizes...)
+	sort.Ints(sizes)
+	times := append([]time.Duration(nil), w.EncryptTimes...)
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	p99 := (summary.Chunks*99+99)/100 - 1
+	summary.MinChunkSize, summary.MaxChunkSize = sizes[0], sizes[len(sizes)-1]
+	summary.P99ChunkSize = sizes[p99]
+	summary.MinEncryptTime, summary.MaxEncryptTime = times[0], times[len(times)-1]
+	summary.P99EncryptTime = times[p99]
+	var totalSize int
+	var totalTime time.Duration
+	for i := range sizes {
+		totalSize += sizes[i]
+		totalTime += times[i]
+	}
+	summary.MeanChunkSize = float64(totalSize) / float64(summary.Chunks)
+	summary.MeanEncryptTime = totalTime / time.Duration(summary.Chunks)
+	return summary
+}
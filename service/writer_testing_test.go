@@ -0,0 +1,62 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport/shadowsocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeasuredWriterSummary(t *testing.T) {
+	cipherList, err := MakeTestCiphers(makeTestSecrets(1))
+	require.NoError(t, err)
+	var ciphertext bytes.Buffer
+	writer := NewMeasuredWriter(shadowsocks.NewWriter(&ciphertext, firstCipher(cipherList)))
+	require.Equal(t, WriterSummary{}, writer.Summary())
+
+	// Chunks of 1 to 100 bytes, in random order.
+	for _, i := range rand.Perm(100) {
+		n, err := writer.Write(make([]byte, i+1))
+		require.NoError(t, err)
+		require.Equal(t, i+1, n)
+	}
+
+	summary := writer.Summary()
+	require.Equal(t, 100, summary.Chunks)
+	require.Equal(t, 1, summary.MinChunkSize)
+	require.Equal(t, 100, summary.MaxChunkSize)
+	require.Equal(t, 99, summary.P99ChunkSize)
+	require.Equal(t, 50.5, summary.MeanChunkSize)
+	require.LessOrEqual(t, summary.MinEncryptTime, summary.MeanEncryptTime)
+	require.LessOrEqual(t, summary.MeanEncryptTime, summary.MaxEncryptTime)
+	require.LessOrEqual(t, summary.P99EncryptTime, summary.MaxEncryptTime)
+	require.Len(t, writer.EncryptTimes, 100)
+	require.NotZero(t, ciphertext.Len())
+}
+
+func TestMeasuredWriterError(t *testing.T) {
+	_, pipeWriter := io.Pipe()
+	pipeWriter.Close()
+	writer := NewMeasuredWriter(pipeWriter)
+	_, err := writer.Write([]byte("data"))
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+	// Failed writes are measured too.
+	require.Equal(t, []int{4}, writer.ChunkSizes)
+}